@@ -0,0 +1,53 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// access_timestamp is only filled in by scans run with --record-atime, in local time like file_timestamp.
+const addAccessTimestampColumnQuery = `ALTER TABLE file_hashes ADD COLUMN IF NOT EXISTS access_timestamp TIMESTAMP`
+
+// recordAccessTime stores the access time from info, which must come from a stat taken before the file was opened:
+// hashing a file reads it, and on most mounts that moves its atime to now.
+func recordAccessTime(db *sql.DB, storedPath string, info os.FileInfo) error {
+	accessed, ok := accessTime(info)
+	if !ok {
+		return nil
+	}
+	_, err := db.Exec("UPDATE file_hashes SET access_timestamp = $2 WHERE filepath = $1", storedPath, accessed.In(time.Local))
+	return err
+}
+
+// warnAtimeMount logs how far access times can be trusted on the filesystem holding path, based on its mount options.
+func warnAtimeMount(path string) {
+	mountPoint, options, err := mountOptions(path)
+	if err != nil {
+		log.Printf("WARNING: can't tell whether %s is mounted with noatime or relatime, so access times may not reflect reads: %v", path, err)
+		return
+	}
+	switch {
+	case slices.Contains(options, "noatime"):
+		log.Printf("WARNING: %s is mounted with noatime, so access times never change on reads and only show when files were created or restored", mountPoint)
+	case slices.Contains(options, "relatime"):
+		log.Printf("WARNING: %s is mounted with relatime, so a read only updates a file's access time if it is older than its mtime or a day old: access times show roughly the last day a file was read, not every read", mountPoint)
+	case slices.Contains(options, "lazytime"):
+		log.Printf("%s is mounted with lazytime; access times are kept in memory and may lag on disk by up to a day", mountPoint)
+	}
+}
+
+// longestMountPoint returns the mount point in mounts that contains path, or "" if none does.
+func longestMountPoint(path string, mounts []string) string {
+	best := ""
+	for _, mountPoint := range mounts {
+		within := path == mountPoint || mountPoint == "/" || strings.HasPrefix(path, strings.TrimSuffix(mountPoint, "/")+"/")
+		if within && len(mountPoint) > len(best) {
+			best = mountPoint
+		}
+	}
+	return best
+}
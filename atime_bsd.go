@@ -0,0 +1,22 @@
+//go:build darwin || freebsd
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+func accessTime(info os.FileInfo) (time.Time, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(st.Atimespec.Sec, st.Atimespec.Nsec), true
+}
+
+func mountOptions(path string) (string, []string, error) {
+	return "", nil, errors.New("mount options are only read on Linux")
+}
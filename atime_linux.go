@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// accessTime returns the file's last access time, if the platform reports one.
+func accessTime(info os.FileInfo) (time.Time, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(st.Atim.Sec, st.Atim.Nsec), true
+}
+
+// mountOptions returns the mount point holding path and its options, from /proc/self/mounts.
+func mountOptions(path string) (string, []string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", nil, err
+	}
+	file, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+
+	options := make(map[string]string)
+	var mountPoints []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		mountPoint := unescapeMountPath(fields[1])
+		mountPoints = append(mountPoints, mountPoint)
+		// Later mounts on the same point hide earlier ones.
+		options[mountPoint] = fields[3]
+	}
+	if err := scanner.Err(); err != nil {
+		return "", nil, err
+	}
+	mountPoint := longestMountPoint(path, mountPoints)
+	if mountPoint == "" {
+		return "", nil, errors.New("no mount found")
+	}
+	return mountPoint, strings.Split(options[mountPoint], ","), nil
+}
+
+// unescapeMountPath undoes the kernel's escaping of spaces, tabs, newlines and backslashes in mount points as \ooo.
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+4 <= len(path) {
+			if n, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+func accessTime(info os.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func mountOptions(path string) (string, []string, error) {
+	return "", nil, errors.New("mount options are only read on Linux")
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// createRecordBatchTableQuery makes the table a batch is copied into, private to the flush's transaction.
+const createRecordBatchTableQuery = `
+CREATE TEMP TABLE record_batch (
+    filepath TEXT NOT NULL,
+    hash TEXT NOT NULL,
+    size BIGINT NOT NULL,
+    file_timestamp TIMESTAMP NOT NULL,
+    hash_calculated_timestamp TIMESTAMP NOT NULL,
+    recorded_timestamp TIMESTAMP NOT NULL,
+    hash_algorithm TEXT NOT NULL
+) ON COMMIT DROP`
+
+// flushRecordBatchQuery moves a copied batch into file_hashes, adding a history row for each record as the single
+// writes do. Inserts and updates are both upserts here, since a batch mixes the two.
+const flushRecordBatchQuery = `
+WITH history AS (
+    INSERT INTO file_history (filepath, hash, size, file_timestamp, recorded_timestamp, hash_algorithm)
+    SELECT filepath, hash, size, file_timestamp, recorded_timestamp, hash_algorithm FROM record_batch
+)
+INSERT INTO file_hashes (filepath, hash, size, file_timestamp, hash_calculated_timestamp, hash_algorithm)
+SELECT filepath, hash, size, file_timestamp, hash_calculated_timestamp, hash_algorithm FROM record_batch
+ON CONFLICT (filepath) DO UPDATE SET hash = EXCLUDED.hash, size = EXCLUDED.size, file_timestamp = EXCLUDED.file_timestamp,
+    hash_calculated_timestamp = EXCLUDED.hash_calculated_timestamp, hash_algorithm = EXCLUDED.hash_algorithm`
+
+// recordBatch holds new and changed records until --batch-size of them have accumulated, then writes them with COPY
+// in one transaction. A worker whose record is held doesn't write its result row itself; it leaves that to the flush
+// with whenWritten, so the results never claim a record the database doesn't have.
+type recordBatch struct {
+	db   *sql.DB
+	size int
+
+	mu      sync.Mutex
+	records []walRecord
+	waiting map[string]*batchedRecord
+
+	// flushMu serializes flushes, which is also what lets their result rows share one sink slot.
+	flushMu sync.Mutex
+}
+
+// batchedRecord is a held record's outcome, and what to do with it once it is known.
+type batchedRecord struct {
+	flushed bool
+	err     error
+	done    func(err error)
+}
+
+func newRecordBatch(db *sql.DB, size int) *recordBatch {
+	return &recordBatch{db: db, size: size, waiting: make(map[string]*batchedRecord)}
+}
+
+// add holds record for the next flush, flushing right away if that fills the batch.
+func (b *recordBatch) add(record walRecord) {
+	b.mu.Lock()
+	b.records = append(b.records, record)
+	b.waiting[record.Filepath] = &batchedRecord{}
+	full := len(b.records) >= b.size
+	b.mu.Unlock()
+	if full {
+		b.flush()
+	}
+}
+
+// whenWritten arranges for done to be called with the outcome of the held record of storedPath once it is flushed,
+// and reports whether it will be. If the record was flushed already, its outcome is returned instead; if there is no
+// held record, a nil error is.
+func (b *recordBatch) whenWritten(storedPath string, done func(err error)) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	record, ok := b.waiting[storedPath]
+	if !ok {
+		return false, nil
+	}
+	if record.flushed {
+		delete(b.waiting, storedPath)
+		return false, record.err
+	}
+	record.done = done
+	return true, nil
+}
+
+// flush writes the held records. Records the database won't take go to the write-ahead log if there is one, like
+// single writes; otherwise their results become errors.
+func (b *recordBatch) flush() {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	records := b.records
+	b.records = nil
+	b.mu.Unlock()
+	if len(records) == 0 {
+		return
+	}
+
+	what := fmt.Sprintf("batch of %d records", len(records))
+	op := func() error { return b.write(records) }
+	var err error
+	if wal == nil {
+		err = retryDB(b.db, what, op)
+	} else {
+		err = retryDBOr(b.db, what, op, func(err error) error {
+			log.Printf("Saving %s to the write-ahead log %s until the database takes it: %v", what, wal.path, err)
+			for _, record := range records {
+				if err := wal.append(record); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to write %s: %v", what, err)
+	}
+
+	var done []func(error)
+	b.mu.Lock()
+	for _, record := range records {
+		held := b.waiting[record.Filepath]
+		if held.done != nil {
+			delete(b.waiting, record.Filepath)
+			done = append(done, held.done)
+		} else {
+			held.flushed, held.err = true, err
+		}
+	}
+	b.mu.Unlock()
+	for _, f := range done {
+		f(err)
+	}
+}
+
+// write copies records into a temporary table and moves them into file_hashes, all in one transaction.
+func (b *recordBatch) write(records []walRecord) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(createRecordBatchTableQuery); err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(pq.CopyIn("record_batch", "filepath", "hash", "size", "file_timestamp", "hash_calculated_timestamp", "recorded_timestamp", "hash_algorithm"))
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if _, err := stmt.Exec(record.Filepath, record.Hash, record.Size, record.FileTimestamp, record.Recorded.UTC(), record.Recorded.UTC(), record.Algorithm); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(flushRecordBatchQuery); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
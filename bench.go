@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	benchSmallFileMax   = 64 << 10
+	benchLargeFileMin   = 64 << 20
+	benchMaxSmallFiles  = 2000
+	benchMaxLargeBytes  = 2 << 30
+	benchDBRoundTrips   = 50
+	benchHashBufferSize = 64 << 20
+)
+
+// runBench measures what bounds a scan on this machine: hashing speed, cold reads from the target disk, and
+// database round trips. Reads use direct I/O where available so repeated runs aren't flattered by the page cache.
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	var dbCfg DBConfig
+	registerDBFlags(fs, &dbCfg)
+	directory := fs.String("directory", "", "Directory to sample files from for read benchmarks. Files are only read, never written.")
+	fs.Usage = commandUsage(fs, "BenchUsage")
+	parseArgs(fs, args)
+
+	fmt.Println(msg("BenchHashHeader", nil))
+	buf := make([]byte, benchHashBufferSize)
+	var hashRate float64
+	for _, name := range hashAlgorithmNames() {
+		rate := benchHash(hashAlgorithms[name], buf)
+		if name == defaultHashAlgorithm {
+			hashRate = rate
+		}
+		fmt.Printf("  %-8s %8.0f MB/s\n", name, rate)
+	}
+
+	var seqRate, smallRate float64
+	if *directory != "" {
+		small, large := sampleBenchFiles(*directory)
+		fmt.Println(msg("BenchDiskHeader", map[string]any{"Directory": *directory}))
+		if len(large) > 0 {
+			seqRate = benchSequential(large)
+			fmt.Println(msg("BenchSequential", map[string]any{"Rate": fmt.Sprintf("%8.0f", seqRate), "Count": len(large)}))
+		} else {
+			fmt.Println(msg("BenchSequentialNone", map[string]any{"MiB": benchLargeFileMin >> 20}))
+		}
+		if len(small) > 0 {
+			smallRate = benchSmallFiles(small)
+			fmt.Println(msg("BenchSmallFiles", map[string]any{"Rate": fmt.Sprintf("%8.0f", smallRate), "Count": len(small), "KiB": benchSmallFileMax >> 10}))
+		} else {
+			fmt.Println(msg("BenchSmallFilesNone", nil))
+		}
+	}
+
+	var rtt time.Duration
+	if dbCfg.DbName != "" {
+		db := connectToDatabase(dbCfg)
+		defer db.Close()
+		var samples []time.Duration
+		for i := 0; i < benchDBRoundTrips; i++ {
+			start := time.Now()
+			if _, err := db.Exec("SELECT 1"); err != nil {
+				log.Fatalf("Database round trip failed: %v", err)
+			}
+			samples = append(samples, time.Since(start))
+		}
+		sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+		rtt = samples[len(samples)/2]
+		fmt.Println(msg("BenchRoundTrip", map[string]any{"Median": rtt.Round(time.Microsecond), "P95": samples[len(samples)*95/100].Round(time.Microsecond)}))
+	}
+
+	fmt.Println(msg("BenchSuggestions", nil))
+	if seqRate > 0 && hashRate < seqRate {
+		fmt.Println(msg("BenchHashBound", nil))
+	} else if seqRate > 0 {
+		fmt.Println(msg("BenchDiskBound", nil))
+	}
+	if smallRate > 0 {
+		// Each new file costs one read plus a lookup and an insert. Enough workers to keep the disk busy while others
+		// wait on the database is what matters for trees of small files.
+		perFile := time.Duration(float64(time.Second) / smallRate)
+		workers := int(math.Ceil(float64(perFile+2*rtt) / float64(perFile)))
+		workers = max(1, min(workers, 64))
+		fmt.Println(msg("BenchSuggestedWorkers", map[string]any{"Workers": workers, "Current": defaultWorkerCount}))
+	}
+	if rtt > 5*time.Millisecond {
+		fmt.Println(msg("BenchHighLatency", nil))
+	}
+}
+
+// benchHash returns MB/s for hashing buf with the given algorithm, repeated for at least half a second.
+func benchHash(newHash func() hash.Hash, buf []byte) float64 {
+	h := newHash()
+	start := time.Now()
+	var total int
+	for time.Since(start) < 500*time.Millisecond {
+		h.Write(buf)
+		total += len(buf)
+	}
+	return float64(total) / 1e6 / time.Since(start).Seconds()
+}
+
+// sampleBenchFiles collects small files and enough large files to read about benchMaxLargeBytes.
+func sampleBenchFiles(root string) ([]string, []string) {
+	var small, large []string
+	var largeBytes int64
+	stop := errors.New("enough samples")
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if info.Size() > 0 && info.Size() < benchSmallFileMax && len(small) < benchMaxSmallFiles {
+			small = append(small, path)
+		} else if info.Size() >= benchLargeFileMin && largeBytes < benchMaxLargeBytes {
+			large = append(large, path)
+			largeBytes += info.Size()
+		}
+		if len(small) >= benchMaxSmallFiles && largeBytes >= benchMaxLargeBytes {
+			return stop
+		}
+		return nil
+	})
+	return small, large
+}
+
+// benchSequential returns MB/s reading the files one after another.
+func benchSequential(paths []string) float64 {
+	start := time.Now()
+	var total int64
+	for _, path := range paths {
+		file, reader, err := openForVerify(path, true, treeReader{})
+		if err != nil {
+			continue
+		}
+		n, _ := io.Copy(io.Discard, io.LimitReader(reader, benchMaxLargeBytes-total))
+		file.Close()
+		total += n
+		if total >= benchMaxLargeBytes {
+			break
+		}
+	}
+	return float64(total) / 1e6 / time.Since(start).Seconds()
+}
+
+// benchSmallFiles returns files/s opening and reading each file in full.
+func benchSmallFiles(paths []string) float64 {
+	start := time.Now()
+	read := 0
+	for _, path := range paths {
+		file, reader, err := openForVerify(path, true, treeReader{})
+		if err != nil {
+			continue
+		}
+		io.Copy(io.Discard, reader)
+		file.Close()
+		read++
+	}
+	return float64(read) / time.Since(start).Seconds()
+}
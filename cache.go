@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+// fileChangesChannel is the NOTIFY channel file_hashes changes are announced on while a cache is in use.
+const fileChangesChannel = "file_hashes_changed"
+
+// createChangeNotifyTriggerQuery announces every write to file_hashes, from any scan, command or manual SQL, so serve
+// can drop cached lookups it affects. NOTIFY payloads are limited to 8000 bytes; a change too long to describe is sent
+// as "*", which empties the whole cache. The trigger is only created if missing, since creating one locks the table.
+const createChangeNotifyTriggerQuery = `
+CREATE OR REPLACE FUNCTION notify_file_hashes_change() RETURNS trigger AS $$
+DECLARE
+    payload TEXT := json_build_object(
+        'old_filepath', OLD.filepath, 'old_hash', OLD.hash,
+        'new_filepath', NEW.filepath, 'new_hash', NEW.hash)::text;
+BEGIN
+    IF octet_length(payload) > 7900 THEN
+        payload := '*';
+    END IF;
+    PERFORM pg_notify('` + fileChangesChannel + `', payload);
+    RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'file_hashes_notify_change') THEN
+        CREATE TRIGGER file_hashes_notify_change AFTER INSERT OR UPDATE OR DELETE ON file_hashes
+        FOR EACH ROW EXECUTE FUNCTION notify_file_hashes_change();
+    END IF;
+END
+$$;
+`
+
+// fileChange is a file_hashes write as announced by the trigger. Old fields are empty for inserts, new ones for
+// deletes.
+type fileChange struct {
+	OldFilepath string `json:"old_filepath"`
+	OldHash     string `json:"old_hash"`
+	NewFilepath string `json:"new_filepath"`
+	NewHash     string `json:"new_hash"`
+}
+
+// lookupCache keeps serve's path and hash lookups in Redis. Redis being unavailable only costs speed: failures are
+// logged and the lookup goes to the database. Entries expire after ttl even if a change notification was missed.
+type lookupCache struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+}
+
+// newLookupCache connects to Redis at addr, with the password from REDIS_PASSWORD if set. Keys are prefixed with
+// the database name, so several indexes can share one Redis.
+func newLookupCache(addr, dbName string, ttl time.Duration) (*lookupCache, error) {
+	client := redis.NewClient(&redis.Options{Addr: addr, Password: os.Getenv("REDIS_PASSWORD")})
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &lookupCache{client: client, prefix: "fileindexer:" + dbName + ":", ttl: ttl}, nil
+}
+
+func (c *lookupCache) pathKey(path string) string {
+	return c.prefix + "path:" + path
+}
+
+func (c *lookupCache) hashKey(hash string) string {
+	return c.prefix + "hash:" + hash
+}
+
+// get decodes the cached value of key into v, reporting whether there was one.
+func (c *lookupCache) get(ctx context.Context, key string, v any) bool {
+	data, err := c.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return false
+	}
+	if err != nil {
+		log.Printf("Cache read failed, using the database: %v", err)
+		return false
+	}
+	return json.Unmarshal(data, v) == nil
+}
+
+func (c *lookupCache) set(ctx context.Context, key string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	if err := c.client.Set(ctx, key, data, c.ttl).Err(); err != nil {
+		log.Printf("Cache write failed: %v", err)
+	}
+}
+
+// invalidate drops the entries a change affects: the path it was at and moved to, and the path lists of the hashes
+// it had and has.
+func (c *lookupCache) invalidate(ctx context.Context, change fileChange) {
+	var keys []string
+	for _, path := range []string{change.OldFilepath, change.NewFilepath} {
+		if path != "" {
+			keys = append(keys, c.pathKey(path))
+		}
+	}
+	for _, hash := range []string{change.OldHash, change.NewHash} {
+		if hash != "" {
+			keys = append(keys, c.hashKey(hash))
+		}
+	}
+	if err := c.client.Del(ctx, keys...).Err(); err != nil {
+		log.Printf("Cache invalidation failed, flushing: %v", err)
+		c.flush(ctx)
+	}
+}
+
+// flush drops every entry of this database, for when changes may have been missed.
+func (c *lookupCache) flush(ctx context.Context) {
+	iter := c.client.Scan(ctx, 0, c.prefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		c.client.Del(ctx, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf("Cache flush failed, entries expire within %s: %v", c.ttl, err)
+	}
+}
+
+// followChanges installs the change trigger and drops cache entries as changes are announced, until the process
+// exits. While the listener is reconnecting, changes go unannounced, so the cache is flushed once it is back.
+func (c *lookupCache) followChanges(db *sql.DB, connectionString string) error {
+	if _, err := db.Exec(createChangeNotifyTriggerQuery); err != nil {
+		return err
+	}
+	listener := pq.NewListener(connectionString, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Change listener: %v", err)
+		}
+	})
+	if err := listener.Listen(fileChangesChannel); err != nil {
+		listener.Close()
+		return err
+	}
+	// Anything cached before the listener started may already be stale.
+	c.flush(context.Background())
+
+	go func() {
+		for notification := range listener.Notify {
+			ctx := context.Background()
+			var change fileChange
+			if notification == nil || notification.Extra == "*" || json.Unmarshal([]byte(notification.Extra), &change) != nil {
+				c.flush(ctx)
+				continue
+			}
+			c.invalidate(ctx, change)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"fileindexer/pkg/indexer"
+)
+
+// maxCheckCopies caps the other paths with the same contents that check lists.
+const maxCheckCopies = 20
+
+// runCheck hashes one file and compares it with its row in file_hashes, for spot checks and scripts. It is meant to
+// answer in well under a second for small files, so it makes no schema changes (which would queue behind a running
+// scan's locks) and gives up quickly on an unreachable database instead of retrying.
+func runCheck(args []string) {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	var dbCfg DBConfig
+	registerDBFlags(fs, &dbCfg)
+	prefix := fs.String("prefix", "", "Prefix the scan removed from file paths before storing them.")
+	algorithm := fs.String("hash-algo", defaultHashAlgorithm, "Hash algorithm for files that aren't indexed yet; indexed files are hashed with the algorithm of their row.")
+	configFile, configSet := registerConfigFlags(fs)
+	fs.Usage = commandUsage(fs, "CheckUsage")
+	parseArgs(fs, args)
+
+	if fs.NArg() != 1 {
+		usageError(fs, "", msg("CheckUsage", nil))
+	}
+	if _, ok := hashAlgorithms[*algorithm]; !ok {
+		usageError(fs, "hash-algo", fmt.Sprintf("Invalid --hash-algo %q, expected one of %v.", *algorithm, hashAlgorithmNames()))
+	}
+	readDBConfigFile(fs, *configFile, *configSet)
+	if dbCfg.DbName == "" {
+		usageError(fs, "dbname", msg("MissingFlag", map[string]any{"Flag": "dbname"}))
+	}
+
+	path, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to resolve %s: %v", fs.Arg(0), err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		log.Fatalf("Failed to stat %s: %v", path, err)
+	}
+	if !info.Mode().IsRegular() {
+		log.Fatalf("%s is not a regular file", path)
+	}
+	storedPath := storedPathFor(Config{Prefix: *prefix}, path)
+
+	db := openDatabase(databaseConnectionString(dbCfg) + " connect_timeout=5")
+	defer db.Close()
+
+	// to_jsonb reads hash_algorithm without failing on indexes that predate the column.
+	var dbHash, dbAlgorithm string
+	var dbSize int64
+	var dbModified time.Time
+	err = db.QueryRow("SELECT hash, size, file_timestamp, coalesce(to_jsonb(f)->>'hash_algorithm', $2) FROM file_hashes f WHERE filepath = $1",
+		storedPath, defaultHashAlgorithm).Scan(&dbHash, &dbSize, &dbModified, &dbAlgorithm)
+	indexed := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		log.Fatalf("Failed to look up %s: %v", storedPath, err)
+	}
+	if indexed {
+		base, _ := sampledAlgorithm(dbAlgorithm)
+		if chunked, _, ok := chunkedAlgorithm(dbAlgorithm); ok {
+			base = chunked
+		}
+		if _, ok := hashAlgorithms[base]; !ok {
+			log.Fatalf("%s is indexed with hash algorithm %q, which can't be computed from the file", storedPath, dbAlgorithm)
+		}
+		*algorithm = dbAlgorithm
+	}
+
+	hash, err := hashFile(file, *algorithm, nil)
+	if err != nil {
+		log.Fatalf("Failed to hash %s: %v", path, err)
+	}
+
+	matches := indexed && hash == dbHash && info.Size() == dbSize
+	data := map[string]any{"Path": storedPath, "Hash": hash, "Algorithm": *algorithm, "OldHash": dbHash}
+	switch {
+	case !indexed:
+		fmt.Println(msg("CheckNotIndexed", data))
+	case matches:
+		fmt.Println(msg("CheckMatch", data))
+	case indexer.SameModTime(info.ModTime(), localWallClock(dbModified)):
+		// The contents changed but the modification time didn't, which writes through the filesystem don't do.
+		fmt.Println(msg("CheckCorrupt", data))
+	default:
+		fmt.Println(msg("CheckChanged", data))
+	}
+
+	// Without the file_hashes_hash index (created by serve and --record-lineage) this reads the whole table.
+	rows, err := db.Query("SELECT filepath FROM file_hashes WHERE hash = $1 AND filepath <> $2 ORDER BY filepath LIMIT $3",
+		hash, storedPath, maxCheckCopies+1)
+	if err != nil {
+		log.Fatalf("Failed to look up copies of %s: %v", storedPath, err)
+	}
+	defer rows.Close()
+	var copies []string
+	for rows.Next() {
+		var other string
+		if err := rows.Scan(&other); err != nil {
+			log.Fatalf("Failed to read copies of %s: %v", storedPath, err)
+		}
+		copies = append(copies, other)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalf("Failed to read copies of %s: %v", storedPath, err)
+	}
+	if len(copies) == 0 {
+		fmt.Println(msg("CheckNoCopies", nil))
+	} else {
+		fmt.Println(msg("CheckCopies", nil))
+		for i, other := range copies {
+			if i == maxCheckCopies {
+				fmt.Println(msg("CheckMoreCopies", map[string]any{"Count": maxCheckCopies}))
+				break
+			}
+			fmt.Printf("  %s\n", other)
+		}
+	}
+
+	if !matches {
+		rows.Close()
+		db.Close()
+		os.Exit(1)
+	}
+}
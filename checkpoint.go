@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// interruptedExitCode is the exit status of a scan stopped by SIGINT or SIGTERM, the one a shell gives Ctrl-C.
+const interruptedExitCode = 130
+
+// maxRuntimeExitCode is the exit status of a scan stopped by --max-runtime, so a cron job can tell that the tree
+// wasn't covered yet.
+const maxRuntimeExitCode = 4
+
+// errScanInterrupted ends a walk once the scan has been interrupted.
+var errScanInterrupted = errors.New("scan interrupted")
+
+// errMaxRuntime is the cause of a scan context cancelled by --max-runtime.
+var errMaxRuntime = errors.New("--max-runtime reached")
+
+// interruptContext returns a context cancelled by the first SIGINT or SIGTERM. That stops the walk and lets the files
+// being hashed finish; a second signal kills the scan as usual. Calling stop gives the signals back once the walk is
+// over, to the default handling or to --watch.
+func interruptContext() (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			signal.Stop(signals)
+			log.Print(msg("ScanInterrupting", nil))
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+// runtimeContext returns a context that is also cancelled at deadline, which --max-runtime budget sets, stopping the
+// scan the way the first SIGINT does.
+func runtimeContext(parent context.Context, deadline time.Time, budget time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithDeadlineCause(parent, deadline, errMaxRuntime)
+	context.AfterFunc(ctx, func() {
+		if errors.Is(context.Cause(ctx), errMaxRuntime) {
+			log.Print(msg("ScanRuntimeReached", map[string]any{"MaxRuntime": budget}))
+		}
+	})
+	return ctx, cancel
+}
+
+// interruptScanRun records the counts of a run stopped by a signal and its checkpoint, the last file in walk order
+// before which every file has a result. finished_timestamp stays NULL, so --resume can continue the run.
+func interruptScanRun(db *sql.DB, id int64, checkpoint string, counts *runCounts) error {
+	_, err := db.Exec(`
+UPDATE scan_runs SET checkpoint_path = $1, files_processed = $2, files_new = $3, files_changed = $4, files_existing = $5,
+    files_failed = $6
+WHERE id = $7`,
+		nullString(checkpoint), counts.processed.Load(), counts.added.Load(), counts.changed.Load(), counts.existing.Load(), counts.failed.Load(), id)
+	return err
+}
+
+// checkpointedScanRun returns the latest interrupted run of cfg.Directory and --subpath that has a checkpoint, and the
+// checkpoint, or 0 if there is none. The counts the run recorded are added to counts, so its totals cover the whole directory.
+func checkpointedScanRun(db *sql.DB, cfg Config, counts *runCounts) (int64, string, error) {
+	if _, err := db.Exec(createScanRunsTableQuery); err != nil {
+		return 0, "", err
+	}
+	var id int64
+	var checkpoint string
+	var processed, added, changed, existing, failed sql.NullInt64
+	err := db.QueryRow(`
+SELECT id, checkpoint_path, files_processed, files_new, files_changed, files_existing, files_failed FROM scan_runs
+WHERE directory = $1 AND coalesce(subpath, '') = $2 AND finished_timestamp IS NULL AND checkpoint_path IS NOT NULL
+ORDER BY id DESC LIMIT 1`, cfg.Directory, cfg.Subpath).Scan(&id, &checkpoint, &processed, &added, &changed, &existing, &failed)
+	if err == sql.ErrNoRows {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	counts.processed.Add(processed.Int64)
+	counts.added.Add(added.Int64)
+	counts.changed.Add(changed.Int64)
+	counts.existing.Add(existing.Int64)
+	counts.failed.Add(failed.Int64)
+	return id, checkpoint, nil
+}
+
+// walkedBefore reports whether a walk reaches path no later than checkpoint, leaving out the directories on the way
+// to checkpoint, which the walk still has to enter. filepath.WalkDir visits the entries of each directory in name
+// order, so the paths compare a component at a time.
+func walkedBefore(path, checkpoint string, isDir bool) bool {
+	a := strings.Split(path, string(filepath.Separator))
+	b := strings.Split(checkpoint, string(filepath.Separator))
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) == len(b) || (len(a) < len(b) && !isDir)
+}
+
+// remainingFiles estimates how much of scanRoot(cfg) a scan stopped at checkpoint has left from the index: the files
+// indexed under it, and those of them whose stored paths sort after the checkpoint's. Sorting by path isn't quite walk
+// order, and files added since the last scan aren't indexed, so the count is approximate.
+func remainingFiles(cfg Config, db *sql.DB, checkpoint string) (remaining, total int64, err error) {
+	err = db.QueryRow(`SELECT count(*) FILTER (WHERE filepath COLLATE "C" > $2), count(*) FROM file_hashes WHERE filepath LIKE $1`,
+		likePrefix(scannedPrefix(cfg)), storedPathFor(cfg, checkpoint)).Scan(&remaining, &total)
+	return remaining, total, err
+}
+
+// finishInterruptedScan records where a scan interrupted by a signal, or by --max-runtime when outOfTime is set,
+// stopped, after its results have been written, and exits. The deferred closes of runScan don't run, so the index and
+// database are closed here. counts are the run's, and processed the files done by the whole scan, which with several
+// --directory roots includes those of the runs before it.
+func finishInterruptedScan(cfg Config, db *sql.DB, runID int64, checkpoint string, counts *runCounts, processed int64, started time.Time, outOfTime bool) {
+	if runID != 0 {
+		if err := interruptScanRun(db, runID, checkpoint, counts); err != nil {
+			log.Printf("Failed to record the checkpoint of scan run %d: %v", runID, err)
+		}
+	}
+	summary := "ScanInterrupted"
+	if outOfTime {
+		summary = "ScanOutOfTime"
+	}
+	log.Print(msg(summary, map[string]any{
+		"Processed": processed, "Duration": time.Since(started).Round(time.Second), "Checkpoint": checkpoint,
+		"Resumable": runID != 0 && len(cfg.Roots) <= 1 && (cfg.Partition || checkpoint != ""),
+	}))
+	// Only a walk of the directory has a checkpoint to tell what is left, and only file_hashes is counted.
+	if outOfTime && checkpoint != "" && db != nil && index == nil {
+		remaining, total, err := remainingFiles(cfg, db, checkpoint)
+		if err != nil {
+			log.Printf("Failed to estimate the files remaining under %s: %v", scanRoot(cfg), err)
+		} else if total > 0 {
+			log.Print(msg("ScanRemaining", map[string]any{
+				"Remaining": remaining, "Total": total, "Percent": fmt.Sprintf("%.0f", 100*float64(remaining)/float64(total)), "Directory": scanRoot(cfg),
+			}))
+		}
+	}
+	if index != nil {
+		index.Close()
+	}
+	if db != nil {
+		db.Close()
+	}
+	if outOfTime {
+		os.Exit(maxRuntimeExitCode)
+	}
+	os.Exit(interruptedExitCode)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+
+	"fileindexer/pkg/indexer"
+)
+
+// file_chunks holds the digest of each chunk of the files hashed with --chunk-size, whose hash is the Merkle root of
+// them. Chunk chunk_index covers the chunk_size bytes from chunk_index * chunk_size; the last may be shorter. A
+// file's chunks are replaced whenever it is hashed with --chunk-size, so they match its file_hashes row as long as
+// that was made with a -merkle- algorithm.
+const createFileChunksTableQuery = `
+CREATE TABLE IF NOT EXISTS file_chunks (
+    filepath TEXT NOT NULL,
+    chunk_index BIGINT NOT NULL,
+    chunk_size BIGINT NOT NULL,
+    hash TEXT NOT NULL,
+    PRIMARY KEY (filepath, chunk_index)
+);
+`
+
+// merkleInfix joins the hash algorithm of a chunked hash to its chunk size, as in sha256-merkle-4MiB. Hashes made with
+// different chunk sizes differ, so a file is hashed again when --chunk-size changes.
+const merkleInfix = "-merkle-"
+
+// minChunkSize is the smallest --chunk-size; smaller chunks would add a row for every few kilobytes of every file.
+const minChunkSize = 4 << 10
+
+// maxLoggedRegions is how many changed regions of a file are logged when it is hashed again.
+const maxLoggedRegions = 10
+
+// chunkedAlgorithmName returns the hash_algorithm recorded for hashes made with algorithm in chunks of chunkSize bytes.
+func chunkedAlgorithmName(algorithm string, chunkSize int64) string {
+	label := strconv.FormatInt(chunkSize, 10)
+	switch {
+	case chunkSize%(1<<20) == 0:
+		label = strconv.FormatInt(chunkSize>>20, 10) + "MiB"
+	case chunkSize%(1<<10) == 0:
+		label = strconv.FormatInt(chunkSize>>10, 10) + "KiB"
+	}
+	return algorithm + merkleInfix + label
+}
+
+// chunkedAlgorithm returns the algorithm and chunk size a chunked hash_algorithm was made with, and whether it names
+// one.
+func chunkedAlgorithm(algorithm string) (string, int64, bool) {
+	base, label, ok := strings.Cut(algorithm, merkleInfix)
+	if !ok {
+		return algorithm, 0, false
+	}
+	chunkSize, err := parseByteSize(label)
+	if err != nil || chunkSize <= 0 {
+		return algorithm, 0, false
+	}
+	return base, chunkSize, true
+}
+
+// hashFileChunks is hashFile for a chunked algorithm, also returning the digests of the chunks.
+func hashFileChunks(file *os.File, algorithm string, share *shareSweep, extra ...io.Writer) (string, []string, error) {
+	base, chunkSize, ok := chunkedAlgorithm(algorithm)
+	if !ok {
+		return "", nil, fmt.Errorf("%q isn't a chunked hash algorithm", algorithm)
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		return "", nil, err
+	}
+	var reader io.Reader = file
+	if share != nil {
+		reader = &shareReader{share: share, file: file}
+	}
+	if throttle != nil {
+		reader = &throttledReader{reader: reader}
+	}
+	return indexer.HashChunks(reader, base, chunkSize, extra...)
+}
+
+// recordChunks replaces the chunks recorded for storedPath with chunks, returning the byte ranges that differ from
+// those recorded before, if there were any of the same size.
+func recordChunks(db *sql.DB, storedPath string, chunkSize int64, chunks []string) ([][2]int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var previous []string
+	rows, err := tx.Query("SELECT hash FROM file_chunks WHERE filepath = $1 AND chunk_size = $2 ORDER BY chunk_index", storedPath, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		previous = append(previous, hash)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM file_chunks WHERE filepath = $1", storedPath); err != nil {
+		return nil, err
+	}
+	stmt, err := tx.Prepare(pq.CopyIn("file_chunks", "filepath", "chunk_index", "chunk_size", "hash"))
+	if err != nil {
+		return nil, err
+	}
+	for i, hash := range chunks {
+		if _, err := stmt.Exec(storedPath, i, chunkSize, hash); err != nil {
+			stmt.Close()
+			return nil, err
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return nil, err
+	}
+	if err := stmt.Close(); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if len(previous) == 0 {
+		return nil, nil
+	}
+	return changedRegions(previous, chunks, chunkSize), nil
+}
+
+// changedRegions returns the byte ranges, start inclusive and end exclusive, of the chunks that differ between two
+// lists of digests, merging neighbouring chunks into one range. Chunks only one list has count as changed; the end of
+// the last range may lie past the end of the file.
+func changedRegions(before, after []string, chunkSize int64) [][2]int64 {
+	var regions [][2]int64
+	for i := 0; i < max(len(before), len(after)); i++ {
+		if i < len(before) && i < len(after) && before[i] == after[i] {
+			continue
+		}
+		start := int64(i) * chunkSize
+		if n := len(regions); n > 0 && regions[n-1][1] == start {
+			regions[n-1][1] += chunkSize
+			continue
+		}
+		regions = append(regions, [2]int64{start, start + chunkSize})
+	}
+	return regions
+}
+
+// logChangedRegions logs which parts of the file at path changed since its chunks were last recorded.
+func logChangedRegions(path string, regions [][2]int64) {
+	if len(regions) == 0 {
+		return
+	}
+	described := make([]string, 0, min(len(regions), maxLoggedRegions))
+	for _, region := range regions[:min(len(regions), maxLoggedRegions)] {
+		described = append(described, fmt.Sprintf("%d-%d", region[0], region[1]))
+	}
+	more := ""
+	if len(regions) > maxLoggedRegions {
+		more = fmt.Sprintf(" and %d more", len(regions)-maxLoggedRegions)
+	}
+	log.Printf("Changed regions of %s (byte offsets): %s%s", path, strings.Join(described, ", "), more)
+}
+
+// hashChunkedFile hashes the file with a chunked algorithm and replaces its recorded chunks, logging the regions that
+// changed since they were recorded.
+func hashChunkedFile(file *os.File, storedPath string, db *sql.DB, algorithm string, share *shareSweep, extra ...io.Writer) (string, error) {
+	hash, chunks, err := hashFileChunks(file, algorithm, share, extra...)
+	if err != nil {
+		return "", err
+	}
+	_, chunkSize, _ := chunkedAlgorithm(algorithm)
+	var regions [][2]int64
+	err = retryDB(db, "chunks of "+storedPath, func() error {
+		var err error
+		regions, err = recordChunks(db, storedPath, chunkSize, chunks)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to record chunk digests: %v", err)
+	}
+	logChangedRegions(storedPath, regions)
+	return hash, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestChunkedAlgorithm(t *testing.T) {
+	tests := []struct {
+		chunkSize int64
+		name      string
+	}{
+		{4 << 20, "sha256-merkle-4MiB"},
+		{64 << 10, "sha256-merkle-64KiB"},
+		{1536 << 10, "sha256-merkle-1536KiB"},
+		{5000, "sha256-merkle-5000"},
+	}
+	for _, tt := range tests {
+		name := chunkedAlgorithmName("sha256", tt.chunkSize)
+		if name != tt.name {
+			t.Errorf("chunkedAlgorithmName(sha256, %d) = %q, want %q", tt.chunkSize, name, tt.name)
+		}
+		if base, chunkSize, ok := chunkedAlgorithm(name); !ok || base != "sha256" || chunkSize != tt.chunkSize {
+			t.Errorf("chunkedAlgorithm(%q) = %q, %d, %v, want sha256, %d, true", name, base, chunkSize, ok, tt.chunkSize)
+		}
+	}
+	for _, name := range []string{"sha256", "md5-sampled", "sha256-merkle-", "sha256-merkle-big"} {
+		if _, _, ok := chunkedAlgorithm(name); ok {
+			t.Errorf("chunkedAlgorithm(%q) took it for a chunked hash", name)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+// Package client calls the HTTP API served by `fileindexer serve`, so other services can look up the index without
+// hand-rolling requests:
+//
+//	c := client.New("http://indexer:8080")
+//	paths, err := c.LookupByHash(ctx, "9e107d9d372bb6826bd81d3542a419d6")
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by LookupByPath for a path that isn't indexed, and by Scan and CancelScan for a scan the
+// server doesn't know.
+var ErrNotFound = errors.New("fileindexer: not found")
+
+// Client is a fileindexer API client. Its methods are safe for concurrent use.
+type Client struct {
+	baseURL string
+	// Token is sent as a bearer token with every request, if set. Servers started with --require-token need one, made
+	// with `fileindexer token create`.
+	Token string
+	// HTTPClient makes the requests. It defaults to one with a one-minute timeout.
+	HTTPClient *http.Client
+}
+
+// New returns a client for the server at baseURL, e.g. http://indexer:8080.
+func New(baseURL string) *Client {
+	return &Client{baseURL: strings.TrimSuffix(baseURL, "/"), HTTPClient: &http.Client{Timeout: time.Minute}}
+}
+
+// File is an indexed file. Times are in the scanning machine's local time.
+type File struct {
+	Path      string    `json:"path"`
+	Hash      string    `json:"hash"`
+	Algorithm string    `json:"hash_algorithm"` // e.g. md5 or sha256
+	Size      int64     `json:"size"`
+	Modified  time.Time `json:"modified"`
+	Indexed   time.Time `json:"indexed"`
+}
+
+// FileDetails is an indexed file with what LookupFileDetails was asked to include. HistoryCursor is set when the file
+// has more history than was returned.
+type FileDetails struct {
+	File
+	History       []HistoryEntry `json:"history"`
+	HistoryCursor string         `json:"history_cursor"`
+	Copies        *HashPaths     `json:"copies"`
+}
+
+// HistoryEntry is a recorded state of a file. Removed entries record the file leaving its path, with the hash it had.
+type HistoryEntry struct {
+	ID       int64     `json:"id"`
+	Path     string    `json:"path"`
+	Hash     string    `json:"hash"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Recorded time.Time `json:"recorded"`
+	Removed  bool      `json:"removed"`
+}
+
+// HashPaths is the paths indexed with a hash. Truncated is set when there were too many to return.
+type HashPaths struct {
+	Hash      string   `json:"hash"`
+	Paths     []string `json:"paths"`
+	Truncated bool     `json:"truncated"`
+}
+
+// ScanDiff is the files whose hash changed between two scan runs. Truncated is set when there were too many to
+// return.
+type ScanDiff struct {
+	From      int64         `json:"from"`
+	To        int64         `json:"to"`
+	Files     []ChangedFile `json:"files"`
+	Truncated bool          `json:"truncated"`
+}
+
+// ChangedFile is one entry of a ScanDiff. Status is "new" or "changed"; OldHash is empty for new files.
+type ChangedFile struct {
+	Path    string `json:"path"`
+	Status  string `json:"status"`
+	OldHash string `json:"old_hash"`
+	Hash    string `json:"hash"`
+	Size    int64  `json:"size"`
+}
+
+// ScanStatus is a scan started over the API. State is running, cancelling, finished, failed or cancelled; Files,
+// Errors and Bytes count the files it has finished so far. Finished is nil while it runs.
+type ScanStatus struct {
+	ID        string     `json:"id"`
+	Directory string     `json:"directory"`
+	PID       int        `json:"pid"`
+	State     string     `json:"state"`
+	Started   time.Time  `json:"started"`
+	Finished  *time.Time `json:"finished"`
+	Error     string     `json:"error"`
+	Files     int        `json:"files"`
+	Errors    int        `json:"errors"`
+	Bytes     int64      `json:"bytes"`
+	LastPath  string     `json:"last_path"`
+}
+
+// StartedScan is the status of a scan TriggerScan started.
+type StartedScan = ScanStatus
+
+// LookupByHash returns the stored paths of the files with hash.
+func (c *Client) LookupByHash(ctx context.Context, hash string) (HashPaths, error) {
+	var result HashPaths
+	err := c.do(ctx, http.MethodGet, "/hashes/"+url.PathEscape(hash), nil, &result)
+	return result, err
+}
+
+// LookupByPath returns the indexed file with the stored path, or ErrNotFound.
+func (c *Client) LookupByPath(ctx context.Context, path string) (File, error) {
+	var result File
+	err := c.do(ctx, http.MethodGet, "/files?"+url.Values{"path": {path}}.Encode(), nil, &result)
+	return result, err
+}
+
+// LookupFileDetails returns the indexed file with the stored path along with include, any of "history" (its
+// recorded states, the newest first) and "copies" (the other paths indexed with its hash), or ErrNotFound.
+func (c *Client) LookupFileDetails(ctx context.Context, path string, include ...string) (FileDetails, error) {
+	var result FileDetails
+	query := url.Values{"path": {path}, "include": {strings.Join(include, ",")}}
+	err := c.do(ctx, http.MethodGet, "/files?"+query.Encode(), nil, &result)
+	return result, err
+}
+
+// DiffScans lists the files under prefix (a stored path prefix, or "" for the whole index) whose hash changed
+// between the finish of scan run from and the finish of scan run to. Run IDs are those in the scan_runs table.
+func (c *Client) DiffScans(ctx context.Context, from, to int64, prefix string) (ScanDiff, error) {
+	query := url.Values{"from": {strconv.FormatInt(from, 10)}, "to": {strconv.FormatInt(to, 10)}}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	var result ScanDiff
+	err := c.do(ctx, http.MethodGet, "/scans/diff?"+query.Encode(), nil, &result)
+	return result, err
+}
+
+// TriggerScan starts a scan of directory on the server and returns without waiting for it. The server must have been
+// started with a --scan-root containing directory, and strips that root's --scan-prefix from stored paths; prefix, if
+// not "", must be that same prefix.
+func (c *Client) TriggerScan(ctx context.Context, directory, prefix string) (StartedScan, error) {
+	body := map[string]string{"directory": directory, "prefix": prefix}
+	var result StartedScan
+	err := c.do(ctx, http.MethodPost, "/scans", body, &result)
+	return result, err
+}
+
+// Scan returns the status of the scan with id, as TriggerScan returned it, or ErrNotFound once the server has
+// forgotten it.
+func (c *Client) Scan(ctx context.Context, id string) (ScanStatus, error) {
+	var result ScanStatus
+	err := c.do(ctx, http.MethodGet, "/scans/"+url.PathEscape(id), nil, &result)
+	return result, err
+}
+
+// CancelScan stops the scan with id as SIGINT would: the files being hashed are finished and the results written.
+// It returns without waiting for that; Scan reports the state cancelled once it is done.
+func (c *Client) CancelScan(ctx context.Context, id string) (ScanStatus, error) {
+	var result ScanStatus
+	err := c.do(ctx, http.MethodDelete, "/scans/"+url.PathEscape(id), nil, &result)
+	return result, err
+}
+
+// Export streams the report named report (files, dupes, stale or diff) with the parameters in query, e.g. prefix, as
+// CSV or JSON lines (format csv or jsonl). The caller must close the returned body. HTTPClient's timeout covers the
+// whole download, so large exports need a client without one.
+func (c *Client) Export(ctx context.Context, report, format string, query url.Values) (io.ReadCloser, error) {
+	query = cloneValues(query)
+	query.Set("format", format)
+	resp, err := c.send(ctx, http.MethodGet, "/export/"+url.PathEscape(report)+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func cloneValues(values url.Values) url.Values {
+	clone := url.Values{}
+	for name, value := range values {
+		clone[name] = append([]string(nil), value...)
+	}
+	return clone
+}
+
+// do sends a request with body (if not nil) as JSON and decodes the JSON response into result.
+func (c *Client) do(ctx context.Context, method, path string, body, result any) error {
+	resp, err := c.send(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("fileindexer: invalid response to %s %s: %v", method, path, err)
+	}
+	return nil
+}
+
+// send sends a request with body (if not nil) as JSON and returns the response if it was successful. Its body is
+// then the caller's to close.
+func (c *Client) send(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return nil, fmt.Errorf("fileindexer: %s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(message)))
+}
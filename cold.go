@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"fileindexer/pkg/indexer"
+)
+
+// parseAge parses ages like "180d", "26w", "2y" or any time.ParseDuration value. A year is 365 days.
+func parseAge(s string) (time.Duration, error) {
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour, "y": 365 * 24 * time.Hour}
+	if unit, ok := units[s[max(len(s)-1, 0):]]; ok {
+		n, err := strconv.ParseFloat(s[:len(s)-1], 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+		return time.Duration(n * float64(unit)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid age %q, expected e.g. 180d, 26w or 2y", s)
+	}
+	return d, nil
+}
+
+// localWallClock is the indexer package's, which reads file_timestamp the same way.
+var localWallClock = indexer.LocalWallClock
+
+// coldFilesQuery lists the files under the stored path prefix $1 of at least $2 bytes last modified by $3, in local
+// time, and not read since either where an access time was recorded, unless $4, with the number of copies of each,
+// largest first.
+const coldFilesQuery = `
+SELECT f.filepath, f.size, f.file_timestamp, f.access_timestamp, f.hash, c.copies FROM file_hashes f
+JOIN (SELECT hash, size, count(*) AS copies FROM file_hashes GROUP BY hash, size) c ON c.hash = f.hash AND c.size = f.size
+WHERE f.filepath LIKE $1 AND f.size >= $2 AND f.file_timestamp <= $3 AND ($4 OR f.access_timestamp IS NULL OR f.access_timestamp <= $3)
+ORDER BY f.size DESC, f.filepath`
+
+// coldCandidate is one row of the cold-data report.
+type coldCandidate struct {
+	Path     string     `json:"path"`
+	Size     int64      `json:"size"`
+	Modified time.Time  `json:"modified"`
+	Accessed *time.Time `json:"accessed,omitempty"`
+	Hash     string     `json:"hash"`
+	Copies   int        `json:"copies"`
+}
+
+// runColdReport lists indexed files that look like candidates for cold storage: not modified for a long time, not
+// read recently where access times are known, and large enough to be worth moving. Files with other copies in the
+// index are flagged, since only one copy needs archiving.
+func runColdReport(args []string) {
+	fs := flag.NewFlagSet("cold-report", flag.ContinueOnError)
+	var dbCfg DBConfig
+	registerDBFlags(fs, &dbCfg)
+	under := fs.String("under", "", "Only consider stored paths starting with this prefix.")
+	olderThan := fs.String("older-than", "1y", "Only list files last modified longer ago than this (e.g. 180d, 26w, 2y).")
+	minSize := fs.String("min-size", "1MiB", "Only list files at least this large.")
+	checkAtime := fs.Bool("atime", false, "Read each candidate's access time from disk instead of using the one recorded by --record-atime, and drop files read more recently than --older-than.")
+	prefix := fs.String("prefix", "", "The --prefix the scan removed from paths, put back to get on-disk paths for --atime and --format paths0.")
+	format := fs.String("format", "csv", "Output format: csv, jsonl (one JSON object per line) or paths0 (NUL-separated on-disk paths, for rsync --from0 --files-from or xargs -0).")
+	humanReadable := fs.Bool("human-readable", false, "Print sizes in the CSV like 1.4GiB instead of in bytes.")
+	limit := fs.Int("limit", 0, "List at most this many candidates, largest first. 0 means no limit.")
+	fs.Usage = commandUsage(fs, "ColdReportUsage")
+	parseArgs(fs, args)
+
+	if dbCfg.DbName == "" {
+		usageError(fs, "dbname", msg("MissingFlag", map[string]any{"Flag": "dbname"}))
+	}
+	age, err := parseAge(*olderThan)
+	if err != nil {
+		usageError(fs, "older-than", err.Error())
+	}
+	minBytes, err := parseByteSize(*minSize)
+	if err != nil {
+		usageError(fs, "min-size", err.Error())
+	}
+	if *format != "csv" && *format != "jsonl" && *format != "paths0" {
+		usageError(fs, "format", fmt.Sprintf("Invalid --format %q.", *format))
+	}
+	cutoff := time.Now().Add(-age)
+
+	db := connectToDatabase(dbCfg)
+	defer db.Close()
+	if _, err := db.Exec(addAccessTimestampColumnQuery); err != nil {
+		log.Fatalf("Failed to add access_timestamp column: %v", err)
+	}
+	if *checkAtime {
+		warnAtimeMount(*prefix + *under)
+	}
+
+	query := coldFilesQuery
+	if *limit > 0 {
+		query += " LIMIT " + strconv.Itoa(*limit)
+	}
+	rows, err := db.Query(query, likePrefix(*under), minBytes, cutoff.In(time.Local), *checkAtime)
+	if err != nil {
+		log.Fatalf("Failed to query cold files: %v", err)
+	}
+	defer rows.Close()
+
+	var csvWriter *csv.Writer
+	encoder := json.NewEncoder(os.Stdout)
+	if *format == "csv" {
+		csvWriter = csv.NewWriter(os.Stdout)
+		defer csvWriter.Flush()
+		csvWriter.Write([]string{"filepath", "size", "modified", "accessed", "hash", "copies"})
+	}
+
+	var count, totalBytes, duplicateBytes int64
+	for rows.Next() {
+		var c coldCandidate
+		var recordedAccess sql.NullTime
+		if err := rows.Scan(&c.Path, &c.Size, &c.Modified, &recordedAccess, &c.Hash, &c.Copies); err != nil {
+			log.Fatalf("Failed to read cold files: %v", err)
+		}
+		c.Modified = localWallClock(c.Modified)
+		if recordedAccess.Valid {
+			accessed := localWallClock(recordedAccess.Time)
+			c.Accessed = &accessed
+		}
+		diskPath := *prefix + c.Path
+		if *checkAtime {
+			c.Accessed = nil
+			info, err := os.Stat(diskPath)
+			if err != nil {
+				log.Printf("Skipping %s: %v", diskPath, err)
+				continue
+			}
+			if accessed, ok := accessTime(info); ok {
+				if accessed.After(cutoff) {
+					continue
+				}
+				c.Accessed = &accessed
+			}
+		}
+
+		count++
+		totalBytes = addSizes(totalBytes, c.Size)
+		if c.Copies > 1 {
+			duplicateBytes = addSizes(duplicateBytes, c.Size)
+		}
+		switch *format {
+		case "csv":
+			accessed := ""
+			if c.Accessed != nil {
+				accessed = c.Accessed.Format(queryTimeLayout)
+			}
+			err = csvWriter.Write([]string{c.Path, formatSize(c.Size, *humanReadable), c.Modified.Format(queryTimeLayout), accessed, c.Hash, strconv.Itoa(c.Copies)})
+		case "jsonl":
+			err = encoder.Encode(c)
+		case "paths0":
+			_, err = os.Stdout.WriteString(diskPath + "\x00")
+		}
+		if err != nil {
+			log.Fatalf("Failed to write report: %v", err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalf("Failed to read cold files: %v", err)
+	}
+	fmt.Fprintln(os.Stderr, msg("ColdReportSummary", map[string]any{
+		"Count": count, "Size": formatByteSize(totalBytes), "DuplicateSize": formatByteSize(duplicateBytes), "Age": *olderThan,
+	}))
+}
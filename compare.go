@@ -0,0 +1,251 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fileindexer/pkg/indexer"
+)
+
+// treeFile is a regular file found under one of the trees compare walks.
+type treeFile struct {
+	size     int64
+	modified time.Time
+}
+
+// compareEntry is a file that differs between the two trees compared, by its path relative to them. A side's size is
+// nil if the file isn't there, and its hash empty if the file wasn't hashed, as happens when the sizes differ.
+type compareEntry struct {
+	Path      string `json:"path"`
+	Status    string `json:"status"`
+	LeftHash  string `json:"left_hash,omitempty"`
+	LeftSize  *int64 `json:"left_size"`
+	RightHash string `json:"right_hash,omitempty"`
+	RightSize *int64 `json:"right_size"`
+}
+
+// listTree returns the regular files under root by their slash-separated path relative to it. Manifests written by
+// --write-manifests are left out, as scans leave them out. Entries that can't be read are logged and counted in failed.
+func listTree(root string, failed *int) (map[string]treeFile, error) {
+	files := make(map[string]treeFile)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			log.Printf("Failed to read %s: %v", path, err)
+			*failed++
+			return nil
+		}
+		if !d.Type().IsRegular() || d.Name() == manifestName {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			log.Printf("Failed to stat %s: %v", path, err)
+			*failed++
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = treeFile{size: info.Size(), modified: info.ModTime()}
+		return nil
+	})
+	return files, err
+}
+
+// treeHasher hashes the files of the trees compare walks, reusing the hash in file_hashes of a file whose size and
+// modification time match its row when there is an index to ask.
+type treeHasher struct {
+	db        *sql.DB
+	prefix    string
+	algorithm string
+	reused    atomic.Int64
+}
+
+func (h *treeHasher) hash(path string, file treeFile) (string, error) {
+	if h.db != nil {
+		dbHash, dbSize, dbAlgorithm, dbModified, err := getDatabaseRecord(h.db, storedPathFor(Config{Prefix: h.prefix}, path))
+		if err != nil && err != sql.ErrNoRows {
+			return "", fmt.Errorf("failed to look up %s: %v", path, err)
+		}
+		if err == nil && dbAlgorithm == h.algorithm && dbSize == file.size && indexer.SameModTime(file.modified, dbModified) {
+			h.reused.Add(1)
+			return dbHash, nil
+		}
+	}
+	hash, _, err := hashPath(path, h.algorithm, false, treeReader{})
+	return hash, err
+}
+
+// runCompare compares two directory trees by content, like a checksum-based rsync dry run: the files only on one side,
+// and the files on both whose contents differ. Files of different sizes differ without being read; the rest are
+// hashed on both sides, or their hashes taken from the index with --dbname.
+func runCompare(args []string) {
+	fs := flag.NewFlagSet("compare", flag.ContinueOnError)
+	var dbCfg DBConfig
+	registerDBFlags(fs, &dbCfg)
+	fs.Lookup("dbname").Usage = "The name of the PostgreSQL database to reuse the hashes of indexed files from. Without it, every file compared is hashed."
+	left := fs.String("left", "", "One directory to compare. Required.")
+	right := fs.String("right", "", "The other directory to compare. Required.")
+	prefix := fs.String("prefix", "", "Prefix the scans removed from file paths before storing them, for looking them up in the index.")
+	hashAlgo := fs.String("hash-algo", defaultHashAlgorithm, fmt.Sprintf("Hash algorithm, one of %v. Only index rows made with it are reused.", hashAlgorithmNames()))
+	workers := fs.Int("workers", defaultWorkerCount, "Number of files hashed concurrently.")
+	format := fs.String("format", "csv", "Output format: csv or jsonl (one JSON object per line).")
+	humanReadable := fs.Bool("human-readable", false, "Print sizes in the CSV like 1.4GiB instead of in bytes.")
+	fs.Usage = commandUsage(fs, "CompareUsage")
+	parseArgs(fs, args)
+
+	if *left == "" || *right == "" || fs.NArg() != 0 {
+		usageError(fs, "", msg("CompareUsage", nil))
+	}
+	if _, ok := hashAlgorithms[*hashAlgo]; !ok {
+		usageError(fs, "hash-algo", fmt.Sprintf("Invalid --hash-algo %q, expected one of %v.", *hashAlgo, hashAlgorithmNames()))
+	}
+	if *workers < 1 {
+		usageError(fs, "workers", fmt.Sprintf("Invalid --workers %d.", *workers))
+	}
+	if *format != "csv" && *format != "jsonl" {
+		usageError(fs, "format", fmt.Sprintf("Invalid --format %q.", *format))
+	}
+	roots := make([]string, 2)
+	for i, dir := range []string{*left, *right} {
+		path, err := filepath.Abs(dir)
+		if err != nil {
+			log.Fatalf("Failed to resolve %s: %v", dir, err)
+		}
+		if info, err := os.Stat(path); err != nil || !info.IsDir() {
+			log.Fatalf("%s is not a directory", dir)
+		}
+		roots[i] = path
+	}
+	if roots[0] == roots[1] {
+		log.Fatalf("--left and --right are the same directory")
+	}
+
+	hasher := &treeHasher{prefix: *prefix, algorithm: *hashAlgo}
+	if dbCfg.DbName != "" {
+		hasher.db = connectToDatabase(dbCfg)
+		defer hasher.db.Close()
+	}
+
+	failed := 0
+	leftFiles, err := listTree(roots[0], &failed)
+	if err != nil {
+		log.Fatalf("Failed to walk %s: %v", roots[0], err)
+	}
+	rightFiles, err := listTree(roots[1], &failed)
+	if err != nil {
+		log.Fatalf("Failed to walk %s: %v", roots[1], err)
+	}
+
+	// Files on one side only and files of different sizes are settled by the walk; the rest wait on their hashes.
+	var entries, pending []compareEntry
+	for rel, l := range leftFiles {
+		leftSize := l.size
+		r, ok := rightFiles[rel]
+		if !ok {
+			entries = append(entries, compareEntry{Path: rel, Status: "left-only", LeftSize: &leftSize})
+			continue
+		}
+		rightSize := r.size
+		entry := compareEntry{Path: rel, Status: "differs", LeftSize: &leftSize, RightSize: &rightSize}
+		if l.size != r.size {
+			entries = append(entries, entry)
+		} else {
+			pending = append(pending, entry)
+		}
+	}
+	for rel, r := range rightFiles {
+		if _, ok := leftFiles[rel]; !ok {
+			rightSize := r.size
+			entries = append(entries, compareEntry{Path: rel, Status: "right-only", RightSize: &rightSize})
+		}
+	}
+
+	var mu sync.Mutex
+	same := 0
+	jobs := make(chan compareEntry)
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range jobs {
+				path := filepath.FromSlash(entry.Path)
+				leftHash, leftErr := hasher.hash(filepath.Join(roots[0], path), leftFiles[entry.Path])
+				rightHash, rightErr := hasher.hash(filepath.Join(roots[1], path), rightFiles[entry.Path])
+				mu.Lock()
+				switch {
+				case leftErr != nil || rightErr != nil:
+					for _, err := range []error{leftErr, rightErr} {
+						if err != nil {
+							log.Printf("Failed to hash %s: %v", entry.Path, err)
+						}
+					}
+					failed++
+				case leftHash == rightHash:
+					same++
+				default:
+					entry.LeftHash, entry.RightHash = leftHash, rightHash
+					entries = append(entries, entry)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, entry := range pending {
+		jobs <- entry
+	}
+	close(jobs)
+	wg.Wait()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+
+	counts := make(map[string]int)
+	if *format == "csv" {
+		size := func(n *int64) string {
+			if n == nil {
+				return ""
+			}
+			return formatSize(*n, *humanReadable)
+		}
+		writer := csv.NewWriter(os.Stdout)
+		writer.Write([]string{"path", "status", "left_hash", "left_size", "right_hash", "right_size"})
+		for _, entry := range entries {
+			counts[entry.Status]++
+			writer.Write([]string{entry.Path, entry.Status, entry.LeftHash, size(entry.LeftSize), entry.RightHash, size(entry.RightSize)})
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			log.Fatalf("Failed to write results: %v", err)
+		}
+	} else {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, entry := range entries {
+			counts[entry.Status]++
+			if err := encoder.Encode(entry); err != nil {
+				log.Fatalf("Failed to write results: %v", err)
+			}
+		}
+	}
+	log.Print(msg("CompareSummary", map[string]any{
+		"Left": roots[0], "Right": roots[1], "LeftOnly": counts["left-only"], "RightOnly": counts["right-only"],
+		"Differs": counts["differs"], "Same": same, "Reused": hasher.reused.Load(), "Failed": failed,
+	}))
+	if len(entries) > 0 || failed > 0 {
+		os.Exit(1)
+	}
+}
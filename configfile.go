@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envFlags are the flags whose defaults come from environment variables. Like flags given on the command line, a
+// variable that is set wins over the config file.
+var envFlags = map[string]string{"dbuser": "DB_USER", "dbhost": "DB_HOST", "dbport": "DB_PORT"}
+
+// isYAMLConfig reports whether a --config file is a YAML file of scan settings rather than a db.conf file.
+func isYAMLConfig(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// loadYAMLConfigFile fills in flags of fs from a YAML file keyed by flag name, plus password as in db.conf. The
+// settings under sets are directory sets, one of which is chosen by name with set; its settings override the ones at
+// the top level, which every set shares:
+//
+//	dbname: files
+//	dbhost: db.example.com
+//	exclude: [.bzvol, $RECYCLE.BIN]
+//	sets:
+//	  nas:
+//	    directory: /mnt/nas
+//	    prefix: /mnt/nas
+//	    network-share: true
+//
+// A list is given to a repeatable flag one item at a time, and joined with commas for --exclude. Flags given on the
+// command line win. With strict, a setting fs has no flag for is an error; otherwise it is left to the commands that
+// have one.
+func loadYAMLConfigFile(fs *flag.FlagSet, path, set string, strict bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var settings map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	var sets map[string]map[string]yaml.Node
+	if node, ok := settings["sets"]; ok {
+		if err := node.Decode(&sets); err != nil {
+			return fmt.Errorf("%s:%d: sets: %v", path, node.Line, err)
+		}
+		delete(settings, "sets")
+	}
+	// Named reports are read by the report command and serve.
+	delete(settings, "reports")
+
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for name, variable := range envFlags {
+		if os.Getenv(variable) != "" {
+			given[name] = true
+		}
+	}
+
+	if set != "" {
+		setSettings, ok := sets[set]
+		if !ok {
+			return fmt.Errorf("%s: no set %q, expected one of %v", path, set, slices.Sorted(maps.Keys(sets)))
+		}
+		if err := applyYAMLSettings(fs, path, setSettings, given, strict); err != nil {
+			return err
+		}
+	}
+	return applyYAMLSettings(fs, path, settings, given, strict)
+}
+
+// applyYAMLSettings sets the flags of settings that aren't given yet, in name order so errors come out the same every
+// time, and marks them given.
+func applyYAMLSettings(fs *flag.FlagSet, path string, settings map[string]yaml.Node, given map[string]bool, strict bool) error {
+	for _, name := range slices.Sorted(maps.Keys(settings)) {
+		node := settings[name]
+		if name == "password" {
+			useConfigPassword(path, node.Value)
+			continue
+		}
+		f := fs.Lookup(name)
+		if f == nil {
+			if !strict {
+				continue
+			}
+			if suggestion := closestFlag(fs, name); suggestion != "" {
+				return fmt.Errorf("%s:%d: unknown setting %q, did you mean %q?", path, node.Line, name, suggestion)
+			}
+			return fmt.Errorf("%s:%d: unknown setting %q", path, node.Line, name)
+		}
+		if given[name] {
+			continue
+		}
+		given[name] = true
+
+		var values []string
+		switch node.Kind {
+		case yaml.ScalarNode:
+			values = []string{node.Value}
+		case yaml.SequenceNode:
+			for _, item := range node.Content {
+				if item.Kind != yaml.ScalarNode {
+					return fmt.Errorf("%s:%d: %s: expected a list of values", path, item.Line, name)
+				}
+				values = append(values, item.Value)
+			}
+			if _, repeatable := f.Value.(*stringList); !repeatable {
+				if name != "exclude" {
+					return fmt.Errorf("%s:%d: %s takes a single value", path, node.Line, name)
+				}
+				values = []string{strings.Join(values, ",")}
+			}
+		default:
+			return fmt.Errorf("%s:%d: %s: expected a value", path, node.Line, name)
+		}
+		for _, value := range values {
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("%s:%d: %s: %v", path, node.Line, name, err)
+			}
+		}
+	}
+	return nil
+}
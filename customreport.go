@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/template"
+)
+
+// reportRow is one results row as a --report-template sees it.
+type reportRow struct {
+	Path   string
+	Hash   string
+	Size   int64 // -1 for errors
+	Status string
+}
+
+// reportData is what a --report-template is executed with: the summary of the scan, and its results rows in the order
+// they were written, to range over once.
+type reportData struct {
+	reportSummary
+	Results <-chan reportRow
+}
+
+// reportTemplateFuncs are the functions a --report-template can call besides the text/template builtins.
+var reportTemplateFuncs = template.FuncMap{
+	"size": func(n int64) string { return formatSize(n, true) },
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// parseReportTemplate reads the --report-template file at path.
+func parseReportTemplate(path string) (*template.Template, error) {
+	return template.New(filepath.Base(path)).Funcs(reportTemplateFuncs).ParseFiles(path)
+}
+
+// reportRows keeps the results rows of a scan in a temporary CSV file, so that a template can go through them after
+// the scan without holding them in memory.
+type reportRows struct {
+	file   *os.File
+	buffer *bufio.Writer
+	writer *csv.Writer
+}
+
+func newReportRows(dir string) (*reportRows, error) {
+	file, err := os.CreateTemp(dir, "fileindexer-report-*.csv")
+	if err != nil {
+		return nil, err
+	}
+	buffer := bufio.NewWriter(file)
+	return &reportRows{file: file, buffer: buffer, writer: csv.NewWriter(buffer)}, nil
+}
+
+// add keeps one results row. Rows are added under the scanReport's lock.
+func (r *reportRows) add(row []string) {
+	r.writer.Write(row)
+}
+
+// each sends the rows kept on the returned channel, which is closed after the last one or once done is closed.
+func (r *reportRows) each(done <-chan struct{}) (<-chan reportRow, error) {
+	r.writer.Flush()
+	if err := r.writer.Error(); err != nil {
+		return nil, err
+	}
+	if err := r.buffer.Flush(); err != nil {
+		return nil, err
+	}
+	if _, err := r.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	rows := make(chan reportRow)
+	go func() {
+		defer close(rows)
+		reader := csv.NewReader(bufio.NewReader(r.file))
+		reader.FieldsPerRecord = len(resultColumns)
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				log.Printf("Failed to read back results for --report-template: %v", err)
+				return
+			}
+			size, _ := strconv.ParseInt(record[2], 10, 64)
+			select {
+			case rows <- reportRow{Path: record[0], Hash: record[1], Size: size, Status: record[3]}:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return rows, nil
+}
+
+func (r *reportRows) close() {
+	r.file.Close()
+	os.Remove(r.file.Name())
+}
+
+// writeTemplateReport executes tmpl with summary and the rows kept by r, writing the result to path.
+func (r *scanReport) writeTemplateReport(path string, tmpl *template.Template, summary reportSummary) error {
+	done := make(chan struct{})
+	defer close(done)
+	rows, err := r.rows.each(done)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	buffer := bufio.NewWriter(file)
+	if err := tmpl.Execute(buffer, reportData{reportSummary: summary, Results: rows}); err != nil {
+		file.Close()
+		return err
+	}
+	if err := buffer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
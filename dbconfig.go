@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultDBConfigFile is the standard place for database settings, e.g. ~/.config/fileindexer/db.conf, or "" if
+// there is no user config directory.
+func defaultDBConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "fileindexer", "db.conf")
+}
+
+// registerConfigFlags adds --config and --set, for commands that read database settings from a file with
+// readDBConfigFile.
+func registerConfigFlags(fs *flag.FlagSet) (configFile, configSet *string) {
+	configFile = fs.String("config", "", "File of database settings (default: "+defaultDBConfigFile()+" if it exists), or a YAML file of scan settings.")
+	configSet = fs.String("set", "", "Directory set of a YAML --config file whose settings to use.")
+	return configFile, configSet
+}
+
+// readDBConfigFile loads the --config file into fs, or the default one if there is one. It must be called after
+// parsing, so that flags given on the command line take precedence. A YAML file is one written for scans, of which
+// only the settings fs has flags for are used.
+func readDBConfigFile(fs *flag.FlagSet, configFile, configSet string) {
+	if isYAMLConfig(configFile) {
+		if err := loadYAMLConfigFile(fs, configFile, configSet, false); err != nil {
+			log.Fatalf("Failed to read database settings: %v", err)
+		}
+	} else if configFile != "" {
+		if err := loadDBConfigFile(fs, configFile); err != nil {
+			log.Fatalf("Failed to read database settings: %v", err)
+		}
+	} else if path := defaultDBConfigFile(); path != "" {
+		if err := loadDBConfigFile(fs, path); err != nil && !os.IsNotExist(err) {
+			log.Fatalf("Failed to read database settings: %v", err)
+		}
+	}
+}
+
+// loadDBConfigFile fills in flags of fs from a file of "name = value" lines, where name is a flag name such as dbname
+// or dbhost, or password for DB_PASSWORD. Blank lines and lines starting with # are ignored. Settings already given
+// by a flag or environment variable win, so the file only supplies defaults.
+func loadDBConfigFile(fs *flag.FlagSet, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected name = value", path, lineNumber)
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if name == "password" {
+			useConfigPassword(path, value)
+			continue
+		}
+		f := fs.Lookup(name)
+		if f == nil {
+			return fmt.Errorf("%s:%d: unknown setting %q", path, lineNumber, name)
+		}
+		if f.Value.String() != "" {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, lineNumber, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// useConfigPassword makes a password from the config file at path DB_PASSWORD, unless that is set already.
+func useConfigPassword(path, password string) {
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0o077 != 0 {
+		log.Printf("Warning: %s contains a password but can be read by other users; chmod 600 it", path)
+	}
+	if os.Getenv("DB_PASSWORD") == "" {
+		os.Setenv("DB_PASSWORD", password)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// maxStatementRetries is how often a statement is retried while the database is reachable, i.e. when the statement
+// itself keeps failing (a deadlock, a serialization failure) rather than the connection.
+const maxStatementRetries = 5
+
+// Probes of an unreachable database back off from the first delay to the last, doubling each time.
+const (
+	firstProbeDelay = time.Second
+	maxProbeDelay   = time.Minute
+)
+
+// pinger is what the circuit breaker probes: a *sql.DB, or the --store backend.
+type pinger interface {
+	Ping() error
+}
+
+// breaker is shared by every database operation of the scan, so an outage stops all workers at once.
+var breaker = newCircuitBreaker()
+
+// circuitBreaker pauses database work while the database is unreachable. The first operation to find it down opens
+// the circuit and starts a single prober; every worker then waits, holding its result, until the prober gets through
+// and closes the circuit again, instead of each retrying its own row in a loop.
+type circuitBreaker struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	open   bool
+	opened time.Time
+}
+
+func newCircuitBreaker() *circuitBreaker {
+	b := &circuitBreaker{}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// wait blocks while the circuit is open.
+func (b *circuitBreaker) wait() {
+	b.mu.Lock()
+	for b.open {
+		b.cond.Wait()
+	}
+	b.mu.Unlock()
+}
+
+func (b *circuitBreaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
+
+// trip opens the circuit and starts probing db, unless another operation already did.
+func (b *circuitBreaker) trip(db pinger, cause error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.open {
+		return
+	}
+	b.open = true
+	b.opened = time.Now()
+	log.Printf("Database unreachable, pausing until it is back: %v", cause)
+
+	go func() {
+		for delay := firstProbeDelay; ; delay = min(delay*2, maxProbeDelay) {
+			time.Sleep(withJitter(delay))
+			err := db.Ping()
+			if err == nil {
+				break
+			}
+			log.Printf("Database still unreachable, retrying in up to %s: %v", min(delay*2, maxProbeDelay), err)
+		}
+		b.mu.Lock()
+		b.open = false
+		log.Printf("Database reachable again after %s, resuming", time.Since(b.opened).Round(time.Second))
+		b.cond.Broadcast()
+		b.mu.Unlock()
+	}()
+}
+
+// withJitter spreads delay over [delay/2, delay) so workers released together don't retry in lockstep.
+func withJitter(delay time.Duration) time.Duration {
+	return delay/2 + rand.N(delay/2)
+}
+
+// retryDB runs op, a database operation described by what, until it succeeds. A failure while the database can't be
+// pinged opens the circuit and op is retried once it closes, however long that takes; other failures are retried
+// with backoff up to maxStatementRetries times before the last error is returned.
+func retryDB(db pinger, what string, op func() error) error {
+	return retryDBOr(db, what, op, nil)
+}
+
+// retryDBOr is retryDB, except that when the circuit is open or the retries run out it returns fallback's result
+// instead of waiting or failing, if fallback is non-nil.
+func retryDBOr(db pinger, what string, op func() error, fallback func(error) error) error {
+	for attempt := 0; ; {
+		if fallback != nil && breaker.isOpen() {
+			return fallback(errors.New("database unreachable"))
+		}
+		breaker.wait()
+		err := op()
+		// No rows is an answer, not a failure.
+		if err == nil || errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if pingErr := db.Ping(); pingErr != nil {
+			breaker.trip(db, pingErr)
+			continue
+		}
+		if attempt++; attempt > maxStatementRetries {
+			if fallback != nil {
+				return fallback(err)
+			}
+			return err
+		}
+		log.Printf("Retrying %s: %v", what, err)
+		time.Sleep(withJitter(time.Duration(attempt) * firstProbeDelay))
+	}
+}
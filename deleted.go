@@ -0,0 +1,181 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// deleted_timestamp is set by --detect-deleted on rows whose file is gone, in local time like file_timestamp, and
+// cleared again if the file comes back. The rows themselves are kept.
+const addDeletedTimestampColumnQuery = `ALTER TABLE file_hashes ADD COLUMN IF NOT EXISTS deleted_timestamp TIMESTAMP`
+
+// localPathFor is the inverse of storedPathFor: where a stored path under cfg.Directory is on disk.
+func localPathFor(cfg Config, storedPath string) string {
+	if cfg.Prefix != "" && hasPathPrefix(cfg.Directory, cfg.Prefix) {
+		return cfg.Prefix + storedPath
+	}
+	return storedPath
+}
+
+// pruneAction is what detectDeleted does with the rows of files that no longer exist.
+type pruneAction int
+
+const (
+	// pruneMark sets deleted_timestamp, keeping the row, as --detect-deleted does.
+	pruneMark pruneAction = iota
+	// pruneDelete deletes the row, for prune --delete.
+	pruneDelete
+	// pruneDryRun only lists the files, for prune --dry-run.
+	pruneDryRun
+)
+
+// indexedFile is a file_hashes row considered by detectDeleted.
+type indexedFile struct {
+	path    string
+	hash    string
+	size    int64
+	deleted bool
+}
+
+// detectDeleted checks every indexed file under the scanned directory against the disk after a scan, marking the ones that no
+// longer exist and writing them to the results as "missing". Files are looked up with lstat rather than by what the
+// walk saw, so excluded, skipped and failed files aren't mistaken for deleted ones. It returns the number missing.
+// action says what is done with their rows; with pruneDryRun, nothing in the database is changed.
+//
+// With --scan-epochs, run is the scan's epoch, and only the files it didn't see are candidates: one query finds them,
+// and another clears the mark of seen files that had been deleted, so the files looked up are usually few.
+func detectDeleted(cfg Config, db *sql.DB, sink resultSink, processed, run int64, action pruneAction) (int, error) {
+	root := scanRoot(cfg)
+	under := scannedPrefix(cfg)
+
+	query := "SELECT filepath, hash, size, deleted_timestamp IS NOT NULL FROM file_hashes WHERE filepath LIKE $1 ORDER BY filepath"
+	args := []any{likePrefix(under)}
+	if run != 0 {
+		if err := retryDB(db, "restoration of seen files under "+root, func() error {
+			_, err := db.Exec("UPDATE file_hashes SET deleted_timestamp = NULL WHERE filepath LIKE $1 AND seen_run_id = $2 AND deleted_timestamp IS NOT NULL",
+				likePrefix(under), run)
+			return err
+		}); err != nil {
+			return 0, fmt.Errorf("failed to clear the deletion of files seen under %s: %v", root, err)
+		}
+		query = "SELECT filepath, hash, size, deleted_timestamp IS NOT NULL FROM file_hashes WHERE filepath LIKE $1 AND seen_run_id IS DISTINCT FROM $2 ORDER BY filepath"
+		args = append(args, run)
+	}
+
+	var files []indexedFile
+	err := retryDB(db, "indexed files under "+root, func() error {
+		files = files[:0]
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var file indexedFile
+			if err := rows.Scan(&file.path, &file.hash, &file.size, &file.deleted); err != nil {
+				return err
+			}
+			files = append(files, file)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return 0, err
+	}
+	// An unmounted share usually leaves an empty mount point behind, which would make everything look deleted.
+	if processed == 0 && len(files) > 0 {
+		log.Printf("WARNING: the scan found no files under %s, which may not be mounted; not marking its %d indexed files as deleted", root, len(files))
+		return 0, nil
+	}
+
+	// The rows describing a deleted record's file go with it; file_history keeps what was recorded of it.
+	var dependents []string
+	if action == pruneDelete {
+		for _, table := range []string{"pii_findings", "file_extents", "file_chunks", "file_lineage"} {
+			exists, err := tableExists(db, table)
+			if err != nil {
+				return 0, fmt.Errorf("failed to check for table %s: %v", table, err)
+			}
+			if exists {
+				dependents = append(dependents, table)
+			}
+		}
+	}
+
+	now := time.Now()
+	missing := 0
+	for _, file := range files {
+		path := localPathFor(cfg, file.path)
+		_, err := os.Lstat(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Not checking %s for deletion: %v", path, err)
+			continue
+		}
+		// When the scan covers the whole index, drives scanned under the same --prefix are told apart by their top
+		// directory, so rows whose top directory isn't on this disk belong to another one.
+		if err != nil && under == "" && !topDirectoryExists(cfg, file.path) {
+			continue
+		}
+
+		switch {
+		case err != nil:
+			missing++
+			switch {
+			case action == pruneDelete:
+				if err := retryDB(db, "deletion of the row of "+file.path, func() error {
+					tx, err := db.Begin()
+					if err != nil {
+						return err
+					}
+					defer tx.Rollback()
+					if _, err := tx.Exec(recordRemovalQuery, file.path, now.UTC()); err != nil {
+						return err
+					}
+					if _, err := tx.Exec("DELETE FROM file_hashes WHERE filepath = $1", file.path); err != nil {
+						return err
+					}
+					for _, table := range dependents {
+						if _, err := tx.Exec("DELETE FROM "+table+" WHERE filepath = $1", file.path); err != nil {
+							return err
+						}
+					}
+					return tx.Commit()
+				}); err != nil {
+					return missing, fmt.Errorf("failed to delete the row of %s: %v", file.path, err)
+				}
+			case action == pruneMark && !file.deleted:
+				if err := retryDB(db, "deletion of "+file.path, func() error {
+					_, err := db.Exec("UPDATE file_hashes SET deleted_timestamp = $2 WHERE filepath = $1", file.path, now)
+					return err
+				}); err != nil {
+					return missing, fmt.Errorf("failed to mark %s as deleted: %v", file.path, err)
+				}
+			}
+			if err := sink.Write(0, []string{file.path, file.hash, fmt.Sprintf("%d", file.size), "missing"}); err != nil {
+				log.Printf("Failed to write result to CSV for file %s: %v", path, err)
+			}
+		case file.deleted && action != pruneDryRun:
+			if err := retryDB(db, "restoration of "+file.path, func() error {
+				_, err := db.Exec("UPDATE file_hashes SET deleted_timestamp = NULL WHERE filepath = $1", file.path)
+				return err
+			}); err != nil {
+				return missing, fmt.Errorf("failed to clear the deletion of %s: %v", file.path, err)
+			}
+		}
+	}
+	return missing, nil
+}
+
+// topDirectoryExists reports whether the first directory of a stored path exists under cfg.Directory.
+func topDirectoryExists(cfg Config, storedPath string) bool {
+	top, _, found := strings.Cut(strings.TrimPrefix(storedPath, "/"), "/")
+	if !found {
+		return true
+	}
+	_, err := os.Lstat(localPathFor(cfg, "/"+top))
+	return err == nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// deniedLogLimit is how many permission errors are logged for each directory. The rest are only counted, for the
+// list of unreadable directories at the end of the scan.
+const deniedLogLimit = 3
+
+// maxDeniedHotspots is how many directories the list of unreadable directories names.
+const maxDeniedHotspots = 20
+
+// A directory with this many unreadable files is listed as high or medium severity, and otherwise as low. One that
+// couldn't be listed at all is high, since how many files it hides isn't known.
+const (
+	deniedHighFiles   = 1000
+	deniedMediumFiles = 100
+)
+
+// denied counts the files and directories a scan wasn't allowed to read, by directory.
+var denied = &deniedTracker{dirs: make(map[string]*deniedDir)}
+
+type deniedTracker struct {
+	mu   sync.Mutex
+	dirs map[string]*deniedDir
+}
+
+type deniedDir struct {
+	files    int
+	unlisted bool // the directory itself couldn't be read
+}
+
+// count counts err if it is a permission error for the file at path, or with isDir, the directory, and reports
+// whether it is to be logged: always for other errors, and for permission errors, the first deniedLogLimit in each
+// directory.
+func (t *deniedTracker) count(path string, isDir bool, err error) bool {
+	if !errors.Is(err, fs.ErrPermission) {
+		return true
+	}
+	dir := path
+	if !isDir {
+		dir = filepath.Dir(path)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counted := t.dirs[dir]
+	if counted == nil {
+		counted = &deniedDir{}
+		t.dirs[dir] = counted
+	}
+	if isDir {
+		counted.unlisted = true
+		return true
+	}
+	counted.files++
+	if counted.files == deniedLogLimit+1 {
+		log.Print(msg("DeniedQuiet", map[string]any{"Directory": dir}))
+	}
+	return counted.files <= deniedLogLimit
+}
+
+// severity is how much of the tree a directory's permission errors leave out of the index.
+func (d *deniedDir) severity() string {
+	switch {
+	case d.unlisted || d.files >= deniedHighFiles:
+		return "HIGH"
+	case d.files >= deniedMediumFiles:
+		return "MEDIUM"
+	}
+	return "LOW"
+}
+
+// logSummary lists the directories with permission errors, the most unreadable files first, with who owns them and a
+// suggestion of what to do about it. Nothing is logged if there were none.
+func (t *deniedTracker) logSummary() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.dirs) == 0 {
+		return
+	}
+	dirs := make([]string, 0, len(t.dirs))
+	var files int
+	for dir, counted := range t.dirs {
+		dirs = append(dirs, dir)
+		files += counted.files
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		a, b := t.dirs[dirs[i]], t.dirs[dirs[j]]
+		if a.unlisted != b.unlisted {
+			return a.unlisted
+		}
+		if a.files != b.files {
+			return a.files > b.files
+		}
+		return dirs[i] < dirs[j]
+	})
+
+	log.Print(msg("DeniedSummary", map[string]any{"Files": formatCount(files), "Count": len(dirs)}))
+	for _, dir := range dirs[:min(len(dirs), maxDeniedHotspots)] {
+		counted := t.dirs[dir]
+		log.Print(msg("DeniedDirectory", map[string]any{
+			"Severity": counted.severity(), "Directory": dir, "Files": formatCount(counted.files), "Unlisted": counted.unlisted,
+			"Owner": describeOwner(dir),
+		}))
+	}
+	if len(dirs) > maxDeniedHotspots {
+		log.Print(msg("DeniedMore", map[string]any{"Count": len(dirs) - maxDeniedHotspots}))
+	}
+	log.Print(msg("DeniedAdvice", nil))
+}
+
+// describeOwner returns the user and group owning path and its permissions, like "alice:hr drwxr-x---", or "" where
+// files have no numeric owners.
+func describeOwner(path string) string {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return ""
+	}
+	uid, gid, ok := fileOwner(info)
+	if !ok {
+		return ""
+	}
+	owner, group := strconv.Itoa(uid), strconv.Itoa(gid)
+	if u, err := user.LookupId(owner); err == nil {
+		owner = u.Username
+	}
+	if g, err := user.LookupGroupId(group); err == nil {
+		group = g.Name
+	}
+	return owner + ":" + group + " " + info.Mode().String()
+}
+
+// formatCount writes n with commas between groups of three digits, like 1,243.
+func formatCount(n int) string {
+	digits := strconv.Itoa(n)
+	for i := len(digits) - 3; i > 0; i -= 3 {
+		digits = digits[:i] + "," + digits[i:]
+	}
+	return digits
+}
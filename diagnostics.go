@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"time"
+)
+
+// startPprofServer serves the net/http/pprof handlers on addr. A dedicated mux keeps them off http.DefaultServeMux.
+func startPprofServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	go func() {
+		log.Printf("Serving pprof on http://%s/debug/pprof/", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("pprof server stopped: %v", err)
+		}
+	}()
+}
+
+// startDiagnosticDumps writes a heap profile and a goroutine dump to dir every interval, and logs memory stats, so
+// growth during a long scan can be inspected afterwards without having had pprof attached at the right moment.
+func startDiagnosticDumps(dir string, interval time.Duration) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Printf("Failed to create diagnostics directory %s, not writing dumps: %v", dir, err)
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			writeDiagnosticDump(dir)
+		}
+	}()
+}
+
+func writeDiagnosticDump(dir string) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	log.Printf("Diagnostics: heap %d MiB in use, %d MiB from OS, %d goroutines, %d GCs",
+		mem.HeapInuse>>20, mem.Sys>>20, runtime.NumGoroutine(), mem.NumGC)
+
+	stamp := time.Now().Format("2006-01-02T15.04.05")
+	for _, dump := range []struct {
+		profile string
+		debug   int
+		ext     string
+	}{{"heap", 0, "pb.gz"}, {"goroutine", 1, "txt"}} {
+		path := filepath.Join(dir, fmt.Sprintf("%s_%s.%s", stamp, dump.profile, dump.ext))
+		file, err := os.Create(path)
+		if err != nil {
+			log.Printf("Failed to create %s: %v", path, err)
+			continue
+		}
+		if err := runtimepprof.Lookup(dump.profile).WriteTo(file, dump.debug); err != nil {
+			log.Printf("Failed to write %s: %v", path, err)
+		}
+		file.Close()
+	}
+}
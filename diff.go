@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// indexStateQuery lists the files under the stored path prefix $1 as the index held them at a point in time, $2 in
+// UTC and $3 in local time: the last history row of each path recorded by then unless it was a removal, and the rows
+// of files indexed before history was kept. Files found deleted by then are left out. Paths come in byte order, as
+// diffIndexStates merges two states.
+const indexStateQuery = `
+SELECT h.filepath, h.hash, h.size FROM (
+    SELECT DISTINCT ON (filepath) filepath, hash, size, removed FROM file_history
+    WHERE filepath LIKE $1 AND recorded_timestamp <= $2
+    ORDER BY filepath, recorded_timestamp DESC, id DESC
+) h
+LEFT JOIN file_hashes f ON f.filepath = h.filepath
+WHERE NOT h.removed AND (f.deleted_timestamp IS NULL OR f.deleted_timestamp > $3)
+UNION ALL
+SELECT filepath, hash, size FROM file_hashes f
+WHERE filepath LIKE $1 AND hash_calculated_timestamp <= $2 AND (deleted_timestamp IS NULL OR deleted_timestamp > $3)
+AND NOT EXISTS (SELECT 1 FROM file_history h WHERE h.filepath = f.filepath)
+ORDER BY filepath COLLATE "C"`
+
+// indexDiffEntry is a file that differs between two states of the index, as written by diff. The previous fields are
+// the hash of a changed file and the old path of a moved one.
+type indexDiffEntry struct {
+	Path             string `json:"filepath"`
+	Status           string `json:"status"`
+	Hash             string `json:"hash"`
+	Size             int64  `json:"size"`
+	PreviousFilepath string `json:"previous_filepath,omitempty"`
+	PreviousHash     string `json:"previous_hash,omitempty"`
+}
+
+// indexState is a cursor over indexStateQuery.
+type indexState struct {
+	rows  *sql.Rows
+	entry indexDiffEntry
+	done  bool
+}
+
+func openIndexState(db *sql.DB, under string, at time.Time) (*indexState, error) {
+	rows, err := db.Query(indexStateQuery, likePrefix(under), at.UTC(), at.In(time.Local))
+	if err != nil {
+		return nil, err
+	}
+	s := &indexState{rows: rows}
+	return s, s.next()
+}
+
+// next moves to the next file, setting done after the last.
+func (s *indexState) next() error {
+	if !s.rows.Next() {
+		s.done = true
+		return s.rows.Err()
+	}
+	s.entry = indexDiffEntry{}
+	return s.rows.Scan(&s.entry.Path, &s.entry.Hash, &s.entry.Size)
+}
+
+// diffIndexStates compares the index under the stored path prefix under at from with its state at to, returning the
+// files added, removed and changed, by path. A file removed from one path and added at another with the same
+// contents is reported once, as moved; empty files are all alike, so they are never taken for moved.
+func diffIndexStates(db *sql.DB, under string, from, to time.Time) ([]indexDiffEntry, error) {
+	before, err := openIndexState(db, under, from)
+	if err != nil {
+		return nil, err
+	}
+	defer before.rows.Close()
+	after, err := openIndexState(db, under, to)
+	if err != nil {
+		return nil, err
+	}
+	defer after.rows.Close()
+
+	var entries, added []indexDiffEntry
+	removed := make(map[string][]int) // hash and size -> indexes in entries of removed files
+	for !before.done || !after.done {
+		var err error
+		switch {
+		case after.done || !before.done && before.entry.Path < after.entry.Path:
+			entry := before.entry
+			entry.Status = "removed"
+			if entry.Size > 0 {
+				key := entry.Hash + "/" + strconv.FormatInt(entry.Size, 10)
+				removed[key] = append(removed[key], len(entries))
+			}
+			entries = append(entries, entry)
+			err = before.next()
+		case before.done || after.entry.Path < before.entry.Path:
+			entry := after.entry
+			entry.Status = "added"
+			added = append(added, entry)
+			err = after.next()
+		default:
+			if before.entry.Hash != after.entry.Hash || before.entry.Size != after.entry.Size {
+				entry := after.entry
+				entry.Status, entry.PreviousHash = "changed", before.entry.Hash
+				entries = append(entries, entry)
+			}
+			if err = before.next(); err == nil {
+				err = after.next()
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Each removed file is paired with the first added file with its contents, in path order.
+	gone := make(map[int]bool)
+	for _, entry := range added {
+		key := entry.Hash + "/" + strconv.FormatInt(entry.Size, 10)
+		if candidates := removed[key]; len(candidates) > 0 {
+			gone[candidates[0]] = true
+			removed[key] = candidates[1:]
+			entry.Status, entry.PreviousFilepath = "moved", entries[candidates[0]].Path
+		}
+		entries = append(entries, entry)
+	}
+	kept := entries[:0]
+	for i, entry := range entries {
+		if !gone[i] {
+			kept = append(kept, entry)
+		}
+	}
+	sort.SliceStable(kept, func(i, j int) bool { return kept[i].Path < kept[j].Path })
+	return kept, nil
+}
+
+// runDiff reports how the index changed between the finish of two scan runs, between a run and now, or since a time:
+// the files added, removed, changed and moved, by stored path.
+func runDiff(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	var dbCfg DBConfig
+	registerDBFlags(fs, &dbCfg)
+	var runs stringList
+	fs.Var(&runs, "run", "A scan run id from scan_runs, whose finish is compared. Give it twice to compare two runs, or once to compare a run with the index now.")
+	since := fs.String("since", "", "Compare the index at this time (e.g. 2024-01-01 or 2024-01-01 15:04:05, local time) with the index now, instead of --run.")
+	under := fs.String("under", "", "Only compare stored paths starting with this prefix.")
+	format := fs.String("format", "csv", "Output format: csv or jsonl (one JSON object per line).")
+	humanReadable := fs.Bool("human-readable", false, "Print sizes in the CSV like 1.4GiB instead of in bytes.")
+	fs.Usage = commandUsage(fs, "DiffUsage")
+	parseArgs(fs, args)
+
+	if dbCfg.DbName == "" {
+		usageError(fs, "dbname", msg("MissingFlag", map[string]any{"Flag": "dbname"}))
+	}
+	if (len(runs) == 0) == (*since == "") || len(runs) > 2 {
+		usageError(fs, "run", "Give --run once or twice, or --since.")
+	}
+	if *format != "csv" && *format != "jsonl" {
+		usageError(fs, "format", fmt.Sprintf("Invalid --format %q.", *format))
+	}
+	var ids []int64
+	for _, run := range runs {
+		id, err := strconv.ParseInt(run, 10, 64)
+		if err != nil || id <= 0 {
+			usageError(fs, "run", fmt.Sprintf("Invalid --run %q, expected a scan run id.", run))
+		}
+		ids = append(ids, id)
+	}
+	var from time.Time
+	if *since != "" {
+		var err error
+		if from, err = parseAsOf(*since); err != nil {
+			usageError(fs, "since", err.Error())
+		}
+	}
+
+	db := connectToDatabase(dbCfg)
+	defer db.Close()
+	if _, err := db.Exec(createFileHistoryTableQuery + addDeletedTimestampColumnQuery); err != nil {
+		log.Fatalf("Failed to prepare the index for comparison: %v", err)
+	}
+
+	to := time.Now()
+	if len(ids) > 0 {
+		var err error
+		if from, err = scanRunFinished(context.Background(), db, ids[0]); err != nil {
+			log.Fatalf("Failed to look up scan run %d: %v", ids[0], err)
+		}
+		if len(ids) == 2 {
+			if to, err = scanRunFinished(context.Background(), db, ids[1]); err != nil {
+				log.Fatalf("Failed to look up scan run %d: %v", ids[1], err)
+			}
+		}
+	}
+	if !from.Before(to) {
+		log.Fatalf("The first state compared must be the earlier: %s is not before %s", from.In(time.Local).Format(queryTimeLayout), to.In(time.Local).Format(queryTimeLayout))
+	}
+
+	entries, err := diffIndexStates(db, *under, from, to)
+	if err != nil {
+		log.Fatalf("Failed to compare the index: %v", err)
+	}
+
+	counts := make(map[string]int)
+	if *format == "csv" {
+		writer := csv.NewWriter(os.Stdout)
+		writer.Write([]string{"filepath", "status", "hash", "size", "previous_filepath", "previous_hash"})
+		for _, entry := range entries {
+			counts[entry.Status]++
+			writer.Write([]string{entry.Path, entry.Status, entry.Hash, formatSize(entry.Size, *humanReadable), entry.PreviousFilepath, entry.PreviousHash})
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			log.Fatalf("Failed to write results: %v", err)
+		}
+	} else {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, entry := range entries {
+			counts[entry.Status]++
+			if err := encoder.Encode(entry); err != nil {
+				log.Fatalf("Failed to write results: %v", err)
+			}
+		}
+	}
+	log.Print(msg("DiffSummary", map[string]any{
+		"Added": counts["added"], "Removed": counts["removed"], "Changed": counts["changed"], "Moved": counts["moved"],
+		"From": from.In(time.Local).Format(queryTimeLayout), "To": to.In(time.Local).Format(queryTimeLayout),
+	}))
+}
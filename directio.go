@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// Direct I/O needs the buffer address, file offset and read length aligned to the device's logical block size.
+// 4 KiB covers every common device; the buffer itself is large so the per-read syscall overhead stays low.
+const (
+	directIOAlignment  = 4096
+	directIOBufferSize = 1 << 20
+)
+
+var directIOFallbackOnce sync.Once
+
+// openForVerify opens a file for hashing during verification. With direct set, reads bypass the page cache so the
+// hash reflects what is actually on disk; if the filesystem refuses (tmpfs, some FUSE mounts) the file is opened
+// normally and a warning is logged once. Files opened without direct I/O are opened through tree.
+func openForVerify(path string, direct bool, tree treeReader) (*os.File, io.Reader, error) {
+	if !direct {
+		file, err := tree.openForHashing(path)
+		return file, file, err
+	}
+
+	file, err := openDirect(path)
+	if err != nil {
+		if _, statErr := os.Stat(path); statErr != nil {
+			return nil, nil, err
+		}
+		directIOFallbackOnce.Do(func() {
+			log.Printf("WARNING: direct I/O unavailable (%v); verification reads may be served from the page cache", err)
+		})
+		file, err = os.Open(path)
+		return file, file, err
+	}
+	return file, newAlignedReader(file), nil
+}
+
+// alignedReader reads a direct I/O file through an aligned buffer, since callers like io.Copy bring their own
+// unaligned buffers.
+type alignedReader struct {
+	file     *os.File
+	buf      []byte
+	pos, end int
+	err      error
+}
+
+func newAlignedReader(file *os.File) *alignedReader {
+	raw := make([]byte, directIOBufferSize+directIOAlignment)
+	offset := 0
+	if rem := int(uintptr(unsafe.Pointer(&raw[0])) % directIOAlignment); rem != 0 {
+		offset = directIOAlignment - rem
+	}
+	return &alignedReader{file: file, buf: raw[offset : offset+directIOBufferSize]}
+}
+
+func (r *alignedReader) Read(p []byte) (int, error) {
+	if r.pos == r.end {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.pos = 0
+		r.end, r.err = r.file.Read(r.buf)
+		if r.end == 0 {
+			if r.err == nil {
+				r.err = io.EOF
+			}
+			return 0, r.err
+		}
+	}
+	n := copy(p, r.buf[r.pos:r.end])
+	r.pos += n
+	return n, nil
+}
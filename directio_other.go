@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func openDirect(path string) (*os.File, error) {
+	return nil, errors.New("direct I/O is not supported on this platform")
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// diskPartition is a partition found in the partition table of a disk or disk image.
+type diskPartition struct {
+	Number     int
+	Scheme     string // gpt or mbr
+	Offset     int64  // from the start of the disk, in bytes
+	Size       int64
+	Type       string // the GPT partition type GUID, or the MBR type byte in hex
+	Name       string // the GPT partition name
+	Filesystem string // as told by filesystemMagic, or "" if not recognized
+	Extended   bool   // an MBR extended partition, which holds the logical partitions that follow it
+}
+
+// Sizes used by readPartitions. Disks with 4096-byte sectors put the GPT header at byte 4096 instead of 512.
+const (
+	mbrSignatureOffset = 510
+	mbrEntriesOffset   = 446
+	maxMBRLogical      = 128 // bounds a looping chain of extended boot records
+	maxGPTEntries      = 1024
+)
+
+var sectorSizes = []int64{512, 4096}
+
+// readPartitions reads the partition table of a disk of size bytes: GPT if there is one, or else an MBR with any
+// logical partitions of its extended partition. A disk without either, like the image of a single filesystem, has no
+// partitions.
+func readPartitions(disk io.ReaderAt, size int64) ([]diskPartition, error) {
+	for _, sectorSize := range sectorSizes {
+		header := make([]byte, 92)
+		if _, err := disk.ReadAt(header, sectorSize); err != nil {
+			continue
+		}
+		if string(header[:8]) == "EFI PART" {
+			return readGPT(disk, size, sectorSize, header)
+		}
+	}
+	return readMBR(disk, size)
+}
+
+func readGPT(disk io.ReaderAt, size, sectorSize int64, header []byte) ([]diskPartition, error) {
+	entriesLBA := int64(binary.LittleEndian.Uint64(header[72:]))
+	count := binary.LittleEndian.Uint32(header[80:])
+	entrySize := int64(binary.LittleEndian.Uint32(header[84:]))
+	if count > maxGPTEntries || entrySize < 128 || entrySize > 4096 {
+		return nil, fmt.Errorf("implausible GPT header: %d entries of %d bytes", count, entrySize)
+	}
+	entries := make([]byte, int64(count)*entrySize)
+	if _, err := disk.ReadAt(entries, entriesLBA*sectorSize); err != nil {
+		return nil, fmt.Errorf("failed to read GPT entries: %v", err)
+	}
+	var partitions []diskPartition
+	for i := int64(0); i < int64(count); i++ {
+		entry := entries[i*entrySize : (i+1)*entrySize]
+		if bytes.Equal(entry[:16], make([]byte, 16)) {
+			continue
+		}
+		first := int64(binary.LittleEndian.Uint64(entry[32:]))
+		last := int64(binary.LittleEndian.Uint64(entry[40:]))
+		if last < first || (last+1)*sectorSize > size {
+			return nil, fmt.Errorf("GPT partition %d lies outside the disk", i+1)
+		}
+		partitions = append(partitions, diskPartition{
+			Number: int(i + 1), Scheme: "gpt", Offset: first * sectorSize, Size: (last - first + 1) * sectorSize,
+			Type: guidString(entry[:16]), Name: utf16String(entry[56:128]),
+		})
+	}
+	return partitions, nil
+}
+
+func readMBR(disk io.ReaderAt, size int64) ([]diskPartition, error) {
+	sector := make([]byte, 512)
+	if _, err := disk.ReadAt(sector, 0); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if sector[mbrSignatureOffset] != 0x55 || sector[mbrSignatureOffset+1] != 0xAA {
+		return nil, nil
+	}
+	// A filesystem boot sector, as at the start of a FAT or NTFS image, ends the same way as an MBR.
+	if filesystemMagic(disk, 0) != "" {
+		return nil, nil
+	}
+	var partitions []diskPartition
+	for i := 0; i < 4; i++ {
+		entry := sector[mbrEntriesOffset+16*i : mbrEntriesOffset+16*(i+1)]
+		kind, start, sectors := entry[4], int64(binary.LittleEndian.Uint32(entry[8:])), int64(binary.LittleEndian.Uint32(entry[12:]))
+		if kind == 0 || sectors == 0 {
+			continue
+		}
+		if (start+sectors)*512 > size {
+			return nil, fmt.Errorf("MBR partition %d lies outside the disk", i+1)
+		}
+		partitions = append(partitions, diskPartition{
+			Number: i + 1, Scheme: "mbr", Offset: start * 512, Size: sectors * 512, Type: fmt.Sprintf("0x%02x", kind), Extended: isExtendedPartition(kind),
+		})
+		if isExtendedPartition(kind) {
+			logical, err := readLogicalPartitions(disk, size, start)
+			if err != nil {
+				return nil, err
+			}
+			partitions = append(partitions, logical...)
+		}
+	}
+	return partitions, nil
+}
+
+func isExtendedPartition(kind byte) bool {
+	return kind == 0x05 || kind == 0x0f || kind == 0x85
+}
+
+// readLogicalPartitions follows the chain of extended boot records of the extended partition starting at sector
+// extended. Logical partitions are numbered from 5, as Linux does.
+func readLogicalPartitions(disk io.ReaderAt, size, extended int64) ([]diskPartition, error) {
+	var partitions []diskPartition
+	sector := make([]byte, 512)
+	for ebr := extended; len(partitions) < maxMBRLogical; {
+		if _, err := disk.ReadAt(sector, ebr*512); err != nil {
+			return nil, fmt.Errorf("failed to read extended boot record: %v", err)
+		}
+		if sector[mbrSignatureOffset] != 0x55 || sector[mbrSignatureOffset+1] != 0xAA {
+			break
+		}
+		entry := sector[mbrEntriesOffset : mbrEntriesOffset+16]
+		if start, sectors := int64(binary.LittleEndian.Uint32(entry[8:])), int64(binary.LittleEndian.Uint32(entry[12:])); entry[4] != 0 && sectors != 0 {
+			if (ebr+start+sectors)*512 > size {
+				return nil, fmt.Errorf("logical partition %d lies outside the disk", len(partitions)+5)
+			}
+			partitions = append(partitions, diskPartition{
+				Number: len(partitions) + 5, Scheme: "mbr", Offset: (ebr + start) * 512, Size: sectors * 512, Type: fmt.Sprintf("0x%02x", entry[4]),
+			})
+		}
+		next := sector[mbrEntriesOffset+16 : mbrEntriesOffset+32]
+		if next[4] == 0 || binary.LittleEndian.Uint32(next[8:]) == 0 {
+			break
+		}
+		ebr = extended + int64(binary.LittleEndian.Uint32(next[8:]))
+	}
+	return partitions, nil
+}
+
+// filesystemSignatures are the magic numbers filesystemMagic looks for, at their offset from the start of the
+// filesystem. ext2, ext3 and ext4 share one and are told apart by their features.
+var filesystemSignatures = []struct {
+	name   string
+	offset int64
+	magic  string
+}{
+	{"ntfs", 3, "NTFS    "},
+	{"exfat", 3, "EXFAT   "},
+	{"vfat", 82, "FAT32   "},
+	{"vfat", 54, "FAT16   "},
+	{"vfat", 54, "FAT12   "},
+	{"xfs", 0, "XFSB"},
+	{"btrfs", 0x10040, "_BHRfS_M"},
+	{"crypto_LUKS", 0, "LUKS\xba\xbe"},
+	{"LVM2_member", 536, "LVM2 001"},
+	{"iso9660", 0x8001, "CD001"},
+	{"swap", 4086, "SWAPSPACE2"},
+}
+
+// Fields of the ext2/3/4 superblock, which starts 1024 bytes into the filesystem.
+const (
+	extSuperblock     = 1024
+	extMagic          = 0xEF53
+	extCompatJournal  = 0x4
+	extIncompatExtent = 0x40
+	extIncompat64Bit  = 0x80
+	extIncompatFlexBG = 0x200
+)
+
+// filesystemMagic names the filesystem starting offset bytes into disk by its signature, the way blkid does, or
+// returns "" if none is recognized.
+func filesystemMagic(disk io.ReaderAt, offset int64) string {
+	superblock := make([]byte, 0x68)
+	if _, err := disk.ReadAt(superblock, offset+extSuperblock); err == nil && binary.LittleEndian.Uint16(superblock[0x38:]) == extMagic {
+		compat := binary.LittleEndian.Uint32(superblock[0x5C:])
+		incompat := binary.LittleEndian.Uint32(superblock[0x60:])
+		switch {
+		case incompat&(extIncompatExtent|extIncompat64Bit|extIncompatFlexBG) != 0:
+			return "ext4"
+		case compat&extCompatJournal != 0:
+			return "ext3"
+		default:
+			return "ext2"
+		}
+	}
+	for _, signature := range filesystemSignatures {
+		buf := make([]byte, len(signature.magic))
+		if _, err := disk.ReadAt(buf, offset+signature.offset); err == nil && string(buf) == signature.magic {
+			return signature.name
+		}
+	}
+	return ""
+}
+
+// guidString formats a GUID stored the way GPT does, with its first three fields little-endian.
+func guidString(b []byte) string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X", binary.LittleEndian.Uint32(b[0:]), binary.LittleEndian.Uint16(b[4:]),
+		binary.LittleEndian.Uint16(b[6:]), b[8:10], b[10:16])
+}
+
+// utf16String decodes a NUL-padded UTF-16LE string, like a GPT partition name.
+func utf16String(b []byte) string {
+	units := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		unit := binary.LittleEndian.Uint16(b[i:])
+		if unit == 0 {
+			break
+		}
+		units = append(units, unit)
+	}
+	return strings.TrimSpace(string(utf16.Decode(units)))
+}
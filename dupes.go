@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+// duplicateSet is one group of indexed files with the same hash and size, as written by dupes --format jsonl and
+// served by /dupes, which leaves out the paths. Reclaimable is what deleting all but one copy would free.
+type duplicateSet struct {
+	Hash        string   `json:"hash"`
+	Size        int64    `json:"size"`
+	Copies      int      `json:"copies"`
+	Reclaimable int64    `json:"reclaimable"`
+	Paths       []string `json:"paths,omitempty"`
+}
+
+// duplicateFilesQuery returns the query listing the files of the duplicate sets under the stored path prefix $1 of
+// files of at least $2 bytes, leaving out rows written with the hash algorithm $3: hash, size, copies and filepath, the
+// sets that would free the most space first. limit, unless 0, caps the number of sets.
+func duplicateFilesQuery(limit int) string {
+	sets := `
+SELECT hash, size, count(*) AS copies FROM file_hashes
+WHERE filepath LIKE $1 AND size >= $2 AND deleted_timestamp IS NULL AND coalesce(hash_algorithm, '') <> $3
+GROUP BY hash, size HAVING count(*) > 1
+ORDER BY size::numeric * (count(*) - 1) DESC, hash, size`
+	if limit > 0 {
+		sets += " LIMIT " + strconv.Itoa(limit)
+	}
+	return `
+SELECT f.hash, f.size, d.copies, f.filepath FROM file_hashes f
+JOIN (` + sets + `) d ON d.hash = f.hash AND d.size = f.size
+WHERE f.filepath LIKE $1 AND f.deleted_timestamp IS NULL
+ORDER BY f.size::numeric * (d.copies - 1) DESC, f.hash, f.size, f.filepath`
+}
+
+// runDupes reports the sets of indexed files with the same hash and size, the sets that would free the most space
+// first. Files marked deleted by --detect-deleted are left out, and so are rows written by --privacy-mode, whose hash
+// is of the path rather than the contents.
+func runDupes(args []string) {
+	fs := flag.NewFlagSet("dupes", flag.ContinueOnError)
+	var dbCfg DBConfig
+	registerDBFlags(fs, &dbCfg)
+	under := fs.String("under", "", "Only consider stored paths starting with this prefix; copies elsewhere don't count.")
+	minSize := fs.String("min-size", "1", "Only report files at least this large. The default leaves out empty files, which are all alike.")
+	format := fs.String("format", "csv", "Output format: csv (one row per file) or jsonl (one JSON object per duplicate set).")
+	humanReadable := fs.Bool("human-readable", false, "Print sizes in the CSV like 1.4GiB instead of in bytes.")
+	limit := fs.Int("limit", 0, "Report at most this many sets, those that would free the most space first. 0 means no limit.")
+	fs.Usage = commandUsage(fs, "DupesUsage")
+	parseArgs(fs, args)
+
+	if dbCfg.DbName == "" {
+		usageError(fs, "dbname", msg("MissingFlag", map[string]any{"Flag": "dbname"}))
+	}
+	minBytes, err := parseByteSize(*minSize)
+	if err != nil {
+		usageError(fs, "min-size", err.Error())
+	}
+	if *format != "csv" && *format != "jsonl" {
+		usageError(fs, "format", fmt.Sprintf("Invalid --format %q.", *format))
+	}
+
+	db := connectToDatabase(dbCfg)
+	defer db.Close()
+	if _, err := db.Exec(addDeletedTimestampColumnQuery); err != nil {
+		log.Fatalf("Failed to add deleted_timestamp column: %v", err)
+	}
+
+	rows, err := db.Query(duplicateFilesQuery(*limit), likePrefix(*under), minBytes, privacyHashAlgorithm)
+	if err != nil {
+		log.Fatalf("Failed to query duplicates: %v", err)
+	}
+	defer rows.Close()
+
+	var csvWriter *csv.Writer
+	encoder := json.NewEncoder(os.Stdout)
+	if *format == "csv" {
+		csvWriter = csv.NewWriter(os.Stdout)
+		defer csvWriter.Flush()
+		csvWriter.Write([]string{"set", "hash", "size", "copies", "filepath"})
+	}
+
+	var current *duplicateSet
+	var setCount, fileCount, reclaimable int64
+	// A set is complete once a row of the next one arrives, or the rows run out.
+	finishSet := func() {
+		if current == nil || *format != "jsonl" {
+			return
+		}
+		if err := encoder.Encode(current); err != nil {
+			log.Fatalf("Failed to write report: %v", err)
+		}
+	}
+	for rows.Next() {
+		var hash, path string
+		var size int64
+		var copies int
+		if err := rows.Scan(&hash, &size, &copies, &path); err != nil {
+			log.Fatalf("Failed to read duplicates: %v", err)
+		}
+		if current == nil || hash != current.Hash || size != current.Size {
+			finishSet()
+			current = &duplicateSet{Hash: hash, Size: size, Copies: copies, Reclaimable: mulSize(size, int64(copies-1))}
+			setCount++
+			reclaimable = addSizes(reclaimable, current.Reclaimable)
+		}
+		fileCount++
+		if *format == "csv" {
+			row := []string{strconv.FormatInt(setCount, 10), hash, formatSize(size, *humanReadable), strconv.Itoa(copies), path}
+			if err := csvWriter.Write(row); err != nil {
+				log.Fatalf("Failed to write report: %v", err)
+			}
+		} else {
+			current.Paths = append(current.Paths, path)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalf("Failed to read duplicates: %v", err)
+	}
+	finishSet()
+	fmt.Fprintln(os.Stderr, msg("DupesSummary", map[string]any{
+		"Sets": setCount, "Files": fileCount, "Reclaimable": formatByteSize(reclaimable),
+	}))
+}
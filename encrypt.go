@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+)
+
+// encryptedPrefix starts every value --encrypt-column has encrypted, so readers can tell them from plaintext written
+// before the column was encrypted. The rest is the base64 of the nonce followed by the sealed value.
+const encryptedPrefix = "aesgcm:"
+
+// encryptableColumns are the columns --encrypt-column accepts, with the command writing each. They are only ever
+// written and shown, never searched, joined or sorted on, so they can hold ciphertext; paths, hashes, sizes and
+// timestamps are needed in plaintext for lookups and stay that way.
+var encryptableColumns = map[string]string{
+	"pii_findings.pattern": "scan",
+	"file_lineage.host":    "scan",
+	"audit_log.details":    "rewrite-paths",
+}
+
+// columnCipher encrypts the values of the columns chosen with --encrypt-column with AES-GCM, and decrypts values of
+// any encryptable column. Each value is sealed with the name of its column as additional data, so a value copied to
+// another column doesn't decrypt.
+type columnCipher struct {
+	aead    cipher.AEAD
+	columns map[string]bool
+}
+
+// readColumnKey returns the key for --encrypt-column, hex encoded in COLUMN_KEY or entered at a prompt, as
+// readPrivacySalt does. A key of 16, 24 or 32 bytes selects AES-128, AES-192 or AES-256; openssl rand -hex 32 makes
+// one. Values written with a key can't be read without it, so it must be kept somewhere other than the database.
+func readColumnKey() []byte {
+	encoded := os.Getenv("COLUMN_KEY")
+	if encoded == "" {
+		fmt.Print(msg("PromptColumnKey", nil))
+		fmt.Scanln(&encoded)
+	}
+	if encoded == "" {
+		log.Fatalf("Encrypted columns need a key (COLUMN_KEY environment variable or prompt)")
+	}
+	key, err := hex.DecodeString(encoded)
+	if err != nil || (len(key) != 16 && len(key) != 24 && len(key) != 32) {
+		log.Fatalf("The column key must be 16, 24 or 32 bytes, hex encoded")
+	}
+	return key
+}
+
+// newColumnCipher returns a columnCipher with key encrypting columns, which checkEncryptColumns has checked.
+func newColumnCipher(key []byte, columns []string) (*columnCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	c := &columnCipher{aead: aead, columns: make(map[string]bool)}
+	for _, column := range columns {
+		c.columns[column] = true
+	}
+	return c, nil
+}
+
+// seal returns value encrypted if column is one of the encrypted columns, or else value itself. Every call draws a
+// new nonce, so equal values don't give equal ciphertexts.
+func (c *columnCipher) seal(column, value string) string {
+	if !c.columns[column] {
+		return value
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		log.Fatalf("Failed to make a nonce: %v", err)
+	}
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(c.aead.Seal(nonce, nonce, []byte(value), []byte(column)))
+}
+
+// open returns the plaintext of a value of column that seal may have encrypted. Values without encryptedPrefix are
+// returned as they are.
+func (c *columnCipher) open(column, value string) (string, error) {
+	encoded, ok := strings.CutPrefix(value, encryptedPrefix)
+	if !ok {
+		return value, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted value in %s", column)
+	}
+	plaintext, err := c.aead.Open(nil, sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():], []byte(column))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt a value of %s, which was encrypted with another key or altered", column)
+	}
+	return string(plaintext), nil
+}
+
+// checkEncryptColumns refuses --encrypt-column values that aren't encryptable columns written by command.
+func checkEncryptColumns(fs *flag.FlagSet, command string, columns []string) {
+	for _, column := range columns {
+		if encryptableColumns[column] != command {
+			var accepted []string
+			for name, writer := range encryptableColumns {
+				if writer == command {
+					accepted = append(accepted, name)
+				}
+			}
+			slices.Sort(accepted)
+			usageError(fs, "encrypt-column", fmt.Sprintf("--encrypt-column %q isn't one of %s", column, strings.Join(accepted, ", ")))
+		}
+	}
+}
+
+// runDecrypt prints the plaintext of values of an encrypted column read one per line, for reading the columns with
+// psql or other tools, e.g. psql -Atc 'SELECT details FROM audit_log' | fileindexer decrypt --column audit_log.details.
+func runDecrypt(args []string) {
+	fs := flag.NewFlagSet("decrypt", flag.ContinueOnError)
+	column := fs.String("column", "", "The column the values are from, as table.column. Required.")
+	fs.Usage = commandUsage(fs, "DecryptUsage")
+	parseArgs(fs, args)
+
+	if _, ok := encryptableColumns[*column]; !ok {
+		usageError(fs, "column", fmt.Sprintf("--column %q isn't a column --encrypt-column encrypts", *column))
+	}
+	// The values come from stdin, so the key can't be prompted for there.
+	if os.Getenv("COLUMN_KEY") == "" {
+		log.Fatalf("decrypt reads the values from stdin, so the key must be in COLUMN_KEY")
+	}
+	columns, err := newColumnCipher(readColumnKey(), nil)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	writer := bufio.NewWriter(os.Stdout)
+	defer writer.Flush()
+	for scanner.Scan() {
+		value, err := columns.open(*column, scanner.Text())
+		if err != nil {
+			writer.Flush()
+			log.Fatalf("%v", err)
+		}
+		fmt.Fprintln(writer, value)
+	}
+	if err := scanner.Err(); err != nil {
+		writer.Flush()
+		log.Fatalf("Failed to read values: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestColumnCipher(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	c, err := newColumnCipher(key, []string{"file_lineage.host"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed := c.seal("file_lineage.host", "build-01")
+	if !strings.HasPrefix(sealed, encryptedPrefix) || strings.Contains(sealed, "build-01") {
+		t.Fatalf("seal = %q, want an encrypted value", sealed)
+	}
+	if again := c.seal("file_lineage.host", "build-01"); again == sealed {
+		t.Error("sealing a value twice gave the same ciphertext")
+	}
+	if plain := c.seal("pii_findings.pattern", "email"); plain != "email" {
+		t.Errorf("seal of a column not encrypted = %q, want it unchanged", plain)
+	}
+
+	other, err := newColumnCipher(bytes.Repeat([]byte{8}, 32), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		c       *columnCipher
+		column  string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "sealed", c: c, column: "file_lineage.host", value: sealed, want: "build-01"},
+		{name: "plaintext", c: c, column: "file_lineage.host", value: "build-02", want: "build-02"},
+		{name: "other column", c: c, column: "audit_log.details", value: sealed, wantErr: true},
+		{name: "other key", c: other, column: "file_lineage.host", value: sealed, wantErr: true},
+		{name: "altered", c: c, column: "file_lineage.host", value: sealed[:len(sealed)-4] + "AAAA", wantErr: true},
+		{name: "not base64", c: c, column: "file_lineage.host", value: encryptedPrefix + "!!", wantErr: true},
+		{name: "too short", c: c, column: "file_lineage.host", value: encryptedPrefix + "AAAA", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.c.open(tt.column, tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("open = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("open = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// seen_run_id is a row's scan epoch with --scan-epochs: the id of the scan run that last saw its file. A resumed run
+// keeps its id, so the files it saw before the interruption still count as seen.
+const addSeenRunColumnQuery = `ALTER TABLE file_hashes ADD COLUMN IF NOT EXISTS seen_run_id INTEGER`
+
+// run_id is the id of the scan run that last wrote a row: the one that added it, or last found it new, changed,
+// rehashed or moved. Rows written before the column was added, or by scans that aren't recorded in scan_runs, have
+// NULL there.
+const addRunColumnQuery = `ALTER TABLE file_hashes ADD COLUMN IF NOT EXISTS run_id INTEGER`
+
+// epochMarkBatchSize is how many stored paths one UPDATE marks as seen.
+const epochMarkBatchSize = 1000
+
+// scanEpoch collects stored paths, with --scan-epochs those of the files a scan sees whatever their result, and sets
+// column of their records to the scan's run a batch at a time. A path whose record isn't written yet, because it is in
+// the write-ahead log, simply stays unmarked.
+type scanEpoch struct {
+	db     *sql.DB
+	run    int64
+	column string
+
+	mu    sync.Mutex
+	paths []string
+}
+
+func newScanEpoch(db *sql.DB, run int64, column string) *scanEpoch {
+	return &scanEpoch{db: db, run: run, column: column}
+}
+
+// rootEpochs returns the epochs of scan run id of cfg.Directory: epoch marks the files it sees with --scan-epochs, and
+// writtenBy the records it writes. Either is nil if unused, and both are for a run that isn't recorded.
+func rootEpochs(db *sql.DB, cfg Config, id int64) (epoch, writtenBy *scanEpoch) {
+	if id == 0 {
+		return nil, nil
+	}
+	if cfg.ScanEpochs {
+		epoch = newScanEpoch(db, id, "seen_run_id")
+	}
+	// Records kept in --store have no file_hashes row to stamp.
+	if cfg.Store == "" {
+		writtenBy = newScanEpoch(db, id, "run_id")
+	}
+	return epoch, writtenBy
+}
+
+// mark records that the scan saw the file of storedPath, writing the batch if that fills it.
+func (e *scanEpoch) mark(storedPath string) {
+	e.mu.Lock()
+	e.paths = append(e.paths, storedPath)
+	var full []string
+	if len(e.paths) >= epochMarkBatchSize {
+		full, e.paths = e.paths, nil
+	}
+	e.mu.Unlock()
+	if full != nil {
+		e.write(full)
+	}
+}
+
+// flush writes the paths marked since the last batch.
+func (e *scanEpoch) flush() {
+	e.mu.Lock()
+	paths := e.paths
+	e.paths = nil
+	e.mu.Unlock()
+	if len(paths) > 0 {
+		e.write(paths)
+	}
+}
+
+// write sets the column on the records of paths. A failure only makes them deletion candidates, which are looked up
+// on disk anyway, or leaves an older run in run_id, so it is logged rather than failing the scan.
+func (e *scanEpoch) write(paths []string) {
+	err := retryDB(e.db, fmt.Sprintf("%s of %d files", e.column, len(paths)), func() error {
+		_, err := e.db.Exec("UPDATE file_hashes SET "+e.column+" = $1 WHERE filepath = ANY($2)", e.run, pq.Array(paths))
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to set %s of %d files to scan run %d: %v", e.column, len(paths), e.run, err)
+	}
+}
+
+// wroteRecord reports whether a file with status had its record written by the scan.
+func wroteRecord(status string) bool {
+	for _, written := range []string{"new", "changed", "forced", "rehashed", "moved"} {
+		if strings.HasPrefix(status, written) {
+			return true
+		}
+	}
+	return false
+}
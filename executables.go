@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// executableReport inventories every ELF, PE and Mach-O binary and every shebang script, whatever its extension.
+type executableReport struct {
+	mu     sync.Mutex
+	file   *os.File
+	writer rowWriter
+	count  int
+}
+
+func newExecutableReport(path string, safe bool) (*executableReport, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	writer := newCSVRowWriter(file, safe)
+	if err := writer.Write([]string{"filepath", "type", "hash", "size", "interpreter"}); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &executableReport{file: file, writer: writer}, nil
+}
+
+// record adds the file to the inventory if its leading bytes identify it as an executable.
+func (r *executableReport) record(storedPath, hash string, size int64, head []byte) error {
+	kind := sniffKind(head)
+	if !executableKinds[kind] {
+		return nil
+	}
+	var interpreter string
+	if kind == "script" {
+		interpreter = shebangInterpreter(head)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.count++
+	if err := r.writer.Write([]string{storedPath, kind, hash, fmt.Sprintf("%d", size), interpreter}); err != nil {
+		return err
+	}
+	r.writer.Flush()
+	return r.writer.Error()
+}
+
+func (r *executableReport) Close() error {
+	r.writer.Flush()
+	if err := r.writer.Error(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
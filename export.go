@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"fileindexer/client"
+)
+
+// exportFlushRows is how many rows an export writes between flushes, so a client sees rows arrive while the query is
+// still running without every row costing a packet.
+const exportFlushRows = 1000
+
+// exportReport is a report GET /export streams. open runs it for a request and returns its rows along with a function
+// turning the current row into its CSV fields and its JSON object. Errors from open are answered with 400 Bad Request,
+// as /scans/diff answers its errors.
+type exportReport struct {
+	header []string
+	open   func(ctx context.Context, db *sql.DB, query url.Values, token apiToken) (*sql.Rows, func() ([]string, any, error), error)
+}
+
+// exportReports are the reports GET /export serves, by name. Their parameters are those of /files, the dupes and
+// cold-report commands, and /scans/diff.
+var exportReports = map[string]exportReport{
+	"files": {
+		header: []string{"filepath", "hash", "hash_algorithm", "size", "modified", "indexed"},
+		open: func(ctx context.Context, db *sql.DB, query url.Values, token apiToken) (*sql.Rows, func() ([]string, any, error), error) {
+			q, err := fileConditions(query, token)
+			if err != nil {
+				return nil, nil, err
+			}
+			rows, err := db.QueryContext(ctx, selectFilesQuery+"WHERE "+strings.Join(q.conditions, " AND ")+" ORDER BY filepath", q.args...)
+			return rows, func() ([]string, any, error) {
+				var record fileRecord
+				if err := rows.Scan(&record.Path, &record.Hash, &record.Algorithm, &record.Size, &record.Modified, &record.Indexed); err != nil {
+					return nil, nil, err
+				}
+				record.Modified, record.Indexed = localWallClock(record.Modified), record.Indexed.In(time.Local)
+				return []string{record.Path, record.Hash, record.Algorithm, strconv.FormatInt(record.Size, 10),
+					record.Modified.Format(queryTimeLayout), record.Indexed.Format(queryTimeLayout)}, record, nil
+			}, err
+		},
+	},
+	"dupes": {
+		header: []string{"set", "hash", "size", "copies", "filepath"},
+		open: func(ctx context.Context, db *sql.DB, query url.Values, token apiToken) (*sql.Rows, func() ([]string, any, error), error) {
+			prefix, ok := token.scopePrefix(query.Get("prefix"))
+			if !ok {
+				return nil, nil, fmt.Errorf("prefix is outside the token's namespace")
+			}
+			minSize, err := exportSize(query, "min_size", "1")
+			if err != nil {
+				return nil, nil, err
+			}
+			rows, err := db.QueryContext(ctx, duplicateFilesQuery(0), likePrefix(prefix), minSize, privacyHashAlgorithm)
+			var set int64
+			var hash string
+			var size int64
+			return rows, func() ([]string, any, error) {
+				var file struct {
+					Set    int64  `json:"set"`
+					Hash   string `json:"hash"`
+					Size   int64  `json:"size"`
+					Copies int    `json:"copies"`
+					Path   string `json:"filepath"`
+				}
+				if err := rows.Scan(&file.Hash, &file.Size, &file.Copies, &file.Path); err != nil {
+					return nil, nil, err
+				}
+				if set == 0 || file.Hash != hash || file.Size != size {
+					set, hash, size = set+1, file.Hash, file.Size
+				}
+				file.Set = set
+				return []string{strconv.FormatInt(set, 10), file.Hash, strconv.FormatInt(file.Size, 10), strconv.Itoa(file.Copies), file.Path}, file, nil
+			}, err
+		},
+	},
+	"stale": {
+		header: []string{"filepath", "size", "modified", "accessed", "hash", "copies"},
+		open: func(ctx context.Context, db *sql.DB, query url.Values, token apiToken) (*sql.Rows, func() ([]string, any, error), error) {
+			prefix, ok := token.scopePrefix(query.Get("prefix"))
+			if !ok {
+				return nil, nil, fmt.Errorf("prefix is outside the token's namespace")
+			}
+			minSize, err := exportSize(query, "min_size", "1MiB")
+			if err != nil {
+				return nil, nil, err
+			}
+			olderThan := query.Get("older_than")
+			if olderThan == "" {
+				olderThan = "1y"
+			}
+			age, err := parseAge(olderThan)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid older_than: %v", err)
+			}
+			rows, err := db.QueryContext(ctx, coldFilesQuery, likePrefix(prefix), minSize, time.Now().Add(-age).In(time.Local), false)
+			return rows, func() ([]string, any, error) {
+				var c coldCandidate
+				var recordedAccess sql.NullTime
+				if err := rows.Scan(&c.Path, &c.Size, &c.Modified, &recordedAccess, &c.Hash, &c.Copies); err != nil {
+					return nil, nil, err
+				}
+				c.Modified = localWallClock(c.Modified)
+				accessed := ""
+				if recordedAccess.Valid {
+					t := localWallClock(recordedAccess.Time)
+					c.Accessed, accessed = &t, t.Format(queryTimeLayout)
+				}
+				return []string{c.Path, strconv.FormatInt(c.Size, 10), c.Modified.Format(queryTimeLayout), accessed, c.Hash, strconv.Itoa(c.Copies)}, c, nil
+			}, err
+		},
+	},
+	"diff": {
+		header: []string{"filepath", "status", "old_hash", "hash", "size"},
+		open: func(ctx context.Context, db *sql.DB, query url.Values, token apiToken) (*sql.Rows, func() ([]string, any, error), error) {
+			from, fromErr := strconv.ParseInt(query.Get("from"), 10, 64)
+			to, toErr := strconv.ParseInt(query.Get("to"), 10, 64)
+			if fromErr != nil || toErr != nil {
+				return nil, nil, fmt.Errorf("from and to must be scan run IDs")
+			}
+			prefix, ok := token.scopePrefix(query.Get("prefix"))
+			if !ok {
+				return nil, nil, fmt.Errorf("prefix is outside the token's namespace")
+			}
+			rows, err := queryScanDiff(ctx, db, from, to, prefix, nil)
+			return rows, func() ([]string, any, error) {
+				var entry scanDiffEntry
+				var oldHash sql.NullString
+				if err := rows.Scan(&entry.Path, &oldHash, &entry.Hash, &entry.Size); err != nil {
+					return nil, nil, err
+				}
+				entry.Status, entry.OldHash = "changed", oldHash.String
+				if !oldHash.Valid {
+					entry.Status = "new"
+				}
+				return []string{entry.Path, entry.Status, entry.OldHash, entry.Hash, strconv.FormatInt(entry.Size, 10)}, entry, nil
+			}, err
+		},
+	},
+}
+
+// exportSize returns the size parameter name of an export request, like 10MiB, or fallback if it isn't given.
+func exportSize(query url.Values, name, fallback string) (int64, error) {
+	value := query.Get(name)
+	if value == "" {
+		value = fallback
+	}
+	size, err := parseByteSize(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return size, nil
+}
+
+func exportReportNames() []string {
+	var names []string
+	for name := range exportReports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// serveExport streams a report as CSV or JSON lines, row by row as the database returns them. Nothing is buffered
+// beyond a few rows: writing to a client that reads slowly blocks, and the next rows aren't read from the database
+// until it has taken the last ones, so a slow download holds back the query instead of filling memory.
+func serveExport(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	name := r.PathValue("report")
+	report, ok := exportReports[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown report %q, expected one of %v", name, exportReportNames()), http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	format := query.Get("format")
+	switch format {
+	case "":
+		format = "csv"
+	case "csv", "jsonl":
+	case "parquet":
+		http.Error(w, "parquet isn't supported; export csv or jsonl and convert it, e.g. with DuckDB", http.StatusBadRequest)
+		return
+	default:
+		http.Error(w, fmt.Sprintf("invalid format %q, expected csv or jsonl", format), http.StatusBadRequest)
+		return
+	}
+	rows, next, err := report.open(r.Context(), db, query, requestToken(r))
+	if err != nil {
+		log.Printf("Failed to export %s: %v", name, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", exportContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+format))
+	if err := writeExport(w, format, report.header, rows, next, http.NewResponseController(w).Flush); err != nil {
+		// Once rows have been sent the status can't change any more, so a failure halfway aborts the response; the client
+		// sees a broken download rather than one that looks complete. A client that went away needs no telling.
+		if r.Context().Err() == nil {
+			log.Printf("Failed to export %s: %v", name, err)
+		}
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func exportContentType(format string) string {
+	if format == "csv" {
+		return "text/csv"
+	}
+	return "application/x-ndjson"
+}
+
+// writeExport writes the rows of a report to w as CSV or JSON lines, with next turning each row into both, and calls
+// flush every exportFlushRows rows. It stops at the first error reading rows or writing them.
+func writeExport(w io.Writer, format string, header []string, rows *sql.Rows, next func() ([]string, any, error), flush func() error) error {
+	csvWriter := csv.NewWriter(w)
+	encoder := json.NewEncoder(w)
+	if format == "csv" {
+		csvWriter.Write(header)
+	}
+	for count := 1; rows.Next(); count++ {
+		fields, item, err := next()
+		if err != nil {
+			return err
+		}
+		if format == "csv" {
+			err = csvWriter.Write(fields)
+		} else {
+			err = encoder.Encode(item)
+		}
+		if err == nil && count%exportFlushRows == 0 {
+			csvWriter.Flush()
+			err = firstError(csvWriter.Error(), flush())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// runExport streams a report from a fileindexer serve to a file or stdout, so scripts get the same exports as API
+// clients without writing HTTP requests. The token for a server with --require-token comes from FILEINDEXER_TOKEN.
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	server := fs.String("server", "", "URL of the fileindexer serve to export from, e.g. http://indexer:8080. Required.")
+	format := fs.String("format", "csv", "Output format: csv or jsonl (one JSON object per line).")
+	var params stringList
+	fs.Var(&params, "param", "Report parameter as name=value, e.g. prefix=/photos/ or older_than=2y. May be repeated.")
+	output := fs.String("output", "", "Write the report to this file instead of stdout.")
+	fs.Usage = commandUsage(fs, "ExportUsage")
+	parseArgs(fs, args)
+
+	if *server == "" {
+		usageError(fs, "server", msg("MissingFlag", map[string]any{"Flag": "server"}))
+	}
+	if fs.NArg() != 1 {
+		usageError(fs, "", msg("ExportUsage", nil))
+	}
+	if *format != "csv" && *format != "jsonl" {
+		usageError(fs, "format", fmt.Sprintf("Invalid --format %q.", *format))
+	}
+	query := url.Values{}
+	for _, param := range params {
+		name, value, ok := strings.Cut(param, "=")
+		if !ok || name == "" {
+			usageError(fs, "param", fmt.Sprintf("Invalid --param %q, expected name=value.", param))
+		}
+		query.Add(name, value)
+	}
+
+	c := client.New(*server)
+	c.Token = os.Getenv("FILEINDEXER_TOKEN")
+	// An export takes as long as it takes; the default client's timeout would cut off large ones.
+	c.HTTPClient = &http.Client{}
+	body, err := c.Export(context.Background(), fs.Arg(0), *format, query)
+	if errors.Is(err, client.ErrNotFound) {
+		log.Fatalf("Unknown report %s, expected one of %v", fs.Arg(0), exportReportNames())
+	}
+	if err != nil {
+		log.Fatalf("Failed to export %s: %v", fs.Arg(0), err)
+	}
+	defer body.Close()
+
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			log.Fatalf("Failed to create %s: %v", *output, err)
+		}
+	}
+	if _, err := io.Copy(out, body); err != nil {
+		log.Fatalf("Failed to export %s: %v", fs.Arg(0), err)
+	}
+	if err := out.Close(); err != nil {
+		log.Fatalf("Failed to write %s: %v", *output, err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+
+	"fileindexer/store"
+)
+
+// index is the --store backend file records are read from and written to instead of file_hashes, or nil. The rest
+// of the run's bookkeeping (scan_runs, file_history, the queue) stays in PostgreSQL.
+var index store.Store
+
+// lookupStoreRecord is lookupFileRecord for --store, with a missing record reported as sql.ErrNoRows like the
+// PostgreSQL lookup does.
+func lookupStoreRecord(storedPath string) (store.Record, error) {
+	var record store.Record
+	err := retryDB(index, "lookup for "+storedPath, func() error {
+		var err error
+		record, err = index.Lookup(storedPath)
+		if errors.Is(err, store.ErrNotFound) {
+			return sql.ErrNoRows
+		}
+		return err
+	})
+	if record.Algorithm == "" {
+		record.Algorithm = defaultHashAlgorithm
+	}
+	return record, err
+}
+
+// putStoreRecord writes a file record to --store. There is no write-ahead log for it, so while the backend is
+// unreachable the workers wait.
+func putStoreRecord(what string, record walRecord) error {
+	return retryDB(index, what, func() error {
+		return index.Put(store.Record{
+			Path:      record.Filepath,
+			Hash:      record.Hash,
+			Algorithm: record.Algorithm,
+			Size:      record.Size,
+			Modified:  record.FileTimestamp,
+			Recorded:  record.Recorded,
+		})
+	})
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// sniffBytes is how much of each file is read to identify it. Everything in magicSignatures fits well within it.
+const sniffBytes = 512
+
+type magicSignature struct {
+	kind   string
+	offset int
+	magic  []byte
+}
+
+// magicSignatures is checked in order, so more specific signatures come before ones that share a prefix.
+var magicSignatures = []magicSignature{
+	{"elf", 0, []byte("\x7fELF")},
+	{"macho", 0, []byte{0xfe, 0xed, 0xfa, 0xce}},
+	{"macho", 0, []byte{0xfe, 0xed, 0xfa, 0xcf}},
+	{"macho", 0, []byte{0xce, 0xfa, 0xed, 0xfe}},
+	{"macho", 0, []byte{0xcf, 0xfa, 0xed, 0xfe}},
+	{"macho", 0, []byte{0xca, 0xfe, 0xba, 0xbe}},
+	{"pe", 0, []byte("MZ")},
+	{"script", 0, []byte("#!")},
+	{"jpeg", 0, []byte{0xff, 0xd8, 0xff}},
+	{"png", 0, []byte("\x89PNG\r\n\x1a\n")},
+	{"gif", 0, []byte("GIF8")},
+	{"tiff", 0, []byte("II*\x00")},
+	{"tiff", 0, []byte("MM\x00*")},
+	{"webp", 8, []byte("WEBP")},
+	{"wav", 8, []byte("WAVE")},
+	{"avi", 8, []byte("AVI ")},
+	{"mp4", 4, []byte("ftyp")},
+	{"mp3", 0, []byte("ID3")},
+	{"flac", 0, []byte("fLaC")},
+	{"ogg", 0, []byte("OggS")},
+	{"pdf", 0, []byte("%PDF-")},
+	{"zip", 0, []byte("PK\x03\x04")},
+	{"zip", 0, []byte("PK\x05\x06")},
+	{"gzip", 0, []byte{0x1f, 0x8b}},
+	{"bzip2", 0, []byte("BZh")},
+	{"xz", 0, []byte("\xfd7zXZ\x00")},
+	{"7z", 0, []byte("7z\xbc\xaf\x27\x1c")},
+	{"rar", 0, []byte("Rar!\x1a\x07")},
+	{"sqlite", 0, []byte("SQLite format 3\x00")},
+}
+
+// extensionKinds lists the sniffed kinds acceptable for each extension. Extensions not listed here are never reported
+// as mismatches, since there is nothing to compare against.
+var extensionKinds = map[string][]string{
+	".jpg": {"jpeg"}, ".jpeg": {"jpeg"}, ".png": {"png"}, ".gif": {"gif"}, ".tif": {"tiff"}, ".tiff": {"tiff"},
+	".webp": {"webp"}, ".wav": {"wav"}, ".avi": {"avi"}, ".mp4": {"mp4"}, ".m4v": {"mp4"}, ".m4a": {"mp4"},
+	".mov": {"mp4"}, ".mp3": {"mp3", ""}, ".flac": {"flac"}, ".ogg": {"ogg"}, ".pdf": {"pdf"},
+	".zip": {"zip"}, ".docx": {"zip"}, ".xlsx": {"zip"}, ".pptx": {"zip"}, ".odt": {"zip"}, ".jar": {"zip"},
+	".apk": {"zip"}, ".gz": {"gzip"}, ".tgz": {"gzip"}, ".bz2": {"bzip2"}, ".xz": {"xz"}, ".7z": {"7z"},
+	".rar": {"rar"}, ".sqlite": {"sqlite"}, ".db": {"sqlite", ""},
+	".exe": {"pe"}, ".dll": {"pe"}, ".sys": {"pe"}, ".so": {"elf"}, ".dylib": {"macho"},
+	".sh": {"script", ""}, ".py": {"script", ""}, ".pl": {"script", ""}, ".rb": {"script", ""},
+	".txt": {""}, ".csv": {""}, ".json": {""}, ".xml": {""}, ".html": {""}, ".htm": {""}, ".md": {""},
+}
+
+// executableKinds are the sniffed kinds that can be run directly.
+var executableKinds = map[string]bool{"elf": true, "pe": true, "macho": true, "script": true}
+
+// archiveKinds are the sniffed kinds that bundle other files, and so may carry software of their own.
+var archiveKinds = map[string]bool{"zip": true, "gzip": true, "bzip2": true, "xz": true, "7z": true, "rar": true}
+
+// sniffKind identifies a file from its leading bytes, returning "" when nothing matches.
+func sniffKind(head []byte) string {
+	for _, sig := range magicSignatures {
+		if len(head) >= sig.offset+len(sig.magic) && bytes.Equal(head[sig.offset:sig.offset+len(sig.magic)], sig.magic) {
+			return sig.kind
+		}
+	}
+	return ""
+}
+
+// readHead returns up to sniffBytes from the start of the file, opened through tree.
+func readHead(tree treeReader, path string) ([]byte, error) {
+	file, err := tree.open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	head := make([]byte, sniffBytes)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+// shebangInterpreter returns the interpreter named on a script's #! line, e.g. "/usr/bin/env python3".
+func shebangInterpreter(head []byte) string {
+	line := head[2:]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	return strings.TrimSpace(strings.TrimSuffix(string(line), "\r"))
+}
+
+// typeMismatch returns the sniffed kind and whether it contradicts the file's extension.
+func typeMismatch(path string, head []byte) (string, bool) {
+	kind := sniffKind(head)
+	accepted, known := extensionKinds[strings.ToLower(filepath.Ext(path))]
+	if !known || len(head) == 0 {
+		return kind, false
+	}
+	for _, k := range accepted {
+		if k == kind {
+			return kind, false
+		}
+	}
+	// Only "" (unrecognised) is acceptable for text formats, but unrecognised content under a binary extension is
+	// common enough (truncated downloads, odd encoders) that it isn't worth flagging.
+	if kind == "" {
+		return kind, false
+	}
+	return kind, true
+}
+
+// typeReport collects the files flagged by --check-types into their own CSV.
+type typeReport struct {
+	mu     sync.Mutex
+	file   *os.File
+	writer rowWriter
+	count  int
+}
+
+func newTypeReport(path string, safe bool) (*typeReport, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	writer := newCSVRowWriter(file, safe)
+	if err := writer.Write([]string{"filepath", "extension", "detected_type"}); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &typeReport{file: file, writer: writer}, nil
+}
+
+// checkFileType checks the file's leading bytes against its extension and, on a mismatch, records it in the report
+// (if any) and returns the status suffix.
+func (r *typeReport) checkFileType(path, storedPath string, head []byte) (string, error) {
+	kind, mismatch := typeMismatch(path, head)
+	if !mismatch {
+		return "", nil
+	}
+	if kind == "" {
+		kind = "unknown"
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.count++
+	if r.writer != nil {
+		if err := r.writer.Write([]string{storedPath, filepath.Ext(path), kind}); err != nil {
+			return "", err
+		}
+		r.writer.Flush()
+	}
+	return "+type-mismatch", nil
+}
+
+func (r *typeReport) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	r.writer.Flush()
+	if err := r.writer.Error(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"fileindexer/pkg/indexer"
+)
+
+// pathFilter holds the --exclude-glob, --include-glob, --exclude-regex and --ignore-file rules of a scan.
+type pathFilter struct {
+	excludeGlobs   []ignoreRule
+	includeGlobs   []ignoreRule
+	excludeRegexps []*regexp.Regexp
+	ignoreFile     string
+	ignoreRules    []ignoreRule
+}
+
+// ignoreRule is a pattern in gitignore syntax: it matches the slash-separated path relative to the scanned directory
+// if it has a slash before its end, and otherwise the name of a file or directory at any depth. * and ? don't match a
+// slash, and ** matches any number of directories.
+type ignoreRule struct {
+	text     string // as given, for messages
+	line     int    // in the ignore file, or 0
+	pattern  string
+	anchored bool
+	dirOnly  bool // the pattern ended in a slash
+	negate   bool // the pattern started with !, re-including what earlier patterns of the ignore file matched
+}
+
+// parseIgnoreRule parses one pattern. Negation is only meaningful in an ignore file.
+func parseIgnoreRule(text string, line int) (ignoreRule, error) {
+	rule := ignoreRule{text: text, line: line}
+	pattern := text
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate, pattern = true, pattern[1:]
+	} else if strings.HasPrefix(pattern, `\!`) || strings.HasPrefix(pattern, `\#`) {
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly, pattern = true, strings.TrimSuffix(pattern, "/")
+	}
+	rule.anchored = strings.Contains(pattern, "/")
+	rule.pattern = strings.TrimPrefix(pattern, "/")
+	if rule.pattern == "" {
+		return rule, fmt.Errorf("pattern %q matches nothing", text)
+	}
+	for _, element := range strings.Split(rule.pattern, "/") {
+		if err := checkGlob(element); err != nil {
+			return rule, fmt.Errorf("invalid pattern %q: %v", text, err)
+		}
+	}
+	return rule, nil
+}
+
+// match reports whether the rule matches rel, the slash-separated relative path of a directory if isDir is set, or
+// else of a file.
+func (r ignoreRule) match(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if !r.anchored {
+		rel = path.Base(rel)
+	}
+	return matchGlob(r.pattern, rel)
+}
+
+// loadIgnoreFile reads the rules of an --ignore-file: a pattern a line, with blank lines and lines starting with #
+// left out, as in a .gitignore.
+func loadIgnoreFile(name string) ([]ignoreRule, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), " \t\r")
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		rule, err := parseIgnoreRule(text, line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, line, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// newPathFilter compiles the rules of the flags, returning nil if there are none. On error, it also returns the name
+// of the flag at fault.
+func newPathFilter(excludeGlobs, includeGlobs, excludeRegexps []string, ignoreFile string) (*pathFilter, string, error) {
+	if len(excludeGlobs) == 0 && len(includeGlobs) == 0 && len(excludeRegexps) == 0 && ignoreFile == "" {
+		return nil, "", nil
+	}
+	f := &pathFilter{ignoreFile: ignoreFile}
+	for _, text := range excludeGlobs {
+		rule, err := parseIgnoreRule(text, 0)
+		if err != nil || rule.negate {
+			return nil, "exclude-glob", fmt.Errorf("Invalid --exclude-glob %q, expected a pattern like node_modules/ or **/*.tmp.", text)
+		}
+		f.excludeGlobs = append(f.excludeGlobs, rule)
+	}
+	for _, text := range includeGlobs {
+		rule, err := parseIgnoreRule(text, 0)
+		if err != nil || rule.negate || rule.dirOnly {
+			return nil, "include-glob", fmt.Errorf("Invalid --include-glob %q, expected a file pattern like *.jpg or photos/**.", text)
+		}
+		f.includeGlobs = append(f.includeGlobs, rule)
+	}
+	for _, text := range excludeRegexps {
+		re, err := regexp.Compile(text)
+		if err != nil {
+			return nil, "exclude-regex", fmt.Errorf("Invalid --exclude-regex %q: %v.", text, err)
+		}
+		f.excludeRegexps = append(f.excludeRegexps, re)
+	}
+	if ignoreFile != "" {
+		var err error
+		if f.ignoreRules, err = loadIgnoreFile(ignoreFile); err != nil {
+			return nil, "ignore-file", fmt.Errorf("Invalid --ignore-file: %v.", err)
+		}
+	}
+	return f, "", nil
+}
+
+// skip returns why the file at path, or the directory if isDir is set, is left out, or "" if it isn't. rel is its
+// slash-separated path relative to the scanned directory, or "" for that directory itself, which globs don't apply to.
+func (f *pathFilter) skip(path, rel string, isDir bool) string {
+	for _, re := range f.excludeRegexps {
+		if re.MatchString(path) {
+			return "--exclude-regex " + re.String()
+		}
+	}
+	if rel == "" {
+		return ""
+	}
+	for _, rule := range f.excludeGlobs {
+		if rule.match(rel, isDir) {
+			return "--exclude-glob " + rule.text
+		}
+	}
+	// As in a .gitignore, the last pattern matching decides.
+	var ignored *ignoreRule
+	for i, rule := range f.ignoreRules {
+		if rule.match(rel, isDir) {
+			ignored = &f.ignoreRules[i]
+		}
+	}
+	if ignored != nil && !ignored.negate {
+		return fmt.Sprintf("%s:%d: %s", f.ignoreFile, ignored.line, ignored.text)
+	}
+	if isDir || len(f.includeGlobs) == 0 {
+		return ""
+	}
+	for _, rule := range f.includeGlobs {
+		if rule.match(rel, false) {
+			return ""
+		}
+	}
+	return "no matching --include-glob"
+}
+
+// exclusion returns why the file at path, or the directory if isDir is set, is left out of the scan by --exclude or
+// cfg.Filter, or "" if it isn't. Relative paths start at cfg.Directory, or without one, at root, the path named as
+// an argument that path was found under. A walk leaves out the whole of an excluded directory, so files under it
+// aren't checked themselves.
+func exclusion(cfg Config, root, path string, isDir bool) string {
+	if exclude := indexer.Excluded(cfg.ExcludeStrings, path); exclude != "" {
+		return "exclusion string: " + exclude
+	}
+	if cfg.Filter == nil {
+		return ""
+	}
+	base := cfg.Directory
+	if base == "" {
+		base = root
+	}
+	rel, err := filepath.Rel(base, path)
+	switch {
+	case err != nil || !within(path, base):
+		rel = filepath.Base(path)
+	case rel == "." && isDir:
+		rel = ""
+	case rel == ".":
+		// A file named on its own matches by its name.
+		rel = filepath.Base(path)
+	}
+	return cfg.Filter.skip(path, filepath.ToSlash(rel), isDir)
+}
+
+// exclusionWithin is exclusion for a file found other than by a walk, which checks the directories from
+// cfg.Directory down to it as well.
+func exclusionWithin(cfg Config, path string) string {
+	if cfg.Filter != nil && cfg.Directory != "" && within(path, cfg.Directory) {
+		if rel, err := filepath.Rel(cfg.Directory, filepath.Dir(path)); err == nil && rel != "." {
+			dir := cfg.Directory
+			for _, element := range strings.Split(rel, string(filepath.Separator)) {
+				dir = filepath.Join(dir, element)
+				if reason := exclusion(cfg, cfg.Directory, dir, true); reason != "" {
+					return reason
+				}
+			}
+		}
+	}
+	return exclusion(cfg, cfg.Directory, path, false)
+}
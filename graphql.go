@@ -0,0 +1,958 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// This is as much of GraphQL as serve needs: query documents with arguments, variables, aliases, fragments and the
+// @include and @skip directives, executed against a schema of object types whose fields are resolved by Go functions.
+// Mutations and subscriptions are refused, and there is no introspection; the schema is served as SDL instead.
+
+// maxGraphQLDepth and maxGraphQLLookups bound what one query can ask for: how deeply selections nest, and how many
+// fields returning objects are resolved, each of which may be a database query.
+const (
+	maxGraphQLDepth   = 10
+	maxGraphQLLookups = 2000
+)
+
+// gqlType is an object type of a GraphQL schema.
+type gqlType struct {
+	name   string
+	doc    string
+	fields []gqlField
+}
+
+// gqlField is a field of an object type. typ is its GraphQL type, such as [File!]!; resolve returns its value for
+// parent, the Go value of the object, with args coerced to the types of the field's arguments: strings for String,
+// int64 for Int and bools for Boolean. Object values are the Go values of their type, lists are slices and null is
+// nil.
+type gqlField struct {
+	name    string
+	doc     string
+	typ     string
+	args    []gqlArgument
+	resolve func(ctx context.Context, parent any, args map[string]any) (any, error)
+}
+
+type gqlArgument struct {
+	name string
+	typ  string
+}
+
+// gqlSchema is the object types of a schema, the first being the query type, and the scalars besides the built-in
+// ones.
+type gqlSchema struct {
+	types   []*gqlType
+	scalars []string
+}
+
+func (s *gqlSchema) objectType(name string) *gqlType {
+	for _, t := range s.types {
+		if t.name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+func (t *gqlType) field(name string) *gqlField {
+	for i := range t.fields {
+		if t.fields[i].name == name {
+			return &t.fields[i]
+		}
+	}
+	return nil
+}
+
+// sdl returns the schema in the GraphQL schema definition language, for clients to generate code or documentation
+// from.
+func (s *gqlSchema) sdl() string {
+	var b strings.Builder
+	for _, scalar := range s.scalars {
+		fmt.Fprintf(&b, "scalar %s\n\n", scalar)
+	}
+	for _, t := range s.types {
+		if t.doc != "" {
+			fmt.Fprintf(&b, "%q\n", t.doc)
+		}
+		fmt.Fprintf(&b, "type %s {\n", t.name)
+		for _, f := range t.fields {
+			if f.doc != "" {
+				fmt.Fprintf(&b, "  %q\n", f.doc)
+			}
+			b.WriteString("  " + f.name)
+			if len(f.args) > 0 {
+				var args []string
+				for _, arg := range f.args {
+					args = append(args, arg.name+": "+arg.typ)
+				}
+				b.WriteString("(" + strings.Join(args, ", ") + ")")
+			}
+			b.WriteString(": " + f.typ + "\n")
+		}
+		b.WriteString("}\n\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// gqlRequest is a GraphQL request, as a POST body or the parameters of a GET.
+type gqlRequest struct {
+	Query         string         `json:"query"`
+	Variables     map[string]any `json:"variables"`
+	OperationName string         `json:"operationName"`
+}
+
+// gqlResponse is the answer to a gqlRequest. Data is left out when the request couldn't be executed at all, or when a
+// non-null field of Query was left null.
+type gqlResponse struct {
+	Data   *gqlObject `json:"data,omitempty"`
+	Errors []gqlError `json:"errors,omitempty"`
+}
+
+// gqlError is an error of a GraphQL response, with the path of the field it happened at.
+type gqlError struct {
+	Message string `json:"message"`
+	Path    []any  `json:"path,omitempty"`
+}
+
+// gqlObject is a result object, whose fields are kept in the order they were selected in.
+type gqlObject struct {
+	keys   []string
+	values map[string]any
+}
+
+func (o *gqlObject) set(key string, value any) {
+	if o.values == nil {
+		o.values = make(map[string]any)
+	}
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *gqlObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		name, _ := json.Marshal(key)
+		value, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(name)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// executeGraphQL runs req against schema. It returns an error without running anything if the request is malformed,
+// and otherwise a response that may carry the errors of some fields along with the data of the others.
+func executeGraphQL(ctx context.Context, schema *gqlSchema, req gqlRequest) (gqlResponse, error) {
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		return gqlResponse{}, err
+	}
+	if name := doc.fragmentCycle(); name != "" {
+		return gqlResponse{}, fmt.Errorf("fragment %s spreads itself", name)
+	}
+	var op *gqlOperation
+	for _, candidate := range doc.operations {
+		if req.OperationName == "" || candidate.name == req.OperationName {
+			if op != nil {
+				return gqlResponse{}, fmt.Errorf("the document has several operations, so operationName must name one")
+			}
+			op = candidate
+		}
+	}
+	if op == nil {
+		return gqlResponse{}, fmt.Errorf("the document has no operation %q", req.OperationName)
+	}
+	if op.kind != "query" {
+		return gqlResponse{}, fmt.Errorf("only queries are supported, not %ss", op.kind)
+	}
+	vars := make(map[string]any)
+	for _, v := range op.variables {
+		value, ok := req.Variables[v.name]
+		if !ok && v.hasDefault {
+			value, ok = v.def, true
+		}
+		if !ok || value == nil {
+			if strings.HasSuffix(v.typ, "!") {
+				return gqlResponse{}, fmt.Errorf("variable $%s of type %s is required", v.name, v.typ)
+			}
+			continue
+		}
+		vars[v.name] = value
+	}
+
+	ex := &gqlExecution{ctx: ctx, schema: schema, fragments: doc.fragments, vars: vars, declared: make(map[string]bool)}
+	for _, v := range op.variables {
+		ex.declared[v.name] = true
+	}
+	data, err := ex.selectFields(op.selections, schema.types[0], nil, nil, 1)
+	if err != nil {
+		return gqlResponse{}, err
+	}
+	return gqlResponse{Data: data, Errors: ex.errors}, nil
+}
+
+// gqlExecution is the state of executing one operation.
+type gqlExecution struct {
+	ctx       context.Context
+	schema    *gqlSchema
+	fragments map[string]*gqlFragment
+	vars      map[string]any
+	declared  map[string]bool
+	lookups   int
+	errors    []gqlError
+}
+
+// selectFields resolves selections on value, an object of type t at path. Errors in the query itself are returned,
+// and stop execution; errors resolving a field are recorded, and leave the field null. A non-null field left null
+// makes the whole object null instead, which selectFields reports by returning nil.
+func (ex *gqlExecution) selectFields(selections []gqlSelection, t *gqlType, value any, path []any, depth int) (*gqlObject, error) {
+	if depth > maxGraphQLDepth {
+		return nil, fmt.Errorf("selections are nested more than %d deep", maxGraphQLDepth)
+	}
+	fields, err := ex.collectFields(selections, t, nil, make(map[string]bool))
+	if err != nil {
+		return nil, err
+	}
+	result := &gqlObject{}
+	for _, sel := range fields {
+		key := sel.alias
+		if key == "" {
+			key = sel.name
+		}
+		if sel.name == "__typename" {
+			result.set(key, t.name)
+			continue
+		}
+		field := t.field(sel.name)
+		if field == nil {
+			return nil, fmt.Errorf("type %s has no field %s", t.name, sel.name)
+		}
+		args, err := ex.coerceArguments(field, sel.args)
+		if err != nil {
+			return nil, err
+		}
+		fieldPath := append(path[:len(path):len(path)], key)
+		object := ex.schema.objectType(strings.Trim(field.typ, "[]!"))
+		if object == nil && len(sel.selections) > 0 {
+			return nil, fmt.Errorf("field %s of type %s has no fields to select", sel.name, field.typ)
+		}
+		if object != nil && len(sel.selections) == 0 {
+			return nil, fmt.Errorf("field %s of type %s needs a selection of its fields", sel.name, field.typ)
+		}
+		if object != nil {
+			if ex.lookups++; ex.lookups > maxGraphQLLookups {
+				return nil, fmt.Errorf("the query resolves more than %d objects; ask for fewer at a time", maxGraphQLLookups)
+			}
+		}
+		resolved, err := field.resolve(ex.ctx, value, args)
+		if err != nil {
+			ex.errors = append(ex.errors, gqlError{Message: err.Error(), Path: fieldPath})
+			resolved = nil
+		} else if object != nil {
+			if resolved, err = ex.complete(sel.selections, object, field.typ, resolved, fieldPath, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		if resolved == nil && strings.HasSuffix(field.typ, "!") {
+			return nil, nil
+		}
+		result.set(key, resolved)
+	}
+	return result, nil
+}
+
+// complete selects the fields of resolved, an object of type t or a list of them as typ says. It returns nil if
+// resolved is null or was made null by a non-null field, or if a non-null item of the list was.
+func (ex *gqlExecution) complete(selections []gqlSelection, t *gqlType, typ string, resolved any, path []any, depth int) (any, error) {
+	v := reflect.ValueOf(resolved)
+	if !v.IsValid() || (v.Kind() == reflect.Pointer && v.IsNil()) {
+		return nil, nil
+	}
+	if v.Kind() != reflect.Slice {
+		object, err := ex.selectFields(selections, t, resolved, path, depth)
+		if object == nil {
+			return nil, err
+		}
+		return object, nil
+	}
+	items := make([]any, v.Len())
+	for i := range items {
+		item, err := ex.selectFields(selections, t, v.Index(i).Interface(), append(path[:len(path):len(path)], i), depth)
+		if err != nil {
+			return nil, err
+		}
+		if item == nil {
+			if strings.HasSuffix(strings.TrimSuffix(typ, "!"), "!]") {
+				return nil, nil
+			}
+			continue
+		}
+		items[i] = item
+	}
+	return items, nil
+}
+
+// collectFields flattens selections on type t into the fields they select, expanding fragments whose type condition
+// is t and leaving out what @include and @skip do.
+func (ex *gqlExecution) collectFields(selections []gqlSelection, t *gqlType, fields []gqlSelection, visited map[string]bool) ([]gqlSelection, error) {
+	for _, sel := range selections {
+		included, err := ex.included(sel.directives)
+		if err != nil {
+			return nil, err
+		}
+		if !included {
+			continue
+		}
+		switch {
+		case sel.spread != "":
+			fragment := ex.fragments[sel.spread]
+			if fragment == nil {
+				return nil, fmt.Errorf("unknown fragment %s", sel.spread)
+			}
+			if visited[sel.spread] || fragment.on != t.name {
+				continue
+			}
+			visited[sel.spread] = true
+			if fields, err = ex.collectFields(fragment.selections, t, fields, visited); err != nil {
+				return nil, err
+			}
+		case sel.inline:
+			if sel.on != "" && sel.on != t.name {
+				continue
+			}
+			if fields, err = ex.collectFields(sel.selections, t, fields, visited); err != nil {
+				return nil, err
+			}
+		default:
+			fields = append(fields, sel)
+		}
+	}
+	return fields, nil
+}
+
+// included applies the @include and @skip directives of a selection.
+func (ex *gqlExecution) included(directives []gqlDirective) (bool, error) {
+	for _, d := range directives {
+		if d.name != "include" && d.name != "skip" {
+			return false, fmt.Errorf("unknown directive @%s", d.name)
+		}
+		value, err := ex.value(d.args["if"])
+		if err != nil {
+			return false, err
+		}
+		condition, ok := value.(bool)
+		if !ok {
+			return false, fmt.Errorf("@%s needs a Boolean if argument", d.name)
+		}
+		if condition == (d.name == "skip") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// coerceArguments checks the arguments given to field against the ones it takes, and returns their values.
+func (ex *gqlExecution) coerceArguments(field *gqlField, given map[string]any) (map[string]any, error) {
+	args := make(map[string]any)
+	for name := range given {
+		if !slices.ContainsFunc(field.args, func(arg gqlArgument) bool { return arg.name == name }) {
+			return nil, fmt.Errorf("field %s has no argument %s", field.name, name)
+		}
+	}
+	for _, arg := range field.args {
+		raw, ok := given[arg.name]
+		var value any
+		if ok {
+			var err error
+			if value, err = ex.value(raw); err != nil {
+				return nil, err
+			}
+		}
+		if value == nil {
+			if strings.HasSuffix(arg.typ, "!") {
+				return nil, fmt.Errorf("argument %s of field %s is required", arg.name, field.name)
+			}
+			continue
+		}
+		coerced, err := coerceScalar(strings.TrimSuffix(arg.typ, "!"), value)
+		if err != nil {
+			return nil, fmt.Errorf("argument %s of field %s: %v", arg.name, field.name, err)
+		}
+		args[arg.name] = coerced
+	}
+	return args, nil
+}
+
+// coerceScalar converts value, from the query or its JSON variables, to the Go value of the scalar type typ.
+func coerceScalar(typ string, value any) (any, error) {
+	switch typ {
+	case "String":
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+	case "Boolean":
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+	case "Int":
+		switch n := value.(type) {
+		case int64:
+			return n, nil
+		case float64:
+			if n == float64(int64(n)) {
+				return int64(n), nil
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported argument type %s", typ)
+	}
+	return nil, fmt.Errorf("expected %s, got %v", typ, value)
+}
+
+// value returns a value of the query with its variables filled in.
+func (ex *gqlExecution) value(raw any) (any, error) {
+	switch v := raw.(type) {
+	case gqlVariableRef:
+		if !ex.declared[string(v)] {
+			return nil, fmt.Errorf("variable $%s isn't declared by the operation", v)
+		}
+		return ex.vars[string(v)], nil
+	case []any:
+		list := make([]any, len(v))
+		for i, item := range v {
+			var err error
+			if list[i], err = ex.value(item); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case map[string]any:
+		object := make(map[string]any, len(v))
+		for key, item := range v {
+			var err error
+			if object[key], err = ex.value(item); err != nil {
+				return nil, err
+			}
+		}
+		return object, nil
+	}
+	return raw, nil
+}
+
+// gqlDocument is a parsed GraphQL document.
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+// fragmentCycle returns the name of a fragment that spreads itself, directly or through others, or "" if none does.
+func (doc *gqlDocument) fragmentCycle() string {
+	// A fragment is 1 while the fragments it spreads are being followed, and 2 once they have been.
+	state := make(map[string]int)
+	var follow func(name string) string
+	var visit func(selections []gqlSelection) string
+	follow = func(name string) string {
+		fragment := doc.fragments[name]
+		switch {
+		case fragment == nil || state[name] == 2:
+			return ""
+		case state[name] == 1:
+			return name
+		}
+		state[name] = 1
+		if cycle := visit(fragment.selections); cycle != "" {
+			return cycle
+		}
+		state[name] = 2
+		return ""
+	}
+	visit = func(selections []gqlSelection) string {
+		for _, sel := range selections {
+			if sel.spread != "" {
+				if cycle := follow(sel.spread); cycle != "" {
+					return cycle
+				}
+			}
+			if cycle := visit(sel.selections); cycle != "" {
+				return cycle
+			}
+		}
+		return ""
+	}
+	for name := range doc.fragments {
+		if cycle := follow(name); cycle != "" {
+			return cycle
+		}
+	}
+	return ""
+}
+
+// gqlOperation is an operation of a document: query, mutation or subscription.
+type gqlOperation struct {
+	kind       string
+	name       string
+	variables  []gqlVariable
+	selections []gqlSelection
+}
+
+type gqlVariable struct {
+	name       string
+	typ        string
+	def        any
+	hasDefault bool
+}
+
+type gqlFragment struct {
+	on         string
+	selections []gqlSelection
+}
+
+// gqlSelection is a field, a fragment spread (spread is the fragment's name) or an inline fragment (inline is set,
+// and on is its type condition, if any).
+type gqlSelection struct {
+	alias      string
+	name       string
+	args       map[string]any
+	directives []gqlDirective
+	selections []gqlSelection
+	spread     string
+	inline     bool
+	on         string
+}
+
+type gqlDirective struct {
+	name string
+	args map[string]any
+}
+
+// gqlVariableRef is a $variable in a value, filled in at execution.
+type gqlVariableRef string
+
+// gqlToken is a lexical token: a name, a number, a string or a punctuator, or EOF at the end.
+type gqlToken struct {
+	kind  string // "name", "int", "float", "string", "punct" or "EOF"
+	text  string
+	value string // the contents of a string
+	pos   int
+}
+
+// gqlSyntaxError is what the parser panics with, and parseGraphQL returns.
+type gqlSyntaxError struct {
+	msg string
+}
+
+func (e gqlSyntaxError) Error() string {
+	return e.msg
+}
+
+// gqlParser parses a document a token at a time, with one token of lookahead in tok.
+type gqlParser struct {
+	src string
+	pos int
+	tok gqlToken
+}
+
+// parseGraphQL parses a GraphQL executable document.
+func parseGraphQL(src string) (doc *gqlDocument, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			syntaxErr, ok := r.(gqlSyntaxError)
+			if !ok {
+				panic(r)
+			}
+			err = syntaxErr
+		}
+	}()
+	p := &gqlParser{src: src}
+	p.advance()
+	doc = &gqlDocument{fragments: make(map[string]*gqlFragment)}
+	for p.tok.kind != "EOF" {
+		switch {
+		case p.peek("{"):
+			doc.operations = append(doc.operations, &gqlOperation{kind: "query", selections: p.selectionSet()})
+		case p.tok.kind == "name" && p.tok.text == "fragment":
+			p.advance()
+			name := p.name()
+			if name == "on" {
+				p.fail("a fragment can't be called on")
+			}
+			if doc.fragments[name] != nil {
+				p.fail("fragment " + name + " is defined twice")
+			}
+			p.keyword("on")
+			fragment := &gqlFragment{on: p.name()}
+			p.directives()
+			fragment.selections = p.selectionSet()
+			doc.fragments[name] = fragment
+		case p.tok.kind == "name" && (p.tok.text == "query" || p.tok.text == "mutation" || p.tok.text == "subscription"):
+			op := &gqlOperation{kind: p.tok.text}
+			p.advance()
+			if p.tok.kind == "name" {
+				op.name = p.name()
+			}
+			if p.skip("(") {
+				for !p.skip(")") {
+					p.expect("$")
+					v := gqlVariable{name: p.name()}
+					p.expect(":")
+					v.typ = p.typeRef()
+					if p.skip("=") {
+						v.def, v.hasDefault = p.value(true), true
+					}
+					p.directives()
+					op.variables = append(op.variables, v)
+				}
+			}
+			p.directives()
+			op.selections = p.selectionSet()
+			doc.operations = append(doc.operations, op)
+		default:
+			p.fail("expected an operation or a fragment")
+		}
+	}
+	if len(doc.operations) == 0 {
+		p.fail("the document has no operation")
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) fail(msg string) {
+	panic(gqlSyntaxError{fmt.Sprintf("syntax error at offset %d: %s", p.tok.pos, msg)})
+}
+
+// peek reports whether the current token is the punctuator text.
+func (p *gqlParser) peek(text string) bool {
+	return p.tok.kind == "punct" && p.tok.text == text
+}
+
+// skip consumes the punctuator text if it is the current token.
+func (p *gqlParser) skip(text string) bool {
+	if p.peek(text) {
+		p.advance()
+		return true
+	}
+	return false
+}
+
+func (p *gqlParser) expect(text string) {
+	if !p.skip(text) {
+		p.fail(fmt.Sprintf("expected %s, found %q", text, p.tok.text))
+	}
+}
+
+func (p *gqlParser) keyword(name string) {
+	if p.tok.kind != "name" || p.tok.text != name {
+		p.fail(fmt.Sprintf("expected %s, found %q", name, p.tok.text))
+	}
+	p.advance()
+}
+
+func (p *gqlParser) name() string {
+	if p.tok.kind != "name" {
+		p.fail(fmt.Sprintf("expected a name, found %q", p.tok.text))
+	}
+	name := p.tok.text
+	p.advance()
+	return name
+}
+
+// typeRef parses a type such as [String!]! and returns it as written, without spaces.
+func (p *gqlParser) typeRef() string {
+	var typ string
+	if p.skip("[") {
+		typ = "[" + p.typeRef() + "]"
+		p.expect("]")
+	} else {
+		typ = p.name()
+	}
+	if p.skip("!") {
+		typ += "!"
+	}
+	return typ
+}
+
+func (p *gqlParser) selectionSet() []gqlSelection {
+	p.expect("{")
+	var selections []gqlSelection
+	for !p.skip("}") {
+		if p.tok.kind == "EOF" {
+			p.fail("unterminated selection set")
+		}
+		selections = append(selections, p.selection())
+	}
+	if len(selections) == 0 {
+		p.fail("empty selection set")
+	}
+	return selections
+}
+
+func (p *gqlParser) selection() gqlSelection {
+	if p.skip("...") {
+		if p.tok.kind == "name" && p.tok.text != "on" {
+			return gqlSelection{spread: p.name(), directives: p.directives()}
+		}
+		sel := gqlSelection{inline: true}
+		if p.tok.kind == "name" {
+			p.advance()
+			sel.on = p.name()
+		}
+		sel.directives = p.directives()
+		sel.selections = p.selectionSet()
+		return sel
+	}
+	sel := gqlSelection{name: p.name()}
+	if p.skip(":") {
+		sel.alias, sel.name = sel.name, p.name()
+	}
+	sel.args = p.arguments()
+	sel.directives = p.directives()
+	if p.peek("{") {
+		sel.selections = p.selectionSet()
+	}
+	return sel
+}
+
+func (p *gqlParser) arguments() map[string]any {
+	if !p.skip("(") {
+		return nil
+	}
+	args := make(map[string]any)
+	for !p.skip(")") {
+		name := p.name()
+		if _, ok := args[name]; ok {
+			p.fail("argument " + name + " is given twice")
+		}
+		p.expect(":")
+		args[name] = p.value(false)
+	}
+	return args
+}
+
+func (p *gqlParser) directives() []gqlDirective {
+	var directives []gqlDirective
+	for p.skip("@") {
+		directives = append(directives, gqlDirective{name: p.name(), args: p.arguments()})
+	}
+	return directives
+}
+
+// value parses a value; constant ones, such as variable defaults, can't use variables. Ints are int64, floats float64
+// and enum values their names, as strings.
+func (p *gqlParser) value(constant bool) any {
+	tok := p.tok
+	switch tok.kind {
+	case "punct":
+		switch tok.text {
+		case "$":
+			if constant {
+				p.fail("a variable can't be used here")
+			}
+			p.advance()
+			return gqlVariableRef(p.name())
+		case "[":
+			p.advance()
+			list := []any{}
+			for !p.skip("]") {
+				list = append(list, p.value(constant))
+			}
+			return list
+		case "{":
+			p.advance()
+			object := make(map[string]any)
+			for !p.skip("}") {
+				name := p.name()
+				p.expect(":")
+				object[name] = p.value(constant)
+			}
+			return object
+		}
+	case "int":
+		p.advance()
+		n, err := strconv.ParseInt(tok.text, 10, 64)
+		if err != nil {
+			p.fail("integer " + tok.text + " is out of range")
+		}
+		return n
+	case "float":
+		p.advance()
+		f, _ := strconv.ParseFloat(tok.text, 64)
+		return f
+	case "string":
+		p.advance()
+		return tok.value
+	case "name":
+		p.advance()
+		switch tok.text {
+		case "true":
+			return true
+		case "false":
+			return false
+		case "null":
+			return nil
+		}
+		return tok.text
+	}
+	p.fail(fmt.Sprintf("expected a value, found %q", tok.text))
+	return nil
+}
+
+// advance reads the next token into tok, skipping whitespace, commas and comments.
+func (p *gqlParser) advance() {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			p.pos++
+		} else if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' && p.src[p.pos] != '\r' {
+				p.pos++
+			}
+		} else if strings.HasPrefix(p.src[p.pos:], "\ufeff") {
+			p.pos += len("\ufeff")
+		} else {
+			break
+		}
+	}
+	start := p.pos
+	p.tok = gqlToken{kind: "EOF", pos: start}
+	if p.pos == len(p.src) {
+		return
+	}
+	c := p.src[p.pos]
+	switch {
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+		p.tok = gqlToken{kind: "punct", text: "...", pos: start}
+	case strings.IndexByte("!$&():=@[]{|}", c) >= 0:
+		p.pos++
+		p.tok = gqlToken{kind: "punct", text: string(c), pos: start}
+	case c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z'):
+		for p.pos < len(p.src) && isGraphQLNameByte(p.src[p.pos]) {
+			p.pos++
+		}
+		p.tok = gqlToken{kind: "name", text: p.src[start:p.pos], pos: start}
+	case c == '-' || ('0' <= c && c <= '9'):
+		p.tok = p.number()
+	case strings.HasPrefix(p.src[p.pos:], `"""`):
+		for p.pos += 3; !strings.HasPrefix(p.src[p.pos:], `"""`); p.pos++ {
+			if p.pos >= len(p.src) {
+				p.tok.pos = start
+				p.fail("unterminated block string")
+			}
+			if strings.HasPrefix(p.src[p.pos:], `\"""`) {
+				p.pos += 3
+			}
+		}
+		p.pos += 3
+		raw := strings.ReplaceAll(p.src[start+3:p.pos-3], `\"""`, `"""`)
+		p.tok = gqlToken{kind: "string", text: p.src[start:p.pos], value: blockStringValue(raw), pos: start}
+	case c == '"':
+		p.tok = p.quoted()
+	default:
+		p.fail(fmt.Sprintf("unexpected character %q", c))
+	}
+}
+
+// blockStringValue returns the value of a block string with raw between its quotes: the indentation its lines after
+// the first share is removed, and so are blank lines at the start and end.
+func blockStringValue(raw string) string {
+	lines := strings.Split(strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(raw), "\n")
+	indent := -1
+	for _, line := range lines[1:] {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed != "" && (indent < 0 || len(line)-len(trimmed) < indent) {
+			indent = len(line) - len(trimmed)
+		}
+	}
+	for i := 1; i < len(lines) && indent > 0; i++ {
+		lines[i] = lines[i][min(indent, len(lines[i])):]
+	}
+	blank := func(line string) bool { return strings.TrimLeft(line, " \t") == "" }
+	for len(lines) > 0 && blank(lines[0]) {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && blank(lines[len(lines)-1]) {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n")
+}
+
+func isGraphQLNameByte(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+// number reads an int or float token.
+func (p *gqlParser) number() gqlToken {
+	start := p.pos
+	kind := "int"
+	digits := func() {
+		from := p.pos
+		for p.pos < len(p.src) && '0' <= p.src[p.pos] && p.src[p.pos] <= '9' {
+			p.pos++
+		}
+		if p.pos == from {
+			p.tok.pos = p.pos
+			p.fail("malformed number")
+		}
+	}
+	if p.src[p.pos] == '-' {
+		p.pos++
+	}
+	digits()
+	if p.pos < len(p.src) && p.src[p.pos] == '.' {
+		kind = "float"
+		p.pos++
+		digits()
+	}
+	if p.pos < len(p.src) && (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') {
+		kind = "float"
+		p.pos++
+		if p.pos < len(p.src) && (p.src[p.pos] == '+' || p.src[p.pos] == '-') {
+			p.pos++
+		}
+		digits()
+	}
+	return gqlToken{kind: kind, text: p.src[start:p.pos], pos: start}
+}
+
+// quoted reads a string token. Its escapes are those of JSON, so it is decoded as one.
+func (p *gqlParser) quoted() gqlToken {
+	start := p.pos
+	for p.pos++; ; p.pos++ {
+		if p.pos >= len(p.src) || p.src[p.pos] == '\n' || p.src[p.pos] == '\r' {
+			p.tok.pos = start
+			p.fail("unterminated string")
+		}
+		if p.src[p.pos] == '\\' {
+			p.pos++
+			continue
+		}
+		if p.src[p.pos] == '"' {
+			break
+		}
+	}
+	p.pos++
+	var value string
+	if err := json.Unmarshal([]byte(p.src[start:p.pos]), &value); err != nil {
+		p.tok.pos = start
+		p.fail("malformed string: " + err.Error())
+	}
+	return gqlToken{kind: "string", text: p.src[start:p.pos], value: value, pos: start}
+}
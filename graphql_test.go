@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testGraphQLSchema has a Query with an echo field, returning its argument as JSON, and Items whose n fails for 2.
+func testGraphQLSchema() *gqlSchema {
+	items := func(v any, err error) func(context.Context, any, map[string]any) (any, error) {
+		return func(context.Context, any, map[string]any) (any, error) { return v, err }
+	}
+	return &gqlSchema{types: []*gqlType{
+		{name: "Query", fields: []gqlField{
+			{name: "echo", typ: "String", args: []gqlArgument{{"s", "String"}, {"n", "Int"}, {"b", "Boolean"}},
+				resolve: func(_ context.Context, _ any, args map[string]any) (any, error) {
+					data, err := json.Marshal(args)
+					return string(data), err
+				}},
+			{name: "items", typ: "[Item!]!", resolve: items([]int{1, 3}, nil)},
+			{name: "failing", typ: "[Item!]", resolve: items([]int{1, 2}, nil)},
+			{name: "loose", typ: "[Item]", resolve: items([]int{1, 2}, nil)},
+			{name: "item", typ: "Item", resolve: items(nil, nil)},
+			{name: "broken", typ: "Int!", resolve: items(nil, errors.New("boom"))},
+		}},
+		{name: "Item", fields: []gqlField{
+			{name: "n", typ: "Int!", resolve: func(_ context.Context, parent any, _ map[string]any) (any, error) {
+				if parent.(int) == 2 {
+					return nil, errors.New("two")
+				}
+				return parent, nil
+			}},
+			{name: "self", typ: "Item!", resolve: func(_ context.Context, parent any, _ map[string]any) (any, error) {
+				return parent, nil
+			}},
+		}},
+	}}
+}
+
+func TestExecuteGraphQL(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		variables map[string]any
+		operation string
+		want      string
+	}{
+		{name: "fields in order", query: `{ items { n } echo }`,
+			want: `{"data":{"items":[{"n":1},{"n":3}],"echo":"{}"}}`},
+		{name: "aliases and typename", query: `query { a: echo(s: "x") __typename }`,
+			want: `{"data":{"a":"{\"s\":\"x\"}","__typename":"Query"}}`},
+		{name: "values", query: `{ echo(s: "tab\there é", n: -12, b: true) }`,
+			want: `{"data":{"echo":"{\"b\":true,\"n\":-12,\"s\":\"tab\\there é\"}"}}`},
+		{name: "block string", query: "{ echo(s: \"\"\"\n    a\n      b\n  \"\"\") }",
+			want: `{"data":{"echo":"{\"s\":\"a\\n  b\"}"}}`},
+		{name: "block string escape", query: `{ echo(s: """say \""" and "quote" """) }`,
+			want: `{"data":{"echo":"{\"s\":\"say \\\"\\\"\\\" and \\\"quote\\\" \"}"}}`},
+		{name: "variables and defaults", query: `query Q($s: String, $n: Int = 7) { echo(s: $s, n: $n) }`, variables: map[string]any{"s": "v"},
+			want: `{"data":{"echo":"{\"n\":7,\"s\":\"v\"}"}}`},
+		{name: "fragments", query: `{ items { ...F ... on Item { self { n } } } } fragment F on Item { n }`,
+			want: `{"data":{"items":[{"n":1,"self":{"n":1}},{"n":3,"self":{"n":3}}]}}`},
+		{name: "skip and include", query: `query($no: Boolean!) { echo @skip(if: true) items @include(if: $no) { n } item { n } }`, variables: map[string]any{"no": false},
+			want: `{"data":{"item":null}}`},
+		{name: "operation name", query: `query A { echo(s: "a") } query B { echo(s: "b") }`, operation: "B",
+			want: `{"data":{"echo":"{\"s\":\"b\"}"}}`},
+		{name: "nullable item fails", query: `{ loose { n } echo }`,
+			want: `{"data":{"loose":[{"n":1},null],"echo":"{}"},"errors":[{"message":"two","path":["loose",1,"n"]}]}`},
+		{name: "non-null item fails", query: `{ failing { n } echo }`,
+			want: `{"data":{"failing":null,"echo":"{}"},"errors":[{"message":"two","path":["failing",1,"n"]}]}`},
+		{name: "non-null field fails", query: `{ broken echo }`,
+			want: `{"errors":[{"message":"boom","path":["broken"]}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := executeGraphQL(context.Background(), testGraphQLSchema(), gqlRequest{Query: tt.query, Variables: tt.variables, OperationName: tt.operation})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.Marshal(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecuteGraphQLErrors(t *testing.T) {
+	deep := "{ items " + strings.Repeat("{ self ", maxGraphQLDepth) + "{ n }" + strings.Repeat(" }", maxGraphQLDepth) + " }"
+	tests := []struct {
+		query   string
+		wantErr string
+	}{
+		{`{ items { n }`, "syntax error"},
+		{`{ echo(s: "unterminated) }`, "syntax error"},
+		{`{ echo(s: 1.5.2) }`, "syntax error"},
+		{`mutation { echo }`, "only queries are supported"},
+		{`query A { echo } query B { echo }`, "operationName must name one"},
+		{`{ nope }`, "type Query has no field nope"},
+		{`{ items }`, "needs a selection of its fields"},
+		{`{ echo { n } }`, "has no fields to select"},
+		{`{ echo(n: "x") }`, "expected Int"},
+		{`{ echo(x: 1) }`, "x"},
+		{`{ echo(s: $s) }`, "$s"},
+		{`query($s: String!) { echo(s: $s) }`, "variable $s of type String! is required"},
+		{`{ ...Missing }`, "Missing"},
+		{`{ items { ...A } } fragment A on Item { ...B } fragment B on Item { ...A }`, "spreads itself"},
+		{deep, fmt.Sprintf("nested more than %d deep", maxGraphQLDepth)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			_, err := executeGraphQL(context.Background(), testGraphQLSchema(), gqlRequest{Query: tt.query})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// graphQLListArgs are the arguments of the GraphQL fields that list a page of items, named after the parameters of the
+// REST list endpoints they are passed to: minSize is min_size, and so on.
+var graphQLListArgs = map[string]string{
+	"prefix":         "prefix",
+	"path":           "path",
+	"hash":           "hash",
+	"minSize":        "min_size",
+	"maxSize":        "max_size",
+	"modifiedAfter":  "modified_after",
+	"modifiedBefore": "modified_before",
+	"since":          "since",
+	"until":          "until",
+	"sort":           "sort",
+	"limit":          "limit",
+	"cursor":         "cursor",
+}
+
+// listArguments returns the GraphQL arguments of a list field taking the REST parameters names, and the page ones.
+func listArguments(names ...string) []gqlArgument {
+	var args []gqlArgument
+	for _, name := range append(names, "sort", "limit", "cursor") {
+		typ := "String"
+		if name == "limit" {
+			typ = "Int"
+		}
+		args = append(args, gqlArgument{name: name, typ: typ})
+	}
+	return args
+}
+
+// listValues turns the arguments of a list field into the query parameters of the REST list endpoint, on top of
+// defaults.
+func listValues(args map[string]any, defaults url.Values) url.Values {
+	values := url.Values{}
+	for name, value := range defaults {
+		values[name] = value
+	}
+	for name, value := range args {
+		switch v := value.(type) {
+		case string:
+			values.Set(graphQLListArgs[name], v)
+		case int64:
+			values.Set(graphQLListArgs[name], strconv.FormatInt(v, 10))
+		}
+	}
+	return values
+}
+
+// listed returns the page a list query read, or the error clients get if it failed, which like the REST endpoints'
+// doesn't say more than that.
+func listed(page listPage, err error) (listPage, error) {
+	if err != nil {
+		log.Printf("Failed to list for a GraphQL query: %v", err)
+		return page, errors.New("listing failed")
+	}
+	return page, nil
+}
+
+// newGraphQLSchema returns the schema of POST /graphql: files, duplicate sets, history and scans, with the same
+// filters, sorts and cursors as the REST endpoints and the same namespaces, so a client can fetch a file with its
+// history and copies, or a duplicate set with its files, in one request.
+func newGraphQLSchema(db *sql.DB, cache *lookupCache, launcher *scanLauncher) *gqlSchema {
+	listFilesPage := func(ctx context.Context, query url.Values, conditions func(*listQuery)) (listPage, error) {
+		p, err := parsePageRequest(query, fileSorts, "path")
+		if err != nil {
+			return listPage{}, err
+		}
+		q, err := fileConditions(query, contextToken(ctx))
+		if err != nil {
+			return listPage{}, err
+		}
+		if conditions != nil {
+			conditions(q)
+		}
+		return listed(listFiles(ctx, db, selectFilesQuery+q.page(p, "filepath", "text"), q.args, p))
+	}
+	listHistoryPage := func(ctx context.Context, query url.Values) (listPage, error) {
+		stmt, args, p, err := listHistoryQuery(query, contextToken(ctx))
+		if err != nil {
+			return listPage{}, err
+		}
+		return listed(listHistory(ctx, db, stmt, args, p))
+	}
+	// file looks up the record of path, or nil if it isn't indexed or is outside the token's namespace.
+	file := func(ctx context.Context, path string) (any, error) {
+		if !contextToken(ctx).covers(path) {
+			return nil, nil
+		}
+		record, err := lookupPath(ctx, db, cache, path)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		if err != nil {
+			log.Printf("Failed to look up %s: %v", path, err)
+			return nil, errors.New("lookup failed")
+		}
+		return &record, nil
+	}
+	page := func(item string) *gqlType {
+		return &gqlType{name: item + "Page", doc: "A page of " + item + " items, as the REST list endpoints answer.", fields: []gqlField{
+			{name: "items", typ: "[" + item + "!]!", resolve: func(ctx context.Context, parent any, args map[string]any) (any, error) {
+				return parent.(listPage).Items, nil
+			}},
+			{name: "nextCursor", doc: "Passed back as cursor, with the same other arguments, for the next page; null on the last.", typ: "String",
+				resolve: func(ctx context.Context, parent any, args map[string]any) (any, error) {
+					if next := parent.(listPage).NextCursor; next != "" {
+						return next, nil
+					}
+					return nil, nil
+				}},
+		}}
+	}
+	// scalar returns the resolver of a field of an object type read by get.
+	scalar := func(get func(parent any) any) func(context.Context, any, map[string]any) (any, error) {
+		return func(ctx context.Context, parent any, args map[string]any) (any, error) {
+			return get(parent), nil
+		}
+	}
+	fileValue := func(parent any) fileRecord {
+		if record, ok := parent.(*fileRecord); ok {
+			return *record
+		}
+		return parent.(fileRecord)
+	}
+
+	query := &gqlType{name: "Query", fields: []gqlField{
+		{name: "file", doc: "The indexed file at a stored path.", typ: "File", args: []gqlArgument{{"path", "String!"}},
+			resolve: func(ctx context.Context, parent any, args map[string]any) (any, error) {
+				return file(ctx, args["path"].(string))
+			}},
+		{name: "files", doc: "Indexed files, as GET /files lists them.", typ: "FilePage!",
+			args: listArguments("prefix", "hash", "minSize", "maxSize", "modifiedAfter", "modifiedBefore"),
+			resolve: func(ctx context.Context, parent any, args map[string]any) (any, error) {
+				return listFilesPage(ctx, listValues(args, nil), nil)
+			}},
+		{name: "dupes", doc: "Sets of indexed files with the same contents, as GET /dupes lists them.", typ: "DupeSetPage!",
+			args: listArguments("prefix", "minSize", "maxSize"),
+			resolve: func(ctx context.Context, parent any, args map[string]any) (any, error) {
+				stmt, queryArgs, p, err := listDupesQuery(listValues(args, nil), contextToken(ctx))
+				if err != nil {
+					return nil, err
+				}
+				return listed(listDupes(ctx, db, stmt, queryArgs, p))
+			}},
+		{name: "history", doc: "Rows of file_history, as GET /history lists them.", typ: "HistoryEntryPage!",
+			args: listArguments("path", "prefix", "minSize", "maxSize", "since", "until"),
+			resolve: func(ctx context.Context, parent any, args map[string]any) (any, error) {
+				return listHistoryPage(ctx, listValues(args, nil))
+			}},
+		{name: "scans", doc: "Scans started over the API, the most recently started first.", typ: "[Scan!]!",
+			resolve: func(ctx context.Context, parent any, args map[string]any) (any, error) {
+				if launcher == nil {
+					return []scanStatus{}, nil
+				}
+				return launcher.list(contextToken(ctx)), nil
+			}},
+		{name: "scan", doc: "A scan started over the API.", typ: "Scan", args: []gqlArgument{{"id", "String!"}},
+			resolve: func(ctx context.Context, parent any, args map[string]any) (any, error) {
+				if launcher == nil {
+					return nil, nil
+				}
+				if status, ok := launcher.status(args["id"].(string), contextToken(ctx)); ok {
+					return status, nil
+				}
+				return nil, nil
+			}},
+	}}
+
+	fileType := &gqlType{name: "File", doc: "An indexed file. Times are in the server's time zone.", fields: []gqlField{
+		{name: "path", typ: "String!", resolve: scalar(func(parent any) any { return fileValue(parent).Path })},
+		{name: "hash", typ: "String!", resolve: scalar(func(parent any) any { return fileValue(parent).Hash })},
+		{name: "hashAlgorithm", typ: "String!", resolve: scalar(func(parent any) any { return fileValue(parent).Algorithm })},
+		{name: "size", typ: "BigInt!", resolve: scalar(func(parent any) any { return fileValue(parent).Size })},
+		{name: "modified", typ: "Time!", resolve: scalar(func(parent any) any { return fileValue(parent).Modified })},
+		{name: "indexed", typ: "Time!", resolve: scalar(func(parent any) any { return fileValue(parent).Indexed })},
+		{name: "history", doc: "The file's rows of file_history, the newest first unless sorted otherwise.", typ: "HistoryEntryPage!",
+			args: listArguments("since", "until"),
+			resolve: func(ctx context.Context, parent any, args map[string]any) (any, error) {
+				return listHistoryPage(ctx, listValues(args, url.Values{"path": {fileValue(parent).Path}, "sort": {"-recorded"}}))
+			}},
+		{name: "copies", doc: "The other indexed files with the same hash.", typ: "FilePage!", args: listArguments(),
+			resolve: func(ctx context.Context, parent any, args map[string]any) (any, error) {
+				record := fileValue(parent)
+				return listFilesPage(ctx, listValues(args, url.Values{"hash": {record.Hash}}), func(q *listQuery) {
+					q.where("filepath <> ?", record.Path)
+				})
+			}},
+	}}
+
+	dupeType := &gqlType{name: "DupeSet", doc: "Indexed files with the same hash and size.", fields: []gqlField{
+		{name: "hash", typ: "String!", resolve: scalar(func(parent any) any { return parent.(duplicateSet).Hash })},
+		{name: "size", typ: "BigInt!", resolve: scalar(func(parent any) any { return parent.(duplicateSet).Size })},
+		{name: "copies", typ: "Int!", resolve: scalar(func(parent any) any { return parent.(duplicateSet).Copies })},
+		{name: "reclaimable", doc: "Bytes that keeping only one copy would free.", typ: "BigInt!",
+			resolve: scalar(func(parent any) any { return parent.(duplicateSet).Reclaimable })},
+		{name: "files", doc: "The files of the set.", typ: "FilePage!", args: listArguments(),
+			resolve: func(ctx context.Context, parent any, args map[string]any) (any, error) {
+				set := parent.(duplicateSet)
+				size := strconv.FormatInt(set.Size, 10)
+				return listFilesPage(ctx, listValues(args, url.Values{"hash": {set.Hash}, "min_size": {size}, "max_size": {size}}), nil)
+			}},
+	}}
+
+	historyType := &gqlType{name: "HistoryEntry", doc: "A row of file_history. Removed rows record a file leaving its path.", fields: []gqlField{
+		{name: "id", typ: "BigInt!", resolve: scalar(func(parent any) any { return parent.(historyEntry).ID })},
+		{name: "path", typ: "String!", resolve: scalar(func(parent any) any { return parent.(historyEntry).Path })},
+		{name: "hash", typ: "String!", resolve: scalar(func(parent any) any { return parent.(historyEntry).Hash })},
+		{name: "size", typ: "BigInt!", resolve: scalar(func(parent any) any { return parent.(historyEntry).Size })},
+		{name: "modified", typ: "Time!", resolve: scalar(func(parent any) any { return parent.(historyEntry).Modified })},
+		{name: "recorded", typ: "Time!", resolve: scalar(func(parent any) any { return parent.(historyEntry).Recorded })},
+		{name: "removed", typ: "Boolean!", resolve: scalar(func(parent any) any { return parent.(historyEntry).Removed })},
+		{name: "file", doc: "The file now indexed at the path, if any.", typ: "File",
+			resolve: func(ctx context.Context, parent any, args map[string]any) (any, error) {
+				return file(ctx, parent.(historyEntry).Path)
+			}},
+	}}
+
+	scanType := &gqlType{name: "Scan", doc: "A scan started over the API, as GET /scans/{id} answers.", fields: []gqlField{
+		{name: "id", typ: "String!", resolve: scalar(func(parent any) any { return parent.(scanStatus).ID })},
+		{name: "directory", typ: "String!", resolve: scalar(func(parent any) any { return parent.(scanStatus).Directory })},
+		{name: "pid", typ: "Int!", resolve: scalar(func(parent any) any { return parent.(scanStatus).PID })},
+		{name: "state", typ: "String!", resolve: scalar(func(parent any) any { return parent.(scanStatus).State })},
+		{name: "started", typ: "Time!", resolve: scalar(func(parent any) any { return parent.(scanStatus).Started })},
+		{name: "finished", typ: "Time", resolve: scalar(func(parent any) any {
+			if finished := parent.(scanStatus).Finished; finished != nil {
+				return *finished
+			}
+			return nil
+		})},
+		{name: "error", typ: "String", resolve: scalar(func(parent any) any {
+			if err := parent.(scanStatus).Error; err != "" {
+				return err
+			}
+			return nil
+		})},
+		{name: "files", typ: "Int!", resolve: scalar(func(parent any) any { return parent.(scanStatus).Files })},
+		{name: "errors", typ: "Int!", resolve: scalar(func(parent any) any { return parent.(scanStatus).Errors })},
+		{name: "bytes", typ: "BigInt!", resolve: scalar(func(parent any) any { return parent.(scanStatus).Bytes })},
+		{name: "lastPath", typ: "String", resolve: scalar(func(parent any) any {
+			if path := parent.(scanStatus).LastPath; path != "" {
+				return path
+			}
+			return nil
+		})},
+	}}
+
+	return &gqlSchema{
+		types:   []*gqlType{query, fileType, page("File"), dupeType, page("DupeSet"), historyType, page("HistoryEntry"), scanType},
+		scalars: []string{"BigInt", "Time"},
+	}
+}
+
+// serveGraphQL answers a GraphQL request, POSTed as JSON or given as the query, variables and operationName
+// parameters of a GET. Requests that can't be executed get a 400 with only errors.
+func serveGraphQL(w http.ResponseWriter, r *http.Request, schema *gqlSchema) {
+	var req gqlRequest
+	if r.Method == http.MethodGet {
+		query := r.URL.Query()
+		req.Query, req.OperationName = query.Get("query"), query.Get("operationName")
+		if variables := query.Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &req.Variables); err != nil {
+				writeGraphQLError(w, "invalid variables: "+err.Error())
+				return
+			}
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeGraphQLError(w, "invalid request: "+err.Error())
+		return
+	}
+	if req.Query == "" {
+		writeGraphQLError(w, "the request has no query")
+		return
+	}
+	response, err := executeGraphQL(r.Context(), schema, req)
+	if err != nil {
+		writeGraphQLError(w, err.Error())
+		return
+	}
+	writeJSON(w, response)
+}
+
+func writeGraphQLError(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(gqlResponse{Errors: []gqlError{{Message: message}}})
+}
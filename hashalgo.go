@@ -0,0 +1,22 @@
+package main
+
+import "fileindexer/pkg/indexer"
+
+// defaultHashAlgorithm is what --hash-algo defaults to, and what rows without a hash_algorithm were hashed with.
+const defaultHashAlgorithm = indexer.DefaultAlgorithm
+
+// hashAlgorithms are the content hashes --hash-algo accepts, those of the indexer package.
+var hashAlgorithms = indexer.Algorithms
+
+// privacyHashAlgorithm is recorded for privacy mode rows, whose hash column holds a keyed digest of the file name.
+const privacyHashAlgorithm = "hmac-sha256"
+
+// hash_algorithm was added after the tables were, so rows from before it have NULL there, meaning md5.
+const addHashAlgorithmColumnQuery = `
+ALTER TABLE file_hashes ADD COLUMN IF NOT EXISTS hash_algorithm TEXT;
+ALTER TABLE file_history ADD COLUMN IF NOT EXISTS hash_algorithm TEXT;
+`
+
+func hashAlgorithmNames() []string {
+	return indexer.AlgorithmNames()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+func init() {
+	// Registered here rather than in the commands literal, which runHelp and the scan usage refer to.
+	commands["help"] = subcommand{run: runHelp, summary: "CommandHelp"}
+	commands["scan"] = subcommand{run: runScanCommand, summary: "CommandScan"}
+	commands["verify"] = subcommand{run: runVerify, summary: "CommandVerify"}
+	commands["rescan"] = subcommand{run: runRescan, summary: "CommandRescan"}
+}
+
+// printScanUsage is the usage for running without a subcommand: the synopsis, the available commands and every scan
+// flag.
+func printScanUsage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, msg("ScanUsage", nil))
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-16s %s\n", name, msg(commands[name].summary, nil))
+	}
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, msg("ScanFlags", nil))
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, msg("HelpHint", nil))
+}
+
+// scanCommandUsage returns the usage of a command that takes the scan flags, such as verify: its synopsis followed by
+// the flags.
+func scanCommandUsage(synopsis string) func() {
+	return func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintln(out, msg(synopsis, nil))
+		fmt.Fprintln(out)
+		fmt.Fprintln(out, msg("ScanFlags", nil))
+	}
+}
+
+// commandUsage returns a flag.FlagSet Usage function printing the command's synopsis followed by its flags.
+func commandUsage(fs *flag.FlagSet, synopsis string) func() {
+	return func() {
+		fmt.Fprintln(fs.Output(), msg(synopsis, nil))
+		fs.PrintDefaults()
+	}
+}
+
+// usageError reports a problem with one flag along with that flag's own help, rather than the full usage, and exits
+// with status 2 like the flag package does.
+func usageError(fs *flag.FlagSet, name, problem string) {
+	out := fs.Output()
+	fmt.Fprintf(out, "%s\n", problem)
+	if f := fs.Lookup(name); f != nil {
+		fmt.Fprintf(out, "  --%s: %s\n", name, f.Usage)
+	}
+	helpCommand := "fileindexer --help"
+	if fs != flag.CommandLine {
+		helpCommand = "fileindexer help " + fs.Name()
+	}
+	fmt.Fprintln(out, msg("SeeHelp", map[string]any{"Command": helpCommand}))
+	os.Exit(2)
+}
+
+// runHelp shows the scan usage, or with a command name, that command's usage.
+func runHelp(args []string) {
+	if len(args) == 0 {
+		printScanUsage()
+		return
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintln(os.Stderr, msg("UnknownCommand", map[string]any{"Command": args[0]}))
+		os.Exit(2)
+	}
+	command.run([]string{"-help"})
+}
+
+// runExamples prints worked examples for the tasks the tool is most often used for.
+func runExamples(args []string) {
+	fs := flag.NewFlagSet("examples", flag.ContinueOnError)
+	fs.Usage = commandUsage(fs, "ExamplesUsage")
+	parseArgs(fs, args)
+	fmt.Println(msg("Examples", nil))
+}
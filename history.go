@@ -0,0 +1,131 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// file_history gets a row every time a file's hash is written to file_hashes, so past states of the index can be
+// reconstructed. Rows are never updated or deleted by the scan. A removed row records that the path's file_hashes row
+// went away other than by being marked deleted, when --detect-moves moved it or prune --delete deleted it, and
+// repeats its last state; the column was added after the table.
+const createFileHistoryTableQuery = `
+CREATE TABLE IF NOT EXISTS file_history (
+    id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    filepath TEXT NOT NULL,
+    hash TEXT NOT NULL,
+    size BIGINT NOT NULL,
+    file_timestamp TIMESTAMP NOT NULL,
+    recorded_timestamp TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS file_history_filepath_recorded ON file_history (filepath, recorded_timestamp);
+ALTER TABLE file_history ADD COLUMN IF NOT EXISTS removed BOOLEAN NOT NULL DEFAULT false;
+`
+
+// recordRemovalQuery adds the removed history row of the path $1 from its file_hashes row, which is about to be
+// renamed or deleted, at the UTC time $2.
+const recordRemovalQuery = `INSERT INTO file_history (filepath, hash, size, file_timestamp, recorded_timestamp, hash_algorithm, removed)
+SELECT filepath, hash, size, file_timestamp, $2, hash_algorithm, true FROM file_hashes WHERE filepath = $1`
+
+// queryTimeLayout is how timestamps are printed by query, in local time.
+const queryTimeLayout = "2006-01-02 15:04:05"
+
+// asOfLayouts are the accepted --as-of formats, tried in order. Times without a zone are local.
+var asOfLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+func parseAsOf(value string) (time.Time, error) {
+	for _, layout := range asOfLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected e.g. 2024-01-01 or 2024-01-01 15:04:05", value)
+}
+
+// runQuery prints the recorded state of indexed files at a point in time, or the full recorded history of one path.
+func runQuery(args []string) {
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	var dbCfg DBConfig
+	registerDBFlags(fs, &dbCfg)
+	asOf := fs.String("as-of", "", "Show the index as it was at this time (e.g. 2024-01-01 or 2024-01-01 15:04:05, local time). Defaults to now.")
+	path := fs.String("path", "", "Only show this stored path, or everything under it when it is a directory prefix.")
+	history := fs.Bool("history", false, "List every recorded version of --path instead of the state at --as-of.")
+	humanReadable := fs.Bool("human-readable", false, "Print sizes like 1.4GiB instead of in bytes.")
+	fs.Usage = commandUsage(fs, "QueryUsage")
+	parseArgs(fs, args)
+
+	if dbCfg.DbName == "" {
+		usageError(fs, "dbname", msg("MissingFlag", map[string]any{"Flag": "dbname"}))
+	}
+	if *history && *path == "" {
+		usageError(fs, "path", msg("MissingFlag", map[string]any{"Flag": "path"}))
+	}
+	at := time.Now()
+	if *asOf != "" {
+		var err error
+		if at, err = parseAsOf(*asOf); err != nil {
+			usageError(fs, "as-of", err.Error())
+		}
+	}
+
+	db := connectToDatabase(dbCfg)
+	defer db.Close()
+	if _, err := db.Exec(createFileHistoryTableQuery); err != nil {
+		log.Fatalf("Failed to create history table: %v", err)
+	}
+
+	pattern := likePrefix(*path)
+	var rows *sql.Rows
+	var err error
+	if *history {
+		rows, err = db.Query(`
+SELECT filepath, hash, size, file_timestamp, recorded_timestamp FROM file_history
+WHERE filepath = $1 AND recorded_timestamp <= $2 AND NOT removed
+ORDER BY recorded_timestamp, id`, *path, at.UTC())
+	} else {
+		// Files indexed before history was kept have no file_history rows; their current row is the best record of
+		// them, as long as it was written before the requested time.
+		rows, err = db.Query(`
+SELECT filepath, hash, size, file_timestamp, recorded_timestamp FROM (
+    SELECT DISTINCT ON (filepath) filepath, hash, size, file_timestamp, recorded_timestamp, removed FROM file_history
+    WHERE filepath LIKE $1 AND recorded_timestamp <= $2
+    ORDER BY filepath, recorded_timestamp DESC, id DESC
+) h
+WHERE NOT removed
+UNION ALL
+SELECT filepath, hash, size, file_timestamp, hash_calculated_timestamp FROM file_hashes f
+WHERE filepath LIKE $1 AND hash_calculated_timestamp <= $2
+AND NOT EXISTS (SELECT 1 FROM file_history h WHERE h.filepath = f.filepath)
+ORDER BY filepath`, pattern, at.UTC())
+	}
+	if err != nil {
+		log.Fatalf("Failed to query history: %v", err)
+	}
+	defer rows.Close()
+
+	writer := csv.NewWriter(os.Stdout)
+	defer writer.Flush()
+	writer.Write([]string{"filepath", "hash", "size", "file_timestamp", "recorded_timestamp"})
+	for rows.Next() {
+		var filepath, hash string
+		var size int64
+		var fileTimestamp, recorded time.Time
+		if err := rows.Scan(&filepath, &hash, &size, &fileTimestamp, &recorded); err != nil {
+			log.Fatalf("Failed to read history: %v", err)
+		}
+		// recorded_timestamp and hash_calculated_timestamp are in UTC, file_timestamp in local time; print both as
+		// local time.
+		recorded = recorded.In(time.Local)
+		if err := writer.Write([]string{filepath, hash, formatSize(size, *humanReadable), fileTimestamp.Format(queryTimeLayout), recorded.Format(queryTimeLayout)}); err != nil {
+			log.Fatalf("Failed to write results: %v", err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalf("Failed to read history: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// scanHooks holds the optional per-file checks enabled for a run. A nil field means the check is disabled.
+type scanHooks struct {
+	pii         *piiDetector
+	types       *typeReport
+	executables *executableReport
+	sbom        *sbomCollector
+	lineage     *lineageRecorder
+	manifests   *manifestWriter
+	policy      []statusRule
+
+	// tree is how the scan reads files, whose guard also checks their access times with --read-only-guarantee.
+	tree treeReader
+}
+
+// newScanHooks sets up whichever optional checks cfg enables, creating their tables and report files. The checks
+// read files through tree.
+func newScanHooks(cfg Config, db *sql.DB, tree treeReader) *scanHooks {
+	hooks := &scanHooks{policy: cfg.StatusPolicy, tree: tree}
+
+	var columns *columnCipher
+	if len(cfg.EncryptColumns) > 0 {
+		var err error
+		if columns, err = newColumnCipher(cfg.ColumnKey, cfg.EncryptColumns); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+
+	if cfg.DetectPII {
+		var err error
+		if hooks.pii, err = newPIIDetector(cfg.PIIPatterns, cfg.PIIMaxBytes); err != nil {
+			log.Fatalf("%v", err)
+		}
+		hooks.pii.columns = columns
+		if _, err := db.Exec(createPIITableQuery); err != nil {
+			log.Fatalf("Failed to create PII findings table: %v", err)
+		}
+	}
+
+	if cfg.CheckTypes {
+		hooks.types = &typeReport{}
+		if cfg.TypeReport != "" {
+			var err error
+			if hooks.types, err = newTypeReport(cfg.TypeReport, cfg.SafeCSV); err != nil {
+				log.Fatalf("Failed to create type report: %v", err)
+			}
+		}
+	}
+
+	if cfg.ExecutableReport != "" {
+		var err error
+		if hooks.executables, err = newExecutableReport(cfg.ExecutableReport, cfg.SafeCSV); err != nil {
+			log.Fatalf("Failed to create executable report: %v", err)
+		}
+	}
+
+	if cfg.SBOMOutput != "" {
+		hooks.sbom = newSBOMCollector(cfg.SBOMOutput, cfg.HashAlgorithm)
+	}
+
+	if cfg.RecordLineage {
+		var err error
+		if hooks.lineage, err = newLineageRecorder(db, columns); err != nil {
+			log.Fatalf("Failed to create lineage table: %v", err)
+		}
+	}
+
+	if cfg.WriteManifests {
+		hooks.manifests = newManifestWriter(cfg)
+	}
+
+	return hooks
+}
+
+// inspect runs the checks that look at a file after it has been hashed, then the --status-policy rules, returning any
+// status suffixes to append. With --read-only-guarantee the file's access time is checked once nothing reads it any
+// more, and before the rules, so that they can match +atime-changed.
+func (h *scanHooks) inspect(path, storedPath, hash string, size int64, status string, info os.FileInfo) (string, error) {
+	suffix, err := h.checkContents(path, storedPath, hash, size, status)
+	if err != nil {
+		return "", err
+	}
+	if h.tree.readOnly != nil {
+		suffix += h.tree.readOnly.check(path, info)
+	}
+	return suffix + applyStatusPolicy(h.policy, storedPath, size, status+suffix), nil
+}
+
+// checkContents runs the checks that look at a file after it has been hashed, returning any status suffixes to append.
+func (h *scanHooks) checkContents(path, storedPath, hash string, size int64, status string) (string, error) {
+	if h.lineage != nil && strings.HasPrefix(status, "new") {
+		if err := retryDB(h.lineage.db, "lineage for "+storedPath, func() error { return h.lineage.record(storedPath, hash, size) }); err != nil {
+			return "", fmt.Errorf("failed to record lineage: %v", err)
+		}
+	}
+	if h.manifests != nil {
+		h.manifests.record(path, hash, status)
+	}
+	if h.types == nil && h.executables == nil && h.sbom == nil {
+		return "", nil
+	}
+
+	head, err := readHead(h.tree, path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file type for %s: %v", path, err)
+	}
+
+	var suffix string
+	if h.types != nil {
+		if suffix, err = h.types.checkFileType(path, storedPath, head); err != nil {
+			return "", err
+		}
+	}
+	if h.executables != nil {
+		if err := h.executables.record(storedPath, hash, size, head); err != nil {
+			return "", err
+		}
+	}
+	if h.sbom != nil {
+		h.sbom.record(storedPath, hash, size, head)
+	}
+	return suffix, nil
+}
+
+// finish closes report files and logs a one-line summary per enabled check.
+func (h *scanHooks) finish() {
+	if h.types != nil {
+		if err := h.types.Close(); err != nil {
+			log.Printf("Failed to write type report: %v", err)
+		}
+		log.Print(msg("TypeCheckSummary", map[string]any{"Count": h.types.count}))
+	}
+	if h.executables != nil {
+		if err := h.executables.Close(); err != nil {
+			log.Printf("Failed to write executable report: %v", err)
+		}
+		log.Print(msg("ExecutableSummary", map[string]any{"Count": h.executables.count}))
+	}
+	if h.sbom != nil {
+		if err := h.sbom.write(); err != nil {
+			log.Printf("Failed to write SBOM %s: %v", h.sbom.path, err)
+		} else {
+			log.Print(msg("SBOMWritten", map[string]any{"Count": len(h.sbom.components), "Path": h.sbom.path}))
+		}
+	}
+	if h.lineage != nil {
+		log.Print(msg("LineageSummary", map[string]any{"Count": h.lineage.count.Load()}))
+	}
+	if h.pii != nil {
+		log.Print(msg("PIISummary", map[string]any{"Count": h.pii.flaggedFiles.Load()}))
+	}
+}
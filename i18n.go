@@ -0,0 +1,72 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	"golang.org/x/text/language"
+)
+
+// Message catalogs, one file per locale named after its language tag. English is the source of truth: a message
+// missing from another catalog falls back to it.
+//
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+var (
+	localizerOnce sync.Once
+	localizer     *i18n.Localizer
+)
+
+// userLanguages returns the locales to try, from FILEINDEXER_LANG or the usual POSIX locale variables.
+func userLanguages() []string {
+	for _, name := range []string{"FILEINDEXER_LANG", "LC_ALL", "LC_MESSAGES", "LANG"} {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		// de_DE.UTF-8@euro -> de-DE; C and POSIX mean "no translation".
+		value, _, _ = strings.Cut(value, ".")
+		value, _, _ = strings.Cut(value, "@")
+		if value == "C" || value == "POSIX" {
+			return nil
+		}
+		return []string{strings.ReplaceAll(value, "_", "-")}
+	}
+	return nil
+}
+
+func loadLocalizer() *i18n.Localizer {
+	localizerOnce.Do(func() {
+		bundle := i18n.NewBundle(language.English)
+		bundle.RegisterUnmarshalFunc("json", json.Unmarshal)
+		entries, err := localeFiles.ReadDir("locales")
+		if err != nil {
+			log.Fatalf("Failed to read message catalogs: %v", err)
+		}
+		for _, entry := range entries {
+			if _, err := bundle.LoadMessageFileFS(localeFiles, "locales/"+entry.Name()); err != nil {
+				log.Fatalf("Failed to load message catalog %s: %v", entry.Name(), err)
+			}
+		}
+		localizer = i18n.NewLocalizer(bundle, userLanguages()...)
+	})
+	return localizer
+}
+
+// msg returns the user-facing message id in the operator's language, filling in data as template fields. Only text
+// meant for people goes through here; debug logging stays in English so it can be searched for.
+func msg(id string, data map[string]any) string {
+	// An untranslated message comes back in English along with a not-found error, which is fine.
+	text, err := loadLocalizer().Localize(&i18n.LocalizeConfig{MessageID: id, TemplateData: data})
+	if text == "" {
+		log.Printf("Missing message %s: %v", id, err)
+		return id
+	}
+	return text
+}
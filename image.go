@@ -0,0 +1,231 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"fileindexer/pkg/indexer"
+)
+
+// disk_partitions holds the partition layout found by image --partitions, replaced each time the disk is hashed.
+// image_path is the stored path of the disk; each partition's hash is in file_hashes under image_path#p<number>.
+const createDiskPartitionsTableQuery = `
+CREATE TABLE IF NOT EXISTS disk_partitions (
+    image_path TEXT NOT NULL,
+    partition_number INTEGER NOT NULL,
+    scheme TEXT NOT NULL,
+    start_offset BIGINT NOT NULL,
+    size BIGINT NOT NULL,
+    partition_type TEXT NOT NULL,
+    name TEXT,
+    filesystem TEXT,
+    recorded_timestamp TIMESTAMP NOT NULL,
+    PRIMARY KEY (image_path, partition_number)
+);
+`
+
+// defaultImageChunkSize is image's --chunk-size.
+const defaultImageChunkSize = "4MiB"
+
+// partitionPath is the stored path of a partition of the disk stored as diskPath.
+func partitionPath(diskPath string, number int) string {
+	return diskPath + "#p" + strconv.Itoa(number)
+}
+
+// runImage hashes block devices and disk images whole, in chunks, like a scan with --chunk-size does a file, and
+// with --partitions each partition found in their partition table too. Filesystems are recognized but not read.
+func runImage(args []string) {
+	fs := flag.NewFlagSet("image", flag.ContinueOnError)
+	var dbCfg DBConfig
+	registerDBFlags(fs, &dbCfg)
+	prefix := fs.String("prefix", "", "Prefix to remove from the disk paths before storing them.")
+	hashAlgo := fs.String("hash-algo", defaultHashAlgorithm, fmt.Sprintf("Hash algorithm, one of %v.", hashAlgorithmNames()))
+	chunkSize := fs.String("chunk-size", defaultImageChunkSize, "Hash the disks in chunks of this size, recorded in file_chunks, so a later run names the regions that changed.")
+	partitions := fs.Bool("partitions", false, "Also hash each partition of the disks' GPT or MBR partition table, recording the layout in disk_partitions.")
+	outputFile := fs.String("output", fmt.Sprintf("%s_image_results.csv", time.Now().Format("2006-01-02T15.04.05.000")), "The path to the CSV file to output the results to.")
+	fs.Usage = commandUsage(fs, "ImageUsage")
+	parseArgs(fs, args)
+
+	if fs.NArg() == 0 {
+		usageError(fs, "", msg("ImageUsage", nil))
+	}
+	if dbCfg.DbName == "" {
+		usageError(fs, "dbname", msg("MissingFlag", map[string]any{"Flag": "dbname"}))
+	}
+	if _, ok := hashAlgorithms[*hashAlgo]; !ok {
+		usageError(fs, "hash-algo", fmt.Sprintf("Invalid --hash-algo %q, expected one of %v.", *hashAlgo, hashAlgorithmNames()))
+	}
+	chunkBytes, err := parseByteSize(*chunkSize)
+	if err != nil || chunkBytes < minChunkSize {
+		usageError(fs, "chunk-size", fmt.Sprintf("Invalid --chunk-size %q, expected a size of at least 4KiB like 4MiB.", *chunkSize))
+	}
+	algorithm := chunkedAlgorithmName(*hashAlgo, chunkBytes)
+
+	db := connectToDatabase(dbCfg)
+	defer db.Close()
+	createScanTables(Config{ChunkSize: chunkBytes}, db)
+	if *partitions {
+		if _, err := db.Exec(createDiskPartitionsTableQuery); err != nil {
+			log.Fatalf("Failed to create disk partitions table: %v", err)
+		}
+	}
+
+	// Each disk is a scan run of its own, finished once the results file they share is written.
+	writer, output := createOutputWriter(*outputFile, "csv", false)
+	var runs []rootRun
+	failed := 0
+	for _, arg := range fs.Args() {
+		path, err := filepath.Abs(arg)
+		if err != nil {
+			log.Fatalf("Failed to resolve %s: %v", arg, err)
+		}
+		cfg := Config{Directory: path, Prefix: *prefix, OutputFile: *outputFile}
+		counts := &runCounts{}
+		id, err := startScanRun(db, cfg)
+		if err != nil {
+			log.Fatalf("Failed to record scan run: %v", err)
+		}
+		runs = append(runs, rootRun{cfg: cfg, id: id, counts: counts})
+		writtenBy := newScanEpoch(db, id, "run_id")
+		write := func(row []string) {
+			counts.tally(row[3])
+			if wroteRecord(row[3]) {
+				writtenBy.mark(row[0])
+			}
+			if err := writer.Write(row); err != nil {
+				log.Printf("Failed to write result for %s: %v", row[0], err)
+			}
+		}
+		if err := hashDisk(db, path, storedPathFor(cfg, path), algorithm, *partitions, write); err != nil {
+			log.Printf("Failed to hash %s: %v", path, err)
+			write([]string{storedPathFor(cfg, path), "", "0", "error: " + err.Error()})
+			failed++
+		}
+		writtenBy.flush()
+	}
+	if err := finalizeOutput(writer, output, *outputFile); err != nil {
+		log.Fatalf("Failed to write %s: %v", *outputFile, err)
+	}
+	for _, run := range runs {
+		if err := finishScanRun(db, run.id, run.cfg, run.counts); err != nil {
+			log.Printf("Failed to record the end of scan run %d: %v", run.id, err)
+		}
+	}
+	log.Print(msg("ScanCompleted", map[string]any{"Output": *outputFile}))
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// hashDisk hashes the block device or disk image at path, stored as storedPath, and with partitions each partition
+// in its partition table, passing a results row for each to write.
+func hashDisk(db *sql.DB, path, storedPath, algorithm string, partitions bool, write func(row []string)) error {
+	disk, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer disk.Close()
+	info, err := disk.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory; scan it instead", path)
+	}
+	// A block device's size is only known by seeking to its end.
+	size, err := disk.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("failed to find the size of %s: %v", path, err)
+	}
+
+	if err := hashDiskRange(db, io.NewSectionReader(disk, 0, size), storedPath, algorithm, size, info.ModTime(), write); err != nil {
+		return err
+	}
+	if !partitions {
+		if fs := filesystemMagic(disk, 0); fs != "" {
+			log.Print(msg("ImageFilesystem", map[string]any{"Path": path, "Filesystem": fs, "Offset": 0}))
+		}
+		return nil
+	}
+
+	found, err := readPartitions(disk, size)
+	if err != nil {
+		return fmt.Errorf("failed to read the partition table of %s: %v", path, err)
+	}
+	if len(found) == 0 {
+		log.Print(msg("ImageNoPartitions", map[string]any{"Path": path, "Filesystem": filesystemMagic(disk, 0)}))
+	}
+	for i := range found {
+		partition := &found[i]
+		// The logical partitions an extended partition holds are hashed on their own.
+		if partition.Extended {
+			continue
+		}
+		partition.Filesystem = filesystemMagic(disk, partition.Offset)
+		if partition.Filesystem != "" {
+			log.Print(msg("ImageFilesystem", map[string]any{"Path": partitionPath(path, partition.Number), "Filesystem": partition.Filesystem, "Offset": partition.Offset}))
+		}
+		reader := io.NewSectionReader(disk, partition.Offset, partition.Size)
+		if err := hashDiskRange(db, reader, partitionPath(storedPath, partition.Number), algorithm, partition.Size, info.ModTime(), write); err != nil {
+			return err
+		}
+	}
+	return retryDB(db, "partitions of "+storedPath, func() error { return recordPartitions(db, storedPath, found) })
+}
+
+// hashDiskRange hashes size bytes from reader in chunks and writes the record of storedPath and its chunks, logging
+// the regions that changed since they were recorded.
+func hashDiskRange(db *sql.DB, reader io.Reader, storedPath, algorithm string, size int64, modified time.Time, write func(row []string)) error {
+	base, chunkSize, _ := chunkedAlgorithm(algorithm)
+	hash, chunks, err := indexer.HashChunks(reader, base, chunkSize)
+	if err != nil {
+		return err
+	}
+	var regions [][2]int64
+	err = retryDB(db, "chunks of "+storedPath, func() error {
+		var err error
+		regions, err = recordChunks(db, storedPath, chunkSize, chunks)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record chunk digests: %v", err)
+	}
+	logChangedRegions(storedPath, regions)
+	status, err := upsertFileRecord(db, nil, storedPath, hash, algorithm, size, modified, false)
+	if err != nil {
+		return fmt.Errorf("failed to write record for %s: %v", storedPath, err)
+	}
+	log.Printf("Path: %s Hash: %s, Size: %d, Status: %s", storedPath, hash, size, status)
+	write([]string{storedPath, hash, strconv.FormatInt(size, 10), status})
+	return nil
+}
+
+// recordPartitions replaces the partitions recorded for the disk stored as storedPath.
+func recordPartitions(db *sql.DB, storedPath string, partitions []diskPartition) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM disk_partitions WHERE image_path = $1", storedPath); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, p := range partitions {
+		_, err := tx.Exec(`
+INSERT INTO disk_partitions (image_path, partition_number, scheme, start_offset, size, partition_type, name, filesystem, recorded_timestamp)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+			storedPath, p.Number, p.Scheme, p.Offset, p.Size, p.Type, nullString(p.Name), nullString(p.Filesystem), now)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const createDirectoryMtimesTableQuery = `
+CREATE TABLE IF NOT EXISTS directory_mtimes (
+    dirpath TEXT PRIMARY KEY,
+    mtime TIMESTAMP NOT NULL,
+    child_count INTEGER NOT NULL
+);
+`
+
+type dirState struct {
+	mtime      time.Time
+	childCount int
+}
+
+// dirTracker implements --incremental. A directory's mtime only changes when entries are added, removed or renamed,
+// so files directly inside a directory whose mtime and entry count match the previous scan are skipped. Its
+// subdirectories are still visited, since their changes don't touch the parent's mtime. Files modified in place are
+// not noticed, which is why this is opt-in and periodic full scans are still needed.
+type dirTracker struct {
+	db        *sql.DB
+	unchanged map[string]bool
+
+	mu      sync.Mutex
+	pending map[string]dirState
+	dirOf   map[string]string
+	failed  map[string]bool
+	skipped int
+}
+
+func newDirTracker(db *sql.DB) (*dirTracker, error) {
+	if _, err := db.Exec(createDirectoryMtimesTableQuery); err != nil {
+		return nil, err
+	}
+	return &dirTracker{
+		db:        db,
+		unchanged: make(map[string]bool),
+		pending:   make(map[string]dirState),
+		dirOf:     make(map[string]string),
+		failed:    make(map[string]bool),
+	}, nil
+}
+
+// visitDir compares a directory with its state from the previous scan. Changed directories are remembered and only
+// saved once the scan completes, so an interrupted scan never causes files to be skipped next time.
+func (t *dirTracker) visitDir(path, storedDir string, info os.FileInfo) error {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	// TIMESTAMP columns hold microseconds in UTC here, so compare at that precision.
+	current := dirState{mtime: info.ModTime().UTC().Truncate(time.Microsecond), childCount: len(entries)}
+
+	var previous dirState
+	err = t.db.QueryRow("SELECT mtime, child_count FROM directory_mtimes WHERE dirpath = $1", storedDir).Scan(&previous.mtime, &previous.childCount)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if err == nil && previous.mtime.Equal(current.mtime) && previous.childCount == current.childCount {
+		t.unchanged[path] = true
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending[storedDir] = current
+	t.dirOf[path] = storedDir
+	return nil
+}
+
+// skipFile reports whether the file sits directly in a directory unchanged since the previous scan.
+func (t *dirTracker) skipFile(path string) bool {
+	if !t.unchanged[filepath.Dir(path)] {
+		return false
+	}
+	t.skipped++
+	return true
+}
+
+// markFailed keeps the file's directory from being recorded, so the failed file is retried on the next scan.
+func (t *dirTracker) markFailed(path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failed[filepath.Dir(path)] = true
+}
+
+// save records the state of every changed directory whose files were all processed successfully.
+func (t *dirTracker) save() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tx, err := t.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for path, storedDir := range t.dirOf {
+		if t.failed[path] {
+			continue
+		}
+		state := t.pending[storedDir]
+		if _, err := tx.Exec(`
+INSERT INTO directory_mtimes (dirpath, mtime, child_count) VALUES ($1, $2, $3)
+ON CONFLICT (dirpath) DO UPDATE SET mtime = EXCLUDED.mtime, child_count = EXCLUDED.child_count`, storedDir, state.mtime, state.childCount); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
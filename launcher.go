@@ -0,0 +1,398 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scanLauncher starts scans requested over the API as child processes of serve, at most one per directory at a time.
+// Only directories under one of roots (absolute, with symlinks resolved) may be scanned, whatever token asked: without
+// --require-token the API has no authentication at all. prefixes are the --scan-prefix of roots, the only prefix the
+// scans of a root strip; a root without one has its paths stored unchanged.
+type scanLauncher struct {
+	roots    []string
+	prefixes map[string]string
+	dbCfg    DBConfig
+	// bandwidth is the --scan-bandwidth the running scans share, in megabytes per second, or 0 for no limit. weights
+	// are the --scan-weight of roots; a root without one has weight 1.
+	bandwidth float64
+	weights   map[string]float64
+
+	mu      sync.Mutex
+	running map[string]*launchedScan
+	// scans are the running scans and the last maxFinishedScans finished ones by ID, for GET /scans/{id}.
+	scans map[string]*launchedScan
+}
+
+// maxFinishedScans is how many finished scans the launcher remembers; older ones are forgotten as others finish.
+const maxFinishedScans = 100
+
+// launchedScan is a scan of a directory under root. rateFile is its --max-read-mbps-file with a bandwidth, and stored
+// the stored path prefix of its directory, which a token's namespace must cover for it to see the scan. Its fields
+// are guarded by the launcher's mutex.
+type launchedScan struct {
+	root      string
+	rateFile  string
+	stored    string
+	process   *os.Process
+	cancelled bool
+	status    scanStatus
+}
+
+// scanStatus is a launched scan as GET /scans/{id} reports it. State is running, cancelling (until the scan has
+// written out its results), finished, failed or cancelled; the counts are of the files the scan has finished so far,
+// from its --status-stream.
+type scanStatus struct {
+	ID        string     `json:"id"`
+	Directory string     `json:"directory"`
+	PID       int        `json:"pid"`
+	State     string     `json:"state"`
+	Started   time.Time  `json:"started"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Files     int        `json:"files"`
+	Errors    int        `json:"errors"`
+	Bytes     int64      `json:"bytes"`
+	LastPath  string     `json:"last_path,omitempty"`
+}
+
+func newScanLauncher(roots []string, prefixes map[string]string, dbCfg DBConfig, bandwidth float64, weights map[string]float64) *scanLauncher {
+	return &scanLauncher{roots: roots, prefixes: prefixes, dbCfg: dbCfg, bandwidth: bandwidth, weights: weights,
+		running: make(map[string]*launchedScan), scans: make(map[string]*launchedScan)}
+}
+
+// errScanRunning is returned by start for a directory that is already being scanned, errOutsideNamespace for one
+// whose stored paths the token doesn't cover, and errScanNotRunning by cancel for a scan that has already ended.
+var (
+	errScanRunning      = errors.New("a scan of this directory is already running")
+	errOutsideNamespace = errors.New("the directory's stored paths would be outside the token's namespace")
+	errScanNotRunning   = errors.New("the scan isn't running")
+)
+
+// rootOf returns the innermost of the roots that directory is or is inside, or "" if there is none.
+func (l *scanLauncher) rootOf(directory string) string {
+	var innermost string
+	for _, root := range l.roots {
+		if within(directory, root) && len(root) > len(innermost) {
+			innermost = root
+		}
+	}
+	return innermost
+}
+
+func (l *scanLauncher) weight(root string) float64 {
+	if weight, ok := l.weights[root]; ok {
+		return weight
+	}
+	return 1
+}
+
+// rebalance shares the bandwidth between the running scans, with l.mu held. Each root with scans running gets a part
+// in proportion to its weight, split evenly between its scans, so a root with many scans, or with much to hash, can't
+// take the share of the others. The scans pick up their new rates within rateFileInterval.
+func (l *scanLauncher) rebalance() {
+	if l.bandwidth <= 0 {
+		return
+	}
+	scans := make(map[string]int)
+	for _, scan := range l.running {
+		scans[scan.root]++
+	}
+	var total float64
+	for root := range scans {
+		total += l.weight(root)
+	}
+	for directory, scan := range l.running {
+		rate := l.bandwidth * l.weight(scan.root) / total / float64(scans[scan.root])
+		if err := writeRateFile(scan.rateFile, rate); err != nil {
+			log.Printf("Failed to set the read rate of the scan of %s: %v", directory, err)
+		}
+	}
+}
+
+// finished records how the scan of directory ended, forgets it as running and gives its bandwidth to the others.
+func (l *scanLauncher) finished(directory string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	scan := l.running[directory]
+	if scan == nil {
+		return
+	}
+	if scan.rateFile != "" {
+		os.Remove(scan.rateFile)
+	}
+	delete(l.running, directory)
+	l.rebalance()
+
+	now := time.Now()
+	scan.status.Finished = &now
+	switch {
+	case scan.cancelled:
+		scan.status.State = "cancelled"
+		log.Printf("Scan %s of %s cancelled", scan.status.ID, directory)
+	case err != nil:
+		scan.status.State, scan.status.Error = "failed", err.Error()
+		log.Printf("Scan %s of %s failed: %v", scan.status.ID, directory, err)
+	default:
+		scan.status.State = "finished"
+		log.Printf("Scan %s of %s finished", scan.status.ID, directory)
+	}
+	// The oldest finished scans are forgotten first.
+	var ended []*launchedScan
+	for _, scan := range l.scans {
+		if scan.status.Finished != nil {
+			ended = append(ended, scan)
+		}
+	}
+	slices.SortFunc(ended, func(a, b *launchedScan) int { return a.status.Finished.Compare(*b.status.Finished) })
+	for _, scan := range ended[:max(0, len(ended)-maxFinishedScans)] {
+		delete(l.scans, scan.status.ID)
+	}
+}
+
+// start runs a scan of directory for token, stripping the --scan-prefix of its root from stored paths, and returns its
+// status. prefix is the one the request named, if any, which must be that same --scan-prefix. The scan writes its log
+// to serve's and its results file to serve's working directory, and records itself in scan_runs like any other.
+func (l *scanLauncher) start(directory, prefix string, token apiToken) (scanStatus, error) {
+	if !filepath.IsAbs(directory) {
+		return scanStatus{}, fmt.Errorf("directory %q isn't absolute", directory)
+	}
+	directory = filepath.Clean(directory)
+	// Symlinks are resolved so they can't lead out of the roots.
+	resolved, err := filepath.EvalSymlinks(directory)
+	if err != nil {
+		return scanStatus{}, err
+	}
+	root := l.rootOf(resolved)
+	if root == "" {
+		return scanStatus{}, fmt.Errorf("directory %q isn't under a --scan-root", directory)
+	}
+	// The prefix comes from the server: one chosen by the client could map a directory outside the token's namespace
+	// onto stored paths inside it, overwriting the records there. The scan writes and marks deleted only stored paths
+	// under the directory's, so the namespace has to cover those.
+	scanPrefix := l.prefixes[root]
+	if prefix != "" && prefix != scanPrefix {
+		return scanStatus{}, fmt.Errorf("prefix %q isn't the --scan-prefix of %s", prefix, root)
+	}
+	stored := namespacePrefix(storedPathFor(Config{Prefix: scanPrefix}, directory))
+	if !token.covers(stored) {
+		return scanStatus{}, errOutsideNamespace
+	}
+	if info, err := os.Stat(resolved); err != nil {
+		return scanStatus{}, err
+	} else if !info.IsDir() {
+		return scanStatus{}, fmt.Errorf("%s isn't a directory", directory)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.running[directory] != nil {
+		return scanStatus{}, errScanRunning
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return scanStatus{}, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return scanStatus{}, err
+	}
+	args := []string{"--directory", directory, "--dbname", l.dbCfg.DbName}
+	for name, value := range map[string]string{"dbuser": l.dbCfg.DbUser, "dbhost": l.dbCfg.DbHost, "dbport": l.dbCfg.DbPort, "prefix": scanPrefix} {
+		if value != "" {
+			args = append(args, "--"+name, value)
+		}
+	}
+	// The new scan's share is written before it starts, and the others' shrink to make room for it.
+	scan := &launchedScan{root: root, stored: stored}
+	scan.status = scanStatus{ID: hex.EncodeToString(id), Directory: directory, State: "running", Started: time.Now()}
+	if l.bandwidth > 0 {
+		file, err := os.CreateTemp("", "fileindexer-rate-*")
+		if err != nil {
+			return scanStatus{}, err
+		}
+		file.Close()
+		scan.rateFile = file.Name()
+		args = append(args, "--max-read-mbps-file", scan.rateFile)
+	}
+
+	// Progress comes from the scan's --status-stream on a pipe, which Windows can't hand a child as an extra file;
+	// there, a scan's counts stay at zero.
+	var progress, progressWriter *os.File
+	if runtime.GOOS != "windows" {
+		if progress, progressWriter, err = os.Pipe(); err != nil {
+			os.Remove(scan.rateFile)
+			return scanStatus{}, err
+		}
+		// The child has its own copy; closing this one lets the stream end when the child exits.
+		defer progressWriter.Close()
+		args = append(args, "--status-stream", "3")
+	}
+	cmd := exec.Command(executable, args...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if progressWriter != nil {
+		cmd.ExtraFiles = []*os.File{progressWriter}
+	}
+	if err := cmd.Start(); err != nil {
+		os.Remove(scan.rateFile)
+		if progress != nil {
+			progress.Close()
+		}
+		return scanStatus{}, err
+	}
+	scan.process, scan.status.PID = cmd.Process, cmd.Process.Pid
+	l.running[directory] = scan
+	l.scans[scan.status.ID] = scan
+	l.rebalance()
+	log.Printf("Started scan %s of %s (pid %d)", scan.status.ID, directory, cmd.Process.Pid)
+
+	go func() {
+		if progress != nil {
+			l.follow(scan, progress)
+			progress.Close()
+		}
+		l.finished(directory, cmd.Wait())
+	}()
+	return scan.status, nil
+}
+
+// follow counts the files scan reports done on its status stream until the scan closes it by exiting.
+func (l *scanLauncher) follow(scan *launchedScan, stream io.Reader) {
+	decoder := json.NewDecoder(stream)
+	for {
+		var event statusEvent
+		if err := decoder.Decode(&event); err != nil {
+			return
+		}
+		l.mu.Lock()
+		switch event.Event {
+		case "file-done":
+			scan.status.Files++
+			scan.status.LastPath = event.Path
+			if event.Size != nil {
+				scan.status.Bytes += *event.Size
+			}
+		case "error":
+			scan.status.Files++
+			scan.status.Errors++
+		}
+		l.mu.Unlock()
+	}
+}
+
+// status returns the status of scan id if token may see it.
+func (l *scanLauncher) status(id string, token apiToken) (scanStatus, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	scan := l.scans[id]
+	if scan == nil || !token.covers(scan.stored) {
+		return scanStatus{}, false
+	}
+	return scan.status, true
+}
+
+// list returns the scans token may see, the most recently started first.
+func (l *scanLauncher) list(token apiToken) []scanStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	scans := []scanStatus{}
+	for _, scan := range l.scans {
+		if token.covers(scan.stored) {
+			scans = append(scans, scan.status)
+		}
+	}
+	slices.SortFunc(scans, func(a, b scanStatus) int { return b.Started.Compare(a.Started) })
+	return scans
+}
+
+// cancel interrupts scan id the way SIGINT does, which cancels the context its workers hash under: the files being
+// hashed are finished, the results written and the run left for --resume. On Windows, which has no SIGINT to send,
+// the scan is killed instead. It returns false if token may not see the scan.
+func (l *scanLauncher) cancel(id string, token apiToken) (scanStatus, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	scan := l.scans[id]
+	if scan == nil || !token.covers(scan.stored) {
+		return scanStatus{}, false, nil
+	}
+	if scan.status.Finished != nil {
+		return scan.status, true, errScanNotRunning
+	}
+	if !scan.cancelled {
+		if err := scan.process.Signal(os.Interrupt); err != nil {
+			if err := scan.process.Kill(); err != nil {
+				return scan.status, true, err
+			}
+		}
+		scan.cancelled, scan.status.State = true, "cancelling"
+		log.Printf("Cancelling scan %s of %s", id, scan.status.Directory)
+	}
+	return scan.status, true, nil
+}
+
+// parseScanWeights parses --scan-weight root=weight values into weights by resolved root, each of which must be one of
+// roots.
+func parseScanWeights(values []string, roots []string) (map[string]float64, error) {
+	weights := make(map[string]float64)
+	for _, value := range values {
+		root, number, err := splitScanRootValue("scan-weight", "root=weight", value, roots)
+		if err != nil {
+			return nil, err
+		}
+		weight, err := strconv.ParseFloat(number, 64)
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("Invalid --scan-weight %q, the weight must be a positive number.", value)
+		}
+		weights[root] = weight
+	}
+	return weights, nil
+}
+
+// parseScanPrefixes parses --scan-prefix root=prefix values into prefixes by resolved root, each of which must be one
+// of roots and have at most one.
+func parseScanPrefixes(values []string, roots []string) (map[string]string, error) {
+	prefixes := make(map[string]string)
+	for _, value := range values {
+		root, prefix, err := splitScanRootValue("scan-prefix", "root=prefix", value, roots)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := prefixes[root]; ok {
+			return nil, fmt.Errorf("Invalid --scan-prefix %q, %s already has a --scan-prefix.", value, root)
+		}
+		prefixes[root] = prefix
+	}
+	return prefixes, nil
+}
+
+// splitScanRootValue splits value, given to --name as form, at its first =, into the root before it, resolved, and
+// the rest. The root must be one of roots.
+func splitScanRootValue(name, form, value string, roots []string) (string, string, error) {
+	root, rest, ok := strings.Cut(value, "=")
+	if !ok {
+		return "", "", fmt.Errorf("Invalid --%s %q, expected %s.", name, value, form)
+	}
+	abs, err := filepath.Abs(root)
+	if err == nil {
+		abs, err = filepath.EvalSymlinks(abs)
+	}
+	if err != nil || !slices.Contains(roots, abs) {
+		return "", "", fmt.Errorf("Invalid --%s %q, %s isn't a --scan-root.", name, value, root)
+	}
+	return abs, rest, nil
+}
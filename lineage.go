@@ -0,0 +1,146 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"flag"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// file_lineage links a newly indexed file to an already indexed file with the same contents, its likely source.
+// The hash index makes the per-file lookup cheap; building it on an existing large file_hashes takes a while, once.
+const createLineageTableQuery = `
+CREATE TABLE IF NOT EXISTS file_lineage (
+    id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    filepath TEXT NOT NULL,
+    source_filepath TEXT NOT NULL,
+    hash TEXT NOT NULL,
+    host TEXT NOT NULL,
+    detected_timestamp TIMESTAMP NOT NULL,
+    UNIQUE (filepath, source_filepath)
+);
+CREATE INDEX IF NOT EXISTS file_hashes_hash ON file_hashes (hash);
+`
+
+// lineageRecorder records copied-from candidates for files that are new to the index.
+type lineageRecorder struct {
+	db    *sql.DB
+	host  string
+	count atomic.Int64
+}
+
+// newLineageRecorder returns a lineageRecorder on db, which records the host name encrypted with columns unless it is
+// nil.
+func newLineageRecorder(db *sql.DB, columns *columnCipher) (*lineageRecorder, error) {
+	if _, err := db.Exec(createLineageTableQuery); err != nil {
+		return nil, err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	if columns != nil {
+		host = columns.seal("file_lineage.host", host)
+	}
+	return &lineageRecorder{db: db, host: host}, nil
+}
+
+// record links storedPath to the earliest indexed file with the same hash and size, if there is one. The earliest
+// copy is the best guess at the original; later copies may themselves have been made from it.
+func (l *lineageRecorder) record(storedPath, hash string, size int64) error {
+	result, err := l.db.Exec(`
+INSERT INTO file_lineage (filepath, source_filepath, hash, host, detected_timestamp)
+SELECT $1::text, filepath, hash, $3, $4 FROM file_hashes
+WHERE hash = $2 AND size = $5 AND filepath <> $1::text
+ORDER BY hash_calculated_timestamp, filepath
+LIMIT 1
+ON CONFLICT (filepath, source_filepath) DO NOTHING`, storedPath, hash, l.host, time.Now().UTC(), size)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		l.count.Add(1)
+	}
+	return nil
+}
+
+// runLineage prints the recorded copy chain of a stored path: where it came from, recursively, and what was copied
+// from it.
+func runLineage(args []string) {
+	fs := flag.NewFlagSet("lineage", flag.ContinueOnError)
+	var dbCfg DBConfig
+	registerDBFlags(fs, &dbCfg)
+	path := fs.String("path", "", "Stored path to trace. Required.")
+	fs.Usage = commandUsage(fs, "LineageUsage")
+	parseArgs(fs, args)
+
+	for _, name := range []string{"dbname", "path"} {
+		if fs.Lookup(name).Value.String() == "" {
+			usageError(fs, name, msg("MissingFlag", map[string]any{"Flag": name}))
+		}
+	}
+
+	db := connectToDatabase(dbCfg)
+	defer db.Close()
+	if _, err := db.Exec(createLineageTableQuery); err != nil {
+		log.Fatalf("Failed to create lineage table: %v", err)
+	}
+
+	// Sources are followed upwards and copies downwards; UNION (not UNION ALL) stops at cycles, which can appear when
+	// files are copied back to where they came from.
+	rows, err := db.Query(`
+WITH RECURSIVE
+sources AS (
+    SELECT filepath, source_filepath, host, detected_timestamp FROM file_lineage WHERE filepath = $1
+    UNION
+    SELECT l.filepath, l.source_filepath, l.host, l.detected_timestamp FROM file_lineage l
+    JOIN sources s ON l.filepath = s.source_filepath
+),
+copies AS (
+    SELECT filepath, source_filepath, host, detected_timestamp FROM file_lineage WHERE source_filepath = $1
+    UNION
+    SELECT l.filepath, l.source_filepath, l.host, l.detected_timestamp FROM file_lineage l
+    JOIN copies c ON l.source_filepath = c.filepath
+)
+SELECT 'source', * FROM sources
+UNION ALL
+SELECT 'copy', * FROM copies
+ORDER BY 5`, *path)
+	if err != nil {
+		log.Fatalf("Failed to query lineage: %v", err)
+	}
+	defer rows.Close()
+
+	writer := csv.NewWriter(os.Stdout)
+	defer writer.Flush()
+	writer.Write([]string{"relation", "filepath", "source_filepath", "host", "detected_timestamp"})
+	// Host names recorded with --encrypt-column file_lineage.host are decrypted, with the key asked for at the first.
+	var columns *columnCipher
+	for rows.Next() {
+		var relation, filepath, source, host string
+		var detected time.Time
+		if err := rows.Scan(&relation, &filepath, &source, &host, &detected); err != nil {
+			log.Fatalf("Failed to read lineage: %v", err)
+		}
+		if strings.HasPrefix(host, encryptedPrefix) {
+			if columns == nil {
+				if columns, err = newColumnCipher(readColumnKey(), nil); err != nil {
+					log.Fatalf("%v", err)
+				}
+			}
+			if host, err = columns.open("file_lineage.host", host); err != nil {
+				log.Fatalf("%v", err)
+			}
+		}
+		if err := writer.Write([]string{relation, filepath, source, host, detected.In(time.Local).Format(queryTimeLayout)}); err != nil {
+			log.Fatalf("Failed to write results: %v", err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalf("Failed to read lineage: %v", err)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fileSorts, dupeSorts and historySorts are what GET /files, /dupes and /history can be sorted by.
+var (
+	fileSorts = map[string]sortColumn{
+		"path":     {"filepath", "text"},
+		"size":     {"size", "bigint"},
+		"modified": {"file_timestamp", "timestamp"},
+	}
+	dupeSorts = map[string]sortColumn{
+		"reclaimable": {"reclaimable", "numeric"},
+		"size":        {"size", "bigint"},
+		"copies":      {"copies", "bigint"},
+	}
+	historySorts = map[string]sortColumn{
+		"recorded": {"recorded_timestamp", "timestamp"},
+		"path":     {"filepath", "text"},
+		"size":     {"size", "bigint"},
+	}
+)
+
+// historyEntry is a file_history row as served by /history, with times in the server's time zone. Removed rows
+// record a file leaving its path, renamed or deleted, with the hash it had.
+type historyEntry struct {
+	ID       int64     `json:"id"`
+	Path     string    `json:"path"`
+	Hash     string    `json:"hash"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Recorded time.Time `json:"recorded"`
+	Removed  bool      `json:"removed,omitempty"`
+}
+
+// listFilters turns the filter parameters of a list request into conditions of q. Sizes are like 10MiB and times
+// like those query --as-of takes. The prefix parameter is narrowed to the token's namespace.
+type listFilters struct {
+	q     *listQuery
+	query url.Values
+	token apiToken
+}
+
+func (f listFilters) prefix(column string) error {
+	prefix, ok := f.token.scopePrefix(f.query.Get("prefix"))
+	if !ok {
+		return fmt.Errorf("prefix is outside the token's namespace")
+	}
+	if prefix != "" {
+		f.q.where(column+" LIKE ?", likePrefix(prefix))
+	}
+	return nil
+}
+
+func (f listFilters) sizes(column string) error {
+	for _, bound := range []struct{ name, op string }{{"min_size", ">="}, {"max_size", "<="}} {
+		if value := f.query.Get(bound.name); value != "" {
+			size, err := parseByteSize(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", bound.name, err)
+			}
+			f.q.where(column+" "+bound.op+" ?", size)
+		}
+	}
+	return nil
+}
+
+// times filters column by the after (inclusive) and before (exclusive) parameters. utc is whether column is kept in
+// UTC rather than in local time.
+func (f listFilters) times(after, before, column string, utc bool) error {
+	for _, bound := range []struct{ name, op string }{{after, ">="}, {before, "<"}} {
+		if value := f.query.Get(bound.name); value != "" {
+			t, err := parseAsOf(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", bound.name, err)
+			}
+			if utc {
+				t = t.UTC()
+			}
+			f.q.where(column+" "+bound.op+" ?", t)
+		}
+	}
+	return nil
+}
+
+// firstError returns the first of errs that isn't nil.
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listEndpoint answers a list request: parse turns it into a query, which list runs.
+func listEndpoint(db *sql.DB, parse func(url.Values, apiToken) (string, []any, pageRequest, error),
+	list func(context.Context, *sql.DB, string, []any, pageRequest) (listPage, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query, args, p, err := parse(r.URL.Query(), requestToken(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err := list(r.Context(), db, query, args, p)
+		if err != nil {
+			log.Printf("Failed to answer %s: %v", r.URL, err)
+			http.Error(w, "listing failed", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, result)
+	}
+}
+
+// listFilesQuery parses a GET /files request without a path: the indexed files under prefix, with hash, between
+// min_size and max_size and modified between modified_after and modified_before, sorted by path (the default), size
+// or modified. Files marked deleted are left out.
+func listFilesQuery(query url.Values, token apiToken) (string, []any, pageRequest, error) {
+	p, err := parsePageRequest(query, fileSorts, "path")
+	if err != nil {
+		return "", nil, p, err
+	}
+	q, err := fileConditions(query, token)
+	if err != nil {
+		return "", nil, p, err
+	}
+	return selectFilesQuery + q.page(p, "filepath", "text"), q.args, p, nil
+}
+
+// selectFilesQuery selects the columns of a fileRecord, with $1 the hash algorithm of rows without one.
+const selectFilesQuery = "SELECT filepath, hash, coalesce(hash_algorithm, $1), size, file_timestamp, hash_calculated_timestamp FROM file_hashes "
+
+// fileConditions returns the conditions of the files a request for /files or the files export asks for, with the
+// default hash algorithm as the first argument.
+func fileConditions(query url.Values, token apiToken) (*listQuery, error) {
+	q := &listQuery{args: []any{defaultHashAlgorithm}}
+	f := listFilters{q, query, token}
+	q.where("deleted_timestamp IS NULL")
+	if hash := query.Get("hash"); hash != "" {
+		q.where("hash = ?", hash)
+	}
+	return q, firstError(f.prefix("filepath"), f.sizes("size"), f.times("modified_after", "modified_before", "file_timestamp", false))
+}
+
+func listFiles(ctx context.Context, db *sql.DB, query string, args []any, p pageRequest) (listPage, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return listPage{}, err
+	}
+	defer rows.Close()
+	records := []fileRecord{}
+	next, err := scanPage(rows, p, func() (string, string, error) {
+		var record fileRecord
+		if err := rows.Scan(&record.Path, &record.Hash, &record.Algorithm, &record.Size, &record.Modified, &record.Indexed); err != nil {
+			return "", "", err
+		}
+		value := record.Path
+		switch p.name {
+		case "size":
+			value = strconv.FormatInt(record.Size, 10)
+		case "modified":
+			value = record.Modified.Format(cursorTimeLayout)
+		}
+		record.Modified, record.Indexed = localWallClock(record.Modified), record.Indexed.In(time.Local)
+		records = append(records, record)
+		return value, record.Path, nil
+	})
+	return listPage{Items: records, NextCursor: next}, err
+}
+
+// listDupesQuery parses a GET /dupes request: the sets of indexed files under prefix with the same hash and size, of
+// at least min_size (by default 1, leaving out empty files) and at most max_size, sorted by -reclaimable (the
+// default), size or copies. As with the dupes command, copies outside prefix don't count, and neither do files marked
+// deleted or rows written by --privacy-mode.
+func listDupesQuery(query url.Values, token apiToken) (string, []any, pageRequest, error) {
+	p, err := parsePageRequest(query, dupeSorts, "-reclaimable")
+	if err != nil {
+		return "", nil, p, err
+	}
+	if !query.Has("min_size") {
+		query.Set("min_size", "1")
+	}
+	q := &listQuery{}
+	f := listFilters{q, query, token}
+	q.where("deleted_timestamp IS NULL")
+	q.where("coalesce(hash_algorithm, '') <> ?", privacyHashAlgorithm)
+	if err := firstError(f.prefix("filepath"), f.sizes("size")); err != nil {
+		return "", nil, p, err
+	}
+	// The sets are grouped first, so the page's conditions apply to their counts.
+	sets := `
+SELECT hash, size, count(*) AS copies, size::numeric * (count(*) - 1) AS reclaimable, hash || ':' || size AS set_key
+FROM file_hashes WHERE ` + strings.Join(q.conditions, " AND ") + `
+GROUP BY hash, size HAVING count(*) > 1`
+	q.conditions = nil
+	return "SELECT hash, size, copies, reclaimable, set_key FROM (" + sets + ") d " + q.page(p, "set_key", "text"), q.args, p, nil
+}
+
+func listDupes(ctx context.Context, db *sql.DB, query string, args []any, p pageRequest) (listPage, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return listPage{}, err
+	}
+	defer rows.Close()
+	sets := []duplicateSet{}
+	next, err := scanPage(rows, p, func() (string, string, error) {
+		var set duplicateSet
+		var key string
+		if err := rows.Scan(&set.Hash, &set.Size, &set.Copies, &set.Reclaimable, &key); err != nil {
+			return "", "", err
+		}
+		sets = append(sets, set)
+		switch p.name {
+		case "size":
+			return strconv.FormatInt(set.Size, 10), key, nil
+		case "copies":
+			return strconv.Itoa(set.Copies), key, nil
+		}
+		return strconv.FormatInt(set.Reclaimable, 10), key, nil
+	})
+	return listPage{Items: sets, NextCursor: next}, err
+}
+
+// listHistoryQuery parses a GET /history request: the file_history rows of path, or of the files under prefix,
+// recorded between since and until, sorted by recorded (the default), path or size.
+func listHistoryQuery(query url.Values, token apiToken) (string, []any, pageRequest, error) {
+	p, err := parsePageRequest(query, historySorts, "recorded")
+	if err != nil {
+		return "", nil, p, err
+	}
+	q := &listQuery{}
+	f := listFilters{q, query, token}
+	if path := query.Get("path"); path != "" {
+		if !token.covers(path) {
+			return "", nil, p, fmt.Errorf("path is outside the token's namespace")
+		}
+		q.where("filepath = ?", path)
+	}
+	if err := firstError(f.prefix("filepath"), f.sizes("size"), f.times("since", "until", "recorded_timestamp", true)); err != nil {
+		return "", nil, p, err
+	}
+	return "SELECT id, filepath, hash, size, file_timestamp, recorded_timestamp, removed FROM file_history " +
+		q.page(p, "id", "bigint"), q.args, p, nil
+}
+
+func listHistory(ctx context.Context, db *sql.DB, query string, args []any, p pageRequest) (listPage, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return listPage{}, err
+	}
+	defer rows.Close()
+	entries := []historyEntry{}
+	next, err := scanPage(rows, p, func() (string, string, error) {
+		var entry historyEntry
+		if err := rows.Scan(&entry.ID, &entry.Path, &entry.Hash, &entry.Size, &entry.Modified, &entry.Recorded, &entry.Removed); err != nil {
+			return "", "", err
+		}
+		value := entry.Recorded.Format(cursorTimeLayout)
+		switch p.name {
+		case "path":
+			value = entry.Path
+		case "size":
+			value = strconv.FormatInt(entry.Size, 10)
+		}
+		entry.Modified, entry.Recorded = localWallClock(entry.Modified), entry.Recorded.In(time.Local)
+		entries = append(entries, entry)
+		return value, strconv.FormatInt(entry.ID, 10), nil
+	})
+	return listPage{Items: entries, NextCursor: next}, err
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// maxLookupBatch is how many digests lookup sends to the database in one query.
+const maxLookupBatch = 1000
+
+// lookupHashesQuery returns up to $2 paths for each digest in $1, in the order the digests were given.
+const lookupHashesQuery = `
+SELECT d.hash, f.filepath
+FROM unnest($1::text[]) WITH ORDINALITY AS d(hash, n)
+CROSS JOIN LATERAL (SELECT filepath FROM file_hashes WHERE hash = d.hash ORDER BY filepath LIMIT $2) f
+ORDER BY d.n, f.filepath`
+
+// runLookup prints the indexed paths of digests read one per line, so other tools can query the index in bulk
+// without a process or connection per file.
+func runLookup(args []string) {
+	fs := flag.NewFlagSet("lookup", flag.ContinueOnError)
+	var dbCfg DBConfig
+	registerDBFlags(fs, &dbCfg)
+	hashes := fs.String("hashes", "", "File of digests to look up, one per line, or - for stdin. Lines from md5sum and similar tools are accepted; only the first field is used. Required.")
+	configFile, configSet := registerConfigFlags(fs)
+	fs.Usage = commandUsage(fs, "LookupUsage")
+	parseArgs(fs, args)
+
+	readDBConfigFile(fs, *configFile, *configSet)
+	for _, name := range []string{"dbname", "hashes"} {
+		if fs.Lookup(name).Value.String() == "" {
+			usageError(fs, name, msg("MissingFlag", map[string]any{"Flag": name}))
+		}
+	}
+
+	input := os.Stdin
+	if *hashes != "-" {
+		file, err := os.Open(*hashes)
+		if err != nil {
+			log.Fatalf("Failed to open %s: %v", *hashes, err)
+		}
+		defer file.Close()
+		input = file
+	}
+
+	db := connectToDatabase(dbCfg)
+	defer db.Close()
+	if _, err := db.Exec(createTableQuery); err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+	// As in serve; without it every batch reads the whole table.
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS file_hashes_hash ON file_hashes (hash)"); err != nil {
+		log.Fatalf("Failed to create hash index: %v", err)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	if err := lookupHashes(db, bufio.NewReader(input), out); err != nil {
+		log.Fatalf("Failed to look up hashes: %v", err)
+	}
+}
+
+// lookupHashes writes "<digest>\t<path>" for each indexed path of each digest read from reader, and nothing for
+// digests that aren't indexed. Digests are queried in batches, but a batch never waits for more input than is
+// already buffered, so a tool that writes one digest at a time gets its answer without closing the pipe.
+func lookupHashes(db *sql.DB, reader *bufio.Reader, out *bufio.Writer) error {
+	var batch []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if fields := strings.Fields(line); len(fields) > 0 {
+			// md5sum and friends mark lines whose file name they had to escape with a leading backslash.
+			digest := strings.ToLower(strings.TrimPrefix(fields[0], "\\"))
+			if _, hexErr := hex.DecodeString(digest); hexErr != nil {
+				log.Printf("Skipping %q, which isn't a hex digest", fields[0])
+			} else {
+				batch = append(batch, digest)
+			}
+		}
+		if len(batch) > 0 && (len(batch) == maxLookupBatch || reader.Buffered() == 0 || err == io.EOF) {
+			if err := printHashPaths(db, batch, out); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// printHashPaths looks up one batch of digests and flushes the results.
+func printHashPaths(db *sql.DB, digests []string, out *bufio.Writer) error {
+	rows, err := db.Query(lookupHashesQuery, pq.Array(digests), maxHashPaths)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	counts := make(map[string]int)
+	for rows.Next() {
+		var digest, path string
+		if err := rows.Scan(&digest, &path); err != nil {
+			return err
+		}
+		counts[digest]++
+		fmt.Fprintf(out, "%s\t%s\n", digest, path)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for digest, count := range counts {
+		if count == maxHashPaths {
+			log.Printf("Only the first %d paths of %s were printed", maxHashPaths, digest)
+		}
+	}
+	return out.Flush()
+}
@@ -1,20 +1,23 @@
 package main
 
 import (
-	"crypto/md5"
+	"context"
 	"database/sql"
-	"encoding/csv"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 
+	"fileindexer/pkg/indexer"
+	"fileindexer/store"
 	_ "github.com/lib/pq"
 )
 
@@ -29,75 +32,353 @@ CREATE TABLE IF NOT EXISTS file_hashes (
 );
 `
 
+// stringList is a flag.Value collecting every occurrence of a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// DBConfig holds the connection settings shared by every command.
+type DBConfig struct {
+	DbName     string
+	DbUser     string
+	DbHost     string
+	DbPort     string
+	DbPassword string
+}
+
 type Config struct {
-	Directory      string
-	DbName         string
-	DbUser         string
-	DbHost         string
-	DbPort         string
-	DbPassword     string
-	OutputFile     string
-	Prefix         string
-	ExcludeStrings []string
-	Force          bool
-}
-
-func parseFlags() Config {
-	directory := flag.String("directory", "", "The target directory containing files to process for MD5 hash calculation. Required.")
-	dbName := flag.String("dbname", "", "The name of the PostgreSQL database to store file hashes. Required.")
-	dbUser := flag.String("dbuser", os.Getenv("DB_USER"), "The PostgreSQL username. Defaults to the DB_USER environment variable.")
-	dbHost := flag.String("dbhost", os.Getenv("DB_HOST"), "The PostgreSQL host. Defaults to the DB_HOST environment variable.")
-	dbPort := flag.String("dbport", os.Getenv("DB_PORT"), "The PostgreSQL port. Defaults to the DB_PORT environment variable.")
-	outputFile := flag.String("output", fmt.Sprintf("%s_results.csv", time.Now().Format("2006-01-02T15.04.05.000")), "The path to the CSV file to output processing results. Defaults to a timestamped file in the current directory.")
-	prefix := flag.String("prefix", "", "Optional prefix to remove from file paths when storing them in the database.")
-	excludeStrings := flag.String("exclude", "", "Comma-separated list of strings. Skip processing files containing any of these strings in their path.")
-	force := flag.Bool("force", false, "Force re-calculating the hash for all files.")
-	flag.Parse()
-
-	if *directory == "" || *dbName == "" {
-		log.Fatalf(`Usage: <command> --directory <target_directory> --dbname <postgres_db_name> [options]
-
-This command scans a directory for files, computes their MD5 hashes, stores the hashes and metadata in a PostgreSQL database, and outputs a CSV summary.
-
-Required Flags:
-  --directory: The target directory to process.
-  --dbname: The name of the PostgreSQL database.
-
-Optional Flags:
-  --dbuser: PostgreSQL username (default: DB_USER environment variable).
-  --dbhost: PostgreSQL host (default: DB_HOST environment variable).
-  --dbport: PostgreSQL port (default: DB_PORT environment variable).
-  --output: Output CSV file path (default: timestamped file in the current directory).
-  --prefix: Prefix to remove from file paths in the database.
-  --exclude: Comma-separated strings to exclude certain file paths.`)
-	}
-
-	return Config{
-		Directory:      *directory,
-		DbName:         *dbName,
-		DbUser:         *dbUser,
-		DbHost:         *dbHost,
-		DbPort:         *dbPort,
-		OutputFile:     *outputFile,
-		Prefix:         *prefix,
-		ExcludeStrings: strings.Split(*excludeStrings, ","),
-		Force:          *force,
-	}
-}
-
-func connectToDatabase(cfg Config) *sql.DB {
+	DBConfig
+	Directory         string   // the directory being scanned: the first of Roots, or the one runScan is on
+	Roots             []string // every --directory, scanned one after another
+	Paths             []string
+	Subpath           string
+	Glob              string
+	Under             string
+	OutputFile        string
+	OutputFormat      string
+	SafeCSV           bool
+	ReportHTML        string
+	ReportTemplate    *template.Template // parsed from --report-template
+	ReportOutput      string
+	Prefix            string   // the --prefix of Directory
+	Prefixes          []string // every --prefix, matched to Roots by rootPrefix
+	ExcludeStrings    []string
+	Filter            *pathFilter // --exclude-glob, --include-glob, --exclude-regex and --ignore-file, or nil
+	Force             bool
+	Verify            bool
+	ChangeDetect      string
+	MinRehashAge      time.Duration
+	Preload           bool
+	DetectDeleted     bool
+	ScanEpochs        bool
+	Watch             bool
+	NetworkShare      bool
+	Workers           int
+	MaxReadMBps       float64
+	MaxReadMBpsFile   string
+	BatchSize         int
+	Partition         bool
+	Resume            bool
+	MaxRuntime        time.Duration
+	ResumeAfter       string // checkpoint of the run continued by --resume, set by runScan
+	StatusPolicy      []statusRule
+	NewestModified    time.Time // files modified after this are ignored, with --ignore-newer-than
+	OldestModified    time.Time // files modified before this are ignored, with --ignore-older-than
+	OwnerID           int       // with --owner, the only user whose files are scanned; -1 otherwise
+	GroupID           int       // with --group, the only group whose files are scanned; -1 otherwise
+	RunAs             *runAsUser
+	ReadOnlyGuarantee bool
+	WriteManifests    bool
+	KeepReadAccess    bool
+	HashAlgorithm     string
+	QuickHash         int64 // files of at least this size are hashed from samples; 0 with --full-hash or without --quick-hash
+	ChunkSize         int64 // with --chunk-size, files are hashed in chunks of this size, and HashAlgorithm names it
+	ShardOutput       bool
+	SortOutput        bool
+	PrivacyMode       bool
+	PrivacySalt       []byte
+	EncryptColumns    []string // the --encrypt-column columns, encrypted with ColumnKey
+	ColumnKey         []byte
+	DetectPII         bool
+	PIIPatterns       []string
+	PIIMaxBytes       int64
+	CheckTypes        bool
+	TypeReport        string
+	ExecutableReport  string
+	SBOMOutput        string
+	VerifyAgainst     string
+	DirectIO          bool
+	Incremental       bool
+	EnumerateOnly     string
+	Worklist          string
+	Enqueue           bool
+	FromQueue         bool
+	WorkerID          string
+	QueueLease        time.Duration
+	PprofAddr         string
+	DiagDir           string
+	DiagInterval      time.Duration
+	MemoryLimit       int64
+	SpillDir          string
+	StatusStreamFD    int
+	ValidateConfig    bool
+	SkipPreflight     bool
+	ChangesFrom       string
+	ChangesFormat     string
+	BaseSnapshot      string
+	Snapshot          string
+	RecordLineage     bool
+	DetectMoves       bool
+	RecordAtime       bool
+	RecordAllocation  bool
+	ExtentMap         bool
+	HumanReadable     bool
+	WALPath           string
+	Store             string
+	StoreDSN          string
+	DBDriver          string
+	Quotas            []quota
+	AlertWebhook      string
+	AlertEmail        string
+	SMTPServer        string
+	SMTPFrom          string
+}
+
+// parseFlags parses the scan flags from args, for command scan, verify or rescan. verify is a scan with --verify, or
+// with --verify-against when a replica is given; rescan is a scan of the indexed files matching --glob under --under.
+func parseFlags(command string, args []string) Config {
+	var cfg Config
+	var raw scanFlags
+	registerScanFlags(command, &cfg, &raw)
+	switch command {
+	case "verify":
+		flag.Usage = scanCommandUsage("VerifyUsage")
+	case "rescan":
+		flag.Usage = scanCommandUsage("RescanUsage")
+	default:
+		flag.Usage = printScanUsage
+	}
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	parseArgs(flag.CommandLine, args)
+	if raw.config != "" {
+		var err error
+		if isYAMLConfig(raw.config) {
+			err = loadYAMLConfigFile(flag.CommandLine, raw.config, raw.configSet, true)
+		} else if raw.configSet != "" {
+			err = fmt.Errorf("--set needs a YAML --config file")
+		} else {
+			err = loadDBConfigFile(flag.CommandLine, raw.config)
+		}
+		if err != nil {
+			log.Fatalf("Failed to read --config: %v", err)
+		}
+	} else if raw.configSet != "" {
+		usageError(flag.CommandLine, "set", "--set needs --config.")
+	}
+	if command == "verify" && cfg.VerifyAgainst != "" {
+		cfg.Verify = false
+	}
+	raw.set = make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { raw.set[f.Name] = true })
+
+	cfg.Paths = flag.Args()
+	if len(cfg.Roots) > 0 {
+		cfg.Directory = cfg.Roots[0]
+	}
+	// Flags implied by others.
+	cfg.DetectPII = cfg.DetectPII || len(cfg.PIIPatterns) > 0
+	cfg.CheckTypes = cfg.CheckTypes || cfg.TypeReport != ""
+	cfg.RecordAllocation = cfg.RecordAllocation || cfg.ExtentMap
+	cfg.ShardOutput = cfg.ShardOutput || cfg.SortOutput
+
+	checkSourceFlags(command, &cfg)
+	checkDatabaseFlags(&cfg, raw)
+	checkResourceFlags(&cfg, raw)
+	checkHashFlags(&cfg, raw)
+	checkContentFlags(cfg)
+	checkFilterFlags(&cfg, raw)
+	checkPrivilegeFlags(&cfg, raw)
+	checkOutputFlags(&cfg, raw)
+
+	cfg.Prefix = rootPrefix(cfg.Directory, cfg.Prefixes)
+	cfg.Incremental = cfg.Incremental && !cfg.Force
+	if cfg.ReadOnlyGuarantee {
+		checkWriteLocations(cfg)
+	}
+	checkIneffectiveFlags(cfg, raw.set, raw.strict)
+	return cfg
+}
+
+// scanFlags holds the scan flags that the check functions turn into Config fields of another type, and those that
+// only affect how the others are read.
+type scanFlags struct {
+	set       map[string]bool // the flags given, on the command line or by --config
+	strict    bool
+	config    string
+	configSet string
+
+	exclude                                    string
+	excludeGlobs, includeGlobs, excludeRegexps stringList
+	ignoreFile                                 string
+	ignoreNewerThan, ignoreOlderThan           string
+	owner, group                               string
+
+	minRehashAge string
+	quickHash    string
+	fullHash     bool
+	chunkSize    string
+	memoryLimit  string
+
+	dbPath         string
+	noWAL          bool
+	runAs          string
+	reportTemplate string
+	statusPolicy   string
+	quotas         stringList
+}
+
+// registerScanFlags adds the flags of command to flag.CommandLine, storing their values in cfg, or in raw when they
+// need converting first.
+func registerScanFlags(command string, cfg *Config, raw *scanFlags) {
+	flag.Var((*stringList)(&cfg.Roots), "directory", "The target directory containing files to hash, or a single file. Required unless files are named as arguments. May be repeated to scan several directories, e.g. mount points, one after another into one results file, each as its own scan run.")
+	flag.StringVar(&cfg.Subpath, "subpath", "", "Scan only this directory under --directory, given relative to it. Deletion detection, --scan-epochs and --preload stay within it, so records elsewhere under --directory are left alone.")
+	if command == "rescan" {
+		flag.StringVar(&cfg.Glob, "glob", "", "Rescan the indexed files whose path below --under matches this pattern, in which ** matches any number of directories (e.g. '**/*.jpg').")
+		flag.StringVar(&cfg.Under, "under", "", "The directory whose indexed files are matched against --glob.")
+	}
+	registerDBFlags(flag.CommandLine, &cfg.DBConfig)
+	flag.StringVar(&cfg.OutputFile, "output", fmt.Sprintf("%s_results.csv", time.Now().Format("2006-01-02T15.04.05.000")), "The path to the CSV file to output processing results. Defaults to a timestamped file in the current directory.")
+	flag.StringVar(&cfg.OutputFormat, "output-format", "csv", "Format of the --output file: csv, json (one array of objects), jsonl (one object per line) or xlsx (an Excel workbook with Results, Errors and Summary sheets). The JSON formats have the CSV columns as keys, with size as a number.")
+	flag.StringVar(&cfg.ReportHTML, "report-html", "", "Also write a self-contained HTML report of the scan to this file: totals, a chart of the statuses, the most common errors and the largest new files, e.g. to attach to a change ticket.")
+	flag.StringVar(&raw.reportTemplate, "report-template", "", "Also render this Go text/template file to --report-output, with the scan summary and its results rows (see README), to produce a report in whatever format is required.")
+	flag.StringVar(&cfg.ReportOutput, "report-output", "", "File to write the --report-template report to.")
+	flag.BoolVar(&cfg.SafeCSV, "safe-csv", false, "Quote every field of the results CSV and the CSV reports, and put an apostrophe before fields starting with =, +, -, @, tab or carriage return, so spreadsheets don't run file names as formulas.")
+	flag.Var((*stringList)(&cfg.Prefixes), "prefix", "Optional prefix to remove from file paths when storing them in the database. May be repeated to give several --directory roots their own: the paths under each root lose the longest --prefix the root is under.")
+	flag.StringVar(&raw.exclude, "exclude", "", "Comma-separated list of strings. Skip processing files containing any of these strings in their path.")
+	flag.Var(&raw.excludeGlobs, "exclude-glob", "Skip files and directories matching this pattern in .gitignore syntax (e.g. node_modules/, .snapshots/ or **/*.tmp), relative to --directory. An excluded directory isn't descended into. May be repeated.")
+	flag.Var(&raw.includeGlobs, "include-glob", "Only scan files matching this pattern in .gitignore syntax (e.g. *.jpg or photos/**), relative to --directory. May be repeated; a file matching any is scanned.")
+	flag.Var(&raw.excludeRegexps, "exclude-regex", "Skip files and directories whose full path matches this regular expression. An excluded directory isn't descended into. May be repeated.")
+	flag.StringVar(&raw.ignoreFile, "ignore-file", "", "File of patterns in .gitignore syntax, including ! to re-include, for files and directories to skip, relative to --directory.")
+	flag.BoolVar(&cfg.Force, "force", false, "Force re-calculating the hash for all files.")
+	flag.BoolVar(&cfg.DetectDeleted, "detect-deleted", false, "After the scan, mark indexed files under --directory that no longer exist with file_hashes.deleted_timestamp and list them in the results as missing.")
+	flag.BoolVar(&cfg.Watch, "watch", false, "After the scan, keep running and follow filesystem events under --directory: created and modified files are hashed and removed ones marked deleted, until SIGINT or SIGTERM.")
+	flag.StringVar(&raw.config, "config", "", "YAML file of settings by flag name, with directory sets chosen by --set; flags on the command line override it. A db.conf file of database settings works too.")
+	flag.StringVar(&raw.configSet, "set", "", "Directory set of the --config file to scan.")
+	flag.BoolVar(&cfg.ScanEpochs, "scan-epochs", false, "Mark the record of every file the scan sees with its scan run in file_hashes.seen_run_id. With --detect-deleted, only the indexed files it didn't see are looked up on disk, found with one query.")
+	flag.BoolVar(&cfg.NetworkShare, "network-share", false, "Tune the scan for an SMB or NFS share: fewer workers, transient errors retried for about half a minute, and a summary of open latencies and the directories with the most failures.")
+	flag.IntVar(&cfg.Workers, "workers", 0, fmt.Sprintf("Number of files hashed concurrently (default %d, or %d with --network-share).", defaultWorkerCount, shareWorkerCount))
+	flag.Float64Var(&cfg.MaxReadMBps, "max-read-mbps", 0, "Read file contents at no more than this many megabytes (10^6 bytes) per second across all workers, so the scan leaves disk bandwidth for other work. Unlimited by default.")
+	flag.StringVar(&cfg.MaxReadMBpsFile, "max-read-mbps-file", "", "Take the --max-read-mbps limit from this file, holding just the number, and reread it every second so it can be changed while the scan runs. serve uses it to share --scan-bandwidth between its scans.")
+	flag.IntVar(&cfg.BatchSize, "batch-size", 0, "Write new and changed records to the database in batches of this many, with COPY in one transaction, instead of one statement per file. Results are only written once their batch is.")
+	flag.BoolVar(&cfg.Partition, "partition", false, "Scan each top-level subdirectory of --directory as its own unit, with its own summary and row in scan_partitions, so a failure in one doesn't cost the others.")
+	flag.BoolVar(&cfg.Resume, "resume", false, "Continue the last run of --directory interrupted by SIGINT or SIGTERM, after the last file it finished, or with --partition, the last unfinished run, skipping the partitions it finished.")
+	flag.DurationVar(&cfg.MaxRuntime, "max-runtime", 0, "Stop the scan as SIGINT would once it has run this long (e.g. 6h): the files being hashed are finished, the results written and the run left for --resume, with an estimate of how much of the tree remains.")
+	flag.BoolVar(&cfg.Verify, "verify", command == "verify", "Also re-hash files whose size and modification time are unchanged, reporting them as corrupt if the contents no longer match the index.")
+	flag.StringVar(&raw.minRehashAge, "min-rehash-age", "", "Don't hash a file again with --force, --verify or --change-detect always if its size and modification time are unchanged and it was hashed less than this long ago (e.g. 30d).")
+	flag.BoolVar(&cfg.Preload, "preload", false, "Read the index records under --directory in one query before scanning, instead of looking up each file on its own; worth it on a slow link to the database. Beyond --memory-limit, only a Bloom filter of their paths is kept.")
+	flag.StringVar(&cfg.ChangeDetect, "change-detect", "size", "When an indexed file is hashed again: size (when its size changed), mtime+size (also when its modification time changed) or always.")
+	flag.StringVar(&cfg.HashAlgorithm, "hash-algo", defaultHashAlgorithm, "Content hash: md5, sha1, sha256, sha512, blake2b (BLAKE2b-512) or xxhash64 (fast, not cryptographic). Files indexed with another algorithm are hashed again.")
+	flag.StringVar(&raw.quickHash, "quick-hash", "", "Hash files of at least this size (e.g. 10GiB) from their first and last 16 MiB plus their size, recorded as <algorithm>-sampled, instead of reading them whole.")
+	flag.StringVar(&raw.chunkSize, "chunk-size", "", "Hash files in chunks of this size (e.g. 4MiB), recording each chunk's digest in the file_chunks table and the Merkle root of them as the file's hash, under an algorithm like md5-merkle-4MiB.")
+	flag.BoolVar(&raw.fullHash, "full-hash", false, "Hash every file in full even with --quick-hash, as from a config file; files indexed from samples are hashed again.")
+	flag.BoolVar(&cfg.ShardOutput, "shard-output", false, "Have each worker write its own results shard and merge them at the end, instead of sharing one locked writer.")
+	flag.BoolVar(&cfg.SortOutput, "sort-output", false, "Sort results by file path when merging shards. Implies --shard-output.")
+	flag.BoolVar(&cfg.DetectPII, "detect-pii", false, "Scan text-like files for credit card numbers, US SSNs and any --pii-pattern while hashing, recording match counts in the pii_findings table.")
+	flag.Var((*stringList)(&cfg.PIIPatterns), "pii-pattern", "Additional PII pattern as name=regex. May be repeated.")
+	flag.Int64Var(&cfg.PIIMaxBytes, "pii-max-bytes", 10<<20, "Only scan the first N bytes of each file for PII.")
+	flag.BoolVar(&cfg.CheckTypes, "check-types", false, "Flag files whose extension doesn't match their content (magic bytes) with a +type-mismatch status.")
+	flag.StringVar(&cfg.TypeReport, "type-report", "", "Also write files flagged by --check-types to this CSV file. Implies --check-types.")
+	flag.StringVar(&cfg.ExecutableReport, "executable-report", "", "Write an inventory of executables (ELF, PE, Mach-O, shebang scripts, detected by content) with their hashes to this CSV file.")
+	flag.BoolVar(&cfg.WriteManifests, "write-manifests", false, "After the scan, write a "+manifestName+" file in each directory listing the hashes of its files and of its subdirectories' manifests, checkable with sha256sum -c (or md5sum -c and so on, for --hash-algo) without the database.")
+	flag.StringVar(&cfg.SBOMOutput, "sbom-output", "", "Write executables and archives found during the scan to this file as a CycloneDX JSON SBOM.")
+	flag.StringVar(&cfg.VerifyAgainst, "verify-against", "", "Instead of indexing, compare every file with its copy under this replica root, using the indexed hash to tell which copy is corrupt. The database is not modified.")
+	flag.BoolVar(&cfg.DirectIO, "direct-io", false, "Bypass the page cache (O_DIRECT, or F_NOCACHE on macOS) when reading files during verification, so hashes reflect what is on disk.")
+	flag.BoolVar(&cfg.Incremental, "incremental", false, "Skip files in directories whose mtime and entry count are unchanged since the last scan. Files modified in place are not noticed; run a full scan periodically.")
+	flag.StringVar(&cfg.EnumerateOnly, "enumerate-only", "", "Only walk the directory and write the files found (path, size, mtime) to this worklist CSV. No database is needed.")
+	flag.StringVar(&cfg.Worklist, "worklist", "", "Hash the files listed in this worklist CSV (from --enumerate-only) instead of walking --directory.")
+	flag.BoolVar(&cfg.Enqueue, "enqueue", false, "Only walk the directory and add the files found to the scan_queue table for --from-queue workers.")
+	flag.BoolVar(&cfg.FromQueue, "from-queue", false, "Hash files claimed from the scan_queue table instead of walking --directory, until the queue is empty.")
+	flag.StringVar(&cfg.WorkerID, "worker-id", defaultWorkerID(), "Identifies this worker's claims in the queue. Defaults to the hostname; a worker restarted with the same ID resumes its own claims.")
+	flag.DurationVar(&cfg.QueueLease, "queue-lease", time.Hour, "How long a queue claim may go unfinished before another worker takes it over.")
+	flag.StringVar(&cfg.PprofAddr, "pprof", "", "Serve net/http/pprof on this address (e.g. localhost:6060) while running.")
+	flag.StringVar(&cfg.DiagDir, "diag-dir", "", "Periodically write heap profiles and goroutine dumps to this directory.")
+	flag.DurationVar(&cfg.DiagInterval, "diag-interval", 5*time.Minute, "How often to write --diag-dir dumps.")
+	flag.StringVar(&raw.memoryLimit, "memory-limit", "", "Approximate memory budget (e.g. 2GiB) for per-file bookkeeping; beyond it, that state moves to a temporary SQLite file. Unlimited by default.")
+	flag.StringVar(&cfg.SpillDir, "spill-dir", "", "Directory for --memory-limit spill files. Defaults to the system temp directory.")
+	flag.IntVar(&cfg.StatusStreamFD, "status-stream", -1, "Write NDJSON progress events (scan-start, file-done, error, summary) to this file descriptor, e.g. 2 for stderr or 3 for a pipe set up by a wrapper.")
+	flag.Var((*stringList)(&cfg.EncryptColumns), "encrypt-column", "Encrypt this column with AES-GCM before storing it: pii_findings.pattern or file_lineage.host. May be repeated. The hex encoded key comes from the COLUMN_KEY environment variable.")
+	flag.BoolVar(&cfg.PrivacyMode, "privacy-mode", false, "Store only metadata plus salted digests of the path and file name. File contents are not read. Salt comes from the PRIVACY_SALT environment variable.")
+	flag.BoolVar(&raw.strict, "strict", false, "Refuse to run when a flag would have no effect (e.g. a --prefix that doesn't match --directory) instead of warning.")
+	flag.BoolVar(&cfg.ValidateConfig, "validate-config", false, "Check database connectivity, read access to --directory and write access to the output location, then exit without scanning.")
+	flag.BoolVar(&cfg.SkipPreflight, "skip-preflight", false, "Don't check read access to a sample of files, free space for the output and database write privileges before scanning.")
+	flag.StringVar(&cfg.ChangesFrom, "changes-from", "", "Only index the files listed as created, modified or renamed in this snapshot diff (- for stdin), instead of walking --directory.")
+	flag.StringVar(&cfg.ChangesFormat, "changes-format", "zfs", "Format of --changes-from: zfs (zfs diff output) or btrfs (btrfs receive --dump of an incremental send).")
+	flag.StringVar(&cfg.BaseSnapshot, "base-snapshot", "", "Name of the snapshot the --changes-from diff starts from, recorded in the scan_runs table.")
+	flag.StringVar(&cfg.Snapshot, "snapshot", "", "Name of the snapshot the --changes-from diff ends at, recorded in the scan_runs table.")
+	flag.BoolVar(&cfg.RecordLineage, "record-lineage", false, "When a new file has the same contents as an already indexed file, record that file as its likely source in the file_lineage table.")
+	flag.BoolVar(&cfg.DetectMoves, "detect-moves", false, "Before adding a new file, look for an indexed file under --directory with the same contents that no longer exists, and move its record to the new path instead, reporting the file as moved.")
+	flag.BoolVar(&cfg.RecordAtime, "record-atime", false, "Record each file's access time, as it was before the scan read it, in file_hashes.access_timestamp. Warns when the mount's noatime or relatime makes access times unreliable.")
+	flag.BoolVar(&cfg.RecordAllocation, "record-allocation", false, "Record each file's allocated size on disk, which is smaller than its size for sparse files, in file_hashes.allocated_size.")
+	flag.BoolVar(&cfg.ExtentMap, "extent-map", false, "Also record the data extents of sparse files in the file_extents table. Implies --record-allocation.")
+	flag.BoolVar(&cfg.HumanReadable, "human-readable", false, "Write sizes in the results CSV like 1.4GiB instead of in bytes, for reports read by people rather than scripts.")
+	flag.StringVar(&cfg.WALPath, "wal", "", "Local write-ahead log for results the database can't take, replayed at the start of the next scan or by flush-wal. Defaults to a per-database file in the user cache directory.")
+	flag.BoolVar(&raw.noWAL, "no-wal", false, "Don't keep a write-ahead log: while the database is down, workers wait with their results in memory.")
+	flag.StringVar(&cfg.Store, "store", "", "Keep file records in this registered storage backend instead of the file_hashes table. Run bookkeeping stays in --dbname.")
+	flag.StringVar(&cfg.StoreDSN, "store-dsn", "", "Data source name for --store, in the backend's own format.")
+	flag.StringVar(&cfg.DBDriver, "db-driver", "postgres", "Database to keep the index in: postgres, or sqlite for a local file named by --db-path with no server needed.")
+	flag.StringVar(&raw.dbPath, "db-path", "", "SQLite database file for --db-driver sqlite. Created if it doesn't exist.")
+	flag.StringVar(&raw.statusPolicy, "status-policy", "", "File of custom statuses to add to the status of matching files, one per line as: name condition... (see README).")
+	flag.StringVar(&raw.ignoreNewerThan, "ignore-newer-than", "", "Skip files modified more recently than this long ago (e.g. 1y to verify only archived files).")
+	flag.StringVar(&raw.ignoreOlderThan, "ignore-older-than", "", "Skip files last modified longer ago than this (e.g. 30d to scan only recent changes).")
+	flag.StringVar(&raw.owner, "owner", "", "Only scan files owned by this user, given as a name or numeric id.")
+	flag.StringVar(&raw.group, "group", "", "Only scan files owned by this group, given as a name or numeric id.")
+	flag.StringVar(&raw.runAs, "run-as", "", "Once the database connection is open, switch to this user (name or id, optionally user:group) for the rest of the scan. Needs root.")
+	flag.BoolVar(&cfg.ReadOnlyGuarantee, "read-only-guarantee", false, "Open the scanned tree's files and directories with O_NOATIME where permitted, refuse to write anything inside it, check that no access time moved, and write an attestation next to the results file and in scan_runs.")
+	flag.BoolVar(&cfg.KeepReadAccess, "keep-read-access", false, "With --run-as on Linux, keep CAP_DAC_READ_SEARCH so every file can still be read, while the rest of the scan runs as the --run-as user.")
+	flag.Var(&raw.quotas, "quota", "Threshold on a stored path prefix as prefix:size=2TiB, prefix:files=1000000 or prefix:growth=50GiB (per week), checked after the scan. May be repeated.")
+	flag.StringVar(&cfg.AlertWebhook, "alert-webhook", "", "POST exceeded --quota alerts as JSON to this URL.")
+	flag.StringVar(&cfg.AlertEmail, "alert-email", "", "Email exceeded --quota alerts to these comma-separated addresses via --smtp-server.")
+	flag.StringVar(&cfg.SMTPServer, "smtp-server", "localhost:25", "SMTP server (host:port) for --alert-email. Credentials come from SMTP_USER and SMTP_PASSWORD if set.")
+	flag.StringVar(&cfg.SMTPFrom, "smtp-from", "fileindexer@localhost", "Sender address for --alert-email.")
+}
+
+// registerDBFlags adds the PostgreSQL connection flags to fs, storing their values in cfg.
+func registerDBFlags(fs *flag.FlagSet, cfg *DBConfig) {
+	fs.StringVar(&cfg.DbName, "dbname", "", "The name of the PostgreSQL database to store file hashes. Required.")
+	fs.StringVar(&cfg.DbUser, "dbuser", os.Getenv("DB_USER"), "The PostgreSQL username. Defaults to the DB_USER environment variable.")
+	fs.StringVar(&cfg.DbHost, "dbhost", os.Getenv("DB_HOST"), "The PostgreSQL host. Defaults to the DB_HOST environment variable.")
+	fs.StringVar(&cfg.DbPort, "dbport", os.Getenv("DB_PORT"), "The PostgreSQL port. Defaults to the DB_PORT environment variable.")
+}
+
+func connectToDatabase(cfg DBConfig) *sql.DB {
+	return openDatabase(databaseConnectionString(cfg))
+}
+
+// databaseConnectionString builds the lib/pq connection string for cfg, asking for the password if DB_PASSWORD isn't
+// set.
+func databaseConnectionString(cfg DBConfig) string {
 	dbPassword := os.Getenv("DB_PASSWORD")
 	if dbPassword == "" {
-		fmt.Print("Enter database password: ")
+		fmt.Print(msg("PromptDBPassword", nil))
 		var inputPassword string
 		fmt.Scanln(&inputPassword)
 		dbPassword = inputPassword
 	}
 
-	connectionString := fmt.Sprintf(
+	return fmt.Sprintf(
 		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		cfg.DbHost, cfg.DbPort, cfg.DbUser, dbPassword, cfg.DbName,
 	)
+}
+
+func openDatabase(connectionString string) *sql.DB {
 	db, err := sql.Open("postgres", connectionString)
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
@@ -105,156 +386,933 @@ func connectToDatabase(cfg Config) *sql.DB {
 	return db
 }
 
-func createOutputWriter(outputFile string) (*csv.Writer, *os.File) {
-	file, err := os.Create(outputFile)
+// partialOutputPath is where results are written while a run is in progress. It is renamed to the real output path
+// only once the run finishes, so an interrupted run leaves a .partial file behind rather than a truncated report.
+func partialOutputPath(outputFile string) string {
+	return outputFile + ".partial"
+}
+
+// resultColumns are the columns of the results file: the CSV header, and the keys of the JSON objects.
+var resultColumns = []string{"filepath", "hash", "size", "status"}
+
+// createOutputWriter creates the in-progress results file and a writer of rows in format, one of outputFormats.
+func createOutputWriter(outputFile, format string, safe bool) (rowWriter, *os.File) {
+	file, err := os.Create(partialOutputPath(outputFile))
 	if err != nil {
 		log.Fatalf("Failed to create output file: %v", err)
 	}
-	writer := csv.NewWriter(file)
-	if err := writer.Write([]string{"filepath", "hash", "size", "status"}); err != nil {
+	switch format {
+	case "json", "jsonl":
+		return newJSONRowWriter(file, resultColumns, format == "json"), file
+	case "xlsx":
+		writer, err := newXLSXRowWriter(file)
+		if err != nil {
+			log.Fatalf("Failed to create output file: %v", err)
+		}
+		return writer, file
+	}
+	writer := newCSVRowWriter(file, safe)
+	if err := writer.Write(resultColumns); err != nil {
 		log.Fatalf("Failed to write CSV header: %v", err)
 	}
 	return writer, file
 }
 
-func processDirectory(cfg Config, db *sql.DB, writer *csv.Writer, writerMutex *sync.Mutex) {
-	sem := make(chan struct{}, 8)
+// finalizeOutput flushes and closes the in-progress output file and atomically moves it to its final name.
+func finalizeOutput(writer rowWriter, file *os.File, outputFile string) error {
+	// A JSON array is only closed, and a workbook only put together, once every row is in it.
+	if finisher, ok := writer.(interface{ finish() }); ok {
+		finisher.finish()
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), outputFile)
+}
+
+// scanner is the state of a scan run shared by its roots and the workers hashing their files, set up by runScan. The
+// features the run doesn't use are left nil.
+type scanner struct {
+	db      *sql.DB
+	sink    resultSink
+	hooks   *scanHooks
+	queue   *workQueue
+	seen    *storedPathSet // the stored paths of the scan so far, which with several --directory roots spans them all
+	workers int
+	tree    treeReader
+	batch   *recordBatch
+
+	// epoch and writtenBy are those of the run of the root being scanned.
+	epoch, writtenBy *scanEpoch
+}
+
+// processDirectory walks scanRoot(cfg), partition by partition when partitions is non-nil, and processes every regular
+// file, returning the number of files rejected because their stored path collided with another file's. Once ctx is
+// done no more files are started, and the ones already started are finished; the last file started by a walk of
+// scanRoot(cfg) is returned as the checkpoint to resume after.
+func (s *scanner) processDirectory(ctx context.Context, cfg Config, partitions *scanPartitions) (int, string) {
+	db, sink, hooks, queue := s.db, s.sink, s.hooks, s.queue
+	slots := make(chan int, s.workers)
+	for i := 0; i < s.workers; i++ {
+		slots <- i
+	}
 	var wg sync.WaitGroup
 
-	err := filepath.Walk(cfg.Directory, func(path string, info os.FileInfo, walkErr error) error {
-		if walkErr != nil {
-			log.Printf("Error accessing %s: %v", path, walkErr)
-			return nil
-		}
-		if !info.Mode().IsRegular() {
-			return nil
+	var dirs *dirTracker
+	if cfg.Incremental {
+		var err error
+		if dirs, err = newDirTracker(db); err != nil {
+			log.Fatalf("Failed to create directory mtime table: %v", err)
 		}
+	}
 
-		for _, exclude := range cfg.ExcludeStrings {
-			if exclude != "" && strings.Contains(path, exclude) {
-				log.Printf("Skipping file %s due to exclusion string: %s", path, exclude)
-				return nil
-			}
-		}
+	// A walk of cfg.Directory starts files in walk order, so once they are finished every file up to the last one
+	// started has a result. Other sources can't be resumed, and privacy mode keeps paths out of the database.
+	resumable := queue == nil && cfg.Worklist == "" && cfg.ChangesFrom == "" && partitions == nil && len(cfg.Paths) == 0 && !cfg.PrivacyMode
+	checkpoint := cfg.ResumeAfter
+
+	files, options := s.fileScanner(hooks.pii), fileOptions(cfg)
+
+	// processIn processes one file of part, which is nil unless the scan is partitioned.
+	processIn := func(part *scanPartition, path string, info os.FileInfo) {
+		storedPath := storedPathFor(cfg, path)
 
-		storedPath := path
-		if cfg.Prefix != "" && strings.HasPrefix(path, cfg.Prefix) {
-			storedPath = path[len(cfg.Prefix):]
+		slot := <-slots
+		if ctx.Err() != nil {
+			// Interrupted while waiting for a worker.
+			slots <- slot
+			return
+		}
+		if resumable {
+			checkpoint = path
+		}
+		if part != nil {
+			part.files.Add(1)
+		}
+		if err := checkStoredPath(s.seen, path, storedPath); err != nil {
+			if cfg.PrivacyMode {
+				// The error names the colliding plaintext path, which must not reach the results file.
+				log.Printf("Rejected %s: %v", path, err)
+				storedPath, err = privacyDigest(cfg.PrivacySalt, storedPath), errors.New("stored path rejected")
+			}
+			writeErrorResult(sink, slot, path, storedPath, err)
+			if queue != nil {
+				queue.complete(path, err)
+			}
+			if part != nil {
+				part.counts.tally("error:")
+				part.files.Done()
+			}
+			slots <- slot
+			return
 		}
 
-		sem <- struct{}{}
 		wg.Add(1)
-		go func(path, storedPath string) {
+		go func(slot int, path, storedPath string, info os.FileInfo) {
 			defer func() {
-				<-sem
+				slots <- slot
 				wg.Done()
 			}()
 
-			hash, size, status, err := processFile(path, storedPath, db, cfg.Force)
-			writerMutex.Lock()
-			defer writerMutex.Unlock()
+			var hash, status string
+			var size int64
+			var err error
+			logPath := path
+			// Nothing is hashed while the database is down; the walk stops too once every slot is waiting here.
+			breaker.wait()
+			if cfg.PrivacyMode {
+				storedPath, hash, size, status, err = processPrivateFile(info, storedPath, db, s.batch, cfg.PrivacySalt)
+				logPath = storedPath
+			} else if cfg.VerifyAgainst != "" {
+				hash, size, status, err = verifyAgainstReplica(path, storedPath, cfg.Directory, cfg.VerifyAgainst, db, cfg.HashAlgorithm, cfg.DirectIO, s.tree)
+			} else {
+				result := files.ScanFile(path, storedPath, options)
+				hash, size, status, err = result.Hash, result.Size, result.Status, result.Err
+				if strings.HasPrefix(status, "corrupt") {
+					// The record is left alone, so the file is reported again until it is restored from a good copy.
+					log.Printf("Contents of %s no longer match the index although its modification time is unchanged", path)
+				}
+			}
+			if err == nil {
+				var suffix string
+				suffix, err = hooks.inspect(path, storedPath, hash, size, status, info)
+				status += suffix
+			}
+			if err == nil && cfg.RecordAtime {
+				if err = retryDB(db, "access time for "+storedPath, func() error { return recordAccessTime(db, storedPath, info) }); err != nil {
+					err = fmt.Errorf("failed to record access time for %s: %v", path, err)
+				}
+			}
+			if err == nil && cfg.RecordAllocation {
+				if err = retryDB(db, "allocation for "+storedPath, func() error { return recordAllocation(db, s.tree, path, storedPath, info, cfg.ExtentMap) }); err != nil {
+					err = fmt.Errorf("failed to record allocation for %s: %v", path, err)
+				}
+			}
 
-			if err != nil {
-				log.Printf("Skipping file %s due to error: %v", path, err)
-				if writeErr := writer.Write([]string{storedPath, "", "-1", fmt.Sprintf("error: %v", err)}); writeErr != nil {
-					log.Printf("Failed to write error to CSV for file %s: %v", path, writeErr)
+			finish := func(slot int, err error) {
+				if s.epoch != nil {
+					s.epoch.mark(storedPath)
+				}
+				if queue != nil {
+					queue.complete(path, err)
+				}
+				if part != nil {
+					if err != nil {
+						part.counts.tally("error:")
+					} else {
+						part.counts.tally(status)
+					}
+					defer part.files.Done()
+				}
+				if err != nil {
+					if dirs != nil {
+						dirs.markFailed(path)
+					}
+					if s.tree.share != nil {
+						s.tree.share.recordFailure(filepath.Dir(path))
+					}
+					writeErrorResult(sink, slot, logPath, storedPath, err)
+					return
+				}
+
+				if s.writtenBy != nil && wroteRecord(status) {
+					s.writtenBy.mark(storedPath)
+				}
+				log.Printf("Path: %s Hash: %s, Size: %d, Status: %s", logPath, hash, size, status)
+				if writeErr := sink.Write(slot, []string{storedPath, hash, fmt.Sprintf("%d", size), status}); writeErr != nil {
+					log.Printf("Failed to write result to CSV for file %s: %v", path, writeErr)
+				}
+			}
+			// A record held for a batch is only reported once it is written, by whichever worker flushes the batch and
+			// in the slot set aside for that, since this one is handed to the next file.
+			if err == nil && s.batch != nil {
+				var held bool
+				if held, err = s.batch.whenWritten(storedPath, func(err error) { finish(s.workers, err) }); held {
+					return
 				}
-				writer.Flush()
-				return
 			}
+			finish(slot, err)
+		}(slot, path, storedPath, info)
+	}
+	process := func(path string, info os.FileInfo) {
+		processIn(nil, path, info)
+	}
+
+	var err error
+	if queue != nil {
+		err = queue.drain(ctx, process)
+	} else if cfg.Worklist != "" {
+		err = readWorklist(ctx, cfg.Worklist, process)
+	} else if cfg.ChangesFrom != "" {
+		err = readChanges(ctx, cfg, process)
+	} else if partitions != nil {
+		err = partitions.walk(ctx, cfg, s.tree, processIn)
+	} else {
+		err = walkFiles(ctx, cfg, s.tree, dirs, process)
+	}
+	if err != nil && err != errScanInterrupted {
+		log.Printf("Error walking through files: %v", err)
+	}
+
+	wg.Wait()
+	if s.batch != nil {
+		s.batch.flush()
+	}
+	if partitions != nil {
+		partitions.wait()
+	}
+
+	if dirs != nil {
+		if err != nil {
+			log.Printf("Not saving directory mtimes since the walk did not complete")
+		} else if err := dirs.save(); err != nil {
+			log.Printf("Failed to save directory mtimes: %v", err)
+		}
+		log.Print(msg("IncrementalSkipped", map[string]any{"Count": dirs.skipped}))
+	}
+	return s.seen.collisionCount(), checkpoint
+}
+
+// walkFiles calls visit for every regular file under scanRoot(cfg), or the files and directories named as arguments,
+// that isn't excluded, skipped as part of an unchanged directory when dirs is non-nil, or walked before
+// cfg.ResumeAfter. The directories are read through tree, and a root that is itself a regular file is visited on its
+// own. The walk stops with errScanInterrupted once ctx is done.
+func walkFiles(ctx context.Context, cfg Config, tree treeReader, dirs *dirTracker, visit func(path string, info os.FileInfo)) error {
+	roots := cfg.Paths
+	if len(roots) == 0 {
+		roots = []string{scanRoot(cfg)}
+	}
+	for _, root := range roots {
+		if err := walkRoot(ctx, cfg, tree, root, dirs, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-			log.Printf("Path: %s Hash: %s, Size: %d, Status: %s", path, hash, size, status)
-			if writeErr := writer.Write([]string{storedPath, hash, fmt.Sprintf("%d", size), status}); writeErr != nil {
-				log.Printf("Failed to write result to CSV for file %s: %v", path, writeErr)
+func walkRoot(ctx context.Context, cfg Config, tree treeReader, root string, dirs *dirTracker, visit func(path string, info os.FileInfo)) error {
+	skip := func(path string, d fs.DirEntry) bool {
+		if cfg.ResumeAfter != "" && path != root && walkedBefore(path, cfg.ResumeAfter, d.IsDir()) {
+			return true
+		}
+		if d.IsDir() {
+			if reason := exclusion(cfg, root, path, true); reason != "" {
+				log.Printf("Skipping directory %s due to %s", path, reason)
+				return true
+			}
+			if dirs != nil {
+				info, err := d.Info()
+				if err == nil {
+					err = dirs.visitDir(path, storedPathFor(cfg, path), info)
+				}
+				if err != nil {
+					log.Printf("Failed to check directory %s for changes, scanning it fully: %v", path, err)
+				}
+			}
+			return false
+		}
+		if d.Name() == manifestName {
+			return true
+		}
+		if reason := exclusion(cfg, root, path, false); reason != "" {
+			log.Printf("Skipping file %s due to %s", path, reason)
+			return true
+		}
+		return dirs != nil && dirs.skipFile(path)
+	}
+	err := indexer.Walk(ctx, root, tree.walk, skip, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			if denied.count(path, info != nil && info.IsDir(), err) {
+				log.Printf("Error accessing %s: %v", path, err)
 			}
-			writer.Flush()
-		}(path, storedPath)
+			if tree.share != nil {
+				tree.share.recordFailure(path)
+			}
+			return nil
+		}
+		if !filteredOut(cfg, path, info) {
+			visit(path, info)
+		}
 		return nil
 	})
+	if ctx.Err() != nil {
+		return errScanInterrupted
+	}
+	return err
+}
 
-	if err != nil {
-		log.Printf("Error walking through files: %v", err)
+// scanRoot returns the directory a scan walks: cfg.Directory, or the --subpath under it.
+func scanRoot(cfg Config) string {
+	if cfg.Subpath == "" {
+		return cfg.Directory
 	}
+	return filepath.Join(cfg.Directory, cfg.Subpath)
+}
 
-	wg.Wait()
+// rootConfigs returns cfg once for every --directory, with Directory set to it, or just cfg if there is none.
+func rootConfigs(cfg Config) []Config {
+	if len(cfg.Roots) == 0 {
+		return []Config{cfg}
+	}
+	configs := make([]Config, len(cfg.Roots))
+	for i, root := range cfg.Roots {
+		configs[i] = cfg
+		configs[i].Directory = root
+		configs[i].Prefix = rootPrefix(root, cfg.Prefixes)
+	}
+	return configs
 }
 
-func main() {
-	cfg := parseFlags()
-	db := connectToDatabase(cfg)
-	defer db.Close()
+// rootPrefix returns the prefix stripped from the paths under root: the only --prefix, or of several, the longest one
+// root is under, if any.
+func rootPrefix(root string, prefixes []string) string {
+	if len(prefixes) == 1 {
+		return prefixes[0]
+	}
+	var longest string
+	for _, prefix := range prefixes {
+		if hasPathPrefix(root, prefix) && len(prefix) > len(longest) {
+			longest = prefix
+		}
+	}
+	return longest
+}
 
-	log.Printf("Creating table if it doesn't exist")
-	if _, err := db.Exec(createTableQuery); err != nil {
-		log.Fatalf("Failed to create table: %v", err)
+// scannedRoots names what a scan walks for messages: scanRoot(cfg), or with several --directory roots, all of them.
+func scannedRoots(cfg Config) string {
+	if len(cfg.Roots) > 1 {
+		return strings.Join(cfg.Roots, ", ")
 	}
+	return scanRoot(cfg)
+}
 
-	writer, outputFile := createOutputWriter(cfg.OutputFile)
-	defer func() {
-		writer.Flush()
-		outputFile.Close()
-	}()
+// within reports whether path is root or inside it.
+func within(path, root string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
 
-	writerMutex := &sync.Mutex{}
-	processDirectory(cfg, db, writer, writerMutex)
+// scannedPrefix returns the stored path prefix of the files under scanRoot(cfg), ending in a slash so that a sibling
+// whose name merely starts the same isn't included, or "" if the scan covers the whole index.
+func scannedPrefix(cfg Config) string {
+	under := storedPathFor(cfg, scanRoot(cfg))
+	if under != "" {
+		under = strings.TrimSuffix(under, "/") + "/"
+	}
+	return under
+}
 
-	log.Printf("MD5 hash calculation and storage completed. Results saved to %s", cfg.OutputFile)
+// storedPathFor returns the path as stored in the database, with cfg.Prefix removed.
+func storedPathFor(cfg Config, path string) string {
+	if cfg.Prefix != "" && hasPathPrefix(path, cfg.Prefix) {
+		return path[len(cfg.Prefix):]
+	}
+	return path
 }
 
-func processFile(path, storedPath string, db *sql.DB, force bool) (string, int64, string, error) {
-	// Open the file for reading
-	file, err := os.Open(path)
-	if err != nil {
-		return "", -1, "", fmt.Errorf("failed to open file %s: %v", path, err)
+// hasPathPrefix reports whether path starts with prefix at a path separator, so that a --prefix of /mnt/i matches
+// /mnt/i and /mnt/i/photos but not /mnt/img.
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
 	}
-	defer file.Close()
+	return prefix == "" || len(path) == len(prefix) || os.IsPathSeparator(prefix[len(prefix)-1]) ||
+		os.IsPathSeparator(path[len(prefix)])
+}
 
-	// Retrieve file metadata
-	size, fileTimestamp, err := getFileMetadata(file)
-	if err != nil {
-		return "", -1, "", fmt.Errorf("failed to retrieve metadata for file %s: %v", path, err)
+func writeErrorResult(sink resultSink, slot int, path, storedPath string, err error) {
+	if denied.count(path, false, err) {
+		log.Printf("Skipping file %s due to error: %v", path, err)
 	}
+	if writeErr := sink.Write(slot, []string{storedPath, "", "-1", fmt.Sprintf("error: %v", err)}); writeErr != nil {
+		log.Printf("Failed to write error to CSV for file %s: %v", path, writeErr)
+	}
+}
 
-	if force {
-		hash, err := hashFile(file)
+// subcommand is an entry point receiving the arguments after the subcommand name, plus the message ID of the
+// one-line summary listed in the usage.
+type subcommand struct {
+	run     func(args []string)
+	summary string
+}
+
+// commands maps subcommand names to their entry points. Running without a subcommand scans a directory.
+var commands = map[string]subcommand{
+	"simulate-rules": {run: runSimulateRules, summary: "CommandSimulateRules"},
+	"rewrite-paths":  {run: runRewritePaths, summary: "CommandRewritePaths"},
+	"bench":          {run: runBench, summary: "CommandBench"},
+	"examples":       {run: runExamples, summary: "CommandExamples"},
+	"query":          {run: runQuery, summary: "CommandQuery"},
+	"lineage":        {run: runLineage, summary: "CommandLineage"},
+	"cold-report":    {run: runColdReport, summary: "CommandColdReport"},
+	"dupes":          {run: runDupes, summary: "CommandDupes"},
+	"prune":          {run: runPrune, summary: "CommandPrune"},
+	"verify-output":  {run: runVerifyOutput, summary: "CommandVerifyOutput"},
+	"seal":           {run: runSeal, summary: "CommandSeal"},
+	"serve":          {run: runServe, summary: "CommandServe"},
+	"token":          {run: runToken, summary: "CommandToken"},
+	"flush-wal":      {run: runFlushWAL, summary: "CommandFlushWAL"},
+	"schema":         {run: runSchema, summary: "CommandSchema"},
+	"check":          {run: runCheck, summary: "CommandCheck"},
+	"lookup":         {run: runLookup, summary: "CommandLookup"},
+	"mount":          {run: runMount, summary: "CommandMount"},
+	"diff":           {run: runDiff, summary: "CommandDiff"},
+	"image":          {run: runImage, summary: "CommandImage"},
+	"compare":        {run: runCompare, summary: "CommandCompare"},
+	"export":         {run: runExport, summary: "CommandExport"},
+	"report":         {run: runReport, summary: "CommandReport"},
+	"decrypt":        {run: runDecrypt, summary: "CommandDecrypt"},
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command.run(os.Args[2:])
+			return
+		}
+	}
+	runScan("scan", os.Args[1:])
+}
+
+// runScanCommand is the scan command, which is also what runs without one.
+func runScanCommand(args []string) {
+	runScan("scan", args)
+}
+
+// runVerify is the verify command: a scan that re-hashes the indexed files to find corrupt ones, or with
+// --verify-against, compares them with a replica.
+func runVerify(args []string) {
+	runScan("verify", args)
+}
+
+func runScan(command string, args []string) {
+	cfg := parseFlags(command, args)
+	// The budget counts from here, so time spent replaying the write-ahead log or preloading counts too.
+	deadline := time.Now().Add(cfg.MaxRuntime)
+	quickHashMin = cfg.QuickHash
+	var tree treeReader
+	if cfg.NetworkShare {
+		tree.share = newShareSweep()
+	}
+	if cfg.ReadOnlyGuarantee {
+		tree.readOnly = newReadOnlyGuard(cfg)
+	}
+	if cfg.MaxReadMBps > 0 {
+		throttle = newReadThrottle(cfg.MaxReadMBps)
+	}
+	if cfg.MaxReadMBpsFile != "" {
+		rate, err := readRateFile(cfg.MaxReadMBpsFile)
+		if err != nil {
+			log.Fatalf("Failed to read --max-read-mbps-file: %v", err)
+		}
+		throttle = newReadThrottle(rate)
+		throttle.follow(cfg.MaxReadMBpsFile)
+	}
+	if cfg.ValidateConfig {
+		validateSetup(cfg)
+		return
+	}
+	if cfg.PprofAddr != "" {
+		startPprofServer(cfg.PprofAddr)
+	}
+	if cfg.DiagDir != "" {
+		startDiagnosticDumps(cfg.DiagDir, cfg.DiagInterval)
+	}
+	if cfg.EnumerateOnly != "" {
+		count, err := writeWorklist(cfg, tree, cfg.EnumerateOnly)
 		if err != nil {
-			return "", -1, "", fmt.Errorf("failed to hash file %s: %v", path, err)
+			log.Fatalf("Failed to write worklist: %v", err)
+		}
+		log.Print(msg("WorklistWritten", map[string]any{"Count": count, "Path": cfg.EnumerateOnly}))
+		return
+	}
+	if cfg.PrivacyMode {
+		cfg.PrivacySalt = readPrivacySalt()
+	}
+	if len(cfg.EncryptColumns) > 0 {
+		cfg.ColumnKey = readColumnKey()
+	}
+	// With --db-driver sqlite there is no PostgreSQL database: db stays nil, and the features that would use it were
+	// refused by parseFlags.
+	var db *sql.DB
+	if cfg.DBDriver != "sqlite" {
+		db = connectToDatabase(cfg.DBConfig)
+		defer db.Close()
+		createScanTables(cfg, db)
+	}
+
+	if cfg.Store != "" {
+		var err error
+		if index, err = store.Open(cfg.Store, cfg.StoreDSN); err != nil {
+			log.Fatalf("Failed to open --store %s: %v", cfg.Store, err)
+		}
+		defer index.Close()
+	}
+
+	var queue *workQueue
+	if cfg.Enqueue || cfg.FromQueue {
+		var err error
+		if queue, err = newWorkQueue(db, cfg.WorkerID, cfg.QueueLease); err != nil {
+			log.Fatalf("Failed to create queue table: %v", err)
 		}
-		if err := updateFileRecord(db, storedPath, hash, size, fileTimestamp); err != nil {
-			return "", -1, "", fmt.Errorf("failed to update record for file %s: %v", path, err)
+	}
+	if cfg.Enqueue {
+		count, err := queue.enqueue(cfg, tree)
+		if err != nil {
+			log.Fatalf("Failed to enqueue files: %v", err)
 		}
-		return hash, size, "forced", nil
+		log.Print(msg("Enqueued", map[string]any{"Count": count}))
+		return
 	}
 
-	// Check if the file exists in the database
-	dbHash, dbSize, err := getDatabaseRecord(db, storedPath)
-	if errors.Is(err, sql.ErrNoRows) {
-		// If no record exists, hash and insert the file
-		hash, err := hashFile(file)
+	if cfg.WALPath != "" && cfg.VerifyAgainst == "" {
+		count, err := flushWAL(db, cfg.WALPath)
 		if err != nil {
-			return "", -1, "", fmt.Errorf("failed to hash file %s: %v", path, err)
+			log.Fatalf("Failed to replay the write-ahead log %s: %v", cfg.WALPath, err)
 		}
-		if err := insertFileRecord(db, storedPath, hash, size, fileTimestamp); err != nil {
-			return "", -1, "", fmt.Errorf("failed to insert record for file %s: %v", path, err)
+		if count > 0 {
+			log.Print(msg("WALFlushed", map[string]any{"Count": count, "Path": cfg.WALPath}))
 		}
-		return hash, size, "new", nil
-	} else if err != nil {
-		return "", -1, "", fmt.Errorf("failed to query database for %s: %v", storedPath, err)
+		if wal, err = openWAL(cfg.WALPath); err != nil {
+			log.Fatalf("Failed to open the write-ahead log %s: %v", cfg.WALPath, err)
+		}
+		defer wal.Close()
+	}
+
+	// Everything the scan opens with the privileges it started with is open by now; the tree is read as --run-as.
+	if cfg.RunAs != nil {
+		switchUser(cfg.RunAs, cfg.KeepReadAccess)
+	} else if os.Geteuid() > 0 && canReadAnything() {
+		log.Print(msg("ReadCapability", nil))
+	}
+
+	// After the write-ahead log is replayed too, so the files whose records it held are found.
+	if cfg.Glob != "" {
+		paths, missing, err := rescanPaths(cfg, db)
+		if err != nil {
+			log.Fatalf("Failed to find the indexed files under %s matching %s: %v", cfg.Under, cfg.Glob, err)
+		}
+		log.Print(msg("RescanMatched", map[string]any{"Count": len(paths) + missing, "Missing": missing, "Directory": cfg.Under, "Glob": cfg.Glob}))
+		if len(paths) == 0 {
+			return
+		}
+		cfg.Paths = paths
+	}
+	if !cfg.SkipPreflight {
+		preflight(cfg, db, tree)
+	}
+	var batch *recordBatch
+	if cfg.BatchSize > 1 && cfg.VerifyAgainst == "" {
+		batch = newRecordBatch(db, cfg.BatchSize)
 	}
+	if cfg.DetectMoves {
+		var err error
+		if moves, err = newMoveDetector(cfg, db); err != nil {
+			log.Fatalf("Failed to prepare move detection: %v", err)
+		}
+	}
+	// After the write-ahead log is replayed, so the preload sees the records it held.
+	if cfg.Preload {
+		var err error
+		if preloaded, err = preloadRecords(db, cfg); err != nil {
+			log.Fatalf("Failed to preload records under %s: %v", cfg.Directory, err)
+		}
+	}
+
+	hooks := newScanHooks(cfg, db, tree)
 
-	// Update the record if the size has changed
-	if size != dbSize {
-		hash, err := hashFile(file)
+	writer, outputFile := createOutputWriter(cfg.OutputFile, cfg.OutputFormat, cfg.SafeCSV)
+
+	var sink resultSink = &sharedSink{writer: writer}
+	if cfg.ShardOutput {
+		shards, err := newShardSink(writer, outputFile.Name(), cfg.SortOutput, cfg.Workers)
 		if err != nil {
-			return "", -1, "", fmt.Errorf("failed to hash file %s: %v", path, err)
+			log.Fatalf("Failed to create output shards: %v", err)
 		}
-		if err := updateFileRecord(db, storedPath, hash, size, fileTimestamp); err != nil {
-			return "", -1, "", fmt.Errorf("failed to update record for file %s: %v", path, err)
+		sink = shards
+	}
+	if cfg.HumanReadable {
+		sink = &humanSizeSink{resultSink: sink}
+	}
+	var stream *statusStream
+	if cfg.StatusStreamFD >= 0 {
+		stream = newStatusStream(cfg.StatusStreamFD)
+		sink = &statusSink{resultSink: sink, stream: stream}
+	}
+	var report *scanReport
+	if cfg.ReportHTML != "" || cfg.ReportTemplate != nil {
+		var err error
+		if report, err = newScanReport(cfg); err != nil {
+			log.Fatalf("Failed to create a temporary file for --report-template: %v", err)
 		}
-		return hash, size, "changed", nil
+		sink = &reportSink{resultSink: sink, report: report}
+	}
+	counts := &runCounts{}
+	counting := &countingSink{resultSink: sink, counts: counts}
+	sink = counting
+	s := &scanner{
+		db: db, sink: sink, hooks: hooks, queue: queue, seen: newStoredPathSet(cfg.MemoryLimit, cfg.SpillDir),
+		workers: cfg.Workers, tree: tree, batch: batch,
 	}
 
-	return dbHash, dbSize, "existing", nil
+	// From here on, the first SIGINT or SIGTERM lets the scan finish the files it started and write out their results.
+	started := time.Now()
+	ctx, stopInterrupts := interruptContext()
+	if cfg.MaxRuntime > 0 {
+		var stopRuntime context.CancelFunc
+		ctx, stopRuntime = runtimeContext(ctx, deadline, cfg.MaxRuntime)
+		defer stopRuntime()
+	}
+	// Every --directory is a scan run of its own, finished once the results file they share is written.
+	var runs []rootRun
+	var collisions int
+	var checkpoint string
+	for _, rootCfg := range rootConfigs(cfg) {
+		// An interrupted scan doesn't start the next root.
+		if len(runs) > 0 && ctx.Err() != nil {
+			break
+		}
+		run := rootRun{cfg: rootCfg, counts: counts}
+		if len(cfg.Roots) > 1 {
+			run.counts = &runCounts{}
+			counting.run = run.counts
+		}
+		run.id, run.cfg = startRootRun(db, rootCfg, run.counts)
+		s.epoch, s.writtenBy = rootEpochs(db, run.cfg, run.id)
+		runs = append(runs, run)
+		if stream != nil {
+			stream.scanStart(run.cfg.Directory)
+		}
+		var partitions *scanPartitions
+		if cfg.Partition {
+			var err error
+			if partitions, err = newScanPartitions(db, run.id, counts); err != nil {
+				log.Fatalf("Failed to create scan partitions table: %v", err)
+			}
+		}
+
+		var rootCollisions int
+		rootCollisions, checkpoint = s.processDirectory(ctx, run.cfg, partitions)
+		collisions += rootCollisions
+		if s.epoch != nil {
+			s.epoch.flush()
+		}
+		if s.writtenBy != nil {
+			s.writtenBy.flush()
+		}
+		// Collisions mean --prefix is wrong, and with it every stored path checked for deletion. An interrupted scan
+		// hasn't seen every file, so none are checked.
+		if cfg.DetectDeleted && collisions == 0 && ctx.Err() == nil {
+			var epochRun int64
+			if s.epoch != nil {
+				epochRun = s.epoch.run
+			}
+			missing, err := detectDeleted(run.cfg, db, sink, run.counts.processed.Load(), epochRun, pruneMark)
+			if err != nil {
+				log.Fatalf("Failed to detect deleted files: %v", err)
+			}
+			log.Print(msg("DeletedSummary", map[string]any{"Count": missing, "Directory": scanRoot(run.cfg)}))
+		}
+	}
+	s.seen.close()
+	interrupted := ctx.Err() != nil
+	outOfTime := errors.Is(context.Cause(ctx), errMaxRuntime)
+	stopInterrupts()
+	denied.logSummary()
+	hooks.finish()
+	if hooks.manifests != nil {
+		if interrupted {
+			log.Printf("Not writing directory manifests since the scan was interrupted")
+		} else {
+			hooks.manifests.write()
+		}
+	}
+	if err := sink.Close(); err != nil {
+		log.Printf("Failed to merge output shards: %v", err)
+	}
+	if stream != nil {
+		stream.summary()
+	}
+	if collisions > 0 {
+		writer.Flush()
+		outputFile.Close()
+		if report != nil && report.rows != nil {
+			report.rows.close()
+		}
+		log.Fatal(msg("ScanCollisions", map[string]any{
+			"Count": collisions, "Prefix": fmt.Sprintf("%q", strings.Join(cfg.Prefixes, ", ")), "Directory": fmt.Sprintf("%q", scannedRoots(cfg)), "Partial": outputFile.Name(),
+		}))
+	}
+
+	if err := finalizeOutput(writer, outputFile, cfg.OutputFile); err != nil {
+		log.Fatalf("Failed to finalize output file %s (partial results remain in %s): %v", cfg.OutputFile, outputFile.Name(), err)
+	}
+	last := runs[len(runs)-1]
+	if report != nil {
+		// The report covers every root, so it names a run only if there is just the one.
+		var reportRun int64
+		if len(cfg.Roots) <= 1 {
+			reportRun = last.id
+		}
+		summary := report.summary(cfg, reportRun, interrupted)
+		if cfg.ReportHTML != "" {
+			if err := writeHTMLReport(cfg.ReportHTML, summary); err != nil {
+				log.Printf("Failed to write HTML report %s: %v", cfg.ReportHTML, err)
+			}
+		}
+		if cfg.ReportTemplate != nil {
+			if err := report.writeTemplateReport(cfg.ReportOutput, cfg.ReportTemplate, summary); err != nil {
+				log.Printf("Failed to write --report-template report %s: %v", cfg.ReportOutput, err)
+			}
+			report.rows.close()
+		}
+	}
+	if tree.readOnly != nil {
+		tree.readOnly.writeAttestation(cfg, db, runs)
+	}
+	// The runs of the roots before the one interrupted went all the way through.
+	if interrupted {
+		runs = runs[:len(runs)-1]
+	}
+	for _, run := range runs {
+		if run.id != 0 {
+			if err := finishScanRun(db, run.id, run.cfg, run.counts); err != nil {
+				log.Printf("Failed to record the end of scan run %d: %v", run.id, err)
+			}
+		}
+	}
+	if interrupted {
+		if tree.share != nil {
+			tree.share.logSummary(scannedRoots(cfg))
+		}
+		finishInterruptedScan(last.cfg, db, last.id, checkpoint, last.counts, counts.processed.Load(), started, outOfTime)
+	}
+
+	log.Print(msg("ScanCompleted", map[string]any{"Output": cfg.OutputFile}))
+	if cfg.Verify {
+		log.Print(msg("VerifySummary", map[string]any{"Count": counts.corrupt.Load()}))
+	}
+	if moves != nil {
+		log.Print(msg("MovesSummary", map[string]any{"Count": moves.count.Load()}))
+	}
+	if tree.share != nil {
+		tree.share.logSummary(scannedRoots(cfg))
+	}
+
+	if len(cfg.Quotas) > 0 {
+		alerts, err := checkQuotas(db, cfg.Quotas)
+		if err != nil {
+			log.Fatalf("Failed to check quotas: %v", err)
+		}
+		if len(alerts) > 0 {
+			sendAlerts(cfg, alerts)
+			if !cfg.Watch {
+				db.Close()
+				os.Exit(quotaExitCode)
+			}
+		}
+	}
+	if cfg.Watch {
+		watchDirectory(cfg, s)
+	}
+}
+
+// createScanTables creates the tables and columns the scan writes to, as far as cfg needs them.
+func createScanTables(cfg Config, db *sql.DB) {
+	log.Printf("Creating table if it doesn't exist")
+	if _, err := db.Exec(createTableQuery); err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+	if _, err := db.Exec(createFileHistoryTableQuery); err != nil {
+		log.Fatalf("Failed to create history table: %v", err)
+	}
+	if _, err := db.Exec(addHashAlgorithmColumnQuery); err != nil {
+		log.Fatalf("Failed to add hash_algorithm column: %v", err)
+	}
+	if err := indexer.UpgradeRecordedTimestamps(db); err != nil {
+		log.Fatalf("Failed to convert hash_calculated_timestamp to UTC: %v", err)
+	}
+	if cfg.RecordAtime {
+		if _, err := db.Exec(addAccessTimestampColumnQuery); err != nil {
+			log.Fatalf("Failed to add access_timestamp column: %v", err)
+		}
+		for _, root := range cfg.Roots {
+			warnAtimeMount(root)
+		}
+	}
+	if cfg.RecordAllocation {
+		if _, err := db.Exec(addAllocatedSizeColumnQuery); err != nil {
+			log.Fatalf("Failed to add allocated_size column: %v", err)
+		}
+	}
+	if cfg.ExtentMap {
+		if _, err := db.Exec(createFileExtentsTableQuery); err != nil {
+			log.Fatalf("Failed to create file extents table: %v", err)
+		}
+	}
+	if cfg.ChunkSize > 0 {
+		if _, err := db.Exec(createFileChunksTableQuery); err != nil {
+			log.Fatalf("Failed to create file chunks table: %v", err)
+		}
+	}
+	if cfg.DetectDeleted || cfg.Watch {
+		if _, err := db.Exec(addDeletedTimestampColumnQuery); err != nil {
+			log.Fatalf("Failed to add deleted_timestamp column: %v", err)
+		}
+	}
+	if cfg.ScanEpochs {
+		if _, err := db.Exec(addSeenRunColumnQuery); err != nil {
+			log.Fatalf("Failed to add seen_run_id column: %v", err)
+		}
+	}
+	if cfg.Store == "" {
+		if _, err := db.Exec(addRunColumnQuery); err != nil {
+			log.Fatalf("Failed to add run_id column: %v", err)
+		}
+	}
+}
+
+// changeDetectPolicies are the values of --change-detect, the indexer package's policies.
+var changeDetectPolicies = indexer.ChangeDetectPolicies
+
+// fileScanner returns the scanner s hashes its files with, which looks records up and writes them through --store, the
+// preload, the batch and the write-ahead log, reads the tree through s.tree, hashes with --quick-hash, throttling and
+// the pii checks (none if pii is nil), and moves the record of a file found under a new path along with it.
+func (s *scanner) fileScanner(pii *piiDetector) *indexer.Scanner {
+	db, tree, batch := s.db, s.tree, s.batch
+	files := indexer.NewScanner(scanStore{db, batch})
+	files.Open = tree.openForHashing
+	// With --quick-hash, large files are hashed from samples, under an algorithm of their own.
+	files.Algorithm = fileAlgorithm
+	files.Hash = func(file *os.File, storedPath, algorithm string) (string, string, error) {
+		return hashContents(file, storedPath, db, algorithm, pii, tree.share)
+	}
+	files.Write = func(record store.Record, status string) (string, error) {
+		// A file that was moved has its old record moved along, rather than a new one added beside it.
+		if status == "new" && moves != nil {
+			from, err := moves.claim(db, record.Path, record.Hash, record.Algorithm, record.Size, record.Modified)
+			if err != nil {
+				return "", fmt.Errorf("failed to look for a move: %v", err)
+			}
+			if from != "" {
+				return "moved", nil
+			}
+		}
+		outcome, err := upsertFileRecord(db, batch, record.Path, record.Hash, record.Algorithm, record.Size, record.Modified, status == "forced")
+		if err != nil {
+			return "", err
+		}
+		return writtenStatus(status, outcome), nil
+	}
+	return files
+}
+
+// fileOptions are the options of cfg that fileScanner's ScanFile goes by.
+func fileOptions(cfg Config) indexer.Options {
+	return indexer.Options{
+		Algorithm:    cfg.HashAlgorithm,
+		ChangeDetect: cfg.ChangeDetect,
+		Force:        cfg.Force,
+		Verify:       cfg.Verify,
+		MinRehashAge: cfg.MinRehashAge,
+	}
+}
+
+// scanStore is the store.Store of fileScanner, which only looks records up with it: writes go through the scanner's
+// Write.
+type scanStore struct {
+	db    *sql.DB
+	batch *recordBatch
+}
+
+func (s scanStore) Lookup(storedPath string) (store.Record, error) {
+	record, err := lookupFileRecord(s.db, storedPath)
+	if errors.Is(err, sql.ErrNoRows) {
+		return record, store.ErrNotFound
+	}
+	return record, err
+}
+
+func (s scanStore) Put(record store.Record) error {
+	_, err := upsertFileRecord(s.db, s.batch, record.Path, record.Hash, record.Algorithm, record.Size, record.Modified, false)
+	return err
+}
+
+func (s scanStore) Ping() error {
+	return s.db.Ping()
+}
+
+func (s scanStore) Close() error {
+	return nil
 }
 
 func getFileMetadata(file *os.File) (int64, time.Time, error) {
@@ -265,42 +1323,118 @@ func getFileMetadata(file *os.File) (int64, time.Time, error) {
 	return fileInfo.Size(), fileInfo.ModTime(), nil
 }
 
-func getDatabaseRecord(db *sql.DB, storedPath string) (string, int64, error) {
-	var dbHash string
-	var dbSize int64
-	err := db.QueryRow("SELECT hash, size FROM file_hashes WHERE filepath = $1", storedPath).Scan(&dbHash, &dbSize)
-	return dbHash, dbSize, err
+// getDatabaseRecord returns the indexed hash, size, hash algorithm and file modification time of a stored path, or
+// sql.ErrNoRows.
+func getDatabaseRecord(db *sql.DB, storedPath string) (string, int64, string, time.Time, error) {
+	record, err := lookupFileRecord(db, storedPath)
+	return record.Hash, record.Size, record.Algorithm, record.Modified, err
 }
 
-func hashFile(file *os.File) (string, error) {
-	hasher := md5.New()
+// lookupFileRecord returns the record of a stored path, with Recorded the time its hash was computed, or
+// sql.ErrNoRows.
+func lookupFileRecord(db *sql.DB, storedPath string) (store.Record, error) {
+	if index != nil {
+		return lookupStoreRecord(storedPath)
+	}
+	if preloaded != nil {
+		if record, ok, err := preloaded.lookup(storedPath); ok {
+			return store.Record{Path: storedPath, Hash: record.hash, Algorithm: record.algorithm, Size: record.size, Modified: record.modified, Recorded: record.hashed}, err
+		}
+	}
+	record := store.Record{Path: storedPath}
+	err := retryDB(db, "SELECT for "+storedPath, func() error {
+		return db.QueryRow("SELECT hash, size, coalesce(hash_algorithm, $2), file_timestamp, hash_calculated_timestamp FROM file_hashes WHERE filepath = $1", storedPath, defaultHashAlgorithm).
+			Scan(&record.Hash, &record.Size, &record.Algorithm, &record.Modified, &record.Recorded)
+	})
+	record.Modified = localWallClock(record.Modified)
+	return record, err
+}
+
+// hashFile hashes the whole file, also feeding the contents to any extra writers along the way. A sampled algorithm
+// hashes only the samples of --quick-hash, which extra writers don't see. Reads go through the retries of share
+// unless it is nil.
+func hashFile(file *os.File, algorithm string, share *shareSweep, extra ...io.Writer) (string, error) {
+	if base, ok := sampledAlgorithm(algorithm); ok {
+		return hashSamples(file, base, share)
+	}
+	if _, _, ok := chunkedAlgorithm(algorithm); ok {
+		hash, _, err := hashFileChunks(file, algorithm, share, extra...)
+		return hash, err
+	}
 	if _, err := file.Seek(0, 0); err != nil {
 		return "", err
 	}
-	if _, err := io.Copy(hasher, file); err != nil {
-		return "", err
+	if share != nil {
+		return hashReader(&shareReader{share: share, file: file}, algorithm, extra...)
 	}
-	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+	return hashReader(file, algorithm, extra...)
 }
 
-func insertFileRecord(db *sql.DB, storedPath, hash string, size int64, fileTimestamp time.Time) error {
-	for {
-		_, err := db.Exec("INSERT INTO file_hashes (filepath, hash, size, file_timestamp, hash_calculated_timestamp) VALUES ($1, $2, $3, $4, $5)", storedPath, hash, size, fileTimestamp, time.Now())
-		if err == nil {
-			return nil
-		}
-		log.Printf("Retrying INSERT for %s: %v", storedPath, err)
-		time.Sleep(1 * time.Second)
+// hashReader hashes everything read from reader with algorithm, one of hashAlgorithms.
+func hashReader(reader io.Reader, algorithm string, extra ...io.Writer) (string, error) {
+	if throttle != nil {
+		reader = &throttledReader{reader: reader}
 	}
+	return indexer.HashReader(reader, algorithm, extra...)
 }
 
-func updateFileRecord(db *sql.DB, storedPath, hash string, size int64, fileTimestamp time.Time) error {
-	for {
-		_, err := db.Exec("UPDATE file_hashes SET hash = $1, size = $2, file_timestamp = $3, hash_calculated_timestamp = $4 WHERE filepath = $5", hash, size, fileTimestamp, time.Now(), storedPath)
-		if err == nil {
-			return nil
+// recordHistoryQuery prefixes the file_hashes writes so the history row is added in the same statement, and so is
+// retried along with it.
+const recordHistoryQuery = "WITH history AS (INSERT INTO file_history (filepath, hash, size, file_timestamp, recorded_timestamp, hash_algorithm) VALUES ($1, $2, $3, $4, $6, $7)) "
+
+// upsertRecordQuery inserts or updates a file's row in one statement, adding a history row only if it did either. With
+// $8 false, a row already holding the same hash, size, modification time and algorithm is left alone. xmax is 0 only
+// in a row version this statement inserted, which tells the two writes apart.
+const upsertRecordQuery = `WITH upsert AS (
+    INSERT INTO file_hashes (filepath, hash, size, file_timestamp, hash_calculated_timestamp, hash_algorithm) VALUES ($1, $2, $3, $4, $5, $7)
+    ON CONFLICT (filepath) DO UPDATE SET hash = EXCLUDED.hash, size = EXCLUDED.size, file_timestamp = EXCLUDED.file_timestamp,
+        hash_calculated_timestamp = EXCLUDED.hash_calculated_timestamp, hash_algorithm = EXCLUDED.hash_algorithm
+    WHERE $8 OR file_hashes.hash <> EXCLUDED.hash OR file_hashes.size <> EXCLUDED.size
+        OR file_hashes.file_timestamp <> EXCLUDED.file_timestamp OR coalesce(file_hashes.hash_algorithm, $9) <> EXCLUDED.hash_algorithm
+    RETURNING xmax = 0 AS inserted
+), history AS (
+    INSERT INTO file_history (filepath, hash, size, file_timestamp, recorded_timestamp, hash_algorithm)
+    SELECT $1, $2, $3, $4, $6::timestamp, $7 FROM upsert
+)
+SELECT inserted FROM upsert`
+
+// upsertFileRecord writes the record of a file whether or not it is indexed yet, so that two runs scanning the same
+// files can't both insert it, or overwrite each other's record with the same one. Unless always is set, a row that
+// already matches is left untouched. It returns "new" if the row was inserted, "changed" if it was updated and
+// "existing" if it was left alone, or "" if the record went to --store, batch or the write-ahead log instead, where
+// that isn't known. batch is nil unless records are written with --batch-size.
+func upsertFileRecord(db *sql.DB, batch *recordBatch, storedPath, hash, algorithm string, size int64, fileTimestamp time.Time, always bool) (string, error) {
+	now := time.Now().UTC()
+	record := walRecord{Filepath: storedPath, Hash: hash, Algorithm: algorithm, Size: size, FileTimestamp: fileTimestamp, Recorded: now}
+	var outcome string
+	err := writeFileRecord(db, batch, "upsert for "+storedPath, record, func() error {
+		var inserted bool
+		err := db.QueryRow(upsertRecordQuery, storedPath, hash, size, fileTimestamp, now, now, algorithm, always, defaultHashAlgorithm).Scan(&inserted)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			outcome = "existing"
+		case err != nil:
+			return err
+		case inserted:
+			outcome = "new"
+		default:
+			outcome = "changed"
 		}
-		log.Printf("Retrying UPDATE for %s: %v", storedPath, err)
-		time.Sleep(1 * time.Second)
+		return nil
+	})
+	return outcome, err
+}
+
+// writtenStatus is the status of a file whose record was written expecting status, given the outcome of the write.
+// The index may have moved on since the file was looked up: a row removed meanwhile makes the file new, a row another
+// run already brought up to date leaves it existing, and one another run added first makes it changed. Forced files
+// stay forced.
+func writtenStatus(status, outcome string) string {
+	switch {
+	case outcome == "" || status == "forced":
+		return status
+	case outcome == "changed" && status != "new":
+		return status
 	}
+	return outcome
 }
@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestHasPathPrefix(t *testing.T) {
+	tests := []struct {
+		path, prefix string
+		want         bool
+	}{
+		{"/mnt/i", "", true},
+		{"/mnt/i", "/mnt/i", true},
+		{"/mnt/i/photos", "/mnt/i", true},
+		{"/mnt/i/photos", "/mnt/i/", true},
+		{"/mnt/img", "/mnt/i", false},
+		{"/mnt/i", "/mnt/i/", false},
+		{"/mnt", "/mnt/i", false},
+	}
+	for _, tt := range tests {
+		if got := hasPathPrefix(tt.path, tt.prefix); got != tt.want {
+			t.Errorf("hasPathPrefix(%q, %q) = %v, want %v", tt.path, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestRootPrefix(t *testing.T) {
+	tests := []struct {
+		root     string
+		prefixes []string
+		want     string
+	}{
+		{"/mnt/i/photos", nil, ""},
+		// A single --prefix applies to every root, as it always has.
+		{"/srv/data", []string{"/mnt/i"}, "/mnt/i"},
+		{"/mnt/i/photos", []string{"/mnt/i", "/mnt/j"}, "/mnt/i"},
+		{"/mnt/i/photos", []string{"/mnt", "/mnt/i/", "/mnt/i"}, "/mnt/i/"},
+		{"/mnt/img", []string{"/mnt/i", "/mnt/j"}, ""},
+		{"/mnt/img", []string{"/mnt/i", "/mnt"}, "/mnt"},
+		{"/mnt/i", []string{"/mnt/i", "/mnt/j"}, "/mnt/i"},
+	}
+	for _, tt := range tests {
+		if got := rootPrefix(tt.root, tt.prefixes); got != tt.want {
+			t.Errorf("rootPrefix(%q, %q) = %q, want %q", tt.root, tt.prefixes, got, tt.want)
+		}
+	}
+}
+
+func TestStoredPathFor(t *testing.T) {
+	tests := []struct {
+		prefix, path, want string
+	}{
+		{"", "/mnt/i/a.jpg", "/mnt/i/a.jpg"},
+		{"/mnt/i", "/mnt/i/a.jpg", "/a.jpg"},
+		{"/mnt/i/", "/mnt/i/a.jpg", "a.jpg"},
+		{"/mnt/i", "/mnt/i", ""},
+		{"/mnt/i", "/mnt/img/a.jpg", "/mnt/img/a.jpg"},
+		{"/mnt/i", "/srv/a.jpg", "/srv/a.jpg"},
+	}
+	for _, tt := range tests {
+		if got := storedPathFor(Config{Prefix: tt.prefix}, tt.path); got != tt.want {
+			t.Errorf("storedPathFor(prefix %q, %q) = %q, want %q", tt.prefix, tt.path, got, tt.want)
+		}
+	}
+}
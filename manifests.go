@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"fileindexer/pkg/indexer"
+)
+
+// manifestName is the file --write-manifests writes in each directory. Walks skip files of that name, so the
+// manifests of one scan aren't indexed by the next.
+const manifestName = ".fileindexer.sum"
+
+// manifestWriter gathers the hashes of the files a scan reads, by directory, and writes them out as checksum files in
+// the format of sha256sum and its siblings.
+type manifestWriter struct {
+	mu        sync.Mutex
+	algorithm string
+	roots     []string
+	files     map[string]map[string]string // directory -> file name -> hash
+}
+
+func newManifestWriter(cfg Config) *manifestWriter {
+	m := &manifestWriter{algorithm: cfg.HashAlgorithm, files: make(map[string]map[string]string)}
+	for _, rc := range rootConfigs(cfg) {
+		m.roots = append(m.roots, filepath.Clean(scanRoot(rc)))
+	}
+	return m
+}
+
+// record notes the hash of the file at path. A file found corrupt by --verify is left out, so that its manifest
+// doesn't vouch for the damaged copy.
+func (m *manifestWriter) record(path, hash, status string) {
+	if strings.HasPrefix(status, "corrupt") {
+		return
+	}
+	dir, name := filepath.Split(filepath.Clean(path))
+	dir = filepath.Clean(dir)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.files[dir] == nil {
+		m.files[dir] = make(map[string]string)
+	}
+	m.files[dir][name] = hash
+}
+
+// write writes a manifest in every directory holding a file the scan hashed, and in the directories between them and
+// the scanned root. A directory's manifest lists its files and the manifests of its subdirectories, so checking the
+// one at the top of a subtree also shows whether any manifest below it was altered. Deeper directories go first, so
+// that each manifest's own hash is known when its parent's is written.
+func (m *manifestWriter) write() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	subdirs := make(map[string][]string)
+	dirs := make(map[string]bool)
+	for dir := range m.files {
+		dirs[dir] = true
+		root := m.rootOf(dir)
+		for dir != root && root != "" {
+			parent := filepath.Dir(dir)
+			if !slices.Contains(subdirs[parent], filepath.Base(dir)) {
+				subdirs[parent] = append(subdirs[parent], filepath.Base(dir))
+			}
+			dirs[parent] = true
+			dir = parent
+		}
+	}
+	ordered := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		ordered = append(ordered, dir)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		if di, dj := strings.Count(ordered[i], string(filepath.Separator)), strings.Count(ordered[j], string(filepath.Separator)); di != dj {
+			return di > dj
+		}
+		return ordered[i] < ordered[j]
+	})
+
+	written, failed := 0, 0
+	for _, dir := range ordered {
+		entries := make(map[string]string, len(m.files[dir])+len(subdirs[dir]))
+		for name, hash := range m.files[dir] {
+			entries[name] = hash
+		}
+		for _, sub := range subdirs[dir] {
+			// A subdirectory whose manifest couldn't be written is simply not listed.
+			if hash, ok := m.files[filepath.Join(dir, sub)][manifestName]; ok {
+				entries[sub+"/"+manifestName] = hash
+			}
+		}
+		hash, err := m.writeManifest(dir, entries)
+		if err != nil {
+			log.Printf("Failed to write manifest in %s: %v", dir, err)
+			failed++
+			continue
+		}
+		// The manifest's hash is filed with the directory's files for its parent to list.
+		if m.files[dir] == nil {
+			m.files[dir] = make(map[string]string)
+		}
+		m.files[dir][manifestName] = hash
+		written++
+	}
+	log.Print(msg("ManifestsWritten", map[string]any{"Count": written, "Failed": failed, "Name": manifestName}))
+}
+
+// rootOf returns the scanned root dir lies in, or "" if none.
+func (m *manifestWriter) rootOf(dir string) string {
+	for _, root := range m.roots {
+		if within(dir, root) {
+			return root
+		}
+	}
+	return ""
+}
+
+// writeManifest replaces the manifest in dir with entries, sorted by name, returning its hash.
+func (m *manifestWriter) writeManifest(dir string, entries map[string]string) (string, error) {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		buf.WriteString(manifestLine(entries[name], name))
+	}
+
+	path := filepath.Join(dir, manifestName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return indexer.HashReader(bytes.NewReader(buf.Bytes()), m.algorithm)
+}
+
+// manifestLine formats a line of a checksum file as sha256sum writes it: a name holding a backslash, newline or
+// carriage return has them escaped, and the line then starts with a backslash.
+func manifestLine(hash, name string) string {
+	if !strings.ContainsAny(name, "\\\n\r") {
+		return fmt.Sprintf("%s  %s\n", hash, name)
+	}
+	name = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r").Replace(name)
+	return fmt.Sprintf("\\%s  %s\n", hash, name)
+}
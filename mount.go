@@ -0,0 +1,295 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// mountCacheTTL is how long a listing of the mounted index is reused, and how long the kernel may cache names and
+// attributes. Lookups of each name in a directory would otherwise each list the directory again.
+const mountCacheTTL = time.Minute
+
+// maxMountEntries caps each directory of the mounted index, since file managers list directories in full.
+const maxMountEntries = 10000
+
+// runMount exposes the index as a read-only FUSE filesystem of symlinks to the indexed files, grouped by hash, by
+// modification date and into duplicate sets. It is experimental: every directory is a query, and large indexes make
+// for slow listings.
+func runMount(args []string) {
+	fs := flag.NewFlagSet("mount", flag.ContinueOnError)
+	var dbCfg DBConfig
+	registerDBFlags(fs, &dbCfg)
+	prefix := fs.String("prefix", "", "Prefix the scan removed from file paths, put back in front of stored paths to make the symlink targets.")
+	configFile, configSet := registerConfigFlags(fs)
+	debug := fs.Bool("debug", false, "Log every FUSE request.")
+	fs.Usage = commandUsage(fs, "MountUsage")
+	parseArgs(fs, args)
+
+	readDBConfigFile(fs, *configFile, *configSet)
+	if fs.NArg() != 1 {
+		usageError(fs, "", msg("MountUsage", nil))
+	}
+	if dbCfg.DbName == "" {
+		usageError(fs, "dbname", msg("MissingFlag", map[string]any{"Flag": "dbname"}))
+	}
+
+	db := connectToDatabase(dbCfg)
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+
+	index := &mountedIndex{db: db, prefix: *prefix}
+	ttl := mountCacheTTL
+	server, err := fusefs.Mount(fs.Arg(0), index.root(), &fusefs.Options{
+		EntryTimeout: &ttl,
+		AttrTimeout:  &ttl,
+		MountOptions: fuse.MountOptions{FsName: "fileindexer:" + dbCfg.DbName, Name: "fileindexer", Options: []string{"ro"}, Debug: *debug},
+	})
+	if err != nil {
+		log.Fatalf("Failed to mount %s: %v", fs.Arg(0), err)
+	}
+	log.Print(msg("Mounted", map[string]any{"Path": fs.Arg(0)}))
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		if err := server.Unmount(); err != nil {
+			log.Printf("Failed to unmount %s: %v", fs.Arg(0), err)
+		}
+	}()
+	server.Wait()
+}
+
+// mountedIndex builds the directories of the mounted index.
+type mountedIndex struct {
+	db     *sql.DB
+	prefix string
+}
+
+// mountEntry is one name in a directory of the mounted index: a subdirectory, or a symlink to an indexed file.
+type mountEntry struct {
+	name   string
+	target string    // for symlinks
+	dir    *mountDir // for subdirectories
+}
+
+// mountDir is a directory of the mounted index, listed from the database when it is read.
+type mountDir struct {
+	fusefs.Inode
+	list func(ctx context.Context) ([]mountEntry, error)
+
+	mu      sync.Mutex
+	entries []mountEntry
+	listed  time.Time
+}
+
+var (
+	_ fusefs.NodeReaddirer = (*mountDir)(nil)
+	_ fusefs.NodeLookuper  = (*mountDir)(nil)
+	_ fusefs.NodeGetattrer = (*mountDir)(nil)
+)
+
+func newMountDir(list func(ctx context.Context) ([]mountEntry, error)) *mountDir {
+	return &mountDir{list: list}
+}
+
+// cachedEntries lists the directory, reusing a listing made within mountCacheTTL.
+func (d *mountDir) cachedEntries(ctx context.Context) ([]mountEntry, syscall.Errno) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.entries != nil && time.Since(d.listed) < mountCacheTTL {
+		return d.entries, 0
+	}
+	entries, err := d.list(ctx)
+	if err != nil {
+		log.Printf("Failed to list %s: %v", d.Path(nil), err)
+		return nil, syscall.EIO
+	}
+	if entries == nil {
+		entries = []mountEntry{}
+	}
+	d.entries, d.listed = entries, time.Now()
+	return entries, 0
+}
+
+func (d *mountDir) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
+	entries, errno := d.cachedEntries(ctx)
+	if errno != 0 {
+		return nil, errno
+	}
+	result := make([]fuse.DirEntry, len(entries))
+	for i, entry := range entries {
+		result[i] = fuse.DirEntry{Name: entry.name, Mode: fuse.S_IFLNK}
+		if entry.dir != nil {
+			result[i].Mode = fuse.S_IFDIR
+		}
+	}
+	return fusefs.NewListDirStream(result), 0
+}
+
+func (d *mountDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	entries, errno := d.cachedEntries(ctx)
+	if errno != 0 {
+		return nil, errno
+	}
+	for _, entry := range entries {
+		if entry.name != name {
+			continue
+		}
+		if entry.dir != nil {
+			out.Mode = fuse.S_IFDIR | 0o555
+			return d.NewInode(ctx, entry.dir, fusefs.StableAttr{Mode: fuse.S_IFDIR}), 0
+		}
+		out.Mode = fuse.S_IFLNK | 0o777
+		out.Size = uint64(len(entry.target))
+		return d.NewInode(ctx, &fusefs.MemSymlink{Data: []byte(entry.target)}, fusefs.StableAttr{Mode: fuse.S_IFLNK}), 0
+	}
+	return nil, syscall.ENOENT
+}
+
+func (d *mountDir) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = fuse.S_IFDIR | 0o555
+	return 0
+}
+
+// root is the top of the mount:
+//
+//	by-hash/<first two hex digits>/<hash>/<file name>
+//	by-date/<year>/<month>/<day>/<file name>
+//	duplicates/<hash>/<file name>
+func (m *mountedIndex) root() *mountDir {
+	return newMountDir(func(ctx context.Context) ([]mountEntry, error) {
+		return []mountEntry{
+			{name: "by-hash", dir: newMountDir(m.hashBuckets)},
+			{name: "by-date", dir: newMountDir(m.dateParts("", "YYYY", ""))},
+			{name: "duplicates", dir: newMountDir(m.duplicateSets)},
+		}, nil
+	})
+}
+
+// hashBuckets spreads by-hash over 256 directories by the first two digits, so no one directory lists every hash.
+func (m *mountedIndex) hashBuckets(ctx context.Context) ([]mountEntry, error) {
+	entries := make([]mountEntry, 0, 256)
+	for i := 0; i < 256; i++ {
+		bucket := fmt.Sprintf("%02x", i)
+		entries = append(entries, mountEntry{name: bucket, dir: newMountDir(func(ctx context.Context) ([]mountEntry, error) {
+			return m.hashDirs(ctx, "SELECT DISTINCT hash FROM file_hashes WHERE hash LIKE $1 ORDER BY hash LIMIT $2", bucket+"%")
+		})})
+	}
+	return entries, nil
+}
+
+// duplicateSets lists the hashes of contents indexed under more than one path, most wasted space first.
+func (m *mountedIndex) duplicateSets(ctx context.Context) ([]mountEntry, error) {
+	return m.hashDirs(ctx, "SELECT hash FROM file_hashes GROUP BY hash, size HAVING count(*) > 1 ORDER BY size * (count(*) - 1) DESC, hash LIMIT $1")
+}
+
+// hashDirs makes a directory for each hash returned by query, whose last parameter is the entry limit.
+func (m *mountedIndex) hashDirs(ctx context.Context, query string, args ...any) ([]mountEntry, error) {
+	names, err := m.queryStrings(ctx, query, append(args, maxMountEntries)...)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]mountEntry, len(names))
+	for i, hash := range names {
+		entries[i] = mountEntry{name: hash, dir: newMountDir(func(ctx context.Context) ([]mountEntry, error) {
+			return m.files(ctx, "SELECT filepath FROM file_hashes WHERE hash = $1 ORDER BY filepath LIMIT $2", hash)
+		})}
+	}
+	return entries, nil
+}
+
+// dateParts lists the years, months or days (by format, a to_char pattern) with files modified in the period of
+// length span starting at start, or in any period if start is empty. Days hold the files themselves.
+func (m *mountedIndex) dateParts(start, format, span string) func(ctx context.Context) ([]mountEntry, error) {
+	return func(ctx context.Context) ([]mountEntry, error) {
+		query := "SELECT DISTINCT to_char(file_timestamp, $1) FROM file_hashes ORDER BY 1 LIMIT $2"
+		args := []any{format}
+		if start != "" {
+			query = `
+SELECT DISTINCT to_char(file_timestamp, $1) FROM file_hashes
+WHERE file_timestamp >= $2::timestamp AND file_timestamp < $2::timestamp + $3::interval ORDER BY 1 LIMIT $4`
+			args = append(args, start, span)
+		}
+		parts, err := m.queryStrings(ctx, query, append(args, maxMountEntries)...)
+		if err != nil {
+			return nil, err
+		}
+		entries := make([]mountEntry, len(parts))
+		for i, part := range parts {
+			var list func(ctx context.Context) ([]mountEntry, error)
+			switch format {
+			case "YYYY":
+				list = m.dateParts(part+"-01-01", "MM", "1 year")
+			case "MM":
+				list = m.dateParts(start[:len("2006-")]+part+"-01", "DD", "1 month")
+			default:
+				day := start[:len("2006-01-")] + part
+				list = func(ctx context.Context) ([]mountEntry, error) {
+					return m.files(ctx, `
+SELECT filepath FROM file_hashes
+WHERE file_timestamp >= $1::timestamp AND file_timestamp < $1::timestamp + interval '1 day' ORDER BY filepath LIMIT $2`, day)
+				}
+			}
+			entries[i] = mountEntry{name: part, dir: newMountDir(list)}
+		}
+		return entries, nil
+	}
+}
+
+// files makes a symlink for each stored path returned by query, whose last parameter is the entry limit. Symlinks are
+// named after the files, with " (2)", " (3)" and so on added to repeated names.
+func (m *mountedIndex) files(ctx context.Context, query string, args ...any) ([]mountEntry, error) {
+	paths, err := m.queryStrings(ctx, query, append(args, maxMountEntries)...)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]mountEntry, len(paths))
+	seen := make(map[string]int)
+	for i, storedPath := range paths {
+		name := path.Base(storedPath)
+		seen[name]++
+		if n := seen[name]; n > 1 {
+			ext := path.Ext(name)
+			name = fmt.Sprintf("%s (%d)%s", name[:len(name)-len(ext)], n, ext)
+		}
+		entries[i] = mountEntry{name: name, target: m.prefix + storedPath}
+	}
+	return entries, nil
+}
+
+func (m *mountedIndex) queryStrings(ctx context.Context, query string, args ...any) ([]string, error) {
+	rows, err := m.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+	if len(result) == maxMountEntries {
+		log.Printf("Only the first %d entries of a directory are shown", maxMountEntries)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package main
+
+import "log"
+
+// runMount needs FUSE, which go-fuse only supports on Linux and macOS.
+func runMount(args []string) {
+	log.Fatalf("mount is only supported on Linux and macOS")
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// moves detects files that were moved or renamed with --detect-moves, or is nil.
+var moves *moveDetector
+
+// moveDetector finds, for a file new to the index, an indexed file under the scanned directory with the same contents
+// whose path no longer exists, and moves that record to the new path instead of adding a second one. pii_findings,
+// file_extents and file_chunks, which describe the file's contents, follow it when those tables exist; file_history
+// and file_lineage keep the old path, which is where the file was when they were recorded.
+type moveDetector struct {
+	cfg     Config
+	under   string
+	follows []string // the tables of pathColumns that exist and move along with a record
+	count   atomic.Int64
+}
+
+func newMoveDetector(cfg Config, db *sql.DB) (*moveDetector, error) {
+	if _, err := db.Exec(addDeletedTimestampColumnQuery); err != nil {
+		return nil, err
+	}
+	// The hash index that --record-lineage uses makes looking up the candidates cheap.
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS file_hashes_hash ON file_hashes (hash)"); err != nil {
+		return nil, err
+	}
+	m := &moveDetector{cfg: cfg, under: scannedPrefix(cfg)}
+	for _, table := range []string{"pii_findings", "file_extents", "file_chunks"} {
+		exists, err := tableExists(db, table)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			m.follows = append(m.follows, table)
+		}
+	}
+	return m, nil
+}
+
+// claim moves the record of a missing file with the same hash, size and algorithm to storedPath and returns the path
+// it was moved from, or "" if there is none. Candidates are looked up on disk like --detect-deleted does, so a file
+// that is only excluded or unreadable isn't taken for moved. Two copies of a moved file can't both claim its record,
+// since the move only happens if the record is still where it was found.
+func (m *moveDetector) claim(db *sql.DB, storedPath, hash, algorithm string, size int64, fileTimestamp time.Time) (string, error) {
+	var candidates []string
+	err := retryDB(db, "moved-file candidates for "+storedPath, func() error {
+		candidates = candidates[:0]
+		rows, err := db.Query("SELECT filepath FROM file_hashes WHERE hash = $1 AND size = $2 AND coalesce(hash_algorithm, $3) = $4 AND filepath LIKE $5 AND filepath <> $6 ORDER BY filepath",
+			hash, size, defaultHashAlgorithm, algorithm, likePrefix(m.under), storedPath)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var candidate string
+			if err := rows.Scan(&candidate); err != nil {
+				return err
+			}
+			candidates = append(candidates, candidate)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for _, candidate := range candidates {
+		if _, err := os.Lstat(localPathFor(m.cfg, candidate)); !os.IsNotExist(err) {
+			continue
+		}
+		// As with deletions, a whole top directory missing under the prefix is more likely another drive's.
+		if m.under == "" && !topDirectoryExists(m.cfg, candidate) {
+			continue
+		}
+		var moved bool
+		err := retryDB(db, "move of "+candidate+" to "+storedPath, func() error {
+			var err error
+			moved, err = m.move(db, candidate, storedPath, hash, algorithm, size, fileTimestamp)
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+		if moved {
+			m.count.Add(1)
+			log.Printf("%s was moved from %s", storedPath, candidate)
+			return candidate, nil
+		}
+	}
+	return "", nil
+}
+
+// move renames the record of from to storedPath in one transaction, with a removed history row for the old path and a
+// history row for the new one, and reports whether the record was still there to move.
+func (m *moveDetector) move(db *sql.DB, from, storedPath, hash, algorithm string, size int64, fileTimestamp time.Time) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC()
+	if _, err := tx.Exec(recordRemovalQuery+" AND hash = $3 AND size = $4", from, now, hash, size); err != nil {
+		return false, err
+	}
+	result, err := tx.Exec(recordHistoryQuery+`UPDATE file_hashes SET filepath = $1, file_timestamp = $4, hash_calculated_timestamp = $5, deleted_timestamp = NULL
+WHERE filepath = $8 AND hash = $2 AND size = $3`,
+		storedPath, hash, size, fileTimestamp, now, now, algorithm, from)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	for _, table := range m.follows {
+		if _, err := tx.Exec("UPDATE "+table+" SET filepath = $1 WHERE filepath = $2", storedPath, from); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
@@ -0,0 +1,6 @@
+package main
+
+import "syscall"
+
+// oNoAtime opens a file without updating its access time, for --read-only-guarantee.
+const oNoAtime = syscall.O_NOATIME
@@ -0,0 +1,6 @@
+//go:build !linux
+
+package main
+
+// oNoAtime is 0 where open has no flag to keep access times; --read-only-guarantee then relies on the mount options.
+const oNoAtime = 0
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// resolveOwner returns the user id named by --owner, which is a user name or a numeric id.
+func resolveOwner(owner string) (int, error) {
+	if id, err := strconv.Atoi(owner); err == nil && id >= 0 {
+		return id, nil
+	}
+	u, err := user.Lookup(owner)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// resolveGroup returns the group id named by --group, which is a group name or a numeric id.
+func resolveGroup(group string) (int, error) {
+	if id, err := strconv.Atoi(group); err == nil && id >= 0 {
+		return id, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// notOwnedBy reports, and logs, whether the file at path belongs to another user than --owner or another group than
+// --group.
+func notOwnedBy(cfg Config, path string, info os.FileInfo) bool {
+	if cfg.OwnerID < 0 && cfg.GroupID < 0 {
+		return false
+	}
+	uid, gid, ok := fileOwner(info)
+	switch {
+	case !ok:
+		log.Printf("Skipping file %s whose owner is unknown", path)
+	case cfg.OwnerID >= 0 && uid != cfg.OwnerID:
+		log.Printf("Skipping file %s owned by user %d, not --owner %d", path, uid, cfg.OwnerID)
+	case cfg.GroupID >= 0 && gid != cfg.GroupID:
+		log.Printf("Skipping file %s owned by group %d, not --group %d", path, gid, cfg.GroupID)
+	default:
+		return false
+	}
+	return true
+}
+
+// filteredOut reports, and logs, whether a file found by a scan is left out by --ignore-newer-than,
+// --ignore-older-than, --owner or --group.
+func filteredOut(cfg Config, path string, info os.FileInfo) bool {
+	return outsideAgeWindow(cfg, path, info) || notOwnedBy(cfg, path, info)
+}
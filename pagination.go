@@ -0,0 +1,150 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultPageSize and maxPageSize bound the items a list endpoint returns at once.
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// cursorTimeLayout is how timestamps are kept in cursors: the stored wall clock, to the stored precision, so a
+// cursor compares equal to the row it was made from.
+const cursorTimeLayout = "2006-01-02 15:04:05.999999"
+
+// sortColumn is a column a list endpoint can be sorted by: its SQL expression, and the type a cursor's value for it
+// is cast back to.
+type sortColumn struct {
+	expr string
+	cast string
+}
+
+// pageCursor is where a page ended: the sort it was made for, and the last item's values of the sort column and of
+// the column that breaks ties. Clients get it base64-encoded and shouldn't look inside.
+type pageCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	Key   string `json:"k"`
+}
+
+// listPage is a list endpoint's answer. NextCursor, passed back as the cursor parameter, gets the next page; it is
+// left out on the last one.
+type listPage struct {
+	Items      any    `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// pageRequest is the sort, limit and cursor parameters of a list request. Sorts are a column name, preceded by - for
+// descending order.
+type pageRequest struct {
+	sort   string
+	name   string
+	column sortColumn
+	desc   bool
+	limit  int
+	after  *pageCursor
+}
+
+func parsePageRequest(query url.Values, columns map[string]sortColumn, defaultSort string) (pageRequest, error) {
+	req := pageRequest{sort: query.Get("sort"), limit: defaultPageSize}
+	if req.sort == "" {
+		req.sort = defaultSort
+	}
+	name, desc := strings.CutPrefix(req.sort, "-")
+	column, ok := columns[name]
+	if !ok {
+		var names []string
+		for name := range columns {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return req, fmt.Errorf("invalid sort %q, expected one of %v, preceded by - for descending order", req.sort, names)
+	}
+	req.name, req.column, req.desc = name, column, desc
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return req, fmt.Errorf("invalid limit %q, expected 1 to %d", value, maxPageSize)
+		}
+		req.limit = limit
+	}
+	if value := query.Get("cursor"); value != "" {
+		var cursor pageCursor
+		data, err := base64.RawURLEncoding.DecodeString(value)
+		if err == nil {
+			err = json.Unmarshal(data, &cursor)
+		}
+		if err != nil {
+			return req, fmt.Errorf("invalid cursor")
+		}
+		if cursor.Sort != req.sort {
+			return req, fmt.Errorf("the cursor is for sort %s, not %s", cursor.Sort, req.sort)
+		}
+		req.after = &cursor
+	}
+	return req, nil
+}
+
+// cursor returns the cursor of the page ending at an item with these values of the sort column and the tiebreak.
+func (p pageRequest) cursor(value, key string) string {
+	data, _ := json.Marshal(pageCursor{Sort: p.sort, Value: value, Key: key})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// scanPage reads the items of page p from rows with scan, which returns each item's values of the sort column and the
+// tiebreak, and returns the cursor of the next page, or "" on the last.
+func scanPage(rows *sql.Rows, p pageRequest, scan func() (value, key string, err error)) (string, error) {
+	var value, key string
+	for items := 0; rows.Next(); items++ {
+		if items == p.limit {
+			return p.cursor(value, key), nil
+		}
+		var err error
+		if value, key, err = scan(); err != nil {
+			return "", err
+		}
+	}
+	return "", rows.Err()
+}
+
+// listQuery collects the conditions of a list endpoint's query. Conditions are written with ? for their arguments,
+// which are numbered as they are added.
+type listQuery struct {
+	conditions []string
+	args       []any
+}
+
+func (q *listQuery) where(condition string, args ...any) {
+	for _, arg := range args {
+		q.args = append(q.args, arg)
+		condition = strings.Replace(condition, "?", "$"+strconv.Itoa(len(q.args)), 1)
+	}
+	q.conditions = append(q.conditions, condition)
+}
+
+// page returns the WHERE, ORDER BY and LIMIT clauses of a query for the page p asks for, with key the unique column
+// that breaks ties in the sort, cast from cursors to keyCast. One row more than the page is asked for, to tell
+// whether there is another page.
+func (q *listQuery) page(p pageRequest, key, keyCast string) string {
+	direction, after := "", ">"
+	if p.desc {
+		direction, after = " DESC", "<"
+	}
+	if p.after != nil {
+		q.where(fmt.Sprintf("(%s, %s) %s (?::%s, ?::%s)", p.column.expr, key, after, p.column.cast, keyCast), p.after.Value, p.after.Key)
+	}
+	where := "true"
+	if len(q.conditions) > 0 {
+		where = strings.Join(q.conditions, " AND ")
+	}
+	return fmt.Sprintf("WHERE %s ORDER BY %s%s, %s%s LIMIT %d", where, p.column.expr, direction, key, direction, p.limit+1)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePageRequest(t *testing.T) {
+	sizeCursor := pageRequest{sort: "-size"}.cursor("1024", "/a/b")
+	tests := []struct {
+		query   string
+		sort    string
+		desc    bool
+		limit   int
+		after   *pageCursor
+		wantErr string
+	}{
+		{query: "", sort: "path", limit: defaultPageSize},
+		{query: "sort=-size&limit=5", sort: "size", desc: true, limit: 5},
+		{query: "limit=1000", sort: "path", limit: 1000},
+		{query: "sort=-size&cursor=" + sizeCursor, sort: "size", desc: true, limit: defaultPageSize, after: &pageCursor{Sort: "-size", Value: "1024", Key: "/a/b"}},
+		{query: "sort=name", wantErr: `invalid sort "name", expected one of [modified path size]`},
+		{query: "limit=0", wantErr: `invalid limit "0"`},
+		{query: "limit=1001", wantErr: `invalid limit "1001"`},
+		{query: "limit=ten", wantErr: `invalid limit "ten"`},
+		{query: "cursor=" + sizeCursor, wantErr: "the cursor is for sort -size, not path"},
+		{query: "cursor=!!", wantErr: "invalid cursor"},
+		{query: "cursor=bm90IGpzb24", wantErr: "invalid cursor"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := parsePageRequest(query, fileSorts, "path")
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.name != tt.sort || p.column != fileSorts[tt.sort] || p.desc != tt.desc || p.limit != tt.limit {
+				t.Errorf("got sort %q desc %v limit %d, want %q %v %d", p.name, p.desc, p.limit, tt.sort, tt.desc, tt.limit)
+			}
+			if !reflect.DeepEqual(p.after, tt.after) {
+				t.Errorf("after = %+v, want %+v", p.after, tt.after)
+			}
+		})
+	}
+}
+
+func TestListQueryPage(t *testing.T) {
+	size := sortColumn{"size", "bigint"}
+	tests := []struct {
+		name       string
+		p          pageRequest
+		conditions bool
+		want       string
+		args       []any
+	}{
+		{
+			name: "first page",
+			p:    pageRequest{column: size, limit: 10},
+			want: "WHERE true ORDER BY size, filepath LIMIT 11",
+		},
+		{
+			name:       "conditions",
+			p:          pageRequest{column: size, limit: 10},
+			conditions: true,
+			want:       "WHERE filepath LIKE $1 AND size >= $2 ORDER BY size, filepath LIMIT 11",
+			args:       []any{"/a/%", int64(5)},
+		},
+		{
+			name:       "after a cursor",
+			p:          pageRequest{column: size, limit: 10, after: &pageCursor{Value: "7", Key: "/a/b"}},
+			conditions: true,
+			want:       "WHERE filepath LIKE $1 AND size >= $2 AND (size, filepath) > ($3::bigint, $4::text) ORDER BY size, filepath LIMIT 11",
+			args:       []any{"/a/%", int64(5), "7", "/a/b"},
+		},
+		{
+			name: "descending after a cursor",
+			p:    pageRequest{column: size, desc: true, limit: 1, after: &pageCursor{Value: "7", Key: "/a/b"}},
+			want: "WHERE (size, filepath) < ($1::bigint, $2::text) ORDER BY size DESC, filepath DESC LIMIT 2",
+			args: []any{"7", "/a/b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &listQuery{}
+			if tt.conditions {
+				q.where("filepath LIKE ?", "/a/%")
+				q.where("size >= ?", int64(5))
+			}
+			if got := q.page(tt.p, "filepath", "text"); got != tt.want {
+				t.Errorf("page = %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(q.args, tt.args) {
+				t.Errorf("args = %v, want %v", q.args, tt.args)
+			}
+		})
+	}
+}
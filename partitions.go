@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// createScanPartitionsTableQuery records each top-level subdirectory of a --partition scan. finished_timestamp is only
+// set once every file of the partition has a result, so a partition without one is scanned again by --resume; a
+// partition whose walk failed keeps the error in walk_error. Timestamps are UTC, as in scan_runs.
+const createScanPartitionsTableQuery = `
+CREATE TABLE IF NOT EXISTS scan_partitions (
+    run_id INTEGER NOT NULL,
+    subdirectory TEXT NOT NULL,
+    started_timestamp TIMESTAMP NOT NULL,
+    finished_timestamp TIMESTAMP,
+    files_processed BIGINT,
+    files_new BIGINT,
+    files_changed BIGINT,
+    files_failed BIGINT,
+    walk_error TEXT,
+    PRIMARY KEY (run_id, subdirectory)
+);
+`
+
+// rootPartition is the partition of the files directly inside --directory.
+const rootPartition = "."
+
+// maxPartitionWalks is how many partitions are walked at once. They share the workers, so walking more than one
+// mostly keeps the workers busy while a walk is stuck on a slow directory.
+const maxPartitionWalks = 4
+
+// scanPartitions implements --partition: each top-level subdirectory of --directory is walked as its own unit, with
+// its own summary and row in scan_partitions, so an interrupted or failed partition can be scanned again with
+// --resume without redoing the others.
+type scanPartitions struct {
+	db    *sql.DB
+	runID int64
+	// done holds the partitions the resumed run already finished.
+	done map[string]bool
+
+	finishing sync.WaitGroup
+}
+
+// scanPartition is one partition being scanned.
+type scanPartition struct {
+	name    string
+	started time.Time
+	counts  runCounts
+	// files has one entry for each file of the partition without a result yet.
+	files sync.WaitGroup
+}
+
+// newScanPartitions sets up the partitions of run runID. When it is a resumed run, the partitions it finished are
+// skipped and their counts added to counts, so the run's totals cover the whole directory.
+func newScanPartitions(db *sql.DB, runID int64, counts *runCounts) (*scanPartitions, error) {
+	if _, err := db.Exec(createScanPartitionsTableQuery); err != nil {
+		return nil, err
+	}
+	p := &scanPartitions{db: db, runID: runID, done: make(map[string]bool)}
+	rows, err := db.Query(`
+SELECT subdirectory, files_processed, files_new, files_changed, files_failed FROM scan_partitions
+WHERE run_id = $1 AND finished_timestamp IS NOT NULL`, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var processed, added, changed, failed int64
+		if err := rows.Scan(&name, &processed, &added, &changed, &failed); err != nil {
+			return nil, err
+		}
+		p.done[name] = true
+		counts.processed.Add(processed)
+		counts.added.Add(added)
+		counts.changed.Add(changed)
+		counts.failed.Add(failed)
+	}
+	return p, rows.Err()
+}
+
+// resumableScanRun returns the id of the latest --partition run of cfg.Directory that didn't finish, or 0 if there
+// is none.
+func resumableScanRun(db *sql.DB, cfg Config) (int64, error) {
+	if _, err := db.Exec(createScanRunsTableQuery + createScanPartitionsTableQuery); err != nil {
+		return 0, err
+	}
+	var id int64
+	err := db.QueryRow(`
+SELECT id FROM scan_runs r
+WHERE directory = $1 AND finished_timestamp IS NULL AND EXISTS (SELECT 1 FROM scan_partitions p WHERE p.run_id = r.id)
+ORDER BY id DESC LIMIT 1`, cfg.Directory).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// walk visits the files of every partition of cfg.Directory that isn't done yet, walked through tree, up to
+// maxPartitionWalks partitions at a time. It returns once the walks are over; the partitions are finished as their last files get results, which
+// wait waits for. Once ctx is done no more partitions are started, and the ones being walked are left unfinished.
+func (p *scanPartitions) walk(ctx context.Context, cfg Config, tree treeReader, visit func(part *scanPartition, path string, info os.FileInfo)) error {
+	entries, err := os.ReadDir(cfg.Directory)
+	if err != nil {
+		return err
+	}
+	names := []string{rootPartition}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+
+	walks := make(chan struct{}, maxPartitionWalks)
+	var walking sync.WaitGroup
+	for _, name := range names {
+		if ctx.Err() != nil {
+			break
+		}
+		if p.done[name] {
+			log.Print(msg("PartitionResumed", map[string]any{"Partition": name}))
+			continue
+		}
+		part := &scanPartition{name: name, started: time.Now()}
+		if err := retryDB(p.db, "start of partition "+name, func() error {
+			_, err := p.db.Exec(`
+INSERT INTO scan_partitions (run_id, subdirectory, started_timestamp) VALUES ($1, $2, $3)
+ON CONFLICT (run_id, subdirectory) DO UPDATE SET started_timestamp = EXCLUDED.started_timestamp, walk_error = NULL`,
+				p.runID, name, part.started.UTC())
+			return err
+		}); err != nil {
+			return err
+		}
+
+		walks <- struct{}{}
+		walking.Add(1)
+		p.finishing.Add(1)
+		go func() {
+			defer walking.Done()
+			log.Print(msg("PartitionStarted", map[string]any{"Partition": name}))
+			visitPart := func(path string, info os.FileInfo) { visit(part, path, info) }
+			var err error
+			if name == rootPartition {
+				err = walkTopFiles(ctx, cfg, entries, visitPart)
+			} else {
+				root := filepath.Join(cfg.Directory, name)
+				// walkRoot logs and skips a directory it can't read, which for the partition's own directory would
+				// leave it looking finished with no files in it.
+				var dir *os.File
+				if dir, err = os.Open(root); err == nil {
+					dir.Close()
+					err = walkRoot(ctx, cfg, tree, root, nil, visitPart)
+				}
+			}
+			<-walks
+			go func() {
+				defer p.finishing.Done()
+				part.files.Wait()
+				p.finish(part, err)
+			}()
+		}()
+	}
+	walking.Wait()
+	return nil
+}
+
+// walkTopFiles visits the regular files among entries of cfg.Directory, as walkRoot would.
+func walkTopFiles(ctx context.Context, cfg Config, entries []os.DirEntry, visit func(path string, info os.FileInfo)) error {
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return errScanInterrupted
+		}
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		path := filepath.Join(cfg.Directory, entry.Name())
+		if reason := exclusion(cfg, cfg.Directory, path, false); reason != "" {
+			log.Printf("Skipping file %s due to %s", path, reason)
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			log.Printf("Error accessing %s: %v", path, err)
+			continue
+		}
+		if filteredOut(cfg, path, info) {
+			continue
+		}
+		visit(path, info)
+	}
+	return nil
+}
+
+// finish records and logs the outcome of a partition whose files all have results.
+func (p *scanPartitions) finish(part *scanPartition, walkErr error) {
+	data := map[string]any{
+		"Partition": part.name, "Processed": part.counts.processed.Load(), "New": part.counts.added.Load(),
+		"Changed": part.counts.changed.Load(), "Failed": part.counts.failed.Load(), "Duration": time.Since(part.started).Round(time.Second),
+	}
+	query := `
+UPDATE scan_partitions SET finished_timestamp = $3, files_processed = $4, files_new = $5, files_changed = $6, files_failed = $7
+WHERE run_id = $1 AND subdirectory = $2`
+	args := []any{p.runID, part.name, time.Now().UTC(), part.counts.processed.Load(), part.counts.added.Load(), part.counts.changed.Load(), part.counts.failed.Load()}
+	if walkErr != nil {
+		// The partition is left unfinished, so --resume walks it again.
+		data["Error"] = walkErr
+		log.Print(msg("PartitionFailed", data))
+		query = "UPDATE scan_partitions SET walk_error = $3 WHERE run_id = $1 AND subdirectory = $2"
+		args = []any{p.runID, part.name, walkErr.Error()}
+	} else {
+		log.Print(msg("PartitionFinished", data))
+	}
+	if err := retryDB(p.db, "end of partition "+part.name, func() error {
+		_, err := p.db.Exec(query, args...)
+		return err
+	}); err != nil {
+		log.Printf("Failed to record the end of partition %s: %v", part.name, err)
+	}
+}
+
+// wait waits until every partition walked has been finished.
+func (p *scanPartitions) wait() {
+	p.finishing.Wait()
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// PostgreSQL refuses btree index entries larger than roughly a third of a page, and filepath carries a UNIQUE index,
+// so anything longer than this fails on INSERT with "index row size exceeds maximum".
+const maxStoredPathBytes = 2700
+
+// maxNameBytes is the per-component limit shared by ext4, xfs, btrfs, NTFS and APFS.
+const maxNameBytes = 255
+
+// maxOSPathBytes returns the longest path the current OS will reliably open.
+func maxOSPathBytes() int {
+	switch runtime.GOOS {
+	case "windows":
+		return 260
+	case "darwin", "freebsd", "openbsd", "netbsd":
+		return 1024
+	default:
+		return 4096
+	}
+}
+
+// validatePathLength checks the on-disk path against OS limits and the stored path against the database limit.
+func validatePathLength(path, storedPath string) error {
+	if len(path) > maxOSPathBytes() {
+		return fmt.Errorf("path is %d bytes, longer than the %s limit of %d", len(path), runtime.GOOS, maxOSPathBytes())
+	}
+	for _, name := range strings.Split(filepath.ToSlash(path), "/") {
+		if len(name) > maxNameBytes {
+			return fmt.Errorf("path component %q is %d bytes, longer than the limit of %d", name, len(name), maxNameBytes)
+		}
+	}
+	if len(storedPath) > maxStoredPathBytes {
+		return fmt.Errorf("stored path is %d bytes, longer than the database limit of %d", len(storedPath), maxStoredPathBytes)
+	}
+	return nil
+}
+
+// storedPathSet remembers which on-disk path produced each stored path during a scan, so prefix stripping can't
+// silently map two files onto the same database row. It holds one entry per file, so on very large trees it moves
+// itself into a temporary SQLite file once it exceeds memoryLimit bytes (0 means no limit).
+type storedPathSet struct {
+	mu          sync.Mutex
+	paths       map[string]string
+	collisions  int
+	memoryLimit int64
+	memoryUsed  int64
+	spillDir    string
+	spill       *spillFile
+}
+
+func newStoredPathSet(memoryLimit int64, spillDir string) *storedPathSet {
+	return &storedPathSet{paths: make(map[string]string), memoryLimit: memoryLimit, spillDir: spillDir}
+}
+
+// claim records storedPath for path. If a different path already claimed it, the earlier path is returned with ok
+// set to false and the set is left unchanged.
+func (s *storedPathSet) claim(storedPath, path string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, found := s.lookup(storedPath)
+	if found && existing != path {
+		s.collisions++
+		return existing, false
+	}
+	if !found {
+		s.insert(storedPath, path)
+	}
+	return path, true
+}
+
+func (s *storedPathSet) lookup(storedPath string) (string, bool) {
+	if s.spill == nil {
+		existing, found := s.paths[storedPath]
+		return existing, found
+	}
+	var existing string
+	if err := s.spill.db.QueryRow("SELECT path FROM paths WHERE stored = ?", storedPath).Scan(&existing); err != nil {
+		return "", false
+	}
+	return existing, true
+}
+
+func (s *storedPathSet) insert(storedPath, path string) {
+	if s.spill != nil {
+		if _, err := s.spill.db.Exec("INSERT INTO paths (stored, path) VALUES (?, ?)", storedPath, path); err != nil {
+			log.Printf("Failed to record stored path %s in spill file, collisions with it won't be detected: %v", storedPath, err)
+		}
+		return
+	}
+
+	s.paths[storedPath] = path
+	s.memoryUsed += int64(len(storedPath) + len(path) + mapEntryOverhead)
+	if s.memoryLimit > 0 && s.memoryUsed > s.memoryLimit {
+		if err := s.spillToDisk(); err != nil {
+			log.Printf("Failed to spill stored path set to disk, continuing in memory: %v", err)
+			s.memoryLimit = 0
+		}
+	}
+}
+
+// spillToDisk moves every entry into a temporary SQLite file and frees the map.
+func (s *storedPathSet) spillToDisk() error {
+	log.Printf("Stored path set reached %d MiB (--memory-limit), moving it to disk", s.memoryUsed>>20)
+	spill, err := newSpillFile(s.spillDir, "CREATE TABLE paths (stored TEXT PRIMARY KEY, path TEXT NOT NULL) WITHOUT ROWID")
+	if err != nil {
+		return err
+	}
+	tx, err := spill.db.Begin()
+	if err != nil {
+		spill.Close()
+		return err
+	}
+	for storedPath, path := range s.paths {
+		if _, err := tx.Exec("INSERT INTO paths (stored, path) VALUES (?, ?)", storedPath, path); err != nil {
+			tx.Rollback()
+			spill.Close()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		spill.Close()
+		return err
+	}
+	s.spill = spill
+	s.paths = nil
+	s.memoryUsed = 0
+	return nil
+}
+
+// close removes the spill file, if any.
+func (s *storedPathSet) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.spill != nil {
+		if err := s.spill.Close(); err != nil {
+			log.Printf("Failed to remove spill file %s: %v", s.spill.path, err)
+		}
+		s.spill = nil
+	}
+}
+
+// checkStoredPath runs both the length validation and the collision check for a file about to be processed.
+func checkStoredPath(seen *storedPathSet, path, storedPath string) error {
+	if err := validatePathLength(path, storedPath); err != nil {
+		return err
+	}
+	if existing, ok := seen.claim(storedPath, path); !ok {
+		log.Printf("WARNING: prefix rewriting maps both %s and %s to stored path %s", existing, path, storedPath)
+		return fmt.Errorf("stored path %s collides with %s", storedPath, existing)
+	}
+	return nil
+}
+
+// collisionCount returns how many files were rejected because their stored path was already claimed.
+func (s *storedPathSet) collisionCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.collisions
+}
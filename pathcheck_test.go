@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidatePathLength(t *testing.T) {
+	long := strings.Repeat("a", maxNameBytes)
+	tests := []struct {
+		name       string
+		path       string
+		storedPath string
+		wantErr    string
+	}{
+		{"short", "/mnt/i/a.txt", "/a.txt", ""},
+		{"longest name", "/mnt/" + long, "/" + long, ""},
+		{"name too long", "/mnt/" + long + "a/b", "/b", "path component"},
+		{"path too long", "/" + strings.Repeat("a/", maxOSPathBytes()/2+1), "/a", "path is"},
+		{"longest stored path", "/mnt", strings.Repeat("a", maxStoredPathBytes), ""},
+		{"stored path too long", "/mnt", strings.Repeat("a", maxStoredPathBytes+1), "stored path is"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePathLength(tt.path, tt.storedPath)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("err = %v, want none", err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want one starting %q", err, tt.wantErr)
+			}
+		})
+	}
+}
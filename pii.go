@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const createPIITableQuery = `
+CREATE TABLE IF NOT EXISTS pii_findings (
+    id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    filepath TEXT NOT NULL,
+    pattern TEXT NOT NULL,
+    match_count INTEGER NOT NULL,
+    detected_timestamp TIMESTAMP NOT NULL,
+    UNIQUE (filepath, pattern)
+);
+`
+
+// Lines longer than this are scanned in pieces. A match straddling the cut is missed, which is acceptable for
+// minified or binary-ish "text" where lines this long occur.
+const maxPIILineBytes = 64 * 1024
+
+type piiPattern struct {
+	name  string
+	re    *regexp.Regexp
+	valid func(match string) bool
+}
+
+// piiDetector holds the patterns to look for and counts how many files had findings over the whole scan. columns is
+// nil unless --encrypt-column is given.
+type piiDetector struct {
+	patterns     []piiPattern
+	maxBytes     int64
+	columns      *columnCipher
+	flaggedFiles atomic.Int64
+}
+
+// newPIIDetector builds the detector from the built-in patterns plus any --pii-pattern name=regex definitions.
+func newPIIDetector(custom []string, maxBytes int64) (*piiDetector, error) {
+	d := &piiDetector{
+		maxBytes: maxBytes,
+		patterns: []piiPattern{
+			{name: "credit-card", re: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), valid: luhnValid},
+			{name: "us-ssn", re: regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`), valid: ssnValid},
+		},
+	}
+	for _, def := range custom {
+		name, expr, ok := strings.Cut(def, "=")
+		if !ok || name == "" || expr == "" {
+			return nil, fmt.Errorf("invalid --pii-pattern %q, expected name=regex", def)
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --pii-pattern %q: %v", def, err)
+		}
+		d.patterns = append(d.patterns, piiPattern{name: name, re: re})
+	}
+	return d, nil
+}
+
+// luhnValid filters card-number-shaped digit runs down to ones with a valid check digit.
+func luhnValid(match string) bool {
+	sum, digits := 0, 0
+	for i := len(match) - 1; i >= 0; i-- {
+		c := match[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		n := int(c - '0')
+		if digits%2 == 1 {
+			n *= 2
+			if n > 9 {
+				n -= 9
+			}
+		}
+		sum += n
+		digits++
+	}
+	return digits >= 13 && sum%10 == 0
+}
+
+// ssnValid rejects area/group/serial numbers the SSA never issues.
+func ssnValid(match string) bool {
+	area, group, serial := match[0:3], match[4:6], match[7:11]
+	return area != "000" && area != "666" && area[0] != '9' && group != "00" && serial != "0000"
+}
+
+// piiScanner is an io.Writer fed the same bytes as the hasher, so contents are only read once.
+type piiScanner struct {
+	detector *piiDetector
+	counts   map[string]int
+	line     []byte
+	read     int64
+	sniffed  bool
+	text     bool
+}
+
+func (d *piiDetector) newScanner() *piiScanner {
+	return &piiScanner{detector: d, counts: make(map[string]int)}
+}
+
+func (s *piiScanner) Write(p []byte) (int, error) {
+	n := len(p)
+	if !s.sniffed {
+		s.sniffed = true
+		s.text = isTextContent(p)
+	}
+	if !s.text || s.read >= s.detector.maxBytes {
+		return n, nil
+	}
+	if remaining := s.detector.maxBytes - s.read; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	s.read += int64(len(p))
+
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			s.line = append(s.line, p...)
+			if len(s.line) >= maxPIILineBytes {
+				s.scanLine()
+			}
+			break
+		}
+		s.line = append(s.line, p[:i]...)
+		s.scanLine()
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// finish scans whatever is left after the last newline.
+func (s *piiScanner) finish() {
+	if len(s.line) > 0 {
+		s.scanLine()
+	}
+}
+
+func (s *piiScanner) scanLine() {
+	for _, pattern := range s.detector.patterns {
+		for _, match := range pattern.re.FindAll(s.line, -1) {
+			if pattern.valid == nil || pattern.valid(string(match)) {
+				s.counts[pattern.name]++
+			}
+		}
+	}
+	s.line = s.line[:0]
+}
+
+// isTextContent sniffs the first chunk of a file the same way net/http does for Content-Type.
+func isTextContent(head []byte) bool {
+	contentType := http.DetectContentType(head)
+	return strings.HasPrefix(contentType, "text/") ||
+		strings.Contains(contentType, "json") ||
+		strings.Contains(contentType, "xml")
+}
+
+// hashContents hashes the file and, when PII detection is enabled, scans it in the same pass and replaces the file's
+// recorded findings. A chunked algorithm replaces the file's recorded chunks as well. It returns the status suffix for
+// files with findings along with the hash. Reads go through the retries of share unless it is nil.
+func hashContents(file *os.File, storedPath string, db *sql.DB, algorithm string, pii *piiDetector, share *shareSweep) (string, string, error) {
+	hashWith := func(extra ...io.Writer) (string, error) {
+		if _, _, ok := chunkedAlgorithm(algorithm); ok {
+			return hashChunkedFile(file, storedPath, db, algorithm, share, extra...)
+		}
+		return hashFile(file, algorithm, share, extra...)
+	}
+	if pii == nil {
+		hash, err := hashWith()
+		return hash, "", err
+	}
+
+	scanner := pii.newScanner()
+	hash, err := hashWith(scanner)
+	if err != nil {
+		return "", "", err
+	}
+	scanner.finish()
+	if err := retryDB(db, "PII findings for "+storedPath, func() error { return recordPIIFindings(db, storedPath, scanner.counts, pii.columns) }); err != nil {
+		return "", "", fmt.Errorf("failed to record PII findings: %v", err)
+	}
+	if len(scanner.counts) > 0 {
+		pii.flaggedFiles.Add(1)
+		return hash, "+pii", nil
+	}
+	return hash, "", nil
+}
+
+// recordPIIFindings replaces the findings of storedPath with counts, encrypting the pattern names with columns unless
+// it is nil.
+func recordPIIFindings(db *sql.DB, storedPath string, counts map[string]int, columns *columnCipher) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM pii_findings WHERE filepath = $1", storedPath); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pattern := name
+		if columns != nil {
+			pattern = columns.seal("pii_findings.pattern", name)
+		}
+		if _, err := tx.Exec("INSERT INTO pii_findings (filepath, pattern, match_count, detected_timestamp) VALUES ($1, $2, $3, $4)", storedPath, pattern, counts[name], time.Now()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
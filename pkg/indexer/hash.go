@@ -0,0 +1,65 @@
+package indexer
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"golang.org/x/crypto/blake2b"
+)
+
+// DefaultAlgorithm is the content hash used when none is chosen, and what records without an algorithm were hashed
+// with.
+const DefaultAlgorithm = "md5"
+
+// Algorithms are the content hashes by name. blake2b is BLAKE2b-512, as computed by b2sum, and xxhash64 is fast but
+// not cryptographic: fine for spotting bit rot, not for proving files weren't tampered with.
+var Algorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"blake2b": func() hash.Hash {
+		h, _ := blake2b.New512(nil) // only fails for keys that are too long
+		return h
+	},
+	"xxhash64": func() hash.Hash { return xxhash.New() },
+}
+
+// AlgorithmNames returns the names of Algorithms, sorted.
+func AlgorithmNames() []string {
+	names := make([]string, 0, len(Algorithms))
+	for name := range Algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HashReader returns the hex digest of everything read from reader with algorithm, one of Algorithms, also feeding
+// it to any extra writers along the way.
+func HashReader(reader io.Reader, algorithm string, extra ...io.Writer) (string, error) {
+	newHash, ok := Algorithms[algorithm]
+	if !ok {
+		return "", fmt.Errorf("unknown hash algorithm %q", algorithm)
+	}
+	hasher := newHash()
+	if _, err := io.Copy(io.MultiWriter(append([]io.Writer{hasher}, extra...)...), reader); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// SameModTime reports whether a file's mtime matches one read back from the index. Databases keep microseconds,
+// rounding or truncating the rest depending on the backend.
+func SameModTime(modified, indexed time.Time) bool {
+	d := modified.Sub(indexed)
+	return d > -time.Microsecond && d < time.Microsecond
+}
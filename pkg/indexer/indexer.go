@@ -0,0 +1,342 @@
+// Package indexer is the core of fileindexer as a library: it walks a directory, hashes the files in it and keeps
+// their records in a store.Store, so other Go programs can index files without running the fileindexer binary.
+//
+//	postgres, err := indexer.NewPostgresStore(db)
+//	if err != nil {
+//		return err
+//	}
+//	scanner := indexer.NewScanner(postgres)
+//	results, err := scanner.Scan(ctx, indexer.Options{Root: "/mnt/i/photos", Prefix: "/mnt/i"})
+//	if err != nil {
+//		return err
+//	}
+//	for result := range results {
+//		fmt.Println(result.StoredPath, result.Hash, result.Status, result.Err)
+//	}
+//
+// Statuses are the ones of the fileindexer results file. What the command adds around this core, such as the
+// write-ahead log, batched writes and the optional checks, isn't part of the library.
+package indexer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"fileindexer/store"
+)
+
+// DefaultWorkers is how many files a scan hashes at once unless Options says otherwise.
+const DefaultWorkers = 8
+
+// ChangeDetectPolicies decide when a file already in the index is hashed again: when its size changed, when its size
+// or modification time changed, or on every scan.
+var ChangeDetectPolicies = []string{"size", "mtime+size", "always"}
+
+// Options configure one scan. Only Root is required.
+type Options struct {
+	// Root is the directory to scan, or a single file.
+	Root string
+	// Prefix is removed from the start of paths to give the paths records are stored under, as with --prefix.
+	Prefix string
+	// Exclude skips the paths containing any of these strings, and the directories they name.
+	Exclude []string
+	// Algorithm is one of Algorithms, DefaultAlgorithm if empty. Files indexed with another one are hashed again.
+	Algorithm string
+	// ChangeDetect is one of ChangeDetectPolicies, "size" if empty.
+	ChangeDetect string
+	// Force hashes every file again and rewrites its record.
+	Force bool
+	// Verify also hashes the files that look unchanged, reporting those whose contents no longer match as corrupt.
+	Verify bool
+	// MinRehashAge holds back the hashing Force, Verify and ChangeDetect "always" do of files that look unchanged and
+	// were hashed less than this long ago, as with --min-rehash-age.
+	MinRehashAge time.Duration
+	// Workers is how many files are hashed at once, DefaultWorkers if zero.
+	Workers int
+}
+
+// Result is the outcome for one file. Err is set if the file couldn't be read or its record couldn't be looked up
+// or written, in which case Hash is empty and Size is -1.
+type Result struct {
+	Path       string
+	StoredPath string
+	Hash       string
+	Size       int64
+	Status     string
+	Err        error
+}
+
+// Scanner indexes files into a store. The functions it has fields for replace the scanner's own handling of that
+// step when set, which is how the fileindexer command adds its share retries, throttling, content checks and
+// write-ahead log; a Scanner must not be changed once it is in use.
+type Scanner struct {
+	store store.Store
+
+	// Open opens a file to hash. The default is os.Open.
+	Open func(path string) (*os.File, error)
+	// Algorithm returns the algorithm a file of size is hashed with, given the scan's. The default is the scan's.
+	Algorithm func(algorithm string, size int64) string
+	// Hash hashes an open file with algorithm, and returns a suffix for its status, such as +pii, along with the
+	// digest. The default is HashReader from the start of the file.
+	Hash func(file *os.File, storedPath, algorithm string) (hash, suffix string, err error)
+	// Write writes the record of a file expected to get status, and returns the status it did get: the index may have
+	// changed since the record was looked up. The default is the store's Put.
+	Write func(record store.Record, status string) (string, error)
+}
+
+// NewScanner returns a Scanner keeping its records in s, which may be a backend registered with the store package or
+// NewPostgresStore's file_hashes table.
+func NewScanner(s store.Store) *Scanner {
+	return &Scanner{store: s}
+}
+
+// Scan walks opts.Root and indexes its files in the background, sending a Result for each. The channel is closed
+// when the scan is done, or soon after ctx is, so it must be read until then or ctx canceled.
+func (s *Scanner) Scan(ctx context.Context, opts Options) (<-chan Result, error) {
+	if opts.Algorithm == "" {
+		opts.Algorithm = DefaultAlgorithm
+	}
+	if _, ok := Algorithms[opts.Algorithm]; !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %q, expected one of %v", opts.Algorithm, AlgorithmNames())
+	}
+	if opts.ChangeDetect == "" {
+		opts.ChangeDetect = "size"
+	}
+	if !slices.Contains(ChangeDetectPolicies, opts.ChangeDetect) {
+		return nil, fmt.Errorf("unknown change detection policy %q, expected one of %v", opts.ChangeDetect, ChangeDetectPolicies)
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultWorkers
+	}
+	if _, err := os.Stat(opts.Root); err != nil {
+		return nil, err
+	}
+
+	results := make(chan Result)
+	send := func(result Result) {
+		select {
+		case results <- result:
+		case <-ctx.Done():
+		}
+	}
+	files := make(chan string)
+	var wg sync.WaitGroup
+	wg.Add(1 + opts.Workers)
+	go func() {
+		defer wg.Done()
+		defer close(files)
+		excluded := func(path string, d fs.DirEntry) bool { return Excluded(opts.Exclude, path) != "" }
+		Walk(ctx, opts.Root, filepath.WalkDir, excluded, func(path string, info fs.FileInfo, err error) error {
+			if err != nil {
+				send(Result{Path: path, StoredPath: storedPath(opts.Prefix, path), Size: -1, Err: err})
+				return nil
+			}
+			select {
+			case files <- path:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	for range opts.Workers {
+		go func() {
+			defer wg.Done()
+			for path := range files {
+				send(s.ScanFile(path, storedPath(opts.Prefix, path), opts))
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results, nil
+}
+
+// storedPath returns the path a file's record is kept under, with prefix removed if path starts with it at a path
+// separator.
+func storedPath(prefix, path string) string {
+	if prefix == "" || !strings.HasPrefix(path, prefix) {
+		return path
+	}
+	if len(path) == len(prefix) || os.IsPathSeparator(prefix[len(prefix)-1]) || os.IsPathSeparator(path[len(prefix)]) {
+		return path[len(prefix):]
+	}
+	return path
+}
+
+// ScanFile compares the file at path with the record of storedPath, hashing it and writing the record when opts call
+// for it. Only the options about hashing are used. It is what Scan does with every file it walks, for callers that
+// find their files another way.
+func (s *Scanner) ScanFile(path, storedPath string, opts Options) Result {
+	result := Result{Path: path, StoredPath: storedPath, Size: -1}
+	fail := func(err error) Result {
+		result.Hash, result.Size, result.Status, result.Err = "", -1, "", err
+		return result
+	}
+	// done reports the file with the hash and size it was hashed or found indexed with.
+	done := func(hash string, size int64, status string) Result {
+		result.Hash, result.Size, result.Status = hash, size, status
+		return result
+	}
+
+	open := s.Open
+	if open == nil {
+		open = os.Open
+	}
+	file, err := open(path)
+	if err != nil {
+		// Wrapped, so that callers can tell permission errors apart.
+		return fail(fmt.Errorf("failed to open file %s: %w", path, err))
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fail(fmt.Errorf("failed to retrieve metadata for file %s: %v", path, err))
+	}
+	size, modified := info.Size(), info.ModTime()
+	algorithm := opts.Algorithm
+	if algorithm == "" {
+		algorithm = DefaultAlgorithm
+	}
+	if s.Algorithm != nil {
+		algorithm = s.Algorithm(algorithm, size)
+	}
+
+	hash := func() (string, string, error) {
+		var sum, suffix string
+		var err error
+		if s.Hash != nil {
+			sum, suffix, err = s.Hash(file, storedPath, algorithm)
+		} else if _, err = file.Seek(0, 0); err == nil {
+			sum, err = HashReader(file, algorithm)
+		}
+		if err != nil {
+			return "", "", fmt.Errorf("failed to hash file %s: %v", path, err)
+		}
+		return sum, suffix, nil
+	}
+	write := func(sum, status string) (string, error) {
+		record := store.Record{Path: storedPath, Hash: sum, Algorithm: algorithm, Size: size, Modified: modified, Recorded: time.Now()}
+		var err error
+		if s.Write != nil {
+			status, err = s.Write(record, status)
+		} else {
+			err = s.store.Put(record)
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to write record for file %s: %v", path, err)
+		}
+		return status, nil
+	}
+	// rehash hashes the file and writes its record, expecting status.
+	rehash := func(status string) Result {
+		sum, suffix, err := hash()
+		if err != nil {
+			return fail(err)
+		}
+		if status, err = write(sum, status); err != nil {
+			return fail(err)
+		}
+		return done(sum, size, status+suffix)
+	}
+	lookup := func() (store.Record, error) {
+		record, err := s.store.Lookup(storedPath)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return record, fmt.Errorf("failed to query database for %s: %v", storedPath, err)
+		}
+		if record.Algorithm == "" {
+			record.Algorithm = DefaultAlgorithm
+		}
+		return record, err
+	}
+	// MinRehashAge holds back the rehashes of files that look unchanged; files whose size or mtime moved, or that were
+	// hashed with another algorithm, are hashed as usual.
+	recentlyHashed := func(record store.Record) bool {
+		return opts.MinRehashAge > 0 && size == record.Size && record.Algorithm == algorithm &&
+			SameModTime(modified, record.Modified) && time.Since(record.Recorded) < opts.MinRehashAge
+	}
+
+	if opts.Force {
+		if opts.MinRehashAge > 0 {
+			record, err := lookup()
+			if err != nil && !errors.Is(err, store.ErrNotFound) {
+				return fail(err)
+			}
+			if err == nil && recentlyHashed(record) {
+				return done(record.Hash, record.Size, "existing")
+			}
+		}
+		return rehash("forced")
+	}
+
+	record, err := lookup()
+	if errors.Is(err, store.ErrNotFound) {
+		return rehash("new")
+	} else if err != nil {
+		return fail(err)
+	}
+	if size != record.Size {
+		return rehash("changed")
+	}
+	// A hash made with another algorithm can't be compared with anything, so the file is hashed again.
+	if record.Algorithm != algorithm {
+		return rehash("rehashed")
+	}
+	if (opts.Verify || opts.ChangeDetect == "always") && recentlyHashed(record) {
+		return done(record.Hash, record.Size, "existing")
+	}
+
+	// With ChangeDetect "mtime+size" a file rewritten in place at the same size is hashed again, and with "always" every
+	// file is; Verify, below, has its own take on files whose mtime is unchanged. The record follows the file either
+	// way, but only different contents make it changed.
+	sameModTime := SameModTime(modified, record.Modified)
+	if (opts.ChangeDetect == "mtime+size" && !sameModTime) || (opts.ChangeDetect == "always" && !opts.Verify) {
+		sum, suffix, err := hash()
+		if err != nil {
+			return fail(err)
+		}
+		if sum == record.Hash && sameModTime {
+			return done(sum, size, "existing"+suffix)
+		}
+		status := "changed"
+		if sum == record.Hash {
+			status = "existing"
+		}
+		if status, err = write(sum, status); err != nil {
+			return fail(err)
+		}
+		return done(sum, size, status+suffix)
+	}
+
+	// Disks and controllers can corrupt a file without touching its size or mtime, which the checks above trust.
+	if opts.Verify {
+		sum, suffix, err := hash()
+		if err != nil {
+			return fail(err)
+		}
+		switch {
+		case sum == record.Hash:
+			return done(sum, size, "verified"+suffix)
+		case sameModTime:
+			// The record is left alone, so the file is reported again until it is restored from a good copy.
+			return done(sum, size, "corrupt"+suffix)
+		}
+		status, err := write(sum, "changed")
+		if err != nil {
+			return fail(err)
+		}
+		return done(sum, size, status+suffix)
+	}
+
+	return done(record.Hash, record.Size, "existing")
+}
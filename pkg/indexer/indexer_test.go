@@ -0,0 +1,141 @@
+package indexer
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"fileindexer/store"
+)
+
+// memoryStore is a store.Store kept in a map.
+type memoryStore struct {
+	mu      sync.Mutex
+	records map[string]store.Record
+}
+
+func (s *memoryStore) Lookup(path string) (store.Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.records[path]
+	if !ok {
+		return store.Record{}, store.ErrNotFound
+	}
+	return record, nil
+}
+
+func (s *memoryStore) Put(record store.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[record.Path] = record
+	return nil
+}
+
+func (s *memoryStore) Ping() error  { return nil }
+func (s *memoryStore) Close() error { return nil }
+
+func TestScanFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(path, []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := HashReader(strings.NewReader("hello"), DefaultAlgorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// indexed is the record of the file as it is now, hashed an hour ago.
+	indexed := store.Record{Path: "a.txt", Hash: sum, Algorithm: DefaultAlgorithm, Size: 5, Modified: modified, Recorded: time.Now().Add(-time.Hour)}
+	with := func(change func(r *store.Record)) *store.Record {
+		r := indexed
+		change(&r)
+		return &r
+	}
+	other := strings.Repeat("0", len(sum))
+
+	tests := []struct {
+		name    string
+		record  *store.Record // nil for a file not yet indexed
+		opts    Options
+		status  string
+		written bool // whether the record is rewritten
+	}{
+		{"new", nil, Options{}, "new", true},
+		{"existing", &indexed, Options{}, "existing", false},
+		{"changed size", with(func(r *store.Record) { r.Size = 4 }), Options{}, "changed", true},
+		{"other algorithm", with(func(r *store.Record) { r.Algorithm = "sha256" }), Options{}, "rehashed", true},
+		{"algorithm unrecorded", with(func(r *store.Record) { r.Algorithm = "" }), Options{}, "existing", false},
+		{"forced", &indexed, Options{Force: true}, "forced", true},
+		{"forced recently hashed", &indexed, Options{Force: true, MinRehashAge: 2 * time.Hour}, "existing", false},
+		{"verified", &indexed, Options{Verify: true}, "verified", false},
+		{"corrupt", with(func(r *store.Record) { r.Hash = other }), Options{Verify: true}, "corrupt", false},
+		{"verify recently hashed", with(func(r *store.Record) { r.Hash = other }), Options{Verify: true, MinRehashAge: 2 * time.Hour}, "existing", false},
+		{"verify rewritten", with(func(r *store.Record) { r.Hash, r.Modified = other, modified.Add(-time.Hour) }), Options{Verify: true}, "changed", true},
+		{"mtime moved", with(func(r *store.Record) { r.Modified = modified.Add(-time.Hour) }), Options{ChangeDetect: "mtime+size"}, "existing", true},
+		{"mtime moved changed", with(func(r *store.Record) { r.Hash, r.Modified = other, modified.Add(-time.Hour) }), Options{ChangeDetect: "mtime+size"}, "changed", true},
+		{"mtime moved size policy", with(func(r *store.Record) { r.Hash, r.Modified = other, modified.Add(-time.Hour) }), Options{}, "existing", false},
+		{"always", with(func(r *store.Record) { r.Hash = other }), Options{ChangeDetect: "always"}, "changed", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &memoryStore{records: make(map[string]store.Record)}
+			if tt.record != nil {
+				s.records["a.txt"] = *tt.record
+			}
+			result := NewScanner(s).ScanFile(path, "a.txt", tt.opts)
+			if result.Err != nil {
+				t.Fatalf("ScanFile: %v", result.Err)
+			}
+			if result.Status != tt.status {
+				t.Errorf("status = %q, want %q", result.Status, tt.status)
+			}
+			if result.Size != 5 {
+				t.Errorf("size = %d, want 5", result.Size)
+			}
+			after := s.records["a.txt"]
+			written := tt.record == nil || after != *tt.record
+			if written != tt.written {
+				t.Errorf("record written = %v, want %v", written, tt.written)
+			}
+			if written && (after.Hash != sum || after.Size != 5 || !after.Modified.Equal(modified)) {
+				t.Errorf("written record = %+v, want the file's hash, size and mtime", after)
+			}
+		})
+	}
+}
+
+func TestScanFileMissing(t *testing.T) {
+	result := NewScanner(&memoryStore{records: make(map[string]store.Record)}).ScanFile(filepath.Join(t.TempDir(), "missing"), "missing", Options{})
+	if !errors.Is(result.Err, os.ErrNotExist) {
+		t.Errorf("err = %v, want one wrapping os.ErrNotExist", result.Err)
+	}
+	if result.Size != -1 || result.Status != "" || result.Hash != "" {
+		t.Errorf("result = %+v, want no status, hash or size", result)
+	}
+}
+
+func TestStoredPath(t *testing.T) {
+	tests := []struct {
+		prefix, path, want string
+	}{
+		{"", "/mnt/i/a.jpg", "/mnt/i/a.jpg"},
+		{"/mnt/i", "/mnt/i/a.jpg", "/a.jpg"},
+		{"/mnt/i/", "/mnt/i/a.jpg", "a.jpg"},
+		{"/mnt/i", "/mnt/i", ""},
+		{"/mnt/i", "/mnt/img/a.jpg", "/mnt/img/a.jpg"},
+		{"/mnt/i", "/srv/a.jpg", "/srv/a.jpg"},
+	}
+	for _, tt := range tests {
+		if got := storedPath(tt.prefix, tt.path); got != tt.want {
+			t.Errorf("storedPath(%q, %q) = %q, want %q", tt.prefix, tt.path, got, tt.want)
+		}
+	}
+}
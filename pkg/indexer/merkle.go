@@ -0,0 +1,62 @@
+package indexer
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// HashChunks hashes what is read from reader in chunks of chunkSize bytes with algorithm, one of Algorithms, also
+// feeding it to any extra writers along the way. It returns the hex digest of each chunk, the last of which may be
+// shorter, and the Merkle root of them: pairs of digests are hashed together, concatenated as bytes, level by level,
+// with an unpaired last digest carried up to the next level as it is. Empty input is one empty chunk, so a file that
+// fits in one chunk has the same root as HashReader gives it.
+func HashChunks(reader io.Reader, algorithm string, chunkSize int64, extra ...io.Writer) (string, []string, error) {
+	newHash, ok := Algorithms[algorithm]
+	if !ok {
+		return "", nil, fmt.Errorf("unknown hash algorithm %q", algorithm)
+	}
+	if chunkSize <= 0 {
+		return "", nil, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	var digests [][]byte
+	hasher := newHash()
+	for {
+		n, err := io.Copy(io.MultiWriter(append([]io.Writer{hasher}, extra...)...), io.LimitReader(reader, chunkSize))
+		if err != nil {
+			return "", nil, err
+		}
+		if n == 0 && len(digests) > 0 {
+			break
+		}
+		digests = append(digests, hasher.Sum(nil))
+		hasher.Reset()
+		if n < chunkSize {
+			break
+		}
+	}
+	chunks := make([]string, len(digests))
+	for i, digest := range digests {
+		chunks[i] = hex.EncodeToString(digest)
+	}
+	return hex.EncodeToString(merkleRoot(digests, newHash())), chunks, nil
+}
+
+// merkleRoot folds digests, of which there is at least one, into their Merkle root, reusing hasher for every node.
+func merkleRoot(digests [][]byte, hasher hash.Hash) []byte {
+	for len(digests) > 1 {
+		next := make([][]byte, 0, (len(digests)+1)/2)
+		for i := 0; i+1 < len(digests); i += 2 {
+			hasher.Reset()
+			hasher.Write(digests[i])
+			hasher.Write(digests[i+1])
+			next = append(next, hasher.Sum(nil))
+		}
+		if len(digests)%2 == 1 {
+			next = append(next, digests[len(digests)-1])
+		}
+		digests = next
+	}
+	return digests[0]
+}
@@ -0,0 +1,85 @@
+package indexer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestHashChunks(t *testing.T) {
+	sum := func(parts ...[]byte) []byte {
+		h := sha256.New()
+		for _, part := range parts {
+			h.Write(part)
+		}
+		return h.Sum(nil)
+	}
+	abcd, efgh, ij := sum([]byte("abcd")), sum([]byte("efgh")), sum([]byte("ij"))
+	hexes := func(digests ...[]byte) []string {
+		var s []string
+		for _, digest := range digests {
+			s = append(s, hex.EncodeToString(digest))
+		}
+		return s
+	}
+	tests := []struct {
+		name   string
+		input  string
+		root   []byte
+		chunks []string
+	}{
+		{"empty", "", sum(), hexes(sum())},
+		{"one short chunk", "ab", sum([]byte("ab")), hexes(sum([]byte("ab")))},
+		{"one whole chunk", "abcd", abcd, hexes(abcd)},
+		{"two whole chunks", "abcdefgh", sum(abcd, efgh), hexes(abcd, efgh)},
+		// The unpaired third digest is carried up as it is, not hashed on its own.
+		{"three chunks", "abcdefghij", sum(sum(abcd, efgh), ij), hexes(abcd, efgh, ij)},
+		{"four chunks", "abcdefghijklmnop", sum(sum(abcd, efgh), sum(sum([]byte("ijkl")), sum([]byte("mnop")))),
+			hexes(abcd, efgh, sum([]byte("ijkl")), sum([]byte("mnop")))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var copied bytes.Buffer
+			root, chunks, err := HashChunks(strings.NewReader(tt.input), "sha256", 4, &copied)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if root != hex.EncodeToString(tt.root) {
+				t.Errorf("root = %s, want %x", root, tt.root)
+			}
+			if strings.Join(chunks, ",") != strings.Join(tt.chunks, ",") {
+				t.Errorf("chunks = %v, want %v", chunks, tt.chunks)
+			}
+			if copied.String() != tt.input {
+				t.Errorf("extra writer got %q, want %q", copied.String(), tt.input)
+			}
+		})
+	}
+}
+
+func TestHashChunksOneChunkMatchesHashReader(t *testing.T) {
+	for _, input := range []string{"", "hello"} {
+		root, _, err := HashChunks(strings.NewReader(input), "md5", 1<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := HashReader(strings.NewReader(input), "md5")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if root != want {
+			t.Errorf("root of %q = %s, want the plain hash %s", input, root, want)
+		}
+	}
+}
+
+func TestHashChunksInvalid(t *testing.T) {
+	if _, _, err := HashChunks(strings.NewReader("x"), "crc32", 4); err == nil {
+		t.Error("an unknown algorithm was accepted")
+	}
+	if _, _, err := HashChunks(strings.NewReader("x"), "sha256", 0); err == nil {
+		t.Error("a chunk size of 0 was accepted")
+	}
+}
@@ -0,0 +1,187 @@
+package indexer
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"fileindexer/store"
+)
+
+// postgresSchema creates file_hashes and file_history as the command does, so either can be first to use a database.
+// It has to be kept in step with the command's createTableQuery, createFileHistoryTableQuery and
+// addHashAlgorithmColumnQuery.
+const postgresSchema = `
+CREATE TABLE IF NOT EXISTS file_hashes (
+    id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    filepath TEXT NOT NULL UNIQUE,
+    hash TEXT NOT NULL,
+    size BIGINT NOT NULL,
+    file_timestamp TIMESTAMP NOT NULL,
+    hash_calculated_timestamp TIMESTAMP NOT NULL
+);
+CREATE TABLE IF NOT EXISTS file_history (
+    id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    filepath TEXT NOT NULL,
+    hash TEXT NOT NULL,
+    size BIGINT NOT NULL,
+    file_timestamp TIMESTAMP NOT NULL,
+    recorded_timestamp TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS file_history_filepath_recorded ON file_history (filepath, recorded_timestamp);
+ALTER TABLE file_history ADD COLUMN IF NOT EXISTS removed BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE file_hashes ADD COLUMN IF NOT EXISTS hash_algorithm TEXT;
+ALTER TABLE file_history ADD COLUMN IF NOT EXISTS hash_algorithm TEXT;
+`
+
+// PostgresStore is a store.Store on the file_hashes table of a fileindexer database, so a program embedding the
+// scanner shares its index with the fileindexer command. Like the command, it adds a file_history row for every record
+// it writes.
+type PostgresStore struct {
+	db *sql.DB
+}
+
+// NewPostgresStore returns a PostgresStore on db, which the caller opens with a PostgreSQL driver such as lib/pq,
+// creating the tables if needed.
+func NewPostgresStore(db *sql.DB) (*PostgresStore, error) {
+	if _, err := db.Exec(postgresSchema); err != nil {
+		return nil, err
+	}
+	if err := UpgradeRecordedTimestamps(db); err != nil {
+		return nil, err
+	}
+	return &PostgresStore{db: db}, nil
+}
+
+// recordedInUTCComment is the comment on file_hashes.hash_calculated_timestamp, which marks a table whose
+// hash_calculated_timestamp UpgradeRecordedTimestamps has converted to UTC.
+const recordedInUTCComment = "When the hash was last written, in UTC."
+
+// UpgradeRecordedTimestamps converts the hash_calculated_timestamp of file_hashes from local time, in which versions
+// before it was kept in UTC wrote it, to UTC, once per database: the conversion is marked by a comment on the column.
+// The local time zone is the one of the machine running it, which should be the one that scanned the files; each
+// stretch of it with its own offset, such as a summer, is converted by that offset. Everything writing
+// hash_calculated_timestamp calls it first, so the table never holds rows in both.
+func UpgradeRecordedTimestamps(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Concurrent scans wait here for the first one to convert the rows, and then find the comment.
+	if _, err := tx.Exec("LOCK TABLE file_hashes IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		return err
+	}
+	var comment sql.NullString
+	if err := tx.QueryRow("SELECT col_description('file_hashes'::regclass, attnum) FROM pg_attribute WHERE attrelid = 'file_hashes'::regclass AND attname = 'hash_calculated_timestamp'").
+		Scan(&comment); err != nil {
+		return err
+	}
+	if comment.String == recordedInUTCComment {
+		return nil
+	}
+
+	var first, last sql.NullTime
+	if err := tx.QueryRow("SELECT min(hash_calculated_timestamp), max(hash_calculated_timestamp) FROM file_hashes").Scan(&first, &last); err != nil {
+		return err
+	}
+	if first.Valid {
+		// The rows are converted by one statement from a table of the zone's offsets, so none is converted twice
+		// however far its offset moves it.
+		if _, err := tx.Exec("CREATE TEMPORARY TABLE local_offsets (since TIMESTAMP, until TIMESTAMP, seconds INTEGER) ON COMMIT DROP"); err != nil {
+			return err
+		}
+		for _, stretch := range localOffsets(LocalWallClock(first.Time), LocalWallClock(last.Time)) {
+			if _, err := tx.Exec("INSERT INTO local_offsets VALUES ($1, $2, $3)", stretch.since, stretch.until, stretch.seconds); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(`
+UPDATE file_hashes f SET hash_calculated_timestamp = f.hash_calculated_timestamp - make_interval(secs => o.seconds)
+FROM local_offsets o
+WHERE f.hash_calculated_timestamp >= o.since AND (o.until IS NULL OR f.hash_calculated_timestamp < o.until)`); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("COMMENT ON COLUMN file_hashes.hash_calculated_timestamp IS '" + recordedInUTCComment + "'"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// localOffset is a stretch of local wall-clock time with one offset from UTC. since and until are wall-clock times
+// given in UTC so they are sent to the database as they read; until is nil for the last stretch.
+type localOffset struct {
+	since   time.Time
+	until   *time.Time
+	seconds int
+}
+
+// localOffsets returns the stretches of the local time zone with a non-zero offset from first to last, both local
+// times. A wall-clock time that occurs twice, as the clocks go back, is taken to be in the later stretch.
+func localOffsets(first, last time.Time) []localOffset {
+	wallClock := func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	}
+	var offsets []localOffset
+	// The first stretch takes in any earlier wall-clock time too.
+	since := time.Time{}
+	for start := first; ; {
+		_, seconds := start.Zone()
+		_, end := start.ZoneBounds()
+		stretch := localOffset{since: since, seconds: seconds}
+		if !end.IsZero() && !end.After(last) {
+			until := wallClock(end)
+			stretch.until = &until
+		}
+		if seconds != 0 {
+			offsets = append(offsets, stretch)
+		}
+		if stretch.until == nil {
+			return offsets
+		}
+		start, since = end, *stretch.until
+	}
+}
+
+// Lookup returns the record of path. file_timestamp holds local wall-clock time, which is read back as such;
+// hash_calculated_timestamp is in UTC.
+func (s *PostgresStore) Lookup(path string) (store.Record, error) {
+	record := store.Record{Path: path}
+	err := s.db.QueryRow("SELECT hash, coalesce(hash_algorithm, $2), size, file_timestamp, hash_calculated_timestamp FROM file_hashes WHERE filepath = $1", path, DefaultAlgorithm).
+		Scan(&record.Hash, &record.Algorithm, &record.Size, &record.Modified, &record.Recorded)
+	if errors.Is(err, sql.ErrNoRows) {
+		return store.Record{}, store.ErrNotFound
+	}
+	record.Modified = LocalWallClock(record.Modified)
+	return record, err
+}
+
+// Put inserts or replaces the record of record.Path, and adds it to file_history in the same statement.
+func (s *PostgresStore) Put(record store.Record) error {
+	_, err := s.db.Exec(`
+WITH history AS (
+    INSERT INTO file_history (filepath, hash, size, file_timestamp, recorded_timestamp, hash_algorithm) VALUES ($1, $2, $3, $4, $5, $6)
+)
+INSERT INTO file_hashes (filepath, hash, size, file_timestamp, hash_calculated_timestamp, hash_algorithm)
+VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (filepath) DO UPDATE SET hash = EXCLUDED.hash, size = EXCLUDED.size, file_timestamp = EXCLUDED.file_timestamp,
+    hash_calculated_timestamp = EXCLUDED.hash_calculated_timestamp, hash_algorithm = EXCLUDED.hash_algorithm`,
+		record.Path, record.Hash, record.Size, record.Modified, record.Recorded.UTC(), record.Algorithm)
+	return err
+}
+
+func (s *PostgresStore) Ping() error {
+	return s.db.Ping()
+}
+
+// Close closes the database.
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
+
+// LocalWallClock reinterprets a time read from a TIMESTAMP column of file_hashes holding local wall-clock time, like
+// file_timestamp, in the local time zone. hash_calculated_timestamp is in UTC, like the other tables' times.
+func LocalWallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.Local)
+}
@@ -0,0 +1,54 @@
+package indexer
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// Excluded returns the first of the exclusion strings contained in path, or "" if none match. An empty string
+// excludes nothing.
+func Excluded(exclude []string, path string) string {
+	for _, s := range exclude {
+		if s != "" && strings.Contains(path, s) {
+			return s
+		}
+	}
+	return ""
+}
+
+// Walk calls visit for every regular file under root, or for root itself if it is a file, walking the tree with
+// walkDir, such as filepath.WalkDir. skip, if not nil, is asked about every directory and regular file first: a
+// directory it returns true for isn't descended into, and a file isn't visited. Errors reading a directory or file
+// are passed to visit, with the info of the entry if there is one to go by, and the walk goes on. It stops early, with ctx's error, when ctx is done, or
+// with visit's when it returns one.
+func Walk(ctx context.Context, root string, walkDir func(string, fs.WalkDirFunc) error, skip func(path string, d fs.DirEntry) bool,
+	visit func(path string, info fs.FileInfo, err error) error) error {
+	return walkDir(root, func(path string, d fs.DirEntry, walkErr error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if walkErr != nil {
+			var info fs.FileInfo
+			if d != nil {
+				info, _ = d.Info()
+			}
+			return visit(path, info, walkErr)
+		}
+		if d.IsDir() {
+			if skip != nil && skip(path, d) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || skip != nil && skip(path, d) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return visit(path, nil, err)
+		}
+		return visit(path, info, nil)
+	})
+}
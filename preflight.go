@@ -0,0 +1,148 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"path/filepath"
+)
+
+const (
+	// preflightSampleFiles is how many files are opened to check read access before a scan starts.
+	preflightSampleFiles = 200
+	// resultRowOverhead approximates the bytes per output row besides the path: hash, size, status and CSV framing.
+	resultRowOverhead = 64
+)
+
+// preflight checks the things that otherwise only surface hours into a scan: files the scan user can't read, an
+// output location that will fill up, and a database user without write access. It exits with an explanation of what
+// to fix rather than returning an error.
+func preflight(cfg Config, db *sql.DB, tree treeReader) {
+	if cfg.Directory != "" && len(cfg.Paths) == 0 && cfg.Worklist == "" && !cfg.FromQueue {
+		for _, rootCfg := range rootConfigs(cfg) {
+			checked, denied, err := sampleReadAccess(rootCfg, tree)
+			if err != nil {
+				log.Fatalf("Preflight: can't read --directory %s: %v. Run as a user with read access to the tree, or pass --skip-preflight to scan anyway.", scanRoot(rootCfg), err)
+			}
+			if checked > 0 && denied == checked {
+				log.Fatalf("Preflight: none of the %d files sampled under %s could be opened. Run as a user with read access to the tree, or pass --skip-preflight to scan anyway.", checked, scanRoot(rootCfg))
+			}
+			if denied > 0 {
+				log.Printf("WARNING: preflight could not open %d of %d sampled files under %s; expect errors in the results for files like these", denied, checked, scanRoot(rootCfg))
+			}
+		}
+	}
+
+	if db == nil {
+		// --db-driver sqlite: the file is created on demand, and there's no previous scan to estimate from.
+		return
+	}
+	if cfg.VerifyAgainst == "" {
+		if err := checkWritePrivileges(db); err != nil {
+			log.Fatalf("Preflight: %v", err)
+		}
+	}
+
+	needed, err := estimateOutputBytes(cfg, db)
+	if err != nil {
+		log.Printf("Preflight: skipping free space check: %v", err)
+		return
+	}
+	dir := filepath.Dir(cfg.OutputFile)
+	free, err := freeBytes(dir)
+	if err != nil {
+		log.Printf("Preflight: skipping free space check: %v", err)
+		return
+	}
+	if needed > free {
+		log.Fatalf("Preflight: the output needs about %d MiB but only %d MiB is free in %s. Point --output at a larger filesystem, or pass --skip-preflight to scan anyway.", needed>>20, free>>20, dir)
+	}
+}
+
+// sampleReadAccess opens the first preflightSampleFiles files of the walk, returning how many were tried and how many
+// could not be opened through tree. In privacy mode contents are never read, so only the listing is checked.
+func sampleReadAccess(cfg Config, tree treeReader) (int, int, error) {
+	if err := checkReadable(scanRoot(cfg)); err != nil {
+		return 0, 0, err
+	}
+	if cfg.PrivacyMode {
+		return 0, 0, nil
+	}
+	checked, denied := 0, 0
+	err := tree.walk(scanRoot(cfg), func(path string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return nil
+		}
+		if exclusion(cfg, scanRoot(cfg), path, d.IsDir()) != "" {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		checked++
+		file, err := tree.open(path)
+		// Reading would move the access time of a file opened without O_NOATIME before the scan sees it.
+		if err == nil && tree.readOnly == nil {
+			_, err = file.Read(make([]byte, 1))
+			file.Close()
+		}
+		if err != nil && err != io.EOF {
+			denied++
+			log.Printf("Preflight: can't read %s: %v", path, err)
+		}
+		if checked >= preflightSampleFiles {
+			return fs.SkipAll
+		}
+		return nil
+	})
+	return checked, denied, err
+}
+
+// checkWritePrivileges confirms the connected user can add and update rows in file_hashes and add to file_history.
+func checkWritePrivileges(db *sql.DB) error {
+	var user string
+	var canInsert, canUpdate, canRecordHistory bool
+	err := db.QueryRow("SELECT current_user, has_table_privilege('file_hashes', 'INSERT'), has_table_privilege('file_hashes', 'UPDATE'), has_table_privilege('file_history', 'INSERT')").Scan(&user, &canInsert, &canUpdate, &canRecordHistory)
+	if err != nil {
+		return fmt.Errorf("failed to check privileges on file_hashes: %v", err)
+	}
+	if !canInsert || !canUpdate || !canRecordHistory {
+		return fmt.Errorf("database user %s can't write to file_hashes and file_history. Ask the database owner to run: GRANT SELECT, INSERT, UPDATE ON file_hashes TO %s; GRANT INSERT ON file_history TO %s", user, user, user)
+	}
+	return nil
+}
+
+// estimateOutputBytes sizes the results file from the rows indexed under the directory by previous scans. Sharded
+// output needs room for the shards and the merged file at the same time.
+func estimateOutputBytes(cfg Config, db *sql.DB) (uint64, error) {
+	if cfg.Directory == "" || cfg.ChangesFrom != "" {
+		return 0, errors.New("only full scans of --directory can be estimated")
+	}
+	var rows int64
+	var pathBytes float64
+	for _, rootCfg := range rootConfigs(cfg) {
+		var rootRows int64
+		var rootPathBytes float64
+		err := db.QueryRow("SELECT count(*), coalesce(sum(octet_length(filepath)), 0) FROM file_hashes WHERE filepath LIKE $1",
+			likePrefix(scannedPrefix(rootCfg))).Scan(&rootRows, &rootPathBytes)
+		if err != nil {
+			return 0, err
+		}
+		rows += rootRows
+		pathBytes += rootPathBytes
+	}
+	if rows == 0 {
+		return 0, errors.New("no previous scan of this directory to estimate from")
+	}
+	needed := uint64(pathBytes + float64(rows)*resultRowOverhead)
+	if cfg.ShardOutput {
+		needed *= 2
+	}
+	return needed, nil
+}
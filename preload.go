@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql"
+	"hash/fnv"
+	"log"
+	"math"
+	"strings"
+	"time"
+)
+
+// preloadedRecordBytes estimates the memory a preloaded record takes beyond its path: the map entry, the hash, the
+// interned algorithm name and the two timestamps.
+const preloadedRecordBytes = mapEntryOverhead + 120
+
+// bloomFalsePositiveRate is what the Bloom filter of a preload too large for --memory-limit is sized for. A false
+// positive only costs the SELECT the preload would have saved.
+const bloomFalsePositiveRate = 0.01
+
+// preloaded holds the records under the scanned directory with --preload, or is nil when every file is looked up on
+// its own.
+var preloaded *recordPreload
+
+// recordPreload answers getDatabaseRecord for stored paths under prefix from records read in one query at the start
+// of the scan, instead of a round trip per file. When the records wouldn't fit in --memory-limit, only a Bloom filter
+// of their paths is kept: files it rules out are new, and the rest are still looked up one by one.
+type recordPreload struct {
+	prefix  string
+	records map[string]preloadedRecord
+	bloom   *bloomFilter
+}
+
+type preloadedRecord struct {
+	hash, algorithm  string
+	size             int64
+	modified, hashed time.Time
+}
+
+// preloadRecords reads the records under the stored path of the scanned directory.
+func preloadRecords(db *sql.DB, cfg Config) (*recordPreload, error) {
+	start := time.Now()
+	p := &recordPreload{prefix: scannedPrefix(cfg)}
+
+	var count, pathBytes int64
+	err := retryDB(db, "size of the preload under "+p.prefix, func() error {
+		return db.QueryRow("SELECT count(*), coalesce(sum(length(filepath)), 0) FROM file_hashes WHERE filepath LIKE $1", likePrefix(p.prefix)).
+			Scan(&count, &pathBytes)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MemoryLimit > 0 && pathBytes+count*preloadedRecordBytes > cfg.MemoryLimit {
+		p.bloom = newBloomFilter(count, bloomFalsePositiveRate)
+	} else {
+		p.records = make(map[string]preloadedRecord, count)
+	}
+
+	err = retryDB(db, "preload under "+p.prefix, func() error {
+		clear(p.records)
+		algorithms := make(map[string]string)
+		rows, err := db.Query("SELECT filepath, hash, size, coalesce(hash_algorithm, $2), file_timestamp, hash_calculated_timestamp FROM file_hashes WHERE filepath LIKE $1",
+			likePrefix(p.prefix), defaultHashAlgorithm)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var path string
+			var record preloadedRecord
+			if err := rows.Scan(&path, &record.hash, &record.size, &record.algorithm, &record.modified, &record.hashed); err != nil {
+				return err
+			}
+			if p.bloom != nil {
+				p.bloom.add(path)
+				continue
+			}
+			// Every record repeats one of a handful of algorithm names.
+			if name, ok := algorithms[record.algorithm]; ok {
+				record.algorithm = name
+			} else {
+				algorithms[record.algorithm] = record.algorithm
+			}
+			record.modified = localWallClock(record.modified)
+			p.records[path] = record
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Print(msg("RecordsPreloaded", map[string]any{
+		"Count": count, "Prefix": p.prefix, "Duration": time.Since(start).Round(time.Millisecond), "Bloom": p.bloom != nil,
+	}))
+	return p, nil
+}
+
+// lookup returns the record of storedPath as getDatabaseRecord does, with ok false if the preload can't tell and the
+// database has to be asked.
+func (p *recordPreload) lookup(storedPath string) (record preloadedRecord, ok bool, err error) {
+	if !strings.HasPrefix(storedPath, p.prefix) {
+		return record, false, nil
+	}
+	if p.bloom != nil {
+		if p.bloom.mayContain(storedPath) {
+			return record, false, nil
+		}
+		return record, true, sql.ErrNoRows
+	}
+	record, found := p.records[storedPath]
+	if !found {
+		return record, true, sql.ErrNoRows
+	}
+	return record, true, nil
+}
+
+// bloomFilter is a set of strings that may report a string it doesn't hold, but never misses one it does.
+type bloomFilter struct {
+	bits   []uint64
+	hashes uint64
+}
+
+// newBloomFilter sizes a filter for n strings with the given false positive rate.
+func newBloomFilter(n int64, falsePositiveRate float64) *bloomFilter {
+	bits := math.Ceil(-float64(max(n, 1)) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	hashes := max(1, math.Round(bits/float64(max(n, 1))*math.Ln2))
+	return &bloomFilter{bits: make([]uint64, (uint64(bits)+63)/64), hashes: uint64(hashes)}
+}
+
+// positions derives the filter's bit positions for s from two halves of one 64-bit hash.
+func (f *bloomFilter) positions(s string, visit func(bit uint64) bool) {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	sum := h.Sum64()
+	a, b := sum&0xffffffff, sum>>32|1
+	size := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < f.hashes; i++ {
+		if !visit((a + i*b) % size) {
+			return
+		}
+	}
+}
+
+func (f *bloomFilter) add(s string) {
+	f.positions(s, func(bit uint64) bool {
+		f.bits[bit/64] |= 1 << (bit % 64)
+		return true
+	})
+}
+
+func (f *bloomFilter) mayContain(s string) bool {
+	found := true
+	f.positions(s, func(bit uint64) bool {
+		found = f.bits[bit/64]&(1<<(bit%64)) != 0
+		return found
+	})
+	return found
+}
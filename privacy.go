@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// readPrivacySalt returns the salt for --privacy-mode, prompting the same way connectToDatabase does for the password.
+// The same salt must be used on every run against a database or every file will look new.
+func readPrivacySalt() []byte {
+	salt := os.Getenv("PRIVACY_SALT")
+	if salt == "" {
+		fmt.Print(msg("PromptPrivacySalt", nil))
+		fmt.Scanln(&salt)
+	}
+	if salt == "" {
+		log.Fatalf("--privacy-mode requires a salt (PRIVACY_SALT environment variable or prompt)")
+	}
+	return []byte(salt)
+}
+
+// privacyDigest is the keyed hash used in place of plaintext names. HMAC rather than a bare salted SHA-256 so the
+// salt can't be recovered by length-extension tricks from known names.
+func privacyDigest(salt []byte, value string) string {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(value))
+	return fmt.Sprintf("%x", mac.Sum(nil))
+}
+
+// processPrivateFile records a file for a privacy-preserving inventory: the stored path is a digest of the real
+// stored path, the hash column holds a digest of the file name, and the file contents are never opened. Returns the
+// digested path alongside the usual hash, size, status and error. Records are held for batch unless it is nil.
+func processPrivateFile(info os.FileInfo, storedPath string, db *sql.DB, batch *recordBatch, salt []byte) (string, string, int64, string, error) {
+	privatePath := privacyDigest(salt, storedPath)
+	nameHash := privacyDigest(salt, filepath.Base(storedPath))
+	size := info.Size()
+	fileTimestamp := info.ModTime()
+
+	_, dbSize, _, _, err := getDatabaseRecord(db, privatePath)
+	if errors.Is(err, sql.ErrNoRows) {
+		outcome, err := upsertFileRecord(db, batch, privatePath, nameHash, privacyHashAlgorithm, size, fileTimestamp, false)
+		if err != nil {
+			return privatePath, "", -1, "", fmt.Errorf("failed to write record: %v", err)
+		}
+		return privatePath, nameHash, size, writtenStatus("new", outcome), nil
+	} else if err != nil {
+		return privatePath, "", -1, "", fmt.Errorf("failed to query database: %v", err)
+	}
+
+	if size != dbSize {
+		outcome, err := upsertFileRecord(db, batch, privatePath, nameHash, privacyHashAlgorithm, size, fileTimestamp, false)
+		if err != nil {
+			return privatePath, "", -1, "", fmt.Errorf("failed to write record: %v", err)
+		}
+		return privatePath, nameHash, size, writtenStatus("changed", outcome), nil
+	}
+	return privatePath, nameHash, size, "existing", nil
+}
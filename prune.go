@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// runPrune marks the indexed files under --directory that no longer exist as deleted, as --detect-deleted does after
+// a scan, but without scanning, or with --delete deletes their rows. The missing files are written to stdout as results
+// rows with status missing; with --dry-run, that is all it does.
+func runPrune(args []string) {
+	fs := flag.NewFlagSet("prune", flag.ContinueOnError)
+	var dbCfg DBConfig
+	registerDBFlags(fs, &dbCfg)
+	directory := fs.String("directory", "", "The directory whose indexed files are checked.")
+	subpath := fs.String("subpath", "", "Only check this directory under --directory, given relative to it.")
+	prefix := fs.String("prefix", "", "The --prefix the directory was scanned with.")
+	deleteRows := fs.Bool("delete", false, "Delete the file_hashes rows of the missing files, and the rows of other tables describing them, instead of marking them deleted. Their file_history rows are kept.")
+	dryRun := fs.Bool("dry-run", false, "Only list the missing files, changing nothing.")
+	fs.Usage = commandUsage(fs, "PruneUsage")
+	parseArgs(fs, args)
+
+	if *directory == "" {
+		usageError(fs, "directory", msg("MissingFlag", map[string]any{"Flag": "directory"}))
+	}
+	if dbCfg.DbName == "" {
+		usageError(fs, "dbname", msg("MissingFlag", map[string]any{"Flag": "dbname"}))
+	}
+	if *subpath != "" && !filepath.IsLocal(*subpath) {
+		usageError(fs, "subpath", fmt.Sprintf("Invalid --subpath %q, expected a path inside --directory, relative to it.", *subpath))
+	}
+	if *deleteRows && *dryRun {
+		log.Fatalf("--delete and --dry-run can't be combined; --dry-run lists the files either would apply to")
+	}
+	action := pruneMark
+	if *deleteRows {
+		action = pruneDelete
+	} else if *dryRun {
+		action = pruneDryRun
+	}
+	cfg := Config{Directory: *directory, Subpath: filepath.Clean(*subpath), Prefix: *prefix}
+	if cfg.Subpath == "." {
+		cfg.Subpath = ""
+	}
+	// The safeguard against an unmounted share counts the files a scan found; here, what the directory holds.
+	entries, err := os.ReadDir(scanRoot(cfg))
+	if err != nil {
+		log.Fatalf("Failed to read %s: %v", scanRoot(cfg), err)
+	}
+
+	db := connectToDatabase(dbCfg)
+	defer db.Close()
+	if _, err := db.Exec(addDeletedTimestampColumnQuery); err != nil {
+		log.Fatalf("Failed to add deleted_timestamp column: %v", err)
+	}
+	// Deleted rows get a removed history row.
+	if *deleteRows {
+		if _, err := db.Exec(createFileHistoryTableQuery + addHashAlgorithmColumnQuery); err != nil {
+			log.Fatalf("Failed to create history table: %v", err)
+		}
+	}
+
+	writer := csv.NewWriter(os.Stdout)
+	writer.Write([]string{"filepath", "hash", "size", "status"})
+	missing, err := detectDeleted(cfg, db, &sharedSink{writer: writer}, int64(len(entries)), 0, action)
+	if err != nil {
+		log.Fatalf("Failed to detect deleted files: %v", err)
+	}
+	summary := map[pruneAction]string{pruneMark: "DeletedSummary", pruneDelete: "PruneDeletedSummary", pruneDryRun: "PruneDryRunSummary"}[action]
+	log.Print(msg(summary, map[string]any{"Count": missing, "Directory": scanRoot(cfg)}))
+}
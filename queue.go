@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+const createQueueTableQuery = `
+CREATE TABLE IF NOT EXISTS scan_queue (
+    id BIGINT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    path TEXT NOT NULL UNIQUE,
+    size BIGINT NOT NULL,
+    mtime TIMESTAMP NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    claimed_by TEXT,
+    claimed_timestamp TIMESTAMP,
+    error TEXT,
+    enqueued_timestamp TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS scan_queue_status_idx ON scan_queue (status, id);
+`
+
+const queueClaimBatch = 100
+
+// workQueue hands out files from the scan_queue table. Several workers, on any number of hosts mounting the
+// filesystem at the same path, can drain one queue: claims use SKIP LOCKED so they never block each other, and a
+// claim older than the lease is assumed to belong to a crashed worker and is handed out again. A worker restarted
+// with the same ID immediately gets back whatever it had claimed.
+type workQueue struct {
+	db       *sql.DB
+	workerID string
+	lease    time.Duration
+}
+
+func newWorkQueue(db *sql.DB, workerID string, lease time.Duration) (*workQueue, error) {
+	if _, err := db.Exec(createQueueTableQuery); err != nil {
+		return nil, err
+	}
+	return &workQueue{db: db, workerID: workerID, lease: lease}, nil
+}
+
+// defaultWorkerID identifies this process in claimed_by. The hostname alone is stable across restarts, which is
+// what lets a restarted worker pick up its own claims; run several workers on one host with distinct --worker-id.
+func defaultWorkerID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "worker"
+	}
+	return host
+}
+
+// enqueue walks cfg.Directory through tree and adds every file to the queue as pending. Files already queued are reset to
+// pending, so re-enqueueing a tree schedules it to be hashed again.
+func (q *workQueue) enqueue(cfg Config, tree treeReader) (int, error) {
+	count := 0
+	var insertErr error
+	walkErr := walkFiles(context.Background(), cfg, tree, nil, func(path string, info os.FileInfo) {
+		if insertErr != nil {
+			return
+		}
+		_, insertErr = q.db.Exec(`
+INSERT INTO scan_queue (path, size, mtime, status, enqueued_timestamp) VALUES ($1, $2, $3, 'pending', $4)
+ON CONFLICT (path) DO UPDATE SET size = EXCLUDED.size, mtime = EXCLUDED.mtime, status = 'pending',
+    claimed_by = NULL, claimed_timestamp = NULL, error = NULL, enqueued_timestamp = EXCLUDED.enqueued_timestamp`,
+			path, info.Size(), info.ModTime().UTC(), time.Now())
+		count++
+	})
+	if walkErr != nil {
+		log.Printf("Error walking through files: %v", walkErr)
+	}
+	return count, insertErr
+}
+
+// drain claims batches of files until the queue is empty or ctx is done, calling visit for each. visit must eventually
+// lead to complete being called for the path; files it doesn't start stay claimed, and are taken back by the next
+// drain with the same worker ID.
+func (q *workQueue) drain(ctx context.Context, visit func(path string, info os.FileInfo)) error {
+	// Only the first claim takes back this worker's leftover claims; after that, our own claims are files still being
+	// processed from the previous batch.
+	resume := true
+	for {
+		if ctx.Err() != nil {
+			return errScanInterrupted
+		}
+		rows, err := q.db.Query(`
+UPDATE scan_queue SET status = 'claimed', claimed_by = $1, claimed_timestamp = $2
+WHERE id IN (
+    SELECT id FROM scan_queue
+    WHERE status = 'pending'
+       OR (status = 'claimed' AND ((claimed_by = $1 AND $5) OR claimed_timestamp < $3))
+    ORDER BY id
+    LIMIT $4
+    FOR UPDATE SKIP LOCKED
+)
+RETURNING path`, q.workerID, time.Now(), time.Now().Add(-q.lease), queueClaimBatch, resume)
+		resume = false
+		if err != nil {
+			return fmt.Errorf("failed to claim work: %v", err)
+		}
+		var paths []string
+		for rows.Next() {
+			var path string
+			if err := rows.Scan(&path); err != nil {
+				rows.Close()
+				return err
+			}
+			paths = append(paths, path)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(paths) == 0 {
+			return nil
+		}
+
+		for _, path := range paths {
+			info, err := os.Lstat(path)
+			if err == nil && !info.Mode().IsRegular() {
+				err = fmt.Errorf("not a regular file")
+			}
+			if err != nil {
+				log.Printf("Error accessing %s: %v", path, err)
+				q.complete(path, err)
+				continue
+			}
+			visit(path, info)
+		}
+	}
+}
+
+// complete marks a claimed file as done, or failed with the error.
+func (q *workQueue) complete(path string, processErr error) {
+	err := retryDB(q.db, "queue update for "+path, func() error {
+		var err error
+		if processErr != nil {
+			_, err = q.db.Exec("UPDATE scan_queue SET status = 'failed', error = $1 WHERE path = $2 AND claimed_by = $3", processErr.Error(), path, q.workerID)
+		} else {
+			_, err = q.db.Exec("UPDATE scan_queue SET status = 'done', error = NULL WHERE path = $1 AND claimed_by = $2", path, q.workerID)
+		}
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to update queue entry for %s: %v", path, err)
+	}
+}
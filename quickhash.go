@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// quickHashSample is how much of the start of a file, and again of its end, --quick-hash reads.
+const quickHashSample = 16 << 20
+
+// sampledSuffix marks the hash_algorithm of records hashed by --quick-hash, like md5-sampled. A sampled hash is never
+// compared with a full one, so a scan with --full-hash hashes those files again in full.
+const sampledSuffix = "-sampled"
+
+// quickHashMin is the --quick-hash size from which files are hashed from samples, or 0 to hash every file in full.
+var quickHashMin int64
+
+// fileAlgorithm returns what a file of size bytes is hashed with: the sampled variant of algorithm if it reaches the
+// --quick-hash size, and algorithm itself otherwise.
+func fileAlgorithm(algorithm string, size int64) string {
+	if quickHashMin > 0 && size >= quickHashMin {
+		return algorithm + sampledSuffix
+	}
+	return algorithm
+}
+
+// sampledAlgorithm returns the algorithm underlying a hash_algorithm, and whether it names a sampled hash.
+func sampledAlgorithm(algorithm string) (string, bool) {
+	return strings.CutSuffix(algorithm, sampledSuffix)
+}
+
+// hashSamples hashes the first and last quickHashSample bytes of file with algorithm, followed by its size in decimal.
+// A file shorter than two samples is read whole; its size still goes in, so the hash differs from a full one. Reads
+// go through the retries of share unless it is nil.
+func hashSamples(file *os.File, algorithm string, share *shareSweep) (string, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	size := info.Size()
+	head := min(size, quickHashSample)
+	tail := max(head, size-quickHashSample)
+	return hashReader(io.MultiReader(fileSection(file, 0, head, share), fileSection(file, tail, size-tail, share), strings.NewReader(strconv.FormatInt(size, 10))), algorithm)
+}
+
+// fileSection reads n bytes of file from offset, through the retries of share unless it is nil.
+func fileSection(file *os.File, offset, n int64, share *shareSweep) io.Reader {
+	if share != nil {
+		return io.LimitReader(&shareReader{share: share, file: file, offset: offset}, n)
+	}
+	return io.NewSectionReader(file, offset, n)
+}
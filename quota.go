@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// quotaExitCode is the exit status of a scan that completed but found a quota exceeded, so schedulers can tell it
+// apart from a failed run (1) or a usage error (2).
+const quotaExitCode = 3
+
+// quota_usage keeps each prefix's totals after every scan that checks quotas, so growth can be measured.
+const createQuotaUsageTableQuery = `
+CREATE TABLE IF NOT EXISTS quota_usage (
+    id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    prefix TEXT NOT NULL,
+    total_size BIGINT NOT NULL,
+    file_count BIGINT NOT NULL,
+    measured_timestamp TIMESTAMP NOT NULL
+);
+`
+
+// quota is one --quota threshold on a stored path prefix. kind is "size" (bytes), "files" (file count) or
+// "growth" (bytes per week).
+type quota struct {
+	prefix string
+	kind   string
+	limit  int64
+}
+
+// parseQuotas parses --quota definitions of the form prefix:kind=limit, e.g. /photos/:size=2TiB,
+// /photos/:files=1000000 or /photos/:growth=50GiB.
+func parseQuotas(defs []string) ([]quota, error) {
+	var quotas []quota
+	for _, def := range defs {
+		i := strings.LastIndex(def, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid --quota %q, expected prefix:size=N, prefix:files=N or prefix:growth=N", def)
+		}
+		kind, value, ok := strings.Cut(def[i+1:], "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid --quota %q, expected prefix:size=N, prefix:files=N or prefix:growth=N", def)
+		}
+		q := quota{prefix: def[:i], kind: kind}
+		var err error
+		switch kind {
+		case "size", "growth":
+			q.limit, err = parseByteSize(value)
+		case "files":
+			q.limit, err = strconv.ParseInt(value, 10, 64)
+		default:
+			err = fmt.Errorf("unknown quota kind %q", kind)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid --quota %q: %v", def, err)
+		}
+		quotas = append(quotas, q)
+	}
+	return quotas, nil
+}
+
+// checkQuotas measures every prefix with a quota, records the measurement and returns a message per exceeded
+// threshold. Totals come from the index, so files deleted from disk but still indexed count towards them.
+func checkQuotas(db *sql.DB, quotas []quota) ([]string, error) {
+	if _, err := db.Exec(createQuotaUsageTableQuery); err != nil {
+		return nil, err
+	}
+
+	type usage struct{ size, files int64 }
+	measured := make(map[string]usage)
+	var alerts []string
+	now := time.Now().UTC()
+	for _, q := range quotas {
+		u, ok := measured[q.prefix]
+		if !ok {
+			if err := db.QueryRow("SELECT "+sumSizeSQL+", count(*) FROM file_hashes WHERE filepath LIKE $1", likePrefix(q.prefix)).Scan(&u.size, &u.files); err != nil {
+				return nil, err
+			}
+			measured[q.prefix] = u
+		}
+
+		switch q.kind {
+		case "size":
+			if u.size > q.limit {
+				alerts = append(alerts, fmt.Sprintf("%s holds %s, over its quota of %s", q.prefix, formatByteSize(u.size), formatByteSize(q.limit)))
+			}
+		case "files":
+			if u.files > q.limit {
+				alerts = append(alerts, fmt.Sprintf("%s holds %d files, over its quota of %d", q.prefix, u.files, q.limit))
+			}
+		case "growth":
+			perWeek, ok, err := weeklyGrowth(db, q.prefix, u.size, now)
+			if err != nil {
+				return nil, err
+			}
+			if ok && perWeek > q.limit {
+				alerts = append(alerts, fmt.Sprintf("%s is growing by %s/week, over its limit of %s/week", q.prefix, formatByteSize(perWeek), formatByteSize(q.limit)))
+			}
+		}
+	}
+
+	for prefix, u := range measured {
+		if _, err := db.Exec("INSERT INTO quota_usage (prefix, total_size, file_count, measured_timestamp) VALUES ($1, $2, $3, $4)", prefix, u.size, u.files, now); err != nil {
+			return nil, err
+		}
+	}
+	return alerts, nil
+}
+
+// weeklyGrowth extrapolates the growth rate of prefix from the last measurement taken at least a week ago, or failing
+// that the oldest one at least a day old. ok is false when there is no usable earlier measurement.
+func weeklyGrowth(db *sql.DB, prefix string, size int64, now time.Time) (int64, bool, error) {
+	const week = 7 * 24 * time.Hour
+	var previous int64
+	var at time.Time
+	err := db.QueryRow("SELECT total_size, measured_timestamp FROM quota_usage WHERE prefix = $1 AND measured_timestamp <= $2 ORDER BY measured_timestamp DESC LIMIT 1",
+		prefix, now.Add(-week)).Scan(&previous, &at)
+	if err == sql.ErrNoRows {
+		err = db.QueryRow("SELECT total_size, measured_timestamp FROM quota_usage WHERE prefix = $1 AND measured_timestamp <= $2 ORDER BY measured_timestamp LIMIT 1",
+			prefix, now.Add(-24*time.Hour)).Scan(&previous, &at)
+	}
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	elapsed := now.Sub(at)
+	return int64(float64(size-previous) * float64(week) / float64(elapsed)), true, nil
+}
+
+// sendAlerts logs the alerts and delivers them to whichever of the webhook and email are configured. Delivery
+// failures are logged; the exit code still reports the alerts.
+func sendAlerts(cfg Config, alerts []string) {
+	for _, alert := range alerts {
+		log.Printf("QUOTA ALERT: %s", alert)
+	}
+	host, _ := os.Hostname()
+
+	if cfg.AlertWebhook != "" {
+		body, _ := json.Marshal(map[string]any{"host": host, "directory": strings.Join(cfg.Roots, ", "), "alerts": alerts})
+		client := &http.Client{Timeout: 30 * time.Second}
+		resp, err := client.Post(cfg.AlertWebhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Failed to send quota alerts to webhook: %v", err)
+		} else {
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				log.Printf("Quota alert webhook returned %s", resp.Status)
+			}
+		}
+	}
+
+	if cfg.AlertEmail != "" {
+		var b strings.Builder
+		fmt.Fprintf(&b, "From: %s\r\nTo: %s\r\nSubject: fileindexer quota alerts on %s\r\n\r\n", cfg.SMTPFrom, cfg.AlertEmail, host)
+		for _, alert := range alerts {
+			fmt.Fprintf(&b, "%s\r\n", alert)
+		}
+		if err := sendMail(cfg.SMTPServer, cfg.SMTPFrom, strings.Split(cfg.AlertEmail, ","), []byte(b.String())); err != nil {
+			log.Printf("Failed to email quota alerts: %v", err)
+		}
+	}
+}
+
+// sendMail sends a message with headers through server, logging in with SMTP_USER and SMTP_PASSWORD if they are set.
+func sendMail(server, from string, to []string, message []byte) error {
+	var auth smtp.Auth
+	if user := os.Getenv("SMTP_USER"); user != "" {
+		serverHost, _, _ := strings.Cut(server, ":")
+		auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), serverHost)
+	}
+	return smtp.SendMail(server, auth, from, to, message)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimiter limits the API requests of each client (a token, or an address when tokens aren't required) with a
+// token bucket: a client can make burst requests at once, and one more every 1/rate seconds.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+	swept   time.Time
+}
+
+// rateBucket is what a client has left of its burst as of updated.
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*rateBucket), swept: time.Now()}
+}
+
+// allow takes a request from client's bucket and reports whether there was one to take. If not, it returns how long
+// until there will be.
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	// Buckets that have filled up again are the same as new ones, so they are dropped now and then to keep clients
+	// that have gone away from piling up.
+	if now.Sub(l.swept) > time.Minute {
+		for name, bucket := range l.buckets {
+			if l.refill(bucket, now) >= l.burst {
+				delete(l.buckets, name)
+			}
+		}
+		l.swept = now
+	}
+	bucket := l.buckets[client]
+	if bucket == nil {
+		bucket = &rateBucket{tokens: l.burst, updated: now}
+		l.buckets[client] = bucket
+	}
+	bucket.tokens, bucket.updated = l.refill(bucket, now), now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// refill returns what bucket holds at now.
+func (l *rateLimiter) refill(bucket *rateBucket, now time.Time) float64 {
+	return math.Min(l.burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(1, 2)
+	for i, want := range []bool{true, true, false} {
+		ok, wait := l.allow("a")
+		if ok != want {
+			t.Fatalf("request %d allowed = %v, want %v", i+1, ok, want)
+		}
+		if !ok && (wait <= 0 || wait > time.Second) {
+			t.Errorf("request %d wait = %v, want up to a second", i+1, wait)
+		}
+	}
+	if ok, _ := l.allow("b"); !ok {
+		t.Error("another client was limited by the first one's requests")
+	}
+
+	// Half a second later, half a request has come back.
+	l.buckets["a"].updated = l.buckets["a"].updated.Add(-500 * time.Millisecond)
+	if ok, wait := l.allow("a"); ok || wait <= 0 || wait > 500*time.Millisecond {
+		t.Errorf("allowed = %v with wait %v, want a wait of up to half a second", ok, wait)
+	}
+	// The bucket fills up to the burst, and no further.
+	l.buckets["a"].updated = l.buckets["a"].updated.Add(-time.Hour)
+	for i, want := range []bool{true, true, false} {
+		if ok, _ := l.allow("a"); ok != want {
+			t.Errorf("request %d after an hour allowed = %v, want %v", i+1, ok, want)
+		}
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	l := newRateLimiter(1, 2)
+	l.allow("idle")
+	l.allow("busy")
+	l.allow("busy")
+	// Two minutes on, idle's bucket has filled up again while busy's is still empty.
+	l.buckets["idle"].updated = l.buckets["idle"].updated.Add(-2 * time.Minute)
+	l.swept = l.swept.Add(-2 * time.Minute)
+	l.allow("busy")
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("the full bucket of an idle client was kept")
+	}
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Error("the bucket of a client in use was dropped")
+	}
+}
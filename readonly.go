@@ -0,0 +1,323 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// maxAttestedPaths is how many of the files whose access or modification time moved the attestation names.
+const maxAttestedPaths = 100
+
+// readOnlyGuard opens the files and directories of the scanned tree without updating their access times where the
+// kernel lets it, and checks afterwards that they weren't.
+type readOnlyGuard struct {
+	roots    []string
+	started  time.Time
+	rootTime map[string]time.Time // access time of each root directory before the scan
+
+	opened   atomic.Int64
+	noatime  atomic.Int64 // opened with O_NOATIME
+	verified atomic.Int64 // files whose times were checked after they were read
+
+	mu            sync.Mutex
+	atimeMoved    []string // the first maxAttestedPaths files whose access time moved
+	atimeCount    int
+	modified      []string // the first maxAttestedPaths files written to by something else during the scan
+	modifiedCount int
+}
+
+// readOnlyAttestation is what --read-only-guarantee writes next to the results file and records in scan_runs.
+type readOnlyAttestation struct {
+	Host               string         `json:"host"`
+	Started            time.Time      `json:"started"`
+	Finished           time.Time      `json:"finished"`
+	Roots              []attestedRoot `json:"roots"`
+	WriteLocations     []string       `json:"write_locations"`
+	NoatimeSupported   bool           `json:"noatime_supported"`
+	Opened             int64          `json:"opened"`
+	OpenedNoatime      int64          `json:"opened_with_noatime"`
+	FilesChecked       int64          `json:"files_checked"`
+	AccessTimeChanged  int            `json:"access_time_changed"`
+	AccessTimeExamples []string       `json:"access_time_changed_paths,omitempty"`
+	ModifiedDuringScan int            `json:"modified_during_scan"`
+	ModifiedExamples   []string       `json:"modified_during_scan_paths,omitempty"`
+	ResultsFile        string         `json:"results_file"`
+	ResultsSHA256      string         `json:"results_sha256"`
+	Untouched          bool           `json:"untouched"`
+}
+
+type attestedRoot struct {
+	Path           string   `json:"path"`
+	Mount          string   `json:"mount,omitempty"`
+	MountOptions   []string `json:"mount_options,omitempty"`
+	ReadOnlyMount  bool     `json:"read_only_mount"`
+	AccessTimeKept bool     `json:"access_time_unchanged"`
+}
+
+func newReadOnlyGuard(cfg Config) *readOnlyGuard {
+	g := &readOnlyGuard{roots: scannedTrees(cfg), started: time.Now(), rootTime: make(map[string]time.Time)}
+	for _, root := range g.roots {
+		if info, err := os.Lstat(root); err == nil {
+			if atime, ok := accessTime(info); ok {
+				g.rootTime[root] = atime
+			}
+		}
+	}
+	return g
+}
+
+// scannedTrees returns the directories and files a scan reads, as absolute paths.
+func scannedTrees(cfg Config) []string {
+	var trees []string
+	for _, path := range append(slices.Clone(cfg.Roots), cfg.Paths...) {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		trees = append(trees, path)
+	}
+	return trees
+}
+
+// writeLocations returns every file and directory a scan with cfg may write to.
+func writeLocations(cfg Config) []string {
+	spillDir := cfg.SpillDir
+	if spillDir == "" {
+		spillDir = os.TempDir()
+	}
+	var locations []string
+	for _, path := range []string{
+		cfg.OutputFile, partialOutputPath(cfg.OutputFile), attestationPath(cfg.OutputFile), spillDir, cfg.ReportHTML, cfg.ReportOutput,
+		cfg.TypeReport, cfg.ExecutableReport, cfg.SBOMOutput, cfg.EnumerateOnly, cfg.WALPath, cfg.DiagDir,
+	} {
+		if path == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		locations = append(locations, path)
+	}
+	if cfg.Store == "sqlite" {
+		if abs, err := filepath.Abs(cfg.StoreDSN); err == nil {
+			locations = append(locations, abs, abs+"-journal", abs+"-wal")
+		}
+	}
+	return locations
+}
+
+// checkWriteLocations refuses a --read-only-guarantee scan that would write anything inside the tree it reads.
+func checkWriteLocations(cfg Config) {
+	for _, location := range writeLocations(cfg) {
+		for _, tree := range scannedTrees(cfg) {
+			if within(location, tree) {
+				log.Fatalf("--read-only-guarantee refuses to write %s, which is inside the scanned %s; point it elsewhere", location, tree)
+			}
+		}
+	}
+}
+
+// attestationPath is where --read-only-guarantee writes its attestation for a results file.
+func attestationPath(outputFile string) string {
+	return outputFile + ".attestation.json"
+}
+
+// open opens a file or directory of the tree for reading, with O_NOATIME where the kernel allows it: for files the
+// process owns, or with CAP_FOWNER. Others are opened as usual, and the mount's atime options decide.
+func (g *readOnlyGuard) open(path string) (*os.File, error) {
+	if oNoAtime != 0 {
+		file, err := os.OpenFile(path, os.O_RDONLY|oNoAtime, 0)
+		if err == nil {
+			g.opened.Add(1)
+			g.noatime.Add(1)
+			return file, nil
+		}
+		if !errors.Is(err, syscall.EPERM) {
+			return nil, err
+		}
+	}
+	file, err := os.Open(path)
+	if err == nil {
+		g.opened.Add(1)
+	}
+	return file, err
+}
+
+// check compares the times of the file at path, read by the scan, with info from before it was read, returning the
+// status suffix for a file whose access time moved.
+func (g *readOnlyGuard) check(path string, info os.FileInfo) string {
+	after, err := os.Lstat(path)
+	if err != nil {
+		return ""
+	}
+	g.verified.Add(1)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if after.Size() != info.Size() || !after.ModTime().Equal(info.ModTime()) {
+		// Something else wrote to the file while it was scanned; its access time says nothing about the scan.
+		g.modifiedCount++
+		if len(g.modified) < maxAttestedPaths {
+			g.modified = append(g.modified, path)
+		}
+		return ""
+	}
+	before, ok := accessTime(info)
+	now, _ := accessTime(after)
+	if !ok || now.Equal(before) {
+		return ""
+	}
+	g.atimeCount++
+	if len(g.atimeMoved) < maxAttestedPaths {
+		g.atimeMoved = append(g.atimeMoved, path)
+	}
+	return "+atime-changed"
+}
+
+// attest puts together the attestation of a scan whose results were written to cfg.OutputFile.
+func (g *readOnlyGuard) attest(cfg Config) (readOnlyAttestation, error) {
+	digest, err := fileSHA256(cfg.OutputFile)
+	if err != nil {
+		return readOnlyAttestation{}, err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	resultsFile, _ := filepath.Abs(cfg.OutputFile)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	a := readOnlyAttestation{
+		Host: host, Started: g.started.UTC(), Finished: time.Now().UTC(), WriteLocations: writeLocations(cfg),
+		NoatimeSupported: oNoAtime != 0, Opened: g.opened.Load(), OpenedNoatime: g.noatime.Load(), FilesChecked: g.verified.Load(),
+		AccessTimeChanged: g.atimeCount, AccessTimeExamples: g.atimeMoved, ModifiedDuringScan: g.modifiedCount, ModifiedExamples: g.modified,
+		ResultsFile: resultsFile, ResultsSHA256: digest, Untouched: g.atimeCount == 0,
+	}
+	sort.Strings(a.AccessTimeExamples)
+	sort.Strings(a.ModifiedExamples)
+	for _, root := range g.roots {
+		attested := attestedRoot{Path: root, AccessTimeKept: true}
+		if mount, options, err := mountOptions(root); err == nil {
+			attested.Mount, attested.MountOptions = mount, options
+			attested.ReadOnlyMount = slices.Contains(options, "ro")
+		}
+		if before, ok := g.rootTime[root]; ok {
+			if info, err := os.Lstat(root); err == nil {
+				if now, ok := accessTime(info); ok && !now.Equal(before) {
+					attested.AccessTimeKept = false
+					a.Untouched = false
+				}
+			}
+		}
+		a.Roots = append(a.Roots, attested)
+	}
+	return a, nil
+}
+
+// writeAttestation writes the attestation of the scan next to its results file and records it in the scan's runs.
+func (g *readOnlyGuard) writeAttestation(cfg Config, db *sql.DB, runs []rootRun) {
+	a, err := g.attest(cfg)
+	if err != nil {
+		log.Printf("Failed to attest the read-only scan: %v", err)
+		return
+	}
+	data, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		log.Printf("Failed to attest the read-only scan: %v", err)
+		return
+	}
+	if err := os.WriteFile(attestationPath(cfg.OutputFile), append(data, '\n'), 0o644); err != nil {
+		log.Printf("Failed to write attestation %s: %v", attestationPath(cfg.OutputFile), err)
+	}
+	for _, run := range runs {
+		if run.id == 0 {
+			continue
+		}
+		if _, err := db.Exec("UPDATE scan_runs SET read_only_attestation = $1 WHERE id = $2", string(data), run.id); err != nil {
+			log.Printf("Failed to record the attestation of scan run %d: %v", run.id, err)
+		}
+	}
+	log.Print(msg("ReadOnlyAttested", map[string]any{
+		"Path": attestationPath(cfg.OutputFile), "Opened": a.Opened, "Noatime": a.OpenedNoatime, "Changed": a.AccessTimeChanged, "Untouched": a.Untouched,
+	}))
+}
+
+// treeReader opens and walks the scanned tree: through the guard with --read-only-guarantee, and with the share's
+// retries with --network-share. The zero value, which commands other than a scan use, reads the tree directly.
+type treeReader struct {
+	share    *shareSweep
+	readOnly *readOnlyGuard
+}
+
+// open opens a file of the scanned tree for reading, through the guard with --read-only-guarantee.
+func (t treeReader) open(path string) (*os.File, error) {
+	if t.readOnly != nil {
+		return t.readOnly.open(path)
+	}
+	return os.Open(path)
+}
+
+// openForHashing opens a file whose contents are about to be hashed, through the share's retries with --network-share.
+func (t treeReader) openForHashing(path string) (*os.File, error) {
+	if t.share != nil {
+		return t.share.open(path, t.open)
+	}
+	return t.open(path)
+}
+
+// walk is filepath.WalkDir, listing directories through the guard with --read-only-guarantee so that their access
+// times are kept too.
+func (t treeReader) walk(root string, fn fs.WalkDirFunc) error {
+	if t.readOnly == nil {
+		return filepath.WalkDir(root, fn)
+	}
+	return fs.WalkDir(treeFS{guard: t.readOnly, root: root}, ".", func(name string, d fs.DirEntry, err error) error {
+		path := root
+		if name != "." {
+			path = filepath.Join(root, filepath.FromSlash(name))
+		}
+		return fn(path, d, err)
+	})
+}
+
+// treeFS is the tree under root as an fs.FS, for fs.WalkDir.
+type treeFS struct {
+	guard *readOnlyGuard
+	root  string
+}
+
+func (t treeFS) path(name string) string {
+	return filepath.Join(t.root, filepath.FromSlash(name))
+}
+
+func (t treeFS) Open(name string) (fs.File, error) {
+	return t.guard.open(t.path(name))
+}
+
+// Stat doesn't follow a symbolic link, as filepath.WalkDir doesn't for its root.
+func (t treeFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Lstat(t.path(name))
+}
+
+func (t treeFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	dir, err := t.guard.open(t.path(name))
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	entries, err := dir.ReadDir(-1)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, err
+}
+
+var _ fs.ReadDirFS = treeFS{}
+var _ fs.StatFS = treeFS{}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"html/template"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reportTopN is how many errors and new files the HTML report lists.
+const reportTopN = 20
+
+// The status chart has a row of reportBarHeight pixels per status: its name, then a bar at most reportBarWidth long.
+const (
+	reportBarHeight = 28
+	reportBarWidth  = 440
+)
+
+// reportColors are the bar colors of the statuses in the HTML report's chart; other statuses are blue.
+var reportColors = map[string]string{
+	"new": "#2e7d32", "changed": "#f9a825", "forced": "#ef6c00", "rehashed": "#6d4c41", "existing": "#9e9e9e",
+	"verified": "#00897b", "corrupt": "#b71c1c", "missing": "#6a1b9a", "moved": "#3949ab", "error": "#e53935",
+}
+
+// scanReport gathers what --report-html and --report-template show from the results rows as they are written: the
+// files and bytes of each status, the most common errors and the largest new files, and for a template, the rows.
+type scanReport struct {
+	mu       sync.Mutex
+	started  time.Time
+	statuses map[string]*reportStatus
+	errors   map[string]*reportError
+	largest  []reportFile // largest first, at most reportTopN
+	rows     *reportRows  // with --report-template, or nil
+}
+
+type reportStatus struct {
+	Status string
+	Files  int64
+	Bytes  int64
+}
+
+// reportError is one error, with the path it was reported for taken out, and the number of files it was reported for.
+type reportError struct {
+	Reason  string
+	Files   int64
+	Example string
+}
+
+type reportFile struct {
+	Path string
+	Size int64
+}
+
+func newScanReport(cfg Config) (*scanReport, error) {
+	r := &scanReport{started: time.Now(), statuses: make(map[string]*reportStatus), errors: make(map[string]*reportError)}
+	if cfg.ReportTemplate != nil {
+		var err error
+		if r.rows, err = newReportRows(cfg.SpillDir); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// add counts one results row. Statuses are counted without their +flag suffixes.
+func (r *scanReport) add(row []string) {
+	path := strings.ToValidUTF8(row[0], "�")
+	size, _ := strconv.ParseInt(row[2], 10, 64)
+	status, _, _ := strings.Cut(row[3], "+")
+	reason, failed := strings.CutPrefix(row[3], "error: ")
+	if failed {
+		status = "error"
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rows != nil {
+		r.rows.add(row)
+	}
+	counted := r.statuses[status]
+	if counted == nil {
+		counted = &reportStatus{Status: status}
+		r.statuses[status] = counted
+	}
+	counted.Files++
+	if size > 0 {
+		counted.Bytes += size
+	}
+	if failed {
+		// Errors name the file they are about; what follows the last colon is why, which files have in common.
+		if i := strings.LastIndex(reason, ": "); i >= 0 {
+			reason = reason[i+2:]
+		}
+		reason = strings.ToValidUTF8(reason, "�")
+		counted := r.errors[reason]
+		if counted == nil {
+			counted = &reportError{Reason: reason, Example: path}
+			r.errors[reason] = counted
+		}
+		counted.Files++
+	}
+	if status == "new" && (len(r.largest) < reportTopN || size > r.largest[len(r.largest)-1].Size) {
+		i := sort.Search(len(r.largest), func(i int) bool { return r.largest[i].Size < size })
+		r.largest = append(r.largest[:i], append([]reportFile{{path, size}}, r.largest[i:]...)...)
+		if len(r.largest) > reportTopN {
+			r.largest = r.largest[:reportTopN]
+		}
+	}
+}
+
+// reportSink passes every results row on to the wrapped sink and adds it to the report.
+type reportSink struct {
+	resultSink
+	report *scanReport
+}
+
+func (s *reportSink) Write(slot int, row []string) error {
+	s.report.add(row)
+	return s.resultSink.Write(slot, row)
+}
+
+// reportSummary is what the reports tell about a scan. Statuses are ordered by files, most first, and Errors are the
+// reportTopN most common.
+type reportSummary struct {
+	Directory   string
+	Output      string
+	Run         int64 // the scan_runs id, or 0
+	Started     time.Time
+	Finished    time.Time
+	Duration    time.Duration
+	Interrupted bool
+	Files       int64
+	Bytes       int64
+	Statuses    []reportStatus
+	Errors      []reportError
+	Largest     []reportFile
+}
+
+// summary sums up the rows added so far. run is the scan_runs id, or 0, and interrupted says the scan stopped early.
+func (r *scanReport) summary(cfg Config, run int64, interrupted bool) reportSummary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	finished := time.Now()
+	summary := reportSummary{
+		Directory: scannedRoots(cfg), Output: cfg.OutputFile, Run: run, Interrupted: interrupted,
+		Started: r.started, Finished: finished, Duration: finished.Sub(r.started).Round(time.Second),
+	}
+
+	for _, status := range r.statuses {
+		summary.Statuses = append(summary.Statuses, *status)
+		summary.Files += status.Files
+		summary.Bytes += status.Bytes
+	}
+	sort.Slice(summary.Statuses, func(i, j int) bool {
+		if summary.Statuses[i].Files != summary.Statuses[j].Files {
+			return summary.Statuses[i].Files > summary.Statuses[j].Files
+		}
+		return summary.Statuses[i].Status < summary.Statuses[j].Status
+	})
+
+	for _, counted := range r.errors {
+		summary.Errors = append(summary.Errors, *counted)
+	}
+	sort.Slice(summary.Errors, func(i, j int) bool {
+		if summary.Errors[i].Files != summary.Errors[j].Files {
+			return summary.Errors[i].Files > summary.Errors[j].Files
+		}
+		return summary.Errors[i].Reason < summary.Errors[j].Reason
+	})
+	if len(summary.Errors) > reportTopN {
+		summary.Errors = summary.Errors[:reportTopN]
+	}
+	summary.Largest = slices.Clone(r.largest)
+	return summary
+}
+
+// reportBar is a bar of the status chart, at Y and Width pixels long.
+type reportBar struct {
+	reportStatus
+	Width int
+	Y     int
+	Color string
+}
+
+// reportPage is what reportTemplate renders.
+type reportPage struct {
+	reportSummary
+	Bars        []reportBar
+	ChartHeight int
+}
+
+// writeHTMLReport renders the --report-html page of summary to path.
+func writeHTMLReport(path string, summary reportSummary) error {
+	page := reportPage{reportSummary: summary}
+	var most int64
+	for _, status := range summary.Statuses {
+		most = max(most, status.Files)
+	}
+	for i, status := range summary.Statuses {
+		color, ok := reportColors[status.Status]
+		if !ok {
+			color = "#1e88e5"
+		}
+		width := max(1, int(reportBarWidth*status.Files/most))
+		page.Bars = append(page.Bars, reportBar{reportStatus: status, Width: width, Y: i * reportBarHeight, Color: color})
+	}
+	page.ChartHeight = len(page.Bars) * reportBarHeight
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := reportTemplate.Execute(file, page); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// reportTemplate is a page with no outside resources, so it can be attached to a ticket or mailed as it is. The chart
+// is inline SVG rather than script, which mail clients and ticket systems strip.
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"size": func(n int64) string { return formatSize(n, true) },
+	"time": func(t time.Time) string { return t.Format(queryTimeLayout) },
+	"add":  func(a, b int) int { return a + b },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>fileindexer scan of {{.Directory}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #212121; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 2em; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: 0.3em 1em 0.3em 0; border-bottom: 1px solid #e0e0e0; vertical-align: top; }
+td.number { text-align: right; font-variant-numeric: tabular-nums; }
+td.path { font-family: monospace; word-break: break-all; }
+.warning { background: #fff3e0; border-left: 4px solid #ef6c00; padding: 0.5em 1em; }
+</style>
+</head>
+<body>
+<h1>fileindexer scan of {{.Directory}}</h1>
+{{if .Interrupted}}<p class="warning">The scan was stopped before it finished; these are the files it got to.</p>{{end}}
+<table>
+<tr><th>Directory</th><td>{{.Directory}}</td></tr>
+{{if .Run}}<tr><th>Run</th><td>{{.Run}}</td></tr>{{end}}
+<tr><th>Started</th><td>{{time .Started}}</td></tr>
+<tr><th>Finished</th><td>{{time .Finished}} ({{.Duration}})</td></tr>
+<tr><th>Files</th><td>{{.Files}}</td></tr>
+<tr><th>Size</th><td>{{size .Bytes}}</td></tr>
+<tr><th>Results file</th><td>{{.Output}}</td></tr>
+</table>
+
+<h2>Status</h2>
+{{if .Bars}}<svg width="640" height="{{.ChartHeight}}" viewBox="0 0 640 {{.ChartHeight}}" role="img" aria-label="Files by status">
+{{range .Bars}}<text x="0" y="{{.Y}}" dy="16" font-size="13">{{.Status}}</text>
+<rect x="100" y="{{.Y}}" width="{{.Width}}" height="22" fill="{{.Color}}"></rect>
+<text x="{{add 106 .Width}}" y="{{.Y}}" dy="16" font-size="12">{{.Files}}</text>
+{{end}}</svg>
+<table>
+<tr><th>Status</th><th>Files</th><th>Size</th></tr>
+{{range .Bars}}<tr><td>{{.Status}}</td><td class="number">{{.Files}}</td><td class="number">{{size .Bytes}}</td></tr>
+{{end}}</table>
+{{else}}<p>No files were processed.</p>{{end}}
+
+<h2>Top errors</h2>
+{{if .Errors}}<table>
+<tr><th>Error</th><th>Files</th><th>For example</th></tr>
+{{range .Errors}}<tr><td>{{.Reason}}</td><td class="number">{{.Files}}</td><td class="path">{{.Example}}</td></tr>
+{{end}}</table>
+{{else}}<p>No errors.</p>{{end}}
+
+<h2>Largest new files</h2>
+{{if .Largest}}<table>
+<tr><th>File</th><th>Size</th></tr>
+{{range .Largest}}<tr><td class="path">{{.Path}}</td><td class="number">{{size .Size}}</td></tr>
+{{end}}</table>
+{{else}}<p>No new files.</p>{{end}}
+</body>
+</html>
+`))
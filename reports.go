@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// reportDefinition is a named report from the reports section of a YAML --config file. It is either SQL, a
+// text/template in which {{param "name"}} stands for a bind parameter, or one of the reports GET /export serves, and
+// params are the defaults of its parameters:
+//
+//	reports:
+//	  large-pdfs:
+//	    description: PDFs over a size
+//	    sql: SELECT filepath, size FROM file_hashes WHERE filepath LIKE '%.pdf' AND size >= {{param "min_size"}}
+//	    params: {min_size: 104857600}
+//	  nas-dupes:
+//	    report: dupes
+//	    params: {prefix: /mnt/nas/}
+//	    every: 24h
+//	    deliver:
+//	      file: /srv/reports/nas-dupes.csv
+//	      email: [storage@example.com]
+//
+// Reports with every are run at that interval by serve, and sent where deliver says.
+type reportDefinition struct {
+	Description string            `yaml:"description"`
+	SQL         string            `yaml:"sql"`
+	Report      string            `yaml:"report"`
+	Params      map[string]string `yaml:"params"`
+	Format      string            `yaml:"format"`
+	Every       time.Duration     `yaml:"every"`
+	Deliver     reportDelivery    `yaml:"deliver"`
+}
+
+// reportDelivery is where a report is sent: written to a file, POSTed to a webhook, and emailed as an attachment.
+type reportDelivery struct {
+	File       string   `yaml:"file"`
+	Webhook    string   `yaml:"webhook"`
+	Email      []string `yaml:"email"`
+	SMTPServer string   `yaml:"smtp-server"`
+	SMTPFrom   string   `yaml:"smtp-from"`
+}
+
+func (d reportDelivery) empty() bool {
+	return d.File == "" && d.Webhook == "" && len(d.Email) == 0
+}
+
+// reportSettings and deliverySettings are the settings a report and its deliver section may have.
+var (
+	reportSettings   = []string{"description", "sql", "report", "params", "format", "every", "deliver"}
+	deliverySettings = []string{"file", "webhook", "email", "smtp-server", "smtp-from"}
+)
+
+// loadReportDefinitions reads the reports section of a YAML config file. A file without one has no reports.
+func loadReportDefinitions(path string) (map[string]reportDefinition, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var settings map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	node, ok := settings["reports"]
+	if !ok {
+		return nil, nil
+	}
+	var nodes map[string]yaml.Node
+	if err := node.Decode(&nodes); err != nil {
+		return nil, fmt.Errorf("%s:%d: reports: %v", path, node.Line, err)
+	}
+	reports := make(map[string]reportDefinition)
+	for _, name := range slices.Sorted(maps.Keys(nodes)) {
+		node := nodes[name]
+		if err := checkSettingNames(path, &node, reportSettings); err != nil {
+			return nil, err
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == "deliver" {
+				if err := checkSettingNames(path, node.Content[i+1], deliverySettings); err != nil {
+					return nil, err
+				}
+			}
+		}
+		var report reportDefinition
+		if err := node.Decode(&report); err != nil {
+			return nil, fmt.Errorf("%s:%d: report %s: %v", path, node.Line, name, err)
+		}
+		if err := report.validate(); err != nil {
+			return nil, fmt.Errorf("%s:%d: report %s: %v", path, node.Line, name, err)
+		}
+		reports[name] = report
+	}
+	return reports, nil
+}
+
+// checkSettingNames returns an error for the first key of the mapping node that isn't one of names, so a misspelled
+// setting isn't silently ignored.
+func checkSettingNames(path string, node *yaml.Node, names []string) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s:%d: expected a mapping of settings", path, node.Line)
+	}
+	for i := 0; i < len(node.Content); i += 2 {
+		if key := node.Content[i]; !slices.Contains(names, key.Value) {
+			return fmt.Errorf("%s:%d: unknown setting %q, expected one of %v", path, key.Line, key.Value, names)
+		}
+	}
+	return nil
+}
+
+func (r reportDefinition) validate() error {
+	if (r.SQL == "") == (r.Report == "") {
+		return fmt.Errorf("needs either sql or report")
+	}
+	if r.Report != "" {
+		if _, ok := exportReports[r.Report]; !ok {
+			return fmt.Errorf("unknown report %q, expected one of %v", r.Report, exportReportNames())
+		}
+	} else if _, err := sqlReportTemplate(r.SQL, func(string) (string, error) { return "", nil }); err != nil {
+		return err
+	}
+	if r.Format != "" && r.Format != "csv" && r.Format != "jsonl" {
+		return fmt.Errorf("invalid format %q, expected csv or jsonl", r.Format)
+	}
+	if r.Every < 0 {
+		return fmt.Errorf("invalid every %s", r.Every)
+	}
+	if r.Every > 0 && r.Deliver.empty() {
+		return fmt.Errorf("every needs deliver settings to send the report to")
+	}
+	return nil
+}
+
+func sqlReportTemplate(text string, param func(string) (string, error)) (*template.Template, error) {
+	return template.New("sql").Option("missingkey=zero").Funcs(template.FuncMap{"param": param}).Parse(text)
+}
+
+// expandReportSQL executes the SQL template of a report with params, returning the query and the values of its bind
+// parameters. The template's data is whether each parameter is given, by name, so {{if .prefix}} tests for one; the
+// values themselves aren't in it, so they can only reach the query as bind parameters, through param.
+func expandReportSQL(text string, params url.Values) (string, []any, error) {
+	var args []any
+	tmpl, err := sqlReportTemplate(text, func(name string) (string, error) {
+		if !params.Has(name) {
+			return "", fmt.Errorf("no value for parameter %s", name)
+		}
+		args = append(args, params.Get(name))
+		return "$" + strconv.Itoa(len(args)), nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	data := make(map[string]bool)
+	for name := range params {
+		data[name] = true
+	}
+	var query strings.Builder
+	if err := tmpl.Execute(&query, data); err != nil {
+		return "", nil, err
+	}
+	return query.String(), args, nil
+}
+
+// renderReport runs report r with params, which override its own, and writes its rows to w in format. SQL reports run
+// in a read-only transaction, so a report can't change the index even if its SQL tries to.
+func renderReport(ctx context.Context, db *sql.DB, r reportDefinition, params url.Values, format string, w io.Writer) error {
+	query := url.Values{}
+	for name, value := range r.Params {
+		query.Set(name, value)
+	}
+	for name, values := range params {
+		query[name] = values
+	}
+	if r.Report != "" {
+		report := exportReports[r.Report]
+		rows, next, err := report.open(ctx, db, query, apiToken{Role: "admin"})
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		return writeExport(w, format, report.header, rows, next, func() error { return nil })
+	}
+
+	text, args, err := expandReportSQL(r.SQL, query)
+	if err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, text, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	return writeExport(w, format, columns, rows, func() ([]string, any, error) {
+		values := make([]any, len(columns))
+		pointers := make([]any, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, nil, err
+		}
+		fields := make([]string, len(columns))
+		item := make(map[string]any, len(columns))
+		for i, value := range values {
+			switch v := value.(type) {
+			case []byte:
+				value = string(v)
+			case time.Time:
+				value = v.Format(queryTimeLayout)
+			}
+			if value != nil {
+				fields[i] = fmt.Sprint(value)
+			}
+			item[columns[i]] = value
+		}
+		return fields, item, nil
+	}, func() error { return nil })
+}
+
+// reportFormat returns the format to write report r in: format if given, else the report's own, else csv.
+func reportFormat(r reportDefinition, format string) string {
+	if format == "" {
+		format = r.Format
+	}
+	if format == "" {
+		format = "csv"
+	}
+	return format
+}
+
+// deliverReport runs report name and sends it where its deliver settings say. It is rendered to a temporary file
+// first, so a failing query sends nothing, and a failing delivery doesn't keep the others from being tried.
+func deliverReport(ctx context.Context, db *sql.DB, name string, r reportDefinition, params url.Values, format string) error {
+	file, err := os.CreateTemp("", "fileindexer-report-*."+format)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	out := bufio.NewWriter(file)
+	if err := renderReport(ctx, db, r, params, format, out); err != nil {
+		return err
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+
+	var errs []error
+	if r.Deliver.File != "" {
+		if err := copyReportFile(file, r.Deliver.File); err != nil {
+			errs = append(errs, fmt.Errorf("writing %s: %v", r.Deliver.File, err))
+		}
+	}
+	if r.Deliver.Webhook != "" {
+		if err := postReport(file, r.Deliver.Webhook, format); err != nil {
+			errs = append(errs, fmt.Errorf("posting to webhook: %v", err))
+		}
+	}
+	if len(r.Deliver.Email) > 0 {
+		if err := emailReport(file, name, r, format); err != nil {
+			errs = append(errs, fmt.Errorf("emailing: %v", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// copyReportFile copies the rendered report to path through a temporary file next to it, so readers of path never
+// see half a report.
+func copyReportFile(report *os.File, path string) error {
+	if _, err := report.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, report)
+	if err = firstError(err, out.Close()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func postReport(report *os.File, webhook, format string) error {
+	if _, err := report.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	// Reports can be large, so the webhook gets longer than quota alerts do.
+	client := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Post(webhook, exportContentType(format), report)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// emailReport mails the rendered report as an attachment, through the SMTP server of its deliver settings (by
+// default localhost:25, like the scan's --smtp-server).
+func emailReport(report *os.File, name string, r reportDefinition, format string) error {
+	data, err := os.ReadFile(report.Name())
+	if err != nil {
+		return err
+	}
+	server, from := r.Deliver.SMTPServer, r.Deliver.SMTPFrom
+	if server == "" {
+		server = "localhost:25"
+	}
+	if from == "" {
+		from = "fileindexer@localhost"
+	}
+	host, _ := os.Hostname()
+	description := r.Description
+	if description == "" {
+		description = "Report " + name
+	}
+
+	var b bytes.Buffer
+	parts := multipart.NewWriter(&b)
+	fmt.Fprintf(&b, "From: %s\r\nTo: %s\r\nSubject: fileindexer report %s on %s\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=%s\r\n\r\n",
+		from, strings.Join(r.Deliver.Email, ", "), name, host, parts.Boundary())
+	text, err := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(text, "%s, run %s.\r\n", description, time.Now().Format(queryTimeLayout))
+	attachment, err := parts.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {exportContentType(format)},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", name+"."+format)},
+	})
+	if err != nil {
+		return err
+	}
+	// Base64 in lines of 76 characters, as MIME requires.
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		fmt.Fprintf(attachment, "%s\r\n", encoded[:76])
+		encoded = encoded[76:]
+	}
+	fmt.Fprintf(attachment, "%s\r\n", encoded)
+	if err := parts.Close(); err != nil {
+		return err
+	}
+	return sendMail(server, from, r.Deliver.Email, b.Bytes())
+}
+
+// scheduleReports runs each of reports that has every at that interval for as long as serve runs, and delivers it.
+// The first run is one interval after serve starts.
+func scheduleReports(db *sql.DB, reports map[string]reportDefinition) {
+	for _, name := range slices.Sorted(maps.Keys(reports)) {
+		r := reports[name]
+		if r.Every == 0 {
+			continue
+		}
+		go func() {
+			for range time.Tick(r.Every) {
+				if err := deliverReport(context.Background(), db, name, r, nil, reportFormat(r, "")); err != nil {
+					log.Printf("Failed to deliver report %s: %v", name, err)
+					continue
+				}
+				log.Print(msg("ReportDelivered", map[string]any{"Name": name}))
+			}
+		}()
+	}
+}
+
+// runReport lists the named reports of a YAML config file, or runs one and writes it out or delivers it.
+func runReport(args []string) {
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	var dbCfg DBConfig
+	registerDBFlags(fs, &dbCfg)
+	configFile, configSet := registerConfigFlags(fs)
+	var params stringList
+	fs.Var(&params, "param", "Report parameter as name=value, overriding the report's params. May be repeated.")
+	format := fs.String("format", "", "Output format: csv or jsonl (one JSON object per line). Defaults to the report's format, or csv.")
+	output := fs.String("output", "", "Write the report to this file instead of stdout.")
+	deliver := fs.Bool("deliver", false, "Send the report where its deliver settings say instead of writing it out.")
+	fs.Usage = commandUsage(fs, "ReportUsage")
+
+	var action string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		action, args = args[0], args[1:]
+	}
+	parseArgs(fs, args)
+
+	if !(action == "list" && fs.NArg() == 0 || action == "run" && fs.NArg() == 1) {
+		usageError(fs, "", msg("ReportUsage", nil))
+	}
+	if !isYAMLConfig(*configFile) {
+		usageError(fs, "config", "--config must name a YAML file with a reports section.")
+	}
+	if *format != "" && *format != "csv" && *format != "jsonl" {
+		usageError(fs, "format", fmt.Sprintf("Invalid --format %q.", *format))
+	}
+	if *deliver && *output != "" {
+		usageError(fs, "output", "--output and --deliver can't be combined.")
+	}
+	query := url.Values{}
+	for _, param := range params {
+		name, value, ok := strings.Cut(param, "=")
+		if !ok || name == "" {
+			usageError(fs, "param", fmt.Sprintf("Invalid --param %q, expected name=value.", param))
+		}
+		query.Add(name, value)
+	}
+	readDBConfigFile(fs, *configFile, *configSet)
+	reports, err := loadReportDefinitions(*configFile)
+	if err != nil {
+		log.Fatalf("Failed to read reports: %v", err)
+	}
+
+	if action == "list" {
+		writer := csv.NewWriter(os.Stdout)
+		writer.Write([]string{"name", "report", "every", "description"})
+		for _, name := range slices.Sorted(maps.Keys(reports)) {
+			r := reports[name]
+			every := ""
+			if r.Every > 0 {
+				every = r.Every.String()
+			}
+			source := r.Report
+			if source == "" {
+				source = "sql"
+			}
+			writer.Write([]string{name, source, every, r.Description})
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			log.Fatalf("Failed to write results: %v", err)
+		}
+		return
+	}
+
+	name := fs.Arg(0)
+	r, ok := reports[name]
+	if !ok {
+		log.Fatalf("No report %s in %s, expected one of %v", name, *configFile, slices.Sorted(maps.Keys(reports)))
+	}
+	if dbCfg.DbName == "" {
+		usageError(fs, "dbname", msg("MissingFlag", map[string]any{"Flag": "dbname"}))
+	}
+	db := connectToDatabase(dbCfg)
+	defer db.Close()
+	ctx := context.Background()
+
+	if *deliver {
+		if r.Deliver.empty() {
+			log.Fatalf("Report %s has no deliver settings", name)
+		}
+		if err := deliverReport(ctx, db, name, r, query, reportFormat(r, *format)); err != nil {
+			log.Fatalf("Failed to deliver report %s: %v", name, err)
+		}
+		log.Print(msg("ReportDelivered", map[string]any{"Name": name}))
+		return
+	}
+
+	file := os.Stdout
+	if *output != "" {
+		if file, err = os.Create(*output); err != nil {
+			log.Fatalf("Failed to create %s: %v", *output, err)
+		}
+	}
+	out := bufio.NewWriter(file)
+	if err := renderReport(ctx, db, r, query, reportFormat(r, *format), out); err != nil {
+		log.Fatalf("Failed to run report %s: %v", name, err)
+	}
+	if err := firstError(out.Flush(), file.Close()); err != nil {
+		log.Fatalf("Failed to write results: %v", err)
+	}
+}
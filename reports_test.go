@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpandReportSQL(t *testing.T) {
+	tests := []struct {
+		name    string
+		sql     string
+		params  url.Values
+		want    string
+		args    []any
+		wantErr string
+	}{
+		{
+			name: "no parameters",
+			sql:  "SELECT count(*) FROM file_hashes",
+			want: "SELECT count(*) FROM file_hashes",
+		},
+		{
+			name:   "bind parameters",
+			sql:    `SELECT filepath FROM file_hashes WHERE size > {{param "min"}} AND filepath LIKE {{param "prefix"}} || '%'`,
+			params: url.Values{"min": {"100"}, "prefix": {"/photos/"}},
+			want:   "SELECT filepath FROM file_hashes WHERE size > $1 AND filepath LIKE $2 || '%'",
+			args:   []any{"100", "/photos/"},
+		},
+		{
+			name:   "repeated parameter",
+			sql:    `SELECT {{param "a"}}, {{param "a"}}`,
+			params: url.Values{"a": {"x"}},
+			want:   "SELECT $1, $2",
+			args:   []any{"x", "x"},
+		},
+		{
+			name:   "optional condition given",
+			sql:    `SELECT 1 FROM file_hashes WHERE true{{if .prefix}} AND filepath LIKE {{param "prefix"}}{{end}}`,
+			params: url.Values{"prefix": {"/a/"}},
+			want:   "SELECT 1 FROM file_hashes WHERE true AND filepath LIKE $1",
+			args:   []any{"/a/"},
+		},
+		{
+			name:   "optional condition left out",
+			sql:    `SELECT 1 FROM file_hashes WHERE true{{if .prefix}} AND filepath LIKE {{param "prefix"}}{{end}}`,
+			params: url.Values{"other": {"x"}},
+			want:   "SELECT 1 FROM file_hashes WHERE true",
+		},
+		{
+			// Values never reach the text of the query, only whether they were given.
+			name:   "value in the data",
+			sql:    `SELECT '{{.prefix}}'`,
+			params: url.Values{"prefix": {"'; DROP TABLE file_hashes; --"}},
+			want:   "SELECT 'true'",
+		},
+		{
+			name:    "missing parameter",
+			sql:     `SELECT {{param "prefix"}}`,
+			wantErr: "no value for parameter prefix",
+		},
+		{
+			name:    "invalid template",
+			sql:     `SELECT {{param "prefix"`,
+			wantErr: "template: sql:1:",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, args, err := expandReportSQL(tt.sql, tt.params)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if query != tt.want {
+				t.Errorf("query = %q, want %q", query, tt.want)
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("args = %v, want %v", args, tt.args)
+			}
+		})
+	}
+}
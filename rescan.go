@@ -0,0 +1,107 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// runRescan is the rescan command: a scan of only the indexed files under --under whose path matches --glob, found in
+// the index rather than by walking the directory, which makes refreshing a few files in a large tree quick.
+func runRescan(args []string) {
+	runScan("rescan", args)
+}
+
+// rescanPaths returns the local paths of the indexed files under cfg.Under matching cfg.Glob that are still regular
+// files on disk, along with how many matching ones no longer are. Files added since the last scan aren't indexed, so
+// they aren't found.
+func rescanPaths(cfg Config, db *sql.DB) ([]string, int, error) {
+	under := scannedPrefix(Config{Directory: cfg.Under, Prefix: cfg.Prefix})
+	query := "SELECT filepath FROM file_hashes WHERE filepath LIKE $1 ORDER BY filepath"
+	args := []any{likePrefix(under)}
+	// A pattern like **/*.jpg narrows the query to the extension, so the database doesn't send every path under --under.
+	if suffix := globSuffix(cfg.Glob); suffix != "" {
+		query = "SELECT filepath FROM file_hashes WHERE filepath LIKE $1 AND filepath LIKE $2 ORDER BY filepath"
+		args = append(args, "%"+strings.TrimSuffix(likePrefix(suffix), "%"))
+	}
+
+	var stored []string
+	err := retryDB(db, "lookup of the files to rescan", func() error {
+		stored = stored[:0]
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var storedPath string
+			if err := rows.Scan(&storedPath); err != nil {
+				return err
+			}
+			if matchGlob(cfg.Glob, storedPath[len(under):]) {
+				stored = append(stored, storedPath)
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var paths []string
+	missing := 0
+	for _, storedPath := range stored {
+		localPath := filepath.Join(cfg.Under, filepath.FromSlash(storedPath[len(under):]))
+		if info, err := os.Lstat(localPath); err != nil || !info.Mode().IsRegular() {
+			missing++
+			continue
+		}
+		paths = append(paths, localPath)
+	}
+	return paths, missing, nil
+}
+
+// checkGlob reports whether pattern is a valid --glob.
+func checkGlob(pattern string) error {
+	_, err := path.Match(pattern, "")
+	return err
+}
+
+// matchGlob reports whether name, a slash-separated relative path, matches pattern. Each element of pattern matches
+// one element of name as with path.Match, except **, which matches any number of them, including none.
+func matchGlob(pattern, name string) bool {
+	return matchGlobElements(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchGlobElements(patterns, names []string) bool {
+	for len(patterns) > 0 {
+		if patterns[0] == "**" {
+			for i := 0; i <= len(names); i++ {
+				if matchGlobElements(patterns[1:], names[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(names) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(patterns[0], names[0]); !ok {
+			return false
+		}
+		patterns, names = patterns[1:], names[1:]
+	}
+	return len(names) == 0
+}
+
+// globSuffix returns the literal ending every path matching pattern has, such as .jpg for **/*.jpg, or "" if its last
+// element isn't a * followed by plain text.
+func globSuffix(pattern string) string {
+	last := pattern[strings.LastIndex(pattern, "/")+1:]
+	if !strings.HasPrefix(last, "*") || strings.ContainsAny(last[1:], `*?[\`) {
+		return ""
+	}
+	return last[1:]
+}
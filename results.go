@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// defaultWorkerCount is the number of files hashed concurrently unless --workers or --network-share says otherwise.
+const defaultWorkerCount = 8
+
+// outputFormats are the values of --output-format.
+var outputFormats = []string{"csv", "json", "jsonl", "xlsx"}
+
+// rowWriter writes the rows of a results file. *csv.Writer is one; jsonRowWriter writes the same rows as JSON.
+type rowWriter interface {
+	Write(row []string) error
+	Flush()
+	Error() error
+}
+
+// jsonRowWriter writes rows as JSON objects keyed by the column names, one per line, and with array set, as the
+// elements of one JSON array. The size column is written as a number when it is one. JSON strings can't hold bytes
+// that aren't UTF-8, so a file path with any is written with them replaced, and exactly in filepath_base64.
+type jsonRowWriter struct {
+	writer  *bufio.Writer
+	columns []string
+	array   bool
+	rows    int
+	err     error
+}
+
+func newJSONRowWriter(w io.Writer, columns []string, array bool) *jsonRowWriter {
+	return &jsonRowWriter{writer: bufio.NewWriter(w), columns: columns, array: array}
+}
+
+func (w *jsonRowWriter) Write(row []string) error {
+	if w.err != nil {
+		return w.err
+	}
+	object := make(map[string]any, len(row)+1)
+	for i, value := range row {
+		column := w.columns[i]
+		object[column] = value
+		if size, err := strconv.ParseInt(value, 10, 64); column == "size" && err == nil {
+			object[column] = size
+		}
+		if column == "filepath" && !utf8.ValidString(value) {
+			object["filepath_base64"] = base64.StdEncoding.EncodeToString([]byte(value))
+		}
+	}
+	data, err := json.Marshal(object)
+	if err != nil {
+		w.err = err
+		return err
+	}
+	if w.array {
+		separator := ",\n"
+		if w.rows == 0 {
+			separator = "[\n"
+		}
+		w.writer.WriteString(separator)
+	}
+	w.writer.Write(data)
+	if !w.array {
+		w.writer.WriteByte('\n')
+	}
+	w.rows++
+	return nil
+}
+
+func (w *jsonRowWriter) Flush() {
+	if w.err == nil {
+		w.err = w.writer.Flush()
+	}
+}
+
+func (w *jsonRowWriter) Error() error {
+	return w.err
+}
+
+// finish closes the array once every row has been written. Lines already end each row otherwise.
+func (w *jsonRowWriter) finish() {
+	if !w.array || w.err != nil {
+		return
+	}
+	if w.rows == 0 {
+		w.writer.WriteString("[")
+	}
+	w.writer.WriteString("\n]\n")
+}
+
+// formulaPrefixes are the leading characters that make a spreadsheet read a cell as a formula.
+const formulaPrefixes = "=+-@\t\r"
+
+// safeCSVWriter writes CSV to be opened in spreadsheets, for --safe-csv. Every field is quoted, so a path is never
+// split or trimmed, and a field a spreadsheet would read as a formula, such as a file named =HYPERLINK(...).txt, gets
+// a leading apostrophe, which spreadsheets show as text. Numbers like -1 are left as they are.
+type safeCSVWriter struct {
+	writer *bufio.Writer
+	err    error
+}
+
+func newCSVRowWriter(w io.Writer, safe bool) rowWriter {
+	if safe {
+		return &safeCSVWriter{writer: bufio.NewWriter(w)}
+	}
+	return csv.NewWriter(w)
+}
+
+// neutralizeFormula returns field with an apostrophe in front if a spreadsheet would read it as a formula.
+func neutralizeFormula(field string) string {
+	if field == "" || !strings.ContainsRune(formulaPrefixes, rune(field[0])) {
+		return field
+	}
+	if _, err := strconv.ParseFloat(field, 64); err == nil {
+		return field
+	}
+	return "'" + field
+}
+
+func (w *safeCSVWriter) Write(row []string) error {
+	if w.err != nil {
+		return w.err
+	}
+	for i, field := range row {
+		if i > 0 {
+			w.writer.WriteByte(',')
+		}
+		w.writer.WriteByte('"')
+		w.writer.WriteString(strings.ReplaceAll(neutralizeFormula(field), `"`, `""`))
+		w.writer.WriteByte('"')
+	}
+	_, w.err = w.writer.WriteString("\n")
+	return w.err
+}
+
+func (w *safeCSVWriter) Flush() {
+	if w.err == nil {
+		w.err = w.writer.Flush()
+	}
+}
+
+func (w *safeCSVWriter) Error() error {
+	return w.err
+}
+
+// resultSink receives one CSV row per processed file. A slot is only ever used by one goroutine at a time.
+type resultSink interface {
+	Write(slot int, row []string) error
+	// Close writes any buffered rows into the final output writer.
+	Close() error
+}
+
+// sharedSink writes every row straight to the output file under a mutex.
+type sharedSink struct {
+	mu     sync.Mutex
+	writer rowWriter
+}
+
+func (s *sharedSink) Write(slot int, row []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.writer.Write(row); err != nil {
+		return err
+	}
+	s.writer.Flush()
+	return s.writer.Error()
+}
+
+func (s *sharedSink) Close() error {
+	return nil
+}
+
+// Sorted output is sorted a run at a time, so memory stays bounded however many files a scan has: each slot holds up
+// to sortRunRows rows, which are sorted and spilled to a run file when it fills up, and Close merges the runs, at most
+// maxMergeRuns at a time.
+const (
+	sortRunRows  = 50000
+	maxMergeRuns = 64
+)
+
+// shardSink gives each worker slot its own file so workers never contend on a lock, and merges the shards into the
+// output writer when the scan is done. With sorted, the slots spill sorted runs instead, which Close merges in order of
+// file path.
+type shardSink struct {
+	output     rowWriter
+	sorted     bool
+	outputPath string
+	files      []*os.File
+	writers    []*csv.Writer
+
+	pending [][][]string // with sorted, the rows of each slot not yet spilled
+	mu      sync.Mutex
+	runs    []*os.File // with sorted, the spilled runs not yet merged, each sorted by file path
+	nextRun int
+}
+
+// newShardSink creates a shard for each of workers, which each hold one slot number for as long as they are processing
+// a file: that is what lets sharded output skip locking.
+func newShardSink(output rowWriter, outputPath string, sorted bool, workers int) (*shardSink, error) {
+	s := &shardSink{output: output, sorted: sorted, outputPath: outputPath}
+	// One shard more than there are workers, for the rows of batched records written by a flush.
+	if sorted {
+		s.pending = make([][][]string, workers+1)
+		return s, nil
+	}
+	for i := 0; i <= workers; i++ {
+		file, err := os.Create(fmt.Sprintf("%s.shard-%d", outputPath, i))
+		if err != nil {
+			s.removeShards()
+			return nil, err
+		}
+		s.files = append(s.files, file)
+		s.writers = append(s.writers, csv.NewWriter(file))
+	}
+	return s, nil
+}
+
+func (s *shardSink) Write(slot int, row []string) error {
+	if !s.sorted {
+		return s.writers[slot].Write(row)
+	}
+	s.pending[slot] = append(s.pending[slot], row)
+	if len(s.pending[slot]) < sortRunRows {
+		return nil
+	}
+	rows := s.pending[slot]
+	s.pending[slot] = nil
+	return s.spill(rows)
+}
+
+// spill sorts rows by file path and writes them to a new run.
+func (s *shardSink) spill(rows [][]string) error {
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i][0] < rows[j][0] })
+	run, err := s.createRun()
+	if err != nil {
+		return err
+	}
+	writer := csv.NewWriter(run)
+	for _, row := range rows {
+		writer.Write(row)
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("failed to write sorted run %s: %v", run.Name(), err)
+	}
+	return nil
+}
+
+// createRun creates the next run file, which removeShards removes with the rest.
+func (s *shardSink) createRun() (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run, err := os.Create(fmt.Sprintf("%s.run-%d", s.outputPath, s.nextRun))
+	if err != nil {
+		return nil, err
+	}
+	s.nextRun++
+	s.runs = append(s.runs, run)
+	return run, nil
+}
+
+func (s *shardSink) Close() error {
+	defer s.removeShards()
+	if s.sorted {
+		return s.mergeRuns()
+	}
+
+	for i, file := range s.files {
+		s.writers[i].Flush()
+		if err := s.writers[i].Error(); err != nil {
+			return fmt.Errorf("failed to flush shard %s: %v", file.Name(), err)
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind shard %s: %v", file.Name(), err)
+		}
+
+		reader := csv.NewReader(file)
+		reader.FieldsPerRecord = -1
+		for {
+			row, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read shard %s: %v", file.Name(), err)
+			}
+			if err := s.output.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	s.output.Flush()
+	return s.output.Error()
+}
+
+// mergeRuns spills the rows the slots still hold and merges every run into the output. Runs beyond maxMergeRuns are
+// merged into bigger ones first, so only that many files are open at a time.
+func (s *shardSink) mergeRuns() error {
+	for slot, rows := range s.pending {
+		if len(rows) > 0 {
+			if err := s.spill(rows); err != nil {
+				return err
+			}
+		}
+		s.pending[slot] = nil
+	}
+	for len(s.runs) > maxMergeRuns {
+		merging := s.runs[:maxMergeRuns:maxMergeRuns]
+		run, err := s.createRun()
+		if err != nil {
+			return err
+		}
+		if err := mergeSortedRuns(merging, csv.NewWriter(run)); err != nil {
+			return err
+		}
+		// The merged runs are removed now rather than with the rest, to free their space as the merge goes.
+		for _, merged := range merging {
+			merged.Close()
+			os.Remove(merged.Name())
+		}
+		s.runs = s.runs[maxMergeRuns:]
+	}
+	return mergeSortedRuns(s.runs, s.output)
+}
+
+// mergeSortedRuns writes the rows of runs, each sorted by file path, to output in order of file path; rows with the
+// same path keep the order of their runs.
+func mergeSortedRuns(runs []*os.File, output rowWriter) error {
+	var heads runHeap
+	for i, run := range runs {
+		if _, err := run.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind sorted run %s: %v", run.Name(), err)
+		}
+		head := &runHead{index: i, name: run.Name(), reader: csv.NewReader(bufio.NewReader(run))}
+		head.reader.FieldsPerRecord = -1
+		if ok, err := head.next(); err != nil {
+			return err
+		} else if ok {
+			heads = append(heads, head)
+		}
+	}
+	heap.Init(&heads)
+	for len(heads) > 0 {
+		head := heads[0]
+		if err := output.Write(head.row); err != nil {
+			return err
+		}
+		if ok, err := head.next(); err != nil {
+			return err
+		} else if ok {
+			heap.Fix(&heads, 0)
+		} else {
+			heap.Pop(&heads)
+		}
+	}
+	output.Flush()
+	return output.Error()
+}
+
+// runHead is the next row of a sorted run being merged.
+type runHead struct {
+	index  int
+	name   string
+	reader *csv.Reader
+	row    []string
+}
+
+// next reads the run's next row, reporting false at its end.
+func (h *runHead) next() (bool, error) {
+	row, err := h.reader.Read()
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read sorted run %s: %v", h.name, err)
+	}
+	h.row = row
+	return true, nil
+}
+
+// runHeap orders the heads of the runs being merged by file path, then by run.
+type runHeap []*runHead
+
+func (h runHeap) Len() int { return len(h) }
+func (h runHeap) Less(i, j int) bool {
+	if h[i].row[0] != h[j].row[0] {
+		return h[i].row[0] < h[j].row[0]
+	}
+	return h[i].index < h[j].index
+}
+func (h runHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x any)   { *h = append(*h, x.(*runHead)) }
+func (h *runHeap) Pop() any {
+	old := *h
+	head := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return head
+}
+
+func (s *shardSink) removeShards() {
+	for _, file := range append(s.files, s.runs...) {
+		file.Close()
+		if err := os.Remove(file.Name()); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove shard %s: %v", file.Name(), err)
+		}
+	}
+	s.files, s.runs = nil, nil
+}
+
+// humanSizeSink rewrites the size column of every row for people (e.g. 1.4GiB) before passing it on. It wraps the
+// output sink directly, so status streams and run counts still see sizes in bytes.
+type humanSizeSink struct {
+	resultSink
+}
+
+func (s *humanSizeSink) Write(slot int, row []string) error {
+	if size, err := strconv.ParseInt(row[2], 10, 64); err == nil {
+		row = append([]string(nil), row...)
+		row[2] = formatSize(size, true)
+	}
+	return s.resultSink.Write(slot, row)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNeutralizeFormula(t *testing.T) {
+	tests := []struct {
+		field string
+		want  string
+	}{
+		{"", ""},
+		{"/photos/a.jpg", "/photos/a.jpg"},
+		{"=HYPERLINK(\"x\").txt", "'=HYPERLINK(\"x\").txt"},
+		{"+1-2", "'+1-2"},
+		{"-cmd", "'-cmd"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\tx", "'\tx"},
+		{"\rx", "'\rx"},
+		{"-1", "-1"},
+		{"+2.5", "+2.5"},
+		{"-1e3", "-1e3"},
+		{"a=b", "a=b"},
+	}
+	for _, tt := range tests {
+		if got := neutralizeFormula(tt.field); got != tt.want {
+			t.Errorf("neutralizeFormula(%q) = %q, want %q", tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestSafeCSVWriter(t *testing.T) {
+	var b bytes.Buffer
+	w := newCSVRowWriter(&b, true)
+	w.Write([]string{"=1+1", `say "hi"`, "-1", "a,b"})
+	w.Write([]string{""})
+	w.Flush()
+	if err := w.Error(); err != nil {
+		t.Fatal(err)
+	}
+	want := "\"'=1+1\",\"say \"\"hi\"\"\",\"-1\",\"a,b\"\n\"\"\n"
+	if b.String() != want {
+		t.Errorf("wrote %q, want %q", b.String(), want)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+)
+
+const createAuditLogTableQuery = `
+CREATE TABLE IF NOT EXISTS audit_log (
+    id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    operation TEXT NOT NULL,
+    details TEXT NOT NULL,
+    rows_affected BIGINT NOT NULL,
+    performed_timestamp TIMESTAMP NOT NULL
+);
+`
+
+// pathColumns lists the columns outside file_hashes.filepath that hold stored paths, so bulk path operations keep
+// them in step. Tables that haven't been created yet (because the feature was never used) are skipped.
+var pathColumns = []struct{ table, column string }{
+	{"pii_findings", "filepath"},
+	{"file_history", "filepath"},
+	{"file_lineage", "filepath"},
+	{"file_lineage", "source_filepath"},
+	{"file_extents", "filepath"},
+	{"file_chunks", "filepath"},
+	{"disk_partitions", "image_path"},
+}
+
+// rewrittenPath is the SQL expression replacing prefix $1 with $2 in column.
+func rewrittenPath(column string) string {
+	return "$2::text || substr(" + column + ", length($1::text) + 1)"
+}
+
+// recordAudit appends an entry to the audit log.
+func recordAudit(tx *sql.Tx, operation, details string, rowsAffected int64) error {
+	if _, err := tx.Exec(createAuditLogTableQuery); err != nil {
+		return err
+	}
+	_, err := tx.Exec("INSERT INTO audit_log (operation, details, rows_affected, performed_timestamp) VALUES ($1, $2, $3, $4)", operation, details, rowsAffected, time.Now())
+	return err
+}
+
+// tableExists reports whether the named table exists in the current schema search path.
+func tableExists(q interface {
+	QueryRow(string, ...any) *sql.Row
+}, table string) (bool, error) {
+	var exists bool
+	err := q.QueryRow("SELECT to_regclass($1) IS NOT NULL", table).Scan(&exists)
+	return exists, err
+}
+
+// runRewritePaths moves every indexed path under --from to the same relative path under --to, so renaming a
+// directory on disk doesn't force a full re-hash of everything beneath it.
+func runRewritePaths(args []string) {
+	fs := flag.NewFlagSet("rewrite-paths", flag.ContinueOnError)
+	var dbCfg DBConfig
+	registerDBFlags(fs, &dbCfg)
+	from := fs.String("from", "", "Stored path prefix to rewrite. Required.")
+	to := fs.String("to", "", "Replacement prefix. Required.")
+	dryRun := fs.Bool("dry-run", false, "Report what would be rewritten without changing anything.")
+	var encrypt []string
+	fs.Var((*stringList)(&encrypt), "encrypt-column", "Encrypt this column with AES-GCM before storing it: audit_log.details. The hex encoded key comes from the COLUMN_KEY environment variable.")
+	fs.Usage = commandUsage(fs, "RewritePathsUsage")
+	parseArgs(fs, args)
+
+	for _, name := range []string{"dbname", "from", "to"} {
+		if fs.Lookup(name).Value.String() == "" {
+			usageError(fs, name, msg("MissingFlag", map[string]any{"Flag": name}))
+		}
+	}
+	checkEncryptColumns(fs, "rewrite-paths", encrypt)
+	details := fmt.Sprintf("from=%s to=%s", *from, *to)
+	if len(encrypt) > 0 && !*dryRun {
+		columns, err := newColumnCipher(readColumnKey(), encrypt)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		details = columns.seal("audit_log.details", details)
+	}
+
+	db := connectToDatabase(dbCfg)
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalf("Failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	pattern := likePrefix(*from)
+
+	var matching int64
+	if err := tx.QueryRow("SELECT count(*) FROM file_hashes WHERE filepath LIKE $1", pattern).Scan(&matching); err != nil {
+		log.Fatalf("Failed to count matching rows: %v", err)
+	}
+
+	// A rewritten path that already belongs to a row outside --from would violate the UNIQUE constraint halfway
+	// through the update, so refuse up front and list them.
+	conflicts, err := tx.Query(`
+SELECT a.filepath, b.filepath FROM file_hashes a
+JOIN file_hashes b ON b.filepath = $2::text || substr(a.filepath, length($1::text) + 1)
+WHERE a.filepath LIKE $3 AND b.filepath NOT LIKE $3
+ORDER BY a.filepath`, *from, *to, pattern)
+	if err != nil {
+		log.Fatalf("Failed to check for conflicts: %v", err)
+	}
+	var conflictCount int
+	for conflicts.Next() {
+		var oldPath, existing string
+		if err := conflicts.Scan(&oldPath, &existing); err != nil {
+			log.Fatalf("Failed to read conflict: %v", err)
+		}
+		conflictCount++
+		log.Printf("Conflict: %s would be rewritten to %s, which is already indexed", oldPath, existing)
+	}
+	if err := conflicts.Err(); err != nil {
+		log.Fatalf("Failed to check for conflicts: %v", err)
+	}
+	conflicts.Close()
+	if conflictCount > 0 {
+		log.Fatal(msg("RewriteRefused", map[string]any{"Count": conflictCount}))
+	}
+
+	if *dryRun {
+		fmt.Println(msg("RewriteDryRun", map[string]any{"Count": matching, "From": *from, "To": *to}))
+		return
+	}
+
+	result, err := tx.Exec("UPDATE file_hashes SET filepath = "+rewrittenPath("filepath")+" WHERE filepath LIKE $3", *from, *to, pattern)
+	if err != nil {
+		log.Fatalf("Failed to rewrite paths: %v", err)
+	}
+	affected, _ := result.RowsAffected()
+
+	for _, pc := range pathColumns {
+		exists, err := tableExists(tx, pc.table)
+		if err != nil {
+			log.Fatalf("Failed to check for table %s: %v", pc.table, err)
+		}
+		if !exists {
+			continue
+		}
+		if _, err := tx.Exec("UPDATE "+pc.table+" SET "+pc.column+" = "+rewrittenPath(pc.column)+" WHERE "+pc.column+" LIKE $3", *from, *to, pattern); err != nil {
+			log.Fatalf("Failed to rewrite paths in %s.%s: %v", pc.table, pc.column, err)
+		}
+	}
+
+	if err := recordAudit(tx, "rewrite-paths", details, affected); err != nil {
+		log.Fatalf("Failed to record audit log entry: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatalf("Failed to commit rewrite: %v", err)
+	}
+	fmt.Println(msg("RewriteDone", map[string]any{"Count": affected, "From": *from, "To": *to}))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"fileindexer/pkg/indexer"
+)
+
+// mapRule rewrites stored paths starting with from so they start with to instead.
+type mapRule struct {
+	from, to string
+}
+
+func parseMapRules(defs []string) ([]mapRule, error) {
+	var rules []mapRule
+	for _, def := range defs {
+		from, to, ok := strings.Cut(def, "=")
+		if !ok || from == "" {
+			return nil, fmt.Errorf("invalid map rule %q, expected /old/prefix=/new/prefix", def)
+		}
+		rules = append(rules, mapRule{from: from, to: to})
+	}
+	return rules, nil
+}
+
+// apply returns the rewritten path and whether any rule matched. The first matching rule wins.
+func applyMapRules(rules []mapRule, path string) (string, bool) {
+	for _, rule := range rules {
+		if strings.HasPrefix(path, rule.from) {
+			return rule.to + path[len(rule.from):], true
+		}
+	}
+	return path, false
+}
+
+// outsideAgeWindow reports, and logs, whether the file at path was modified outside the window set by
+// --ignore-newer-than and --ignore-older-than.
+func outsideAgeWindow(cfg Config, path string, info os.FileInfo) bool {
+	modified := info.ModTime()
+	switch {
+	case !cfg.NewestModified.IsZero() && modified.After(cfg.NewestModified):
+		log.Printf("Skipping file %s modified %s, after the --ignore-newer-than cutoff", path, modified.Format(time.RFC3339))
+	case !cfg.OldestModified.IsZero() && modified.Before(cfg.OldestModified):
+		log.Printf("Skipping file %s modified %s, before the --ignore-older-than cutoff", path, modified.Format(time.RFC3339))
+	default:
+		return false
+	}
+	return true
+}
+
+// likePrefix turns a literal path prefix into a LIKE pattern matching everything under it.
+func likePrefix(prefix string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix)
+	return escaped + "%"
+}
+
+// runSimulateRules applies proposed exclude and prefix-map rules to the paths already in the index and reports what
+// they would do, without changing anything.
+func runSimulateRules(args []string) {
+	fs := flag.NewFlagSet("simulate-rules", flag.ContinueOnError)
+	var dbCfg DBConfig
+	registerDBFlags(fs, &dbCfg)
+	excludeStrings := fs.String("exclude", "", "Comma-separated list of exclusion strings to test, with the same substring semantics as the scan's --exclude.")
+	var maps stringList
+	fs.Var(&maps, "map", "Prefix rewrite rule to test, as /old/prefix=/new/prefix. May be repeated; the first matching rule wins.")
+	under := fs.String("under", "", "Only consider indexed paths starting with this prefix.")
+	details := fs.String("details", "", "Write every affected path and what would happen to it to this CSV file.")
+	fs.Usage = commandUsage(fs, "SimulateRulesUsage")
+	parseArgs(fs, args)
+
+	if dbCfg.DbName == "" {
+		usageError(fs, "dbname", msg("MissingFlag", map[string]any{"Flag": "dbname"}))
+	}
+	rules, err := parseMapRules(maps)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	excludes := strings.Split(*excludeStrings, ",")
+
+	db := connectToDatabase(dbCfg)
+	defer db.Close()
+
+	rows, err := db.Query("SELECT filepath FROM file_hashes WHERE filepath LIKE $1 ORDER BY filepath", likePrefix(*under))
+	if err != nil {
+		log.Fatalf("Failed to query indexed paths: %v", err)
+	}
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			log.Fatalf("Failed to read indexed path: %v", err)
+		}
+		paths = append(paths, path)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalf("Failed to read indexed paths: %v", err)
+	}
+	rows.Close()
+
+	// First pass decides what each rule does to each path; the second looks for renames landing on a path that is
+	// kept as-is or that another rename also targets, which would violate the UNIQUE filepath constraint.
+	type outcome struct {
+		path, action, detail string
+	}
+	outcomes := make([]outcome, 0, len(paths))
+	unchanged := make(map[string]bool)
+	targets := make(map[string]int)
+	for _, path := range paths {
+		if exclude := indexer.Excluded(excludes, path); exclude != "" {
+			outcomes = append(outcomes, outcome{path, "excluded", exclude})
+		} else if newPath, ok := applyMapRules(rules, path); ok && newPath != path {
+			outcomes = append(outcomes, outcome{path, "renamed", newPath})
+			targets[newPath]++
+		} else {
+			outcomes = append(outcomes, outcome{path, "unchanged", ""})
+			unchanged[path] = true
+		}
+	}
+
+	counts := make(map[string]int)
+	var detailWriter *csv.Writer
+	if *details != "" {
+		file, err := os.Create(*details)
+		if err != nil {
+			log.Fatalf("Failed to create details file: %v", err)
+		}
+		defer file.Close()
+		detailWriter = csv.NewWriter(file)
+		defer detailWriter.Flush()
+		detailWriter.Write([]string{"filepath", "action", "detail"})
+	}
+	for _, o := range outcomes {
+		if o.action == "renamed" && (unchanged[o.detail] || targets[o.detail] > 1) {
+			o.action = "conflict"
+		}
+		counts[o.action]++
+		if detailWriter != nil && o.action != "unchanged" {
+			if err := detailWriter.Write([]string{o.path, o.action, o.detail}); err != nil {
+				log.Fatalf("Failed to write details: %v", err)
+			}
+		}
+	}
+
+	fmt.Println(msg("SimulateRulesSummary", map[string]any{
+		"Total": len(paths), "Excluded": counts["excluded"], "Renamed": counts["renamed"],
+		"Conflicts": counts["conflict"], "Unchanged": counts["unchanged"],
+	}))
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestLikePrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"", "%"},
+		{"/mnt/photos/", "/mnt/photos/%"},
+		{"/mnt/100%/", `/mnt/100\%/%`},
+		{"/mnt/my_files", `/mnt/my\_files%`},
+		{`C:\Users\`, `C:\\Users\\%`},
+		{`/a\%_b`, `/a\\\%\_b%`},
+	}
+	for _, tt := range tests {
+		if got := likePrefix(tt.prefix); got != tt.want {
+			t.Errorf("likePrefix(%q) = %q, want %q", tt.prefix, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// runAsUser is the account --run-as switches the scan to once the database is open.
+type runAsUser struct {
+	name   string
+	uid    int
+	gid    int
+	groups []int // supplementary groups, those of the user unless --run-as named a group
+}
+
+// resolveRunAs resolves --run-as, a user name or id optionally followed by :group. Without a group, the scan runs with
+// the user's primary and supplementary groups, as a login would.
+func resolveRunAs(spec string) (*runAsUser, error) {
+	name, group, hasGroup := strings.Cut(spec, ":")
+	uid, err := resolveOwner(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown user %q: %v", name, err)
+	}
+	r := &runAsUser{name: name, uid: uid, gid: -1}
+	u, lookupErr := user.LookupId(strconv.Itoa(uid))
+	if lookupErr == nil {
+		r.name = u.Username
+	}
+	if hasGroup {
+		if r.gid, err = resolveGroup(group); err != nil {
+			return nil, fmt.Errorf("unknown group %q: %v", group, err)
+		}
+		r.groups = []int{r.gid}
+		return r, nil
+	}
+	if lookupErr != nil {
+		return nil, fmt.Errorf("user %q has no account to take its group from; name one as %s:group", name, name)
+	}
+	if r.gid, err = strconv.Atoi(u.Gid); err != nil {
+		return nil, fmt.Errorf("user %q has primary group %q, which isn't numeric", name, u.Gid)
+	}
+	ids, err := u.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the groups of user %q: %v", name, err)
+	}
+	for _, id := range ids {
+		if gid, err := strconv.Atoi(id); err == nil {
+			r.groups = append(r.groups, gid)
+		}
+	}
+	return r, nil
+}
+
+// switchUser changes the process to the --run-as user, keeping CAP_DAC_READ_SEARCH with keepReadAccess. It is called
+// once the database connection, the store and the write-ahead log are open, before any file of the tree is read, so
+// only those were opened with the privileges the scan started with.
+func switchUser(r *runAsUser, keepReadAccess bool) {
+	if err := dropPrivileges(r.uid, r.gid, r.groups, keepReadAccess); err != nil {
+		log.Fatalf("Failed to switch to --run-as user %s: %v", r.name, err)
+	}
+	log.Print(msg("RunningAs", map[string]any{"User": r.name, "UID": r.uid, "GID": r.gid, "KeepReadAccess": keepReadAccess}))
+}
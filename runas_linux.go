@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// runAsSupported is whether --run-as can change the user of the process.
+const runAsSupported = true
+
+// capDACReadSearch is the capability to read any file and list any directory regardless of their permissions.
+const capDACReadSearch = 2
+
+// Arguments of prctl(2) and capset(2) the syscall package has no names for.
+const (
+	prSetKeepCaps          = 8
+	linuxCapabilityVersion = 0x20080522 // _LINUX_CAPABILITY_VERSION_3, whose sets take two 32-bit words
+)
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective, permitted, inheritable uint32
+}
+
+// dropPrivileges switches every thread of the process to uid, gid and groups. With keepReadAccess, CAP_DAC_READ_SEARCH
+// is kept through the switch and every other capability dropped, so the scan can still read the whole tree without
+// being able to write to it or regain root.
+//
+// Capabilities belong to each thread, so they are set on all of them at once with AllThreadsSyscall. The runtime can
+// only do that without cgo, whose threads it doesn't know about.
+func dropPrivileges(uid, gid int, groups []int, keepReadAccess bool) error {
+	if os.Geteuid() != 0 {
+		return errors.New("changing user needs root")
+	}
+	if keepReadAccess {
+		if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetKeepCaps, 1, 0); errno != 0 {
+			if errno == syscall.ENOTSUP {
+				return errors.New("--keep-read-access needs a build without cgo (CGO_ENABLED=0 go build)")
+			}
+			return fmt.Errorf("failed to keep capabilities: %v", errno)
+		}
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("failed to set groups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("failed to set group: %v", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("failed to set user: %v", err)
+	}
+	if !keepReadAccess {
+		return nil
+	}
+	header := capHeader{version: linuxCapabilityVersion}
+	data := [2]capData{{effective: 1 << capDACReadSearch, permitted: 1 << capDACReadSearch}}
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("failed to keep CAP_DAC_READ_SEARCH: %v", errno)
+	}
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetKeepCaps, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to reset the keep capabilities flag: %v", errno)
+	}
+	return nil
+}
+
+// canReadAnything reports whether the process holds CAP_DAC_READ_SEARCH, so file permissions don't limit what it
+// reads: as root, after --run-as with --keep-read-access, or from a binary given it with setcap.
+func canReadAnything() bool {
+	file, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "CapEff:"); ok {
+			caps, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+			return err == nil && caps&(1<<capDACReadSearch) != 0
+		}
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// runAsSupported is whether --run-as can change the user of the process.
+const runAsSupported = true
+
+// dropPrivileges switches the process to uid, gid and groups. Capabilities are Linux's, so keepReadAccess was refused
+// by parseFlags.
+func dropPrivileges(uid, gid int, groups []int, keepReadAccess bool) error {
+	if os.Geteuid() != 0 {
+		return errors.New("changing user needs root")
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("failed to set groups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("failed to set group: %v", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("failed to set user: %v", err)
+	}
+	return nil
+}
+
+// canReadAnything reports whether file permissions don't limit what the process reads, which without capabilities
+// is only so for root.
+func canReadAnything() bool {
+	return os.Geteuid() == 0
+}
@@ -0,0 +1,14 @@
+package main
+
+import "errors"
+
+// runAsSupported is whether --run-as can change the user of the process.
+const runAsSupported = false
+
+func dropPrivileges(uid, gid int, groups []int, keepReadAccess bool) error {
+	return errors.New("--run-as isn't supported on Windows")
+}
+
+func canReadAnything() bool {
+	return false
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The output and count columns are filled in when the run finishes: the output columns so the results file can be
+// checked against the run that wrote it, the counts for serve's time series. They were added after the table, hence
+// the ALTERs. total_size and total_files are the index totals under the scanned directory after the run.
+// checkpoint_path is set instead when a signal interrupts the run, to the file --resume continues after. subpath is the
+// --subpath of a scan of part of the directory; the totals still cover all of it. read_only_attestation is the JSON
+// attestation of a --read-only-guarantee scan. tool_version is the toolVersion of the binary that ran the scan.
+const createScanRunsTableQuery = `
+CREATE TABLE IF NOT EXISTS scan_runs (
+    id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    directory TEXT NOT NULL,
+    base_snapshot TEXT,
+    snapshot TEXT,
+    started_timestamp TIMESTAMP NOT NULL,
+    finished_timestamp TIMESTAMP
+);
+ALTER TABLE scan_runs ADD COLUMN IF NOT EXISTS output_host TEXT;
+ALTER TABLE scan_runs ADD COLUMN IF NOT EXISTS output_path TEXT;
+ALTER TABLE scan_runs ADD COLUMN IF NOT EXISTS output_sha256 TEXT;
+ALTER TABLE scan_runs ADD COLUMN IF NOT EXISTS files_processed BIGINT;
+ALTER TABLE scan_runs ADD COLUMN IF NOT EXISTS files_new BIGINT;
+ALTER TABLE scan_runs ADD COLUMN IF NOT EXISTS files_changed BIGINT;
+ALTER TABLE scan_runs ADD COLUMN IF NOT EXISTS files_failed BIGINT;
+ALTER TABLE scan_runs ADD COLUMN IF NOT EXISTS total_size BIGINT;
+ALTER TABLE scan_runs ADD COLUMN IF NOT EXISTS total_files BIGINT;
+ALTER TABLE scan_runs ADD COLUMN IF NOT EXISTS checkpoint_path TEXT;
+ALTER TABLE scan_runs ADD COLUMN IF NOT EXISTS subpath TEXT;
+ALTER TABLE scan_runs ADD COLUMN IF NOT EXISTS read_only_attestation TEXT;
+ALTER TABLE scan_runs ADD COLUMN IF NOT EXISTS files_existing BIGINT;
+ALTER TABLE scan_runs ADD COLUMN IF NOT EXISTS tool_version TEXT;
+`
+
+// startScanRun records the start of a scan that modifies the index and returns its id. Snapshot names are stored
+// when the scan was fed a snapshot diff, so the index can be tied back to the snapshots it reflects.
+func startScanRun(db *sql.DB, cfg Config) (int64, error) {
+	if _, err := db.Exec(createScanRunsTableQuery); err != nil {
+		return 0, err
+	}
+	var id int64
+	err := db.QueryRow("INSERT INTO scan_runs (directory, subpath, base_snapshot, snapshot, started_timestamp, tool_version) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+		cfg.Directory, nullString(cfg.Subpath), nullString(cfg.BaseSnapshot), nullString(cfg.Snapshot), time.Now().UTC(), toolVersion()).Scan(&id)
+	return id, err
+}
+
+// runCounts tallies a run's results rows by status.
+type runCounts struct {
+	processed, added, changed, existing, failed, corrupt atomic.Int64
+}
+
+// countingSink passes every results row on to the wrapped sink and counts it.
+type countingSink struct {
+	resultSink
+	counts *runCounts
+	run    *runCounts // with several --directory roots, the counts of the run of the one being scanned
+}
+
+func (s *countingSink) Write(slot int, row []string) error {
+	s.counts.tally(row[3])
+	if s.run != nil {
+		s.run.tally(row[3])
+	}
+	return s.resultSink.Write(slot, row)
+}
+
+// rootRun is the scan run of one --directory.
+type rootRun struct {
+	cfg    Config
+	id     int64 // 0 if the scan isn't recorded in scan_runs
+	counts *runCounts
+}
+
+// startRootRun records the start of the scan of cfg.Directory, or with --resume looks up the run it continues, and
+// returns the run's id and cfg with the checkpoint to resume after. counts are the run's counts, which a resumed run
+// starts from. Scans that don't modify the index aren't recorded, and get id 0.
+func startRootRun(db *sql.DB, cfg Config, counts *runCounts) (int64, Config) {
+	if cfg.VerifyAgainst != "" || db == nil {
+		return 0, cfg
+	}
+	var id int64
+	var err error
+	if cfg.Resume {
+		if cfg.Partition {
+			id, err = resumableScanRun(db, cfg)
+		} else {
+			id, cfg.ResumeAfter, err = checkpointedScanRun(db, cfg, counts)
+		}
+		if err != nil {
+			log.Fatalf("Failed to look up the run to resume: %v", err)
+		}
+		if id != 0 {
+			log.Print(msg("ScanResumed", map[string]any{"Run": id, "Directory": cfg.Directory}))
+			if cfg.ResumeAfter != "" {
+				log.Print(msg("ScanResumedAfter", map[string]any{"Path": cfg.ResumeAfter}))
+			}
+		} else {
+			log.Print(msg("NothingToResume", map[string]any{"Directory": cfg.Directory}))
+		}
+	}
+	if id == 0 {
+		if id, err = startScanRun(db, cfg); err != nil {
+			log.Fatalf("Failed to record scan run: %v", err)
+		}
+	}
+	return id, cfg
+}
+
+// tally counts one results row with the given status.
+func (c *runCounts) tally(status string) {
+	c.processed.Add(1)
+	switch {
+	case strings.HasPrefix(status, "error:"):
+		c.failed.Add(1)
+	case strings.HasPrefix(status, "new"):
+		c.added.Add(1)
+	case strings.HasPrefix(status, "changed"), strings.HasPrefix(status, "forced"):
+		c.changed.Add(1)
+	case strings.HasPrefix(status, "existing"):
+		c.existing.Add(1)
+	case strings.HasPrefix(status, "corrupt"):
+		c.corrupt.Add(1)
+	}
+}
+
+// finishScanRun marks a scan as having run to completion and records its counts, the index totals under the scanned
+// directory, and where its results file was written along with its SHA-256 digest. Runs that died part way keep a
+// NULL finished_timestamp.
+func finishScanRun(db *sql.DB, id int64, cfg Config, counts *runCounts) error {
+	// Privacy mode stores digests, so there is no directory prefix to total under.
+	var under string
+	if cfg.Directory != "" && !cfg.PrivacyMode {
+		if under = storedPathFor(cfg, cfg.Directory); under != "" {
+			under = strings.TrimSuffix(under, "/") + "/"
+		}
+	}
+	// With --store the index isn't in file_hashes, and the totals are left empty.
+	var totalSize, totalFiles sql.NullInt64
+	if cfg.Store == "" {
+		if err := db.QueryRow("SELECT "+sumSizeSQL+", count(*) FROM file_hashes WHERE filepath LIKE $1", likePrefix(under)).Scan(&totalSize, &totalFiles); err != nil {
+			return fmt.Errorf("failed to total the index: %v", err)
+		}
+	}
+
+	outputFile := cfg.OutputFile
+	digest, err := fileSHA256(outputFile)
+	if err != nil {
+		return fmt.Errorf("failed to hash output file %s: %v", outputFile, err)
+	}
+	if abs, err := filepath.Abs(outputFile); err == nil {
+		outputFile = abs
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	_, err = db.Exec(`
+UPDATE scan_runs SET finished_timestamp = $1, output_host = $2, output_path = $3, output_sha256 = $4,
+    files_processed = $5, files_new = $6, files_changed = $7, files_existing = $8, files_failed = $9, total_size = $10,
+    total_files = $11
+WHERE id = $12`,
+		time.Now().UTC(), host, outputFile, digest,
+		counts.processed.Load(), counts.added.Load(), counts.changed.Load(), counts.existing.Load(), counts.failed.Load(), totalSize, totalFiles, id)
+	return err
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// runVerifyOutput checks a results file against the digests recorded in scan_runs, printing the run that wrote it.
+// It exits with status 1 if no run recorded this file's contents, e.g. because it was edited or truncated.
+func runVerifyOutput(args []string) {
+	fs := flag.NewFlagSet("verify-output", flag.ContinueOnError)
+	var dbCfg DBConfig
+	registerDBFlags(fs, &dbCfg)
+	file := fs.String("file", "", "Results file to check. Required.")
+	fs.Usage = commandUsage(fs, "VerifyOutputUsage")
+	parseArgs(fs, args)
+
+	for _, name := range []string{"dbname", "file"} {
+		if fs.Lookup(name).Value.String() == "" {
+			usageError(fs, name, msg("MissingFlag", map[string]any{"Flag": name}))
+		}
+	}
+
+	digest, err := fileSHA256(*file)
+	if err != nil {
+		log.Fatalf("Failed to hash %s: %v", *file, err)
+	}
+	db := connectToDatabase(dbCfg)
+	defer db.Close()
+	if _, err := db.Exec(createScanRunsTableQuery); err != nil {
+		log.Fatalf("Failed to create scan runs table: %v", err)
+	}
+
+	var id int64
+	var directory, host, path string
+	var finished time.Time
+	err = db.QueryRow("SELECT id, directory, output_host, output_path, finished_timestamp FROM scan_runs WHERE output_sha256 = $1 ORDER BY id DESC LIMIT 1",
+		digest).Scan(&id, &directory, &host, &path, &finished)
+	if err == sql.ErrNoRows {
+		fmt.Println(msg("VerifyOutputMismatch", map[string]any{"File": *file, "Digest": digest}))
+		db.Close()
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatalf("Failed to look up scan runs: %v", err)
+	}
+	fmt.Println(msg("VerifyOutputMatch", map[string]any{
+		"File": *file, "Run": id, "Directory": directory, "Host": host, "Path": path, "Finished": finished.In(time.Local).Format(queryTimeLayout),
+	}))
+}
+
+// nullString stores an empty string as NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// maxDiffEntries caps the files returned by diffScanRuns.
+const maxDiffEntries = 100000
+
+// scanDiffEntry is a file whose hash changed between two scan runs. OldHash is empty for files new to the index.
+type scanDiffEntry struct {
+	Path    string `json:"path"`
+	Status  string `json:"status"`
+	OldHash string `json:"old_hash,omitempty"`
+	Hash    string `json:"hash"`
+	Size    int64  `json:"size"`
+}
+
+// scanDiff is the answer to /scans/diff.
+type scanDiff struct {
+	From      int64           `json:"from"`
+	To        int64           `json:"to"`
+	Files     []scanDiffEntry `json:"files"`
+	Truncated bool            `json:"truncated,omitempty"`
+}
+
+// diffScanRuns lists the files under prefix (a stored path prefix, or "" for all) whose hash changed between the
+// finish of run from and the finish of run to, from file_history. Rewriting a file with the same hash isn't a change,
+// and since deletions aren't recorded, files removed in between don't show up.
+func diffScanRuns(ctx context.Context, db *sql.DB, from, to int64, prefix string) (scanDiff, error) {
+	diff := scanDiff{From: from, To: to, Files: []scanDiffEntry{}}
+	rows, err := queryScanDiff(ctx, db, from, to, prefix, maxDiffEntries+1)
+	if err != nil {
+		return diff, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry scanDiffEntry
+		var oldHash sql.NullString
+		if err := rows.Scan(&entry.Path, &oldHash, &entry.Hash, &entry.Size); err != nil {
+			return diff, err
+		}
+		entry.Status, entry.OldHash = "changed", oldHash.String
+		if !oldHash.Valid {
+			entry.Status = "new"
+		}
+		diff.Files = append(diff.Files, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return diff, err
+	}
+	if len(diff.Files) > maxDiffEntries {
+		diff.Files, diff.Truncated = diff.Files[:maxDiffEntries], true
+	}
+	return diff, nil
+}
+
+// queryScanDiff returns the rows of the files under prefix whose hash changed between the finish of scan runs from and
+// to, by path, at most limit of them, or all if limit is nil: filepath, old hash (NULL for new files), hash and size.
+func queryScanDiff(ctx context.Context, db *sql.DB, from, to int64, prefix string, limit any) (*sql.Rows, error) {
+	fromFinished, err := scanRunFinished(ctx, db, from)
+	if err != nil {
+		return nil, err
+	}
+	toFinished, err := scanRunFinished(ctx, db, to)
+	if err != nil {
+		return nil, err
+	}
+	if !fromFinished.Before(toFinished) {
+		return nil, fmt.Errorf("scan run %d finished after run %d", from, to)
+	}
+	return db.QueryContext(ctx, `
+SELECT filepath, old_hash, hash, size FROM (
+    SELECT DISTINCT ON (h.filepath) h.filepath, h.hash, h.size,
+        (SELECT p.hash FROM file_history p WHERE p.filepath = h.filepath AND p.recorded_timestamp <= $1
+         ORDER BY p.recorded_timestamp DESC LIMIT 1) AS old_hash
+    FROM file_history h
+    WHERE h.recorded_timestamp > $1 AND h.recorded_timestamp <= $2 AND h.filepath LIKE $3 AND NOT h.removed
+    ORDER BY h.filepath, h.recorded_timestamp DESC
+) changes
+WHERE old_hash IS DISTINCT FROM hash
+ORDER BY filepath
+LIMIT $4`, fromFinished, toFinished, likePrefix(prefix), limit)
+}
+
+func scanRunFinished(ctx context.Context, db *sql.DB, id int64) (time.Time, error) {
+	var finished sql.NullTime
+	err := db.QueryRowContext(ctx, "SELECT finished_timestamp FROM scan_runs WHERE id = $1", id).Scan(&finished)
+	if err == sql.ErrNoRows {
+		return time.Time{}, fmt.Errorf("no scan run %d", id)
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !finished.Valid {
+		return time.Time{}, fmt.Errorf("scan run %d didn't finish", id)
+	}
+	return finished.Time, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CycloneDX 1.5 subset: just enough for vulnerability matchers that key on file hashes.
+type cdxBOM struct {
+	BOMFormat    string         `json:"bomFormat"`
+	SpecVersion  string         `json:"specVersion"`
+	SerialNumber string         `json:"serialNumber"`
+	Version      int            `json:"version"`
+	Metadata     cdxMetadata    `json:"metadata"`
+	Components   []cdxComponent `json:"components"`
+}
+
+type cdxMetadata struct {
+	Timestamp string   `json:"timestamp"`
+	Tools     cdxTools `json:"tools"`
+}
+
+type cdxTools struct {
+	Components []cdxComponent `json:"components"`
+}
+
+type cdxComponent struct {
+	Type       string        `json:"type"`
+	BOMRef     string        `json:"bom-ref,omitempty"`
+	Name       string        `json:"name"`
+	Hashes     []cdxHash     `json:"hashes,omitempty"`
+	Properties []cdxProperty `json:"properties,omitempty"`
+}
+
+type cdxHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// cdxHashAlgorithms are the CycloneDX names of the hash algorithms that have one. Hashes made with any other, such as
+// xxhash64 or the sampled and chunked variants, mean nothing to a vulnerability matcher and are left out.
+var cdxHashAlgorithms = map[string]string{
+	"md5":     "MD5",
+	"sha1":    "SHA-1",
+	"sha256":  "SHA-256",
+	"sha512":  "SHA-512",
+	"blake2b": "BLAKE2b-512",
+}
+
+// sbomCollector gathers executables and archives seen during the scan and writes them out as a CycloneDX BOM.
+type sbomCollector struct {
+	mu         sync.Mutex
+	path       string
+	algorithm  string
+	components []cdxComponent
+}
+
+// newSBOMCollector writes to path the files of a scan hashing with algorithm.
+func newSBOMCollector(path, algorithm string) *sbomCollector {
+	return &sbomCollector{path: path, algorithm: algorithm}
+}
+
+func (c *sbomCollector) record(storedPath, hash string, size int64, head []byte) {
+	kind := sniffKind(head)
+	if !executableKinds[kind] && !archiveKinds[kind] {
+		return
+	}
+	component := cdxComponent{
+		Type:   "file",
+		BOMRef: storedPath,
+		Name:   filepath.Base(storedPath),
+		Properties: []cdxProperty{
+			{Name: "fileindexer:path", Value: storedPath},
+			{Name: "fileindexer:type", Value: kind},
+			{Name: "fileindexer:size", Value: fmt.Sprintf("%d", size)},
+		},
+	}
+	if alg, ok := cdxHashAlgorithms[fileAlgorithm(c.algorithm, size)]; ok {
+		component.Hashes = []cdxHash{{Alg: alg, Content: hash}}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.components = append(c.components, component)
+}
+
+// write sorts the components by path, so BOMs from two scans of the same tree diff cleanly, and writes the file.
+func (c *sbomCollector) write() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sort.Slice(c.components, func(i, j int) bool { return c.components[i].BOMRef < c.components[j].BOMRef })
+	serial, err := randomUUID()
+	if err != nil {
+		return err
+	}
+	bom := cdxBOM{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + serial,
+		Version:      1,
+		Metadata: cdxMetadata{
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+			Tools:     cdxTools{Components: []cdxComponent{{Type: "application", Name: "fileindexer"}}},
+		},
+		Components: c.components,
+	}
+
+	file, err := os.Create(c.path)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(bom); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// randomUUID returns a random (version 4) UUID string.
+func randomUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
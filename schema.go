@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// schemaQueries is every table the tool creates, in an order that can be run against an empty database. Most tables
+// are only created when the feature using them is first used, so an index in use may have fewer.
+var schemaQueries = []string{
+	createTableQuery,
+	addAccessTimestampColumnQuery,
+	addAllocatedSizeColumnQuery,
+	addDeletedTimestampColumnQuery,
+	addSeenRunColumnQuery,
+	addRunColumnQuery,
+	createFileHistoryTableQuery,
+	addHashAlgorithmColumnQuery,
+	createFileExtentsTableQuery,
+	createFileChunksTableQuery,
+	createDiskPartitionsTableQuery,
+	createScanRunsTableQuery,
+	createScanPartitionsTableQuery,
+	createLineageTableQuery,
+	createPIITableQuery,
+	createQuotaUsageTableQuery,
+	createDirectoryMtimesTableQuery,
+	createQueueTableQuery,
+	createAuditLogTableQuery,
+	createIndexSealsTableQuery,
+	createAPITokensTableQuery,
+}
+
+// createViewsQuery defines read-only views for BI tools, documented with comments that Metabase and Superset show
+// alongside the columns. They are never used by the tool itself, so changing a table means checking them by hand.
+const createViewsQuery = `
+CREATE OR REPLACE VIEW current_files AS
+SELECT filepath, hash, size, allocated_size, file_timestamp, access_timestamp,
+    hash_calculated_timestamp AS indexed_timestamp, coalesce(hash_algorithm, 'md5') AS hash_algorithm, run_id
+FROM file_hashes
+WHERE deleted_timestamp IS NULL;
+COMMENT ON VIEW current_files IS 'Every file in the index with its latest hash, except those found deleted. Timestamps are in the scanning machine''s local time, except indexed_timestamp.';
+COMMENT ON COLUMN current_files.filepath IS 'Path as stored, after any --map prefix rewrites; a keyed hash in privacy mode.';
+COMMENT ON COLUMN current_files.hash IS 'Hash of the contents, hex encoded, made with hash_algorithm.';
+COMMENT ON COLUMN current_files.size IS 'Size in bytes.';
+COMMENT ON COLUMN current_files.allocated_size IS 'Bytes occupied on disk, less than size for sparse files. Only recorded by scans run with --record-allocation.';
+COMMENT ON COLUMN current_files.file_timestamp IS 'Modification time of the file when it was hashed.';
+COMMENT ON COLUMN current_files.access_timestamp IS 'Last access time seen by a scan run with --record-atime.';
+COMMENT ON COLUMN current_files.indexed_timestamp IS 'When the hash was last written, in UTC.';
+COMMENT ON COLUMN current_files.hash_algorithm IS 'The --hash-algo the hash was made with, followed by -sampled for --quick-hash or -merkle- and the chunk size for --chunk-size, or hmac-sha256 for privacy mode digests of the file name.';
+COMMENT ON COLUMN current_files.run_id IS 'The scan run (scan_summary.id) that last wrote the record; empty for records written by older versions.';
+
+CREATE OR REPLACE VIEW duplicates AS
+SELECT hash, size, count(*) AS copies, size * (count(*) - 1) AS wasted_bytes,
+    string_agg(filepath, E'\n' ORDER BY filepath) AS filepaths
+FROM file_hashes
+WHERE deleted_timestamp IS NULL
+GROUP BY hash, size
+HAVING count(*) > 1;
+COMMENT ON VIEW duplicates IS 'Contents stored under more than one path, one row per set of identical files.';
+COMMENT ON COLUMN duplicates.copies IS 'Number of paths with these contents.';
+COMMENT ON COLUMN duplicates.wasted_bytes IS 'Bytes that would be freed by keeping only one copy.';
+COMMENT ON COLUMN duplicates.filepaths IS 'The paths, one per line.';
+
+CREATE OR REPLACE VIEW deleted_files AS
+SELECT DISTINCT ON (h.filepath) h.filepath, h.hash, h.size, h.file_timestamp,
+    h.recorded_timestamp AS last_recorded_timestamp, f.deleted_timestamp
+FROM file_history h
+LEFT JOIN file_hashes f ON f.filepath = h.filepath
+WHERE f.filepath IS NULL OR f.deleted_timestamp IS NOT NULL
+ORDER BY h.filepath, h.recorded_timestamp DESC;
+COMMENT ON VIEW deleted_files IS 'Files that were indexed once but have since been found missing by a scan run with --detect-deleted, or removed from file_hashes, with their last recorded state.';
+COMMENT ON COLUMN deleted_files.last_recorded_timestamp IS 'When the last hash of the file was written, in UTC.';
+COMMENT ON COLUMN deleted_files.deleted_timestamp IS 'When a scan first found the file missing, in the scanning machine''s local time; empty for rows removed from file_hashes.';
+
+CREATE OR REPLACE VIEW scan_summary AS
+SELECT id, directory, started_timestamp, finished_timestamp,
+    EXTRACT(EPOCH FROM finished_timestamp - started_timestamp) AS duration_seconds,
+    files_processed, files_new, files_changed, files_failed, total_files, total_size,
+    base_snapshot, snapshot, output_host, output_path, files_existing, tool_version
+FROM scan_runs;
+COMMENT ON VIEW scan_summary IS 'One row per scan that modified the index. Timestamps are in UTC; the counts are empty for unfinished runs and runs from older versions.';
+COMMENT ON COLUMN scan_summary.files_processed IS 'Files the scan wrote a results row for, including failures.';
+COMMENT ON COLUMN scan_summary.total_files IS 'Files indexed under the directory after the scan.';
+COMMENT ON COLUMN scan_summary.total_size IS 'Bytes indexed under the directory after the scan.';
+COMMENT ON COLUMN scan_summary.tool_version IS 'Version of fileindexer that ran the scan.';
+
+CREATE OR REPLACE VIEW last_scans AS
+SELECT DISTINCT ON (directory) directory, id AS run_id, started_timestamp, finished_timestamp,
+    files_processed, files_new, files_changed, files_existing, files_failed, tool_version
+FROM scan_runs
+WHERE finished_timestamp IS NOT NULL AND subpath IS NULL
+ORDER BY directory, finished_timestamp DESC;
+COMMENT ON VIEW last_scans IS 'The last scan of each directory that ran to completion, ignoring scans of a --subpath. Timestamps are in UTC.';
+`
+
+// runSchema prints the database schema for use outside the tool, e.g. to create the views with psql.
+func runSchema(args []string) {
+	fs := flag.NewFlagSet("schema", flag.ContinueOnError)
+	fs.Usage = commandUsage(fs, "SchemaUsage")
+	parseArgs(fs, args)
+
+	if fs.NArg() != 1 || fs.Arg(0) != "export" {
+		usageError(fs, "", msg("SchemaUsage", nil))
+	}
+
+	for _, query := range schemaQueries {
+		query = strings.TrimSpace(query)
+		if !strings.HasSuffix(query, ";") {
+			query += ";"
+		}
+		fmt.Printf("%s\n\n", query)
+	}
+	fmt.Println(strings.TrimSpace(createViewsQuery))
+}
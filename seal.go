@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Each row of index_seals is a digest of file_hashes at one point in time, signed so that an auditor holding the
+// public key can later tell whether the index was changed since. public_key is the key the seal was made with, for
+// reference only: a check trusts the key it is given, not one from the database it is checking.
+const createIndexSealsTableQuery = `
+CREATE TABLE IF NOT EXISTS index_seals (
+    id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    sealed_timestamp TIMESTAMP NOT NULL,
+    files BIGINT NOT NULL,
+    digest TEXT NOT NULL,
+    signature TEXT NOT NULL,
+    public_key TEXT NOT NULL
+);
+`
+
+// indexDigest returns the number of rows in file_hashes and the SHA-256 of their paths and hashes, each terminated by
+// a NUL byte, in byte order of path. It doesn't depend on the database's collation or on anything but those two
+// columns, so a rescan that finds nothing new leaves it unchanged.
+func indexDigest(db *sql.DB) (int64, string, error) {
+	rows, err := db.Query(`SELECT filepath, hash FROM file_hashes ORDER BY filepath COLLATE "C"`)
+	if err != nil {
+		return 0, "", err
+	}
+	defer rows.Close()
+	hasher := sha256.New()
+	var files int64
+	for rows.Next() {
+		var path, hash string
+		if err := rows.Scan(&path, &hash); err != nil {
+			return 0, "", err
+		}
+		fmt.Fprintf(hasher, "%s\x00%s\x00", path, hash)
+		files++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, "", err
+	}
+	return files, fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// sealPayload is what a seal's signature covers, so neither its file count nor its time can be changed either.
+func sealPayload(sealed time.Time, files int64, digest string) []byte {
+	return []byte(fmt.Sprintf("fileindexer index seal\nsealed %s\nfiles %d\nsha256 %s\n", sealed.UTC().Format(time.RFC3339), files, digest))
+}
+
+// readPEMKey returns the DER bytes of the first PEM block of type blockType in path.
+func readPEMKey(path, blockType string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			return nil, fmt.Errorf("%s: no %s PEM block", path, blockType)
+		}
+		if block.Type == blockType {
+			return block.Bytes, nil
+		}
+	}
+}
+
+// readSealPrivateKey reads a PKCS #8 Ed25519 private key, as written by openssl genpkey -algorithm ed25519.
+func readSealPrivateKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEMKey(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	return private, nil
+}
+
+// readSealPublicKey reads a PKIX Ed25519 public key, as written by openssl pkey -pubout.
+func readSealPublicKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEMKey(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	return public, nil
+}
+
+// runSeal seals the index: it computes the digest of every path and hash in file_hashes, signs it with --key and
+// records it in index_seals. With --check, it instead recomputes the digest and checks it and the signature of that
+// seal with --public-key, exiting with status 1 if either doesn't match.
+func runSeal(args []string) {
+	fs := flag.NewFlagSet("seal", flag.ContinueOnError)
+	var dbCfg DBConfig
+	registerDBFlags(fs, &dbCfg)
+	keyFile := fs.String("key", "", "Ed25519 private key to sign the seal with, in PKCS #8 PEM (openssl genpkey -algorithm ed25519).")
+	check := fs.Int64("check", 0, "Instead of sealing, check the index against the seal with this id.")
+	publicKeyFile := fs.String("public-key", "", "Ed25519 public key in PEM (openssl pkey -pubout) to check the --check seal's signature with.")
+	fs.Usage = commandUsage(fs, "SealUsage")
+	parseArgs(fs, args)
+
+	if dbCfg.DbName == "" {
+		usageError(fs, "dbname", msg("MissingFlag", map[string]any{"Flag": "dbname"}))
+	}
+	if *check == 0 && *keyFile == "" {
+		usageError(fs, "key", msg("MissingFlag", map[string]any{"Flag": "key"}))
+	}
+	if *check != 0 && *publicKeyFile == "" {
+		usageError(fs, "public-key", msg("MissingFlag", map[string]any{"Flag": "public-key"}))
+	}
+
+	db := connectToDatabase(dbCfg)
+	defer db.Close()
+	if _, err := db.Exec(createIndexSealsTableQuery); err != nil {
+		log.Fatalf("Failed to create index seals table: %v", err)
+	}
+	if *check != 0 {
+		if !checkSeal(db, *check, *publicKeyFile) {
+			db.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
+	private, err := readSealPrivateKey(*keyFile)
+	if err != nil {
+		log.Fatalf("Failed to read --key: %v", err)
+	}
+	// Truncated to what the payload records, so the stored time signs the same way when read back.
+	sealed := time.Now().UTC().Truncate(time.Second)
+	files, digest, err := indexDigest(db)
+	if err != nil {
+		log.Fatalf("Failed to compute the index digest: %v", err)
+	}
+	signature := ed25519.Sign(private, sealPayload(sealed, files, digest))
+	public, err := x509.MarshalPKIXPublicKey(private.Public())
+	if err != nil {
+		log.Fatalf("Failed to encode the public key: %v", err)
+	}
+	var id int64
+	err = db.QueryRow("INSERT INTO index_seals (sealed_timestamp, files, digest, signature, public_key) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		sealed, files, digest, base64.StdEncoding.EncodeToString(signature), base64.StdEncoding.EncodeToString(public)).Scan(&id)
+	if err != nil {
+		log.Fatalf("Failed to record the seal: %v", err)
+	}
+	fmt.Println(msg("SealCreated", map[string]any{"ID": id, "Files": files, "Digest": digest, "Sealed": sealed.Format(time.RFC3339)}))
+	fmt.Printf("signature: %s\n", base64.StdEncoding.EncodeToString(signature))
+}
+
+// checkSeal checks the seal with id against publicKeyFile and the index as it is now, printing the outcome, and
+// reports whether both match.
+func checkSeal(db *sql.DB, id int64, publicKeyFile string) bool {
+	public, err := readSealPublicKey(publicKeyFile)
+	if err != nil {
+		log.Fatalf("Failed to read --public-key: %v", err)
+	}
+	var sealed time.Time
+	var files int64
+	var digest, encodedSignature string
+	err = db.QueryRow("SELECT sealed_timestamp, files, digest, signature FROM index_seals WHERE id = $1", id).
+		Scan(&sealed, &files, &digest, &encodedSignature)
+	if err == sql.ErrNoRows {
+		log.Fatalf("No seal %d in index_seals", id)
+	}
+	if err != nil {
+		log.Fatalf("Failed to look up seal %d: %v", id, err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(encodedSignature)
+	if err != nil || !ed25519.Verify(public, sealPayload(sealed, files, digest), signature) {
+		fmt.Println(msg("SealSignatureInvalid", map[string]any{"ID": id}))
+		return false
+	}
+
+	currentFiles, currentDigest, err := indexDigest(db)
+	if err != nil {
+		log.Fatalf("Failed to compute the index digest: %v", err)
+	}
+	data := map[string]any{"ID": id, "Sealed": sealed.Format(time.RFC3339), "Files": files, "CurrentFiles": currentFiles, "Digest": currentDigest}
+	if currentDigest != digest {
+		fmt.Println(msg("SealMismatch", data))
+		return false
+	}
+	fmt.Println(msg("SealMatch", data))
+	return true
+}
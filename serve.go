@@ -0,0 +1,564 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runMetrics are the per-run time series served to Grafana, as SQL expressions over scan_runs. Runs from before a
+// column was recorded have NULLs there and are left out of its series.
+var runMetrics = map[string]struct {
+	label string
+	expr  string
+}{
+	"total_size":       {"Indexed bytes under the directory", "total_size"},
+	"total_files":      {"Indexed files under the directory", "total_files"},
+	"files_processed":  {"Files processed", "files_processed"},
+	"files_new":        {"New files", "files_new"},
+	"files_changed":    {"Changed files", "files_changed"},
+	"files_existing":   {"Unchanged files", "files_existing"},
+	"files_failed":     {"Failed files", "files_failed"},
+	"change_rate":      {"Share of processed files that were new or changed", "(files_new + files_changed)::float8 / NULLIF(files_processed, 0)"},
+	"error_rate":       {"Share of processed files that failed", "files_failed::float8 / NULLIF(files_processed, 0)"},
+	"duration_seconds": {"Run duration in seconds", "EXTRACT(EPOCH FROM finished_timestamp - started_timestamp)::float8"},
+}
+
+// maxHashPaths caps the paths returned for one hash; the empty file alone can have millions of copies.
+const maxHashPaths = 10000
+
+// runServe serves scan_runs as time series in the protocol of Grafana's JSON datasource plugin, so dashboards can
+// chart the index across scans without anyone writing SQL, along with path and hash lookups.
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	var dbCfg DBConfig
+	registerDBFlags(fs, &dbCfg)
+	listen := fs.String("listen", "localhost:8080", "Address to serve the API on.")
+	redisAddr := fs.String("redis", "", "Cache path and hash lookups in Redis at this address (host:port, password from REDIS_PASSWORD).")
+	var scanRoots stringList
+	fs.Var(&scanRoots, "scan-root", "Allow POST /scans to start scans of directories under this one. May be repeated. Needs DB_PASSWORD set, for the scans to connect with.")
+	scanBandwidth := fs.Float64("scan-bandwidth", 0, "Share this many megabytes per second of reads between the scans started over the API, divided between the --scan-root roots with scans running by their --scan-weight. Unlimited by default.")
+	var scanPrefixes, scanWeights stringList
+	fs.Var(&scanPrefixes, "scan-prefix", "Prefix the scans of a --scan-root remove from stored paths, as root=prefix, e.g. /mnt/projects=/mnt. A root without one stores paths unchanged. May be repeated.")
+	fs.Var(&scanWeights, "scan-weight", "Weight of a --scan-root in the --scan-bandwidth shares, as root=weight (default 1), e.g. /mnt/archive=3. May be repeated.")
+	cacheTTL := fs.Duration("cache-ttl", 10*time.Minute, "How long a cached lookup is kept, at most. Entries are dropped as soon as the index changes; this bounds staleness if a change is missed.")
+	rateLimit := fs.Float64("rate-limit", 0, "Allow each client address, and with --require-token each API token, this many requests per second. Unlimited by default.")
+	rateBurst := fs.Int("rate-burst", 0, "Allow this many requests at once before --rate-limit applies. Defaults to one second's worth, at least 1.")
+	requireToken := fs.Bool("require-token", false, "Require an API token made with the token command on every request but GET /, as an Authorization: Bearer header. Without it, anyone who can reach --listen has full access.")
+	configFile, configSet := registerConfigFlags(fs)
+	fs.Usage = commandUsage(fs, "ServeUsage")
+	parseArgs(fs, args)
+
+	readDBConfigFile(fs, *configFile, *configSet)
+	if dbCfg.DbName == "" {
+		usageError(fs, "dbname", msg("MissingFlag", map[string]any{"Flag": "dbname"}))
+	}
+
+	var limiter *rateLimiter
+	if *rateLimit < 0 {
+		usageError(fs, "rate-limit", fmt.Sprintf("Invalid --rate-limit %g.", *rateLimit))
+	}
+	if *rateBurst < 0 || *rateBurst > 0 && *rateLimit == 0 {
+		usageError(fs, "rate-burst", "--rate-burst needs --rate-limit, and can't be negative.")
+	}
+	if *rateLimit > 0 {
+		burst := *rateBurst
+		if burst == 0 {
+			burst = max(1, int(math.Ceil(*rateLimit)))
+		}
+		limiter = newRateLimiter(*rateLimit, burst)
+	}
+
+	var launcher *scanLauncher
+	if len(scanRoots) > 0 {
+		if os.Getenv("DB_PASSWORD") == "" {
+			usageError(fs, "scan-root", "--scan-root needs the DB_PASSWORD environment variable, since the scans it starts can't prompt for a password.")
+		}
+		var roots []string
+		for _, root := range scanRoots {
+			abs, err := filepath.Abs(root)
+			if err == nil {
+				abs, err = filepath.EvalSymlinks(abs)
+			}
+			if err != nil {
+				log.Fatalf("Invalid --scan-root %s: %v", root, err)
+			}
+			roots = append(roots, abs)
+		}
+		if *scanBandwidth < 0 {
+			usageError(fs, "scan-bandwidth", fmt.Sprintf("Invalid --scan-bandwidth %g.", *scanBandwidth))
+		}
+		if *scanBandwidth == 0 && len(scanWeights) > 0 {
+			usageError(fs, "scan-weight", "--scan-weight needs --scan-bandwidth, the bandwidth it shares out.")
+		}
+		weights, err := parseScanWeights(scanWeights, roots)
+		if err != nil {
+			usageError(fs, "scan-weight", err.Error())
+		}
+		prefixes, err := parseScanPrefixes(scanPrefixes, roots)
+		if err != nil {
+			usageError(fs, "scan-prefix", err.Error())
+		}
+		launcher = newScanLauncher(roots, prefixes, dbCfg, *scanBandwidth, weights)
+	} else if *scanBandwidth != 0 || len(scanWeights) > 0 || len(scanPrefixes) > 0 {
+		usageError(fs, "scan-root", "--scan-bandwidth, --scan-weight and --scan-prefix need --scan-root.")
+	}
+
+	connectionString := databaseConnectionString(dbCfg)
+	db := openDatabase(connectionString)
+	defer db.Close()
+	if _, err := db.Exec(createScanRunsTableQuery); err != nil {
+		log.Fatalf("Failed to create scan runs table: %v", err)
+	}
+	if _, err := db.Exec(createTableQuery); err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+	if _, err := db.Exec(createFileHistoryTableQuery + addHashAlgorithmColumnQuery); err != nil {
+		log.Fatalf("Failed to add hash_algorithm column: %v", err)
+	}
+	if _, err := db.Exec(addDeletedTimestampColumnQuery); err != nil {
+		log.Fatalf("Failed to add deleted_timestamp column: %v", err)
+	}
+	if _, err := db.Exec(createAPITokensTableQuery); err != nil {
+		log.Fatalf("Failed to create API tokens table: %v", err)
+	}
+	// Hash lookups need the index lineage uses; building it on a large existing table takes a while, once.
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS file_hashes_hash ON file_hashes (hash)"); err != nil {
+		log.Fatalf("Failed to create hash index: %v", err)
+	}
+
+	// Named reports with every in a YAML --config file are delivered on schedule while serve runs.
+	if isYAMLConfig(*configFile) {
+		reports, err := loadReportDefinitions(*configFile)
+		if err != nil {
+			log.Fatalf("Failed to read reports: %v", err)
+		}
+		scheduleReports(db, reports)
+	}
+
+	var cache *lookupCache
+	if *redisAddr != "" {
+		var err error
+		if cache, err = newLookupCache(*redisAddr, dbCfg.DbName, *cacheTTL); err != nil {
+			log.Fatalf("Failed to connect to Redis at %s: %v", *redisAddr, err)
+		}
+		if err := cache.followChanges(db, connectionString); err != nil {
+			log.Fatalf("Failed to follow index changes for the cache: %v", err)
+		}
+	}
+
+	log.Print(msg("Serving", map[string]any{"Address": *listen}))
+	if err := http.ListenAndServe(*listen, newAPIHandler(db, cache, launcher, &apiAuth{db: db, required: *requireToken, limiter: limiter})); err != nil {
+		log.Fatalf("Server stopped: %v", err)
+	}
+}
+
+// newAPIHandler serves the API from db, caching lookups in cache unless it is nil, to requests auth lets through. Scans
+// can be started over the API only if launcher isn't nil.
+func newAPIHandler(db *sql.DB, cache *lookupCache, launcher *scanLauncher, auth *apiAuth) http.Handler {
+	mux := http.NewServeMux()
+	// Grafana's "Save & test" expects a 200 from the root.
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK\n"))
+	})
+	mux.HandleFunc("POST /metrics", auth.authorize("read-only", func(w http.ResponseWriter, r *http.Request) {
+		type option struct {
+			Label string `json:"label"`
+			Value string `json:"value"`
+		}
+		var options []option
+		for _, name := range metricNames() {
+			options = append(options, option{Label: runMetrics[name].label, Value: name})
+		}
+		writeJSON(w, options)
+	}))
+	// /search is the older SimpleJson plugin's name for /metrics.
+	mux.HandleFunc("POST /search", auth.authorize("read-only", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, metricNames())
+	}))
+	mux.HandleFunc("POST /query", auth.authorize("read-only", func(w http.ResponseWriter, r *http.Request) {
+		// scan_runs is kept by scanned directory, not stored path, so it can't be narrowed to a namespace.
+		if requestToken(r).Namespace != "" {
+			http.Error(w, "scan run metrics cover whole directories and aren't available to tokens confined to a namespace", http.StatusForbidden)
+			return
+		}
+		var req grafanaQuery
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid query: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		series, err := querySeries(db, req)
+		if err != nil {
+			log.Printf("Failed to answer query: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, series)
+	}))
+	listFilesEndpoint := listEndpoint(db, listFilesQuery, listFiles)
+	mux.HandleFunc("GET /files", auth.authorize("read-only", func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			listFilesEndpoint(w, r)
+			return
+		}
+		// Paths outside the token's namespace are answered as if they weren't indexed, so it can't probe for them.
+		if !requestToken(r).covers(path) {
+			http.NotFound(w, r)
+			return
+		}
+		record, err := lookupPath(r.Context(), db, cache, path)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to look up %s: %v", path, err)
+			http.Error(w, "lookup failed", http.StatusInternalServerError)
+			return
+		}
+		include := r.URL.Query().Get("include")
+		if include == "" {
+			writeJSON(w, record)
+			return
+		}
+		for _, name := range strings.Split(include, ",") {
+			if !slices.Contains(fileIncludes, name) {
+				http.Error(w, fmt.Sprintf("invalid include %q, expected a comma-separated list of %v", name, fileIncludes), http.StatusBadRequest)
+				return
+			}
+		}
+		details, err := lookupFileDetails(r.Context(), db, cache, record, strings.Split(include, ","), requestToken(r))
+		if err != nil {
+			log.Printf("Failed to look up %s: %v", path, err)
+			http.Error(w, "lookup failed", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, details)
+	}))
+	mux.HandleFunc("GET /dupes", auth.authorize("read-only", listEndpoint(db, listDupesQuery, listDupes)))
+	mux.HandleFunc("GET /history", auth.authorize("read-only", listEndpoint(db, listHistoryQuery, listHistory)))
+	mux.HandleFunc("GET /export/{report}", auth.authorize("read-only", func(w http.ResponseWriter, r *http.Request) {
+		serveExport(w, r, db)
+	}))
+	mux.HandleFunc("GET /hashes/{hash}", auth.authorize("read-only", func(w http.ResponseWriter, r *http.Request) {
+		paths, err := lookupHash(r.Context(), db, cache, r.PathValue("hash"), requestToken(r).Namespace)
+		if err != nil {
+			log.Printf("Failed to look up hash %s: %v", r.PathValue("hash"), err)
+			http.Error(w, "lookup failed", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, paths)
+	}))
+	mux.HandleFunc("GET /scans/diff", auth.authorize("read-only", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		from, fromErr := strconv.ParseInt(query.Get("from"), 10, 64)
+		to, toErr := strconv.ParseInt(query.Get("to"), 10, 64)
+		if fromErr != nil || toErr != nil {
+			http.Error(w, "from and to must be scan run IDs", http.StatusBadRequest)
+			return
+		}
+		prefix, ok := requestToken(r).scopePrefix(query.Get("prefix"))
+		if !ok {
+			http.Error(w, "prefix is outside the token's namespace", http.StatusForbidden)
+			return
+		}
+		diff, err := diffScanRuns(r.Context(), db, from, to, prefix)
+		if err != nil {
+			log.Printf("Failed to diff scan runs %d and %d: %v", from, to, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, diff)
+	}))
+	mux.HandleFunc("POST /scans", auth.authorize("scan-trigger", func(w http.ResponseWriter, r *http.Request) {
+		if launcher == nil {
+			http.Error(w, "scans can't be started over this API: serve was started without --scan-root", http.StatusForbidden)
+			return
+		}
+		var req struct {
+			Directory string `json:"directory"`
+			Prefix    string `json:"prefix"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		status, err := launcher.start(req.Directory, req.Prefix, requestToken(r))
+		if errors.Is(err, errScanRunning) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, errOutsideNamespace) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(status)
+	}))
+	// Scans are known by the IDs POST /scans answers with, for as long as serve runs; scans of directories whose
+	// stored paths are outside the token's namespace look unknown.
+	mux.HandleFunc("GET /scans", auth.authorize("read-only", func(w http.ResponseWriter, r *http.Request) {
+		if launcher == nil {
+			writeJSON(w, []scanStatus{})
+			return
+		}
+		writeJSON(w, launcher.list(requestToken(r)))
+	}))
+	mux.HandleFunc("GET /scans/{id}", auth.authorize("read-only", func(w http.ResponseWriter, r *http.Request) {
+		if launcher == nil {
+			http.NotFound(w, r)
+			return
+		}
+		status, ok := launcher.status(r.PathValue("id"), requestToken(r))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, status)
+	}))
+	mux.HandleFunc("DELETE /scans/{id}", auth.authorize("scan-trigger", func(w http.ResponseWriter, r *http.Request) {
+		if launcher == nil {
+			http.NotFound(w, r)
+			return
+		}
+		status, ok, err := launcher.cancel(r.PathValue("id"), requestToken(r))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if errors.Is(err, errScanNotRunning) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to cancel scan %s: %v", r.PathValue("id"), err)
+			http.Error(w, "cancelling failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(status)
+	}))
+	graphQL := newGraphQLSchema(db, cache, launcher)
+	mux.HandleFunc("POST /graphql", auth.authorize("read-only", func(w http.ResponseWriter, r *http.Request) {
+		serveGraphQL(w, r, graphQL)
+	}))
+	mux.HandleFunc("GET /graphql", auth.authorize("read-only", func(w http.ResponseWriter, r *http.Request) {
+		serveGraphQL(w, r, graphQL)
+	}))
+	mux.HandleFunc("GET /graphql/schema", auth.authorize("read-only", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(graphQL.sdl()))
+	}))
+	handleTokens(mux, db, auth)
+	return mux
+}
+
+// fileRecord is a file_hashes row as served by /files, with times in the server's time zone.
+type fileRecord struct {
+	Path      string    `json:"path"`
+	Hash      string    `json:"hash"`
+	Algorithm string    `json:"hash_algorithm"`
+	Size      int64     `json:"size"`
+	Modified  time.Time `json:"modified"`
+	Indexed   time.Time `json:"indexed"`
+}
+
+// fileDetails is a file's record along with what GET /files?path= was asked to include: its file_history rows, the
+// newest first, and the other paths indexed with its hash. HistoryCursor continues the history on GET /history when
+// there are more rows than a page holds.
+type fileDetails struct {
+	fileRecord
+	History       []historyEntry `json:"history,omitempty"`
+	HistoryCursor string         `json:"history_cursor,omitempty"`
+	Copies        *hashPaths     `json:"copies,omitempty"`
+}
+
+// fileIncludes are what GET /files?path= can include.
+var fileIncludes = []string{"history", "copies"}
+
+// lookupFileDetails adds include to record, so a client that shows a file with its history and copies needs one
+// request rather than three.
+func lookupFileDetails(ctx context.Context, db *sql.DB, cache *lookupCache, record fileRecord, include []string, token apiToken) (fileDetails, error) {
+	details := fileDetails{fileRecord: record}
+	for _, name := range include {
+		switch name {
+		case "history":
+			query, args, p, err := listHistoryQuery(url.Values{"path": {record.Path}, "sort": {"-recorded"}, "limit": {strconv.Itoa(maxPageSize)}}, token)
+			if err != nil {
+				return details, err
+			}
+			page, err := listHistory(ctx, db, query, args, p)
+			if err != nil {
+				return details, err
+			}
+			details.History, details.HistoryCursor = page.Items.([]historyEntry), page.NextCursor
+		case "copies":
+			copies, err := lookupHash(ctx, db, cache, record.Hash, token.Namespace)
+			if err != nil {
+				return details, err
+			}
+			copies.Paths = slices.DeleteFunc(copies.Paths, func(path string) bool { return path == record.Path })
+			details.Copies = &copies
+		}
+	}
+	return details, nil
+}
+
+// hashPaths is the answer to /hashes: every indexed path with the hash, up to maxHashPaths.
+type hashPaths struct {
+	Hash      string   `json:"hash"`
+	Paths     []string `json:"paths"`
+	Truncated bool     `json:"truncated,omitempty"`
+}
+
+// lookupPath returns the record of a stored path, or sql.ErrNoRows.
+func lookupPath(ctx context.Context, db *sql.DB, cache *lookupCache, path string) (fileRecord, error) {
+	var record fileRecord
+	if cache != nil && cache.get(ctx, cache.pathKey(path), &record) {
+		return record, nil
+	}
+	err := db.QueryRowContext(ctx, `
+SELECT filepath, hash, coalesce(hash_algorithm, $2), size, file_timestamp, hash_calculated_timestamp FROM file_hashes
+WHERE filepath = $1`, path, defaultHashAlgorithm).Scan(&record.Path, &record.Hash, &record.Algorithm, &record.Size, &record.Modified, &record.Indexed)
+	if err != nil {
+		return record, err
+	}
+	record.Modified, record.Indexed = localWallClock(record.Modified), record.Indexed.In(time.Local)
+	if cache != nil {
+		cache.set(ctx, cache.pathKey(path), record)
+	}
+	return record, nil
+}
+
+// lookupHash returns the paths indexed with hash under namespace, a stored path prefix or "" for all. Unknown hashes
+// get an empty list, which is cached too. Only lookups of the whole index are cached, since the cache drops entries by
+// hash alone.
+func lookupHash(ctx context.Context, db *sql.DB, cache *lookupCache, hash, namespace string) (hashPaths, error) {
+	result := hashPaths{Hash: hash, Paths: []string{}}
+	if namespace != "" {
+		cache = nil
+	}
+	if cache != nil && cache.get(ctx, cache.hashKey(hash), &result) {
+		return result, nil
+	}
+	rows, err := db.QueryContext(ctx, "SELECT filepath FROM file_hashes WHERE hash = $1 AND filepath LIKE $3 ORDER BY filepath LIMIT $2", hash, maxHashPaths+1, likePrefix(namespace))
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return result, err
+		}
+		result.Paths = append(result.Paths, path)
+	}
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+	if len(result.Paths) > maxHashPaths {
+		result.Paths, result.Truncated = result.Paths[:maxHashPaths], true
+	}
+	if cache != nil {
+		cache.set(ctx, cache.hashKey(hash), result)
+	}
+	return result, nil
+}
+
+func metricNames() []string {
+	var names []string
+	for name := range runMetrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// grafanaQuery is the part of a JSON datasource /query request that is used. A target's payload may name a
+// directory to chart only that directory's runs; otherwise each scanned directory gets its own series.
+type grafanaQuery struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	Targets []struct {
+		Target  string `json:"target"`
+		Payload struct {
+			Directory string `json:"directory"`
+		} `json:"payload"`
+	} `json:"targets"`
+}
+
+// grafanaSeries is one time series in a /query response. Datapoints are [value, unix milliseconds] pairs.
+type grafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+func querySeries(db *sql.DB, req grafanaQuery) ([]grafanaSeries, error) {
+	series := []grafanaSeries{}
+	for _, target := range req.Targets {
+		metric, ok := runMetrics[target.Target]
+		if !ok {
+			return nil, fmt.Errorf("unknown metric %q", target.Target)
+		}
+		rows, err := db.Query(`
+SELECT directory, finished_timestamp, `+metric.expr+` FROM scan_runs
+WHERE finished_timestamp BETWEEN $1 AND $2 AND `+metric.expr+` IS NOT NULL AND ($3 = '' OR directory = $3)
+ORDER BY directory, finished_timestamp`, req.Range.From.UTC(), req.Range.To.UTC(), target.Payload.Directory)
+		if err != nil {
+			return nil, err
+		}
+		byDirectory := make(map[string]int)
+		for rows.Next() {
+			var directory string
+			var finished time.Time
+			var value float64
+			if err := rows.Scan(&directory, &finished, &value); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			i, ok := byDirectory[directory]
+			if !ok {
+				i = len(series)
+				byDirectory[directory] = i
+				series = append(series, grafanaSeries{Target: target.Target + " " + directory, Datapoints: [][2]float64{}})
+			}
+			series[i].Datapoints = append(series[i].Datapoints, [2]float64{value, float64(finished.UnixMilli())})
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return series, nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
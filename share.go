@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// shareWorkerCount is the default number of workers with --network-share. SMB and NFS servers serialize much of
+// their work per client, so more concurrent opens mostly add latency and provoke timeouts.
+const shareWorkerCount = 2
+
+// A transient error on a network share is retried this many times, backing off from the first delay, doubling each
+// time: about half a minute in all, enough to ride out an SMB reconnect or an NFS server failover.
+const (
+	maxShareRetries = 5
+	firstShareDelay = time.Second
+)
+
+// maxShareSamples caps the open latencies kept for the percentiles of the share summary. Beyond it, samples are
+// replaced at random so they stay representative of the whole scan.
+const maxShareSamples = 100000
+
+// maxShareHotspots is how many of the directories with the most failures the share summary lists.
+const maxShareHotspots = 10
+
+// shareSweep retries transient errors on a network share and records what the share summary reports.
+type shareSweep struct {
+	mu        sync.Mutex
+	opens     int
+	latencies []time.Duration
+	slowest   time.Duration
+	retried   int
+	failed    int
+	hotspots  map[string]int
+}
+
+func newShareSweep() *shareSweep {
+	return &shareSweep{hotspots: make(map[string]int)}
+}
+
+// isTransientShareError reports whether err is one of the errors a network filesystem returns while the server or the
+// connection to it is briefly unavailable, listed per platform in transientShareErrors.
+func isTransientShareError(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	for _, transient := range transientShareErrors {
+		if errno == transient {
+			return true
+		}
+	}
+	return false
+}
+
+// retry runs op, described by what, until it succeeds, fails with an error that isn't transient, or runs out of
+// retries.
+func (s *shareSweep) retry(what string, op func() error) error {
+	delay := firstShareDelay
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || attempt == maxShareRetries || !isTransientShareError(err) {
+			return err
+		}
+		s.mu.Lock()
+		s.retried++
+		s.mu.Unlock()
+		log.Printf("Retrying %s in %s: %v", what, delay, err)
+		time.Sleep(withJitter(delay))
+		delay *= 2
+	}
+}
+
+// open opens path for hashing with open, retrying transient errors and recording how long the successful open took.
+func (s *shareSweep) open(path string, open func(string) (*os.File, error)) (*os.File, error) {
+	var file *os.File
+	err := s.retry("open of "+path, func() error {
+		start := time.Now()
+		var err error
+		if file, err = open(path); err == nil {
+			s.recordLatency(time.Since(start))
+		}
+		return err
+	})
+	return file, err
+}
+
+func (s *shareSweep) recordLatency(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.opens++
+	s.slowest = max(s.slowest, latency)
+	if len(s.latencies) < maxShareSamples {
+		s.latencies = append(s.latencies, latency)
+	} else if i := rand.N(s.opens); i < maxShareSamples {
+		s.latencies[i] = latency
+	}
+}
+
+// recordFailure counts a file or directory of dir that couldn't be read, after any retries.
+func (s *shareSweep) recordFailure(dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed++
+	s.hotspots[dir]++
+}
+
+// shareReader reads a file on a network share from start to end, retrying transient read errors. Reads go through
+// ReadAt so a retry asks for the same offset again, whatever position the failed read left the file at.
+type shareReader struct {
+	share  *shareSweep
+	file   *os.File
+	offset int64
+}
+
+func (r *shareReader) Read(p []byte) (int, error) {
+	var n int
+	err := r.share.retry(fmt.Sprintf("read of %s at offset %d", r.file.Name(), r.offset), func() error {
+		var err error
+		n, err = r.file.ReadAt(p, r.offset)
+		// Whatever was read counts; an error after it is met again, and retried, by the next read.
+		if n > 0 && err != nil {
+			err = nil
+		}
+		return err
+	})
+	r.offset += int64(n)
+	return n, err
+}
+
+var _ io.Reader = (*shareReader)(nil)
+
+// logSummary logs the share summary of a scan of directory: open latency percentiles, how many transient errors were
+// retried and how many files still failed, and the directories where they failed most.
+func (s *shareSweep) logSummary(directory string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	log.Print(msg("ShareSummary", map[string]any{"Directory": directory}))
+	if len(s.latencies) > 0 {
+		sorted := append([]time.Duration(nil), s.latencies...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		percentile := func(p int) time.Duration {
+			return sorted[(len(sorted)-1)*p/100].Round(time.Microsecond)
+		}
+		log.Print(msg("ShareLatency", map[string]any{
+			"Count": s.opens, "P50": percentile(50), "P90": percentile(90), "P99": percentile(99), "Max": s.slowest.Round(time.Microsecond),
+		}))
+	}
+	log.Print(msg("ShareErrors", map[string]any{"Retried": s.retried, "Failed": s.failed}))
+	if len(s.hotspots) == 0 {
+		return
+	}
+
+	dirs := make([]string, 0, len(s.hotspots))
+	for dir := range s.hotspots {
+		dirs = append(dirs, dir)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		if s.hotspots[dirs[i]] != s.hotspots[dirs[j]] {
+			return s.hotspots[dirs[i]] > s.hotspots[dirs[j]]
+		}
+		return dirs[i] < dirs[j]
+	})
+	log.Print(msg("ShareHotspots", nil))
+	for _, dir := range dirs[:min(len(dirs), maxShareHotspots)] {
+		log.Printf("  %6d  %s", s.hotspots[dir], dir)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// transientShareErrors are the errors NFS and SMB (CIFS) mounts return while the server is unreachable, restarting or
+// failing over, and which usually go away on their own.
+var transientShareErrors = []syscall.Errno{
+	syscall.EIO,
+	syscall.EAGAIN,
+	syscall.EINTR,
+	syscall.ETIMEDOUT,
+	syscall.ESTALE,
+	syscall.ECONNRESET,
+	syscall.ECONNABORTED,
+	syscall.EHOSTDOWN,
+	syscall.EHOSTUNREACH,
+	syscall.ENETDOWN,
+	syscall.ENETUNREACH,
+	syscall.ENETRESET,
+}
@@ -0,0 +1,17 @@
+package main
+
+import "syscall"
+
+// transientShareErrors are the Windows errors reading a UNC path or mapped drive returns while the SMB server is
+// unreachable or the session is being re-established, and which usually go away on their own.
+var transientShareErrors = []syscall.Errno{
+	54,   // ERROR_NETWORK_BUSY
+	55,   // ERROR_DEV_NOT_EXIST
+	58,   // ERROR_BAD_NET_RESP
+	59,   // ERROR_UNEXP_NET_ERR
+	64,   // ERROR_NETNAME_DELETED
+	121,  // ERROR_SEM_TIMEOUT
+	240,  // ERROR_VC_DISCONNECTED
+	1231, // ERROR_NETWORK_UNREACHABLE
+	1236, // ERROR_CONNECTION_ABORTED
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// byteUnits maps size suffixes to multipliers. Decimal and binary suffixes are both accepted since people write
+// "2G" and "2GiB" interchangeably; both are treated as powers of 1024.
+var byteUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"tib", 1 << 40}, {"gib", 1 << 30}, {"mib", 1 << 20}, {"kib", 1 << 10},
+	{"tb", 1 << 40}, {"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10},
+	{"t", 1 << 40}, {"g", 1 << 30}, {"m", 1 << 20}, {"k", 1 << 10},
+	{"b", 1},
+}
+
+// parseByteSize parses sizes like "512MiB", "2G" or "1048576".
+func parseByteSize(s string) (int64, error) {
+	value := strings.ToLower(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	// Whole numbers are parsed exactly, so sizes up to the int64 limit survive.
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil && n >= 0 {
+		if n > math.MaxInt64/multiplier {
+			return 0, fmt.Errorf("size %q is too large", s)
+		}
+		return n * multiplier, nil
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	// float64(math.MaxInt64) rounds up to 2^63, so anything at or above it would overflow the conversion.
+	if bytes := n * float64(multiplier); bytes < float64(math.MaxInt64) {
+		return int64(bytes), nil
+	}
+	return 0, fmt.Errorf("size %q is too large", s)
+}
+
+// sumSizeSQL totals the size column of a query, clamped to the int64 range: Postgres sums BIGINTs as NUMERIC, which
+// can exceed it.
+const sumSizeSQL = "LEAST(coalesce(sum(size), 0), 9223372036854775807)::bigint"
+
+// addSizes adds two non-negative sizes, saturating at math.MaxInt64 instead of wrapping around.
+func addSizes(a, b int64) int64 {
+	if b > math.MaxInt64-a {
+		return math.MaxInt64
+	}
+	return a + b
+}
+
+// mulSize multiplies a non-negative size by a non-negative count, saturating at math.MaxInt64 instead of wrapping
+// around.
+func mulSize(size, n int64) int64 {
+	if n != 0 && size > math.MaxInt64/n {
+		return math.MaxInt64
+	}
+	return size * n
+}
+
+// humanUnits are the suffixes used by formatByteSize, in steps of 1024.
+var humanUnits = []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+
+// formatByteSize formats a size for people, e.g. 1.4GiB. Sizes below 1 KiB are printed in bytes, and one decimal is
+// shown below 10 units.
+func formatByteSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	value := float64(n)
+	unit := 0
+	for value >= 1024 && unit < len(humanUnits)-1 {
+		value /= 1024
+		unit++
+	}
+	if value < 10 {
+		return strconv.FormatFloat(value, 'f', 1, 64) + humanUnits[unit]
+	}
+	return strconv.FormatFloat(value, 'f', 0, 64) + humanUnits[unit]
+}
+
+// formatSize formats a size for a report column: in bytes for machines, or with formatByteSize when human is set.
+// Negative sizes, which mark errors, are always printed as they are.
+func formatSize(n int64, human bool) string {
+	if human && n >= 0 {
+		return formatByteSize(n)
+	}
+	return strconv.FormatInt(n, 10)
+}
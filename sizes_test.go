@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    int64
+		wantErr bool
+	}{
+		{s: "0", want: 0},
+		{s: "1048576", want: 1 << 20},
+		{s: "512MiB", want: 512 << 20},
+		{s: "512mb", want: 512 << 20},
+		{s: "2G", want: 2 << 30},
+		{s: " 10 KiB ", want: 10 << 10},
+		{s: "1.5k", want: 1536},
+		{s: "100B", want: 100},
+		{s: "1TB", want: 1 << 40},
+		{s: "9223372036854775807", want: math.MaxInt64},
+		{s: "8388607TiB", want: 8388607 << 40},
+		{s: "8388608TiB", wantErr: true},
+		{s: "9223372036854775808", wantErr: true},
+		{s: "1e30", wantErr: true},
+		{s: "", wantErr: true},
+		{s: "-1", wantErr: true},
+		{s: "-1.5M", wantErr: true},
+		{s: "ten", wantErr: true},
+		{s: "5 PB", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseByteSize(tt.s)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseByteSize(%q) = %d, want an error", tt.s, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseByteSize(%q) = %d, %v, want %d", tt.s, got, err, tt.want)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		n     int64
+		human bool
+		want  string
+	}{
+		{0, false, "0"},
+		{1 << 30, false, "1073741824"},
+		{-1, false, "-1"},
+		{-1, true, "-1"},
+		{0, true, "0B"},
+		{1023, true, "1023B"},
+		{1024, true, "1.0KiB"},
+		{1536, true, "1.5KiB"},
+		{10 << 20, true, "10MiB"},
+		{1503238554, true, "1.4GiB"},
+		{1000 << 40, true, "1000TiB"},
+		{math.MaxInt64, true, "8.0EiB"},
+	}
+	for _, tt := range tests {
+		if got := formatSize(tt.n, tt.human); got != tt.want {
+			t.Errorf("formatSize(%d, %v) = %q, want %q", tt.n, tt.human, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// changeSet is the result of parsing a snapshot diff: the paths created or modified, in the order first seen, and
+// how many were removed.
+type changeSet struct {
+	paths   []string
+	index   map[string]int
+	removed int
+}
+
+func newChangeSet() *changeSet {
+	return &changeSet{index: make(map[string]int)}
+}
+
+func (c *changeSet) add(path string) {
+	if _, ok := c.index[path]; !ok {
+		c.index[path] = len(c.paths)
+		c.paths = append(c.paths, path)
+	}
+}
+
+// rename moves oldPath's entry to newPath, or adds newPath if oldPath wasn't changed itself.
+func (c *changeSet) rename(oldPath, newPath string) {
+	if i, ok := c.index[oldPath]; ok {
+		delete(c.index, oldPath)
+		c.paths[i] = newPath
+		c.index[newPath] = i
+		return
+	}
+	c.add(newPath)
+}
+
+// parseZFSDiff reads `zfs diff` output, with or without -H, -F and -t. Paths are absolute, under the dataset's
+// mountpoint, with unusual characters escaped as \0ooo.
+func parseZFSDiff(r io.Reader) (*changeSet, error) {
+	changes := newChangeSet()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) > 0 && strings.Contains(fields[0], ".") {
+			fields = fields[1:] // -t timestamp
+		}
+		if len(fields) < 2 {
+			continue
+		}
+		change := fields[0]
+		var paths []string
+		for _, field := range fields[1:] {
+			// Skip the -F file type column; paths always start with a slash.
+			if strings.HasPrefix(field, "/") {
+				paths = append(paths, field)
+			}
+		}
+		if len(paths) == 1 {
+			if oldPath, newPath, ok := strings.Cut(paths[0], " -> "); ok {
+				paths = []string{oldPath, newPath}
+			}
+		}
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("line %d: no path in %q", line, scanner.Text())
+		}
+		for i := range paths {
+			paths[i] = unescapeZFSPath(paths[i])
+		}
+
+		switch {
+		case change == "-":
+			changes.removed++
+		case change == "+" || change == "M":
+			changes.add(paths[0])
+		case change == "R" && len(paths) == 2:
+			changes.rename(paths[0], paths[1])
+		default:
+			return nil, fmt.Errorf("line %d: unrecognised change %q", line, scanner.Text())
+		}
+	}
+	return changes, scanner.Err()
+}
+
+// unescapeZFSPath undoes zfs diff's escaping of spaces, backslashes and non-printable bytes as \0ooo.
+func unescapeZFSPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+5 <= len(path) {
+			if n, err := strconv.ParseUint(path[i+1:i+5], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 4
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// parseBtrfsDump reads `btrfs receive --dump` output for an incremental `btrfs send -p`. Paths are relative to the
+// received subvolume and prefixed with its name ("./snap/dir/file"), so they're joined onto root with that prefix
+// removed.
+func parseBtrfsDump(r io.Reader, root string) (*changeSet, error) {
+	changes := newChangeSet()
+	resolve := func(path string) string {
+		path = strings.TrimPrefix(path, "./")
+		if _, rest, ok := strings.Cut(path, "/"); ok {
+			return filepath.Join(root, rest)
+		}
+		return root
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fields := splitEscaped(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		command, path := fields[0], resolve(fields[1])
+		switch command {
+		case "mkfile", "link", "write", "clone", "truncate", "update_extent", "set_xattr", "remove_xattr", "encoded_write":
+			changes.add(path)
+		case "rename":
+			for _, field := range fields[2:] {
+				if dest, ok := strings.CutPrefix(field, "dest="); ok {
+					changes.rename(path, resolve(dest))
+				}
+			}
+		case "unlink":
+			changes.removed++
+		}
+	}
+	return changes, scanner.Err()
+}
+
+// splitEscaped splits a btrfs dump line on whitespace, honouring backslash escapes within paths.
+func splitEscaped(line string) []string {
+	var fields []string
+	var b strings.Builder
+	inField := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && i+1 < len(line):
+			i++
+			b.WriteByte(line[i])
+			inField = true
+		case c == ' ' || c == '\t':
+			if inField {
+				fields = append(fields, b.String())
+				b.Reset()
+				inField = false
+			}
+		default:
+			b.WriteByte(c)
+			inField = true
+		}
+	}
+	if inField {
+		fields = append(fields, b.String())
+	}
+	return fields
+}
+
+// readChanges calls visit for every regular file named in the --changes-from diff that still exists under
+// cfg.Directory and isn't excluded, until ctx is done.
+func readChanges(ctx context.Context, cfg Config, visit func(path string, info os.FileInfo)) error {
+	var r io.Reader = os.Stdin
+	if cfg.ChangesFrom != "-" {
+		file, err := os.Open(cfg.ChangesFrom)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	var changes *changeSet
+	var err error
+	if cfg.ChangesFormat == "btrfs" {
+		changes, err = parseBtrfsDump(r, cfg.Directory)
+	} else {
+		changes, err = parseZFSDiff(r)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse %s diff: %v", cfg.ChangesFormat, err)
+	}
+
+	root := strings.TrimSuffix(cfg.Directory, string(filepath.Separator)) + string(filepath.Separator)
+	for _, path := range changes.paths {
+		if ctx.Err() != nil {
+			return errScanInterrupted
+		}
+		if !strings.HasPrefix(path, root) {
+			log.Printf("Skipping changed path %s outside --directory", path)
+			continue
+		}
+		if reason := exclusionWithin(cfg, path); reason != "" {
+			log.Printf("Skipping file %s due to %s", path, reason)
+			continue
+		}
+		info, err := os.Lstat(path)
+		if err != nil {
+			log.Printf("Skipping changed path %s: %v", path, err)
+			continue
+		}
+		if info.Mode().IsRegular() && !filteredOut(cfg, path, info) {
+			visit(path, info)
+		}
+	}
+	log.Printf("Snapshot diff listed %d changed paths; %d removed paths stay in the index", len(changes.paths), changes.removed)
+	return nil
+}
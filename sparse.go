@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"os"
+)
+
+// allocated_size is the space a file occupies on disk, which for sparse files is less than its size. It is only
+// filled in by scans run with --record-allocation.
+const addAllocatedSizeColumnQuery = `ALTER TABLE file_hashes ADD COLUMN IF NOT EXISTS allocated_size BIGINT`
+
+// file_extents holds the data extents of sparse files scanned with --extent-map; everything between them is a hole.
+const createFileExtentsTableQuery = `
+CREATE TABLE IF NOT EXISTS file_extents (
+    id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    filepath TEXT NOT NULL,
+    data_offset BIGINT NOT NULL,
+    data_length BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS file_extents_filepath ON file_extents (filepath);
+`
+
+// extent is a range of a file that holds data.
+type extent struct {
+	offset, length int64
+}
+
+// recordAllocation stores the allocated size of the file at path and, with extents set, replaces its recorded
+// extent map, reading the file through tree. Only sparse files get an extent map; a fully allocated file is one extent
+// and is left out.
+func recordAllocation(db *sql.DB, tree treeReader, path, storedPath string, info os.FileInfo, extents bool) error {
+	allocated, ok := allocatedBytes(info)
+	if !ok {
+		return nil
+	}
+	if !extents {
+		_, err := db.Exec("UPDATE file_hashes SET allocated_size = $2 WHERE filepath = $1", storedPath, allocated)
+		return err
+	}
+
+	var dataExtents []extent
+	if allocated < info.Size() {
+		file, err := tree.open(path)
+		if err != nil {
+			return err
+		}
+		dataExtents, err = findDataExtents(file, info.Size())
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE file_hashes SET allocated_size = $2 WHERE filepath = $1", storedPath, allocated); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM file_extents WHERE filepath = $1", storedPath); err != nil {
+		return err
+	}
+	for _, e := range dataExtents {
+		if _, err := tx.Exec("INSERT INTO file_extents (filepath, data_offset, data_length) VALUES ($1, $2, $3)", storedPath, e.offset, e.length); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// sparseReader reads a file through its data extents, producing the zeros of holes without reading them from disk.
+// It yields the same bytes as reading the file start to end, so hashes are unaffected.
+type sparseReader struct {
+	file    *os.File
+	extents []extent
+	size    int64
+	pos     int64
+}
+
+func (r *sparseReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	for len(r.extents) > 0 && r.pos >= r.extents[0].offset+r.extents[0].length {
+		r.extents = r.extents[1:]
+	}
+
+	holeEnd := r.size
+	if len(r.extents) > 0 {
+		e := r.extents[0]
+		if r.pos >= e.offset {
+			end := min(e.offset+e.length, r.size)
+			n, err := r.file.ReadAt(p[:min(int64(len(p)), end-r.pos)], r.pos)
+			r.pos += int64(n)
+			if err == io.EOF && r.pos < r.size {
+				// The file shrank since its extents were mapped.
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+		holeEnd = e.offset
+	}
+	n := int(min(int64(len(p)), holeEnd-r.pos))
+	clear(p[:n])
+	r.pos += int64(n)
+	return n, nil
+}
+
+// skipHoles returns a reader over file that skips reading its holes if it is sparse, or file itself otherwise.
+func skipHoles(file *os.File, size int64) io.Reader {
+	info, err := file.Stat()
+	if err != nil {
+		return file
+	}
+	if allocated, ok := allocatedBytes(info); !ok || allocated >= size {
+		return file
+	}
+	extents, err := findDataExtents(file, size)
+	if err != nil {
+		return file
+	}
+	return &sparseReader{file: file, extents: extents, size: size}
+}
@@ -0,0 +1,7 @@
+package main
+
+// macOS numbers SEEK_HOLE and SEEK_DATA the other way round from Linux and FreeBSD.
+const (
+	seekHole = 3
+	seekData = 4
+)
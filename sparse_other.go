@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func allocatedBytes(info os.FileInfo) (int64, bool) {
+	return 0, false
+}
+
+func findDataExtents(file *os.File, size int64) ([]extent, error) {
+	return nil, errors.New("extent maps are not supported on this platform")
+}
@@ -0,0 +1,8 @@
+//go:build linux || freebsd
+
+package main
+
+const (
+	seekData = 3
+	seekHole = 4
+)
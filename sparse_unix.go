@@ -0,0 +1,46 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// allocatedBytes returns the space the file occupies on disk, from its count of 512-byte blocks.
+func allocatedBytes(info os.FileInfo) (int64, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int64(st.Blocks) * 512, true
+}
+
+// findDataExtents maps the data extents of the first size bytes of file with SEEK_DATA and SEEK_HOLE. Filesystems
+// without hole tracking report the whole file as one extent.
+func findDataExtents(file *os.File, size int64) ([]extent, error) {
+	defer file.Seek(0, io.SeekStart)
+	var extents []extent
+	for offset := int64(0); offset < size; {
+		data, err := file.Seek(offset, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			// No data after offset: the rest of the file is a hole.
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		hole, err := file.Seek(data, seekHole)
+		if err != nil {
+			return nil, err
+		}
+		hole = min(hole, size)
+		if hole > data {
+			extents = append(extents, extent{offset: data, length: hole - data})
+		}
+		offset = hole
+	}
+	return extents, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+
+	_ "modernc.org/sqlite"
+)
+
+// Rough per-entry overhead of a map[string]string entry beyond the string bytes themselves: two string headers,
+// bucket slot and load-factor slack.
+const mapEntryOverhead = 64
+
+// spillFile is a throwaway SQLite database used once an in-memory structure outgrows --memory-limit. Durability is
+// switched off since the file is deleted at the end of the run anyway.
+type spillFile struct {
+	path string
+	db   *sql.DB
+}
+
+func newSpillFile(dir, schema string) (*spillFile, error) {
+	file, err := os.CreateTemp(dir, "fileindexer-spill-*.db")
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	db, err := sql.Open("sqlite", file.Name())
+	if err != nil {
+		os.Remove(file.Name())
+		return nil, err
+	}
+	// One connection: the pragmas are per-connection, and callers serialize access anyway.
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{"PRAGMA journal_mode = OFF", "PRAGMA synchronous = OFF", schema} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			os.Remove(file.Name())
+			return nil, err
+		}
+	}
+	return &spillFile{path: file.Name(), db: db}, nil
+}
+
+func (f *spillFile) Close() error {
+	f.db.Close()
+	return os.Remove(f.path)
+}
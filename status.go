@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statusEvent is one line of the --status-stream NDJSON output. Fields irrelevant to an event are omitted.
+type statusEvent struct {
+	Event          string         `json:"event"`
+	Time           string         `json:"time"`
+	Directory      string         `json:"directory,omitempty"`
+	Path           string         `json:"path,omitempty"`
+	Hash           string         `json:"hash,omitempty"`
+	Size           *int64         `json:"size,omitempty"`
+	Status         string         `json:"status,omitempty"`
+	Error          string         `json:"error,omitempty"`
+	Files          *int           `json:"files,omitempty"`
+	Errors         *int           `json:"errors,omitempty"`
+	Statuses       map[string]int `json:"statuses,omitempty"`
+	ElapsedSeconds *float64       `json:"elapsed_seconds,omitempty"`
+}
+
+// statusStream writes machine-readable progress events, one JSON object per line, to a file descriptor chosen by
+// the caller (e.g. 3, with the wrapper holding the other end of a pipe) so nothing has to parse the human log.
+type statusStream struct {
+	mu       sync.Mutex
+	encoder  *json.Encoder
+	start    time.Time
+	files    int
+	errors   int
+	statuses map[string]int
+}
+
+func newStatusStream(fd int) *statusStream {
+	return &statusStream{
+		encoder:  json.NewEncoder(os.NewFile(uintptr(fd), "status-stream")),
+		start:    time.Now(),
+		statuses: make(map[string]int),
+	}
+}
+
+func (s *statusStream) emit(event statusEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	event.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	// A closed or broken stream must never stop the scan, so encoding errors are ignored.
+	s.encoder.Encode(event)
+}
+
+func (s *statusStream) scanStart(directory string) {
+	s.emit(statusEvent{Event: "scan-start", Directory: directory})
+}
+
+// result turns one results row into a file-done or error event.
+func (s *statusStream) result(row []string) {
+	path, hash, status := row[0], row[1], row[3]
+	size, _ := strconv.ParseInt(row[2], 10, 64)
+
+	s.mu.Lock()
+	s.files++
+	isError := strings.HasPrefix(status, "error:")
+	if isError {
+		s.errors++
+		s.statuses["error"]++
+	} else {
+		s.statuses[status]++
+	}
+	s.mu.Unlock()
+
+	if isError {
+		s.emit(statusEvent{Event: "error", Path: path, Error: strings.TrimSpace(strings.TrimPrefix(status, "error:"))})
+		return
+	}
+	s.emit(statusEvent{Event: "file-done", Path: path, Hash: hash, Size: &size, Status: status})
+}
+
+func (s *statusStream) summary() {
+	s.mu.Lock()
+	files, errors := s.files, s.errors
+	statuses := make(map[string]int, len(s.statuses))
+	for status, count := range s.statuses {
+		statuses[status] = count
+	}
+	s.mu.Unlock()
+
+	elapsed := time.Since(s.start).Seconds()
+	s.emit(statusEvent{Event: "summary", Files: &files, Errors: &errors, Statuses: statuses, ElapsedSeconds: &elapsed})
+}
+
+// statusSink passes every results row on to the wrapped sink and reports it on the status stream.
+type statusSink struct {
+	resultSink
+	stream *statusStream
+}
+
+func (s *statusSink) Write(slot int, row []string) error {
+	s.stream.result(row)
+	return s.resultSink.Write(slot, row)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// baseStatuses are the statuses a scan gives a file on its own; every results row starts with one of them (or with
+// "error:"). A status policy can match them with status: but not define them.
+var baseStatuses = append([]string{"new", "changed", "existing", "forced", "rehashed", "verified", "corrupt", "missing", "moved"}, replicaStatuses...)
+
+// builtinFlags are the suffixes the optional checks add to a status, as +name. A status policy can match them with
+// flag: but not define them.
+var builtinFlags = []string{"type-mismatch", "pii", "atime-changed"}
+
+var statusNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// statusRule gives files matching all of its conditions the custom status name, added to their status as +name.
+type statusRule struct {
+	name       string
+	conditions []statusCondition
+}
+
+// statusCondition is one condition of a statusRule, as kind:value.
+type statusCondition struct {
+	kind, value string
+	size        int64 // for min-size and max-size
+}
+
+// loadStatusPolicy reads a --status-policy file. Each line names a custom status followed by the conditions a file
+// must all meet to get it:
+//
+//	# status    conditions
+//	quarantined under:/incoming/
+//	pii-flagged flag:pii
+//	suspicious  flag:type-mismatch name:*.pdf
+//	huge        status:new min-size:10GiB
+//
+// Conditions are under:<stored path prefix>, name:<file name glob>, status:<base status>, flag:<suffix> (a built-in
+// flag, or a custom status defined on an earlier line), min-size:<size> and max-size:<size>. Several lines may give
+// the same status. Names that aren't statuses or flags the scan knows are errors, so a typo can't silently match
+// nothing.
+func loadStatusPolicy(path string) ([]statusRule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	known := make(map[string]bool)
+	for _, flag := range builtinFlags {
+		known[flag] = true
+	}
+	var rules []statusRule
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		rule, err := parseStatusRule(fields, known)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNumber, err)
+		}
+		known[rule.name] = true
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func parseStatusRule(fields []string, known map[string]bool) (statusRule, error) {
+	rule := statusRule{name: fields[0]}
+	switch {
+	case !statusNamePattern.MatchString(rule.name):
+		return rule, fmt.Errorf("invalid status %q, expected lowercase letters, digits and dashes", rule.name)
+	case isBaseStatus(rule.name) || rule.name == "error" || slices.Contains(builtinFlags, rule.name):
+		return rule, fmt.Errorf("%q is a built-in status and can't be assigned by a policy", rule.name)
+	case len(fields) == 1:
+		return rule, fmt.Errorf("status %q has no conditions", rule.name)
+	}
+
+	for _, field := range fields[1:] {
+		kind, value, ok := strings.Cut(field, ":")
+		if !ok || value == "" {
+			return rule, fmt.Errorf("invalid condition %q, expected kind:value", field)
+		}
+		condition := statusCondition{kind: kind, value: value}
+		switch kind {
+		case "under":
+		case "name":
+			if _, err := filepath.Match(value, ""); err != nil {
+				return rule, fmt.Errorf("invalid name pattern %q: %v", value, err)
+			}
+		case "status":
+			if !isBaseStatus(value) {
+				return rule, fmt.Errorf("unknown status %q, expected one of %v", value, baseStatuses)
+			}
+		case "flag":
+			if !known[value] {
+				return rule, fmt.Errorf("unknown flag %q, expected a built-in flag %v or a status defined above", value, builtinFlags)
+			}
+		case "min-size", "max-size":
+			var err error
+			if condition.size, err = parseByteSize(value); err != nil {
+				return rule, fmt.Errorf("invalid %s: %v", kind, err)
+			}
+		default:
+			return rule, fmt.Errorf("unknown condition %q", kind)
+		}
+		rule.conditions = append(rule.conditions, condition)
+	}
+	return rule, nil
+}
+
+func isBaseStatus(status string) bool {
+	return slices.Contains(baseStatuses, status)
+}
+
+// applyStatusPolicy returns the suffixes of the custom statuses a file gets from rules, given its stored path, size
+// and status so far. Each status is added once, however many of its rules match, and later rules see the statuses
+// added by earlier ones.
+func applyStatusPolicy(rules []statusRule, storedPath string, size int64, status string) string {
+	var suffix string
+	for _, rule := range rules {
+		current := strings.Split(status+suffix, "+")
+		if slices.Contains(current[1:], rule.name) || !rule.matches(storedPath, size, current) {
+			continue
+		}
+		suffix += "+" + rule.name
+	}
+	return suffix
+}
+
+// matches reports whether a file meets every condition of the rule. status is the file's status split at "+", the
+// base status first.
+func (r statusRule) matches(storedPath string, size int64, status []string) bool {
+	for _, c := range r.conditions {
+		var ok bool
+		switch c.kind {
+		case "under":
+			ok = strings.HasPrefix(storedPath, c.value)
+		case "name":
+			ok, _ = filepath.Match(c.value, filepath.Base(storedPath))
+		case "status":
+			ok = status[0] == c.value
+		case "flag":
+			ok = slices.Contains(status[1:], c.value)
+		case "min-size":
+			ok = size >= c.size
+		case "max-size":
+			ok = size <= c.size
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
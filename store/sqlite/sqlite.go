@@ -0,0 +1,102 @@
+// Package sqlite is a store.Store kept in a local SQLite file, for indexing on a machine without a PostgreSQL server.
+// Its tables mirror file_hashes and file_history, so the same queries mostly work against either.
+//
+// SQLite has no time zone support of its own, so Put converts both timestamps of a record to UTC before writing them.
+// Only file_timestamp differs from PostgreSQL, where file_hashes keeps it in the scanning machine's local time.
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+	"net/url"
+
+	"fileindexer/store"
+
+	_ "modernc.org/sqlite"
+)
+
+func init() {
+	store.RegisterStore("sqlite", Open)
+}
+
+const schema = `
+CREATE TABLE IF NOT EXISTS file_hashes (
+    filepath TEXT PRIMARY KEY,
+    hash TEXT NOT NULL,
+    size INTEGER NOT NULL,
+    file_timestamp TIMESTAMP NOT NULL,
+    hash_calculated_timestamp TIMESTAMP NOT NULL,
+    hash_algorithm TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS file_hashes_hash ON file_hashes (hash);
+CREATE TABLE IF NOT EXISTS file_history (
+    filepath TEXT NOT NULL,
+    hash TEXT NOT NULL,
+    size INTEGER NOT NULL,
+    file_timestamp TIMESTAMP NOT NULL,
+    recorded_timestamp TIMESTAMP NOT NULL,
+    hash_algorithm TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS file_history_filepath ON file_history (filepath, recorded_timestamp);`
+
+// sqliteStore is an SQLite database file.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// Open opens the SQLite database at dsn, a file path, creating it and the tables if needed.
+func Open(dsn string) (store.Store, error) {
+	// WAL journaling lets lookups proceed during a write, and with synchronous=NORMAL a commit only waits for the
+	// disk at checkpoints. A power cut can then lose the last few records, which the next scan hashes again.
+	db, err := sql.Open("sqlite", dsn+"?"+url.Values{"_pragma": {"journal_mode(WAL)", "synchronous(NORMAL)", "busy_timeout(10000)"}}.Encode())
+	if err != nil {
+		return nil, err
+	}
+	// SQLite takes one writer at a time anyway; a single connection queues the scan workers here instead of having
+	// them fail with SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) Lookup(path string) (store.Record, error) {
+	record := store.Record{Path: path}
+	err := s.db.QueryRow("SELECT hash, hash_algorithm, size, file_timestamp, hash_calculated_timestamp FROM file_hashes WHERE filepath = ?", path).
+		Scan(&record.Hash, &record.Algorithm, &record.Size, &record.Modified, &record.Recorded)
+	if errors.Is(err, sql.ErrNoRows) {
+		return record, store.ErrNotFound
+	}
+	return record, err
+}
+
+func (s *sqliteStore) Put(record store.Record) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	modified, recorded := record.Modified.UTC(), record.Recorded.UTC()
+	if _, err := tx.Exec("INSERT INTO file_history (filepath, hash, size, file_timestamp, recorded_timestamp, hash_algorithm) VALUES (?, ?, ?, ?, ?, ?)",
+		record.Path, record.Hash, record.Size, modified, recorded, record.Algorithm); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+INSERT INTO file_hashes (filepath, hash, size, file_timestamp, hash_calculated_timestamp, hash_algorithm) VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (filepath) DO UPDATE SET hash = excluded.hash, size = excluded.size, file_timestamp = excluded.file_timestamp,
+    hash_calculated_timestamp = excluded.hash_calculated_timestamp, hash_algorithm = excluded.hash_algorithm`,
+		record.Path, record.Hash, record.Size, modified, recorded, record.Algorithm); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Ping() error {
+	return s.db.Ping()
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
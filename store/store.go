@@ -0,0 +1,90 @@
+// Package store lets other modules provide the backend fileindexer keeps its file records in, in place of the
+// file_hashes table in PostgreSQL.
+//
+// A backend registers a factory from its package's init function, the way database/sql drivers do:
+//
+//	func init() {
+//		store.RegisterStore("clickhouse", func(dsn string) (store.Store, error) { ... })
+//	}
+//
+// and is linked into fileindexer by a blank import in a file of its own next to main.go. Scans then select it with
+// --store clickhouse --store-dsn <dsn>. The storetest package checks an implementation against the behaviour the scan
+// relies on.
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned by Lookup for a path with no record.
+var ErrNotFound = errors.New("store: no record for path")
+
+// Record is what is kept for each indexed file. Path is the stored path, after any --prefix and --map rewrites.
+type Record struct {
+	Path      string
+	Hash      string
+	Algorithm string // the --hash-algo Hash was computed with, e.g. "sha256"
+	Size      int64
+	Modified  time.Time // the file's mtime when it was hashed
+	Recorded  time.Time // when the hash was computed
+}
+
+// Store holds the index's file records. Its methods are called from every scan worker at once, so they must be safe
+// for concurrent use.
+type Store interface {
+	// Lookup returns the record for path, or ErrNotFound. Paths are compared exactly, byte for byte.
+	Lookup(path string) (Record, error)
+	// Put stores record, replacing any record for the same path. Backends that keep history may keep the old one.
+	Put(record Record) error
+	// Ping reports whether the backend is reachable. While it fails, the scan pauses instead of failing files.
+	Ping() error
+	Close() error
+}
+
+// Factory opens a Store from a backend-specific data source name.
+type Factory func(dsn string) (Store, error)
+
+var (
+	mu        sync.Mutex
+	factories = make(map[string]Factory)
+)
+
+// RegisterStore makes a backend available under name. It panics if factory is nil or name is already registered.
+func RegisterStore(name string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	if factory == nil {
+		panic("store: RegisterStore factory is nil")
+	}
+	if _, dup := factories[name]; dup {
+		panic("store: RegisterStore called twice for " + name)
+	}
+	factories[name] = factory
+}
+
+// Open opens the backend registered under name.
+func Open(name, dsn string) (Store, error) {
+	mu.Lock()
+	factory, ok := factories[name]
+	mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown store %q (registered: %v)", name, Names())
+	}
+	return factory(dsn)
+}
+
+// Names returns the registered backends, sorted.
+func Names() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
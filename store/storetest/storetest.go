@@ -0,0 +1,184 @@
+// Package storetest checks a store.Store implementation against the behaviour fileindexer relies on. Call Run from a
+// test in the backend's own module:
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) store.Store {
+//			s, err := Open(testDSN(t)) // an empty store, e.g. a fresh database or table
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			return s
+//		})
+//	}
+package storetest
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"fileindexer/store"
+)
+
+// Run runs the conformance checks as subtests. open must return an empty store each time it is called; Run closes it.
+func Run(t *testing.T, open func(t *testing.T) store.Store) {
+	checks := []struct {
+		name  string
+		check func(t *testing.T, s store.Store)
+	}{
+		{"Ping", testPing},
+		{"LookupMissing", testLookupMissing},
+		{"PutLookup", testPutLookup},
+		{"PutReplaces", testPutReplaces},
+		{"ExactPaths", testExactPaths},
+		{"Sizes", testSizes},
+		{"Concurrent", testConcurrent},
+	}
+	for _, c := range checks {
+		t.Run(c.name, func(t *testing.T) {
+			s := open(t)
+			defer func() {
+				if err := s.Close(); err != nil {
+					t.Errorf("Close: %v", err)
+				}
+			}()
+			c.check(t, s)
+		})
+	}
+}
+
+// Timestamps are compared to the second, the resolution of the coarsest backends; fileindexer compares
+// modification times no more finely.
+func record(path, hash string, size int64) store.Record {
+	modified := time.Date(2024, 2, 29, 23, 59, 58, 0, time.UTC)
+	return store.Record{Path: path, Hash: hash, Algorithm: "sha256", Size: size, Modified: modified, Recorded: modified.Add(time.Hour)}
+}
+
+func put(t *testing.T, s store.Store, r store.Record) {
+	t.Helper()
+	if err := s.Put(r); err != nil {
+		t.Fatalf("Put(%q): %v", r.Path, err)
+	}
+}
+
+func lookup(t *testing.T, s store.Store, path string) store.Record {
+	t.Helper()
+	r, err := s.Lookup(path)
+	if err != nil {
+		t.Fatalf("Lookup(%q): %v", path, err)
+	}
+	return r
+}
+
+func expect(t *testing.T, got, want store.Record) {
+	t.Helper()
+	if got.Path != want.Path || got.Hash != want.Hash || got.Algorithm != want.Algorithm || got.Size != want.Size {
+		t.Errorf("got record %q %s:%q %d, want %q %s:%q %d", got.Path, got.Algorithm, got.Hash, got.Size, want.Path, want.Algorithm, want.Hash, want.Size)
+	}
+	if !got.Modified.Truncate(time.Second).Equal(want.Modified.Truncate(time.Second)) {
+		t.Errorf("%q: got Modified %v, want %v", want.Path, got.Modified, want.Modified)
+	}
+	if !got.Recorded.Truncate(time.Second).Equal(want.Recorded.Truncate(time.Second)) {
+		t.Errorf("%q: got Recorded %v, want %v", want.Path, got.Recorded, want.Recorded)
+	}
+}
+
+func testPing(t *testing.T, s store.Store) {
+	if err := s.Ping(); err != nil {
+		t.Errorf("Ping: %v", err)
+	}
+}
+
+func testLookupMissing(t *testing.T, s store.Store) {
+	if _, err := s.Lookup("/no/such/file"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("Lookup of a missing path returned %v, want store.ErrNotFound", err)
+	}
+}
+
+func testPutLookup(t *testing.T, s store.Store) {
+	want := record("/data/a.txt", "0cc175b9c0f1b6a831c399e269772661", 1)
+	put(t, s, want)
+	expect(t, lookup(t, s, want.Path), want)
+}
+
+func testPutReplaces(t *testing.T, s store.Store) {
+	first := record("/data/a.txt", "0cc175b9c0f1b6a831c399e269772661", 1)
+	put(t, s, first)
+	second := record(first.Path, "187ef4436122d1cc2f40dc2b92f0eba0", 2)
+	second.Algorithm = "md5"
+	second.Modified = second.Modified.Add(time.Minute)
+	second.Recorded = second.Recorded.Add(time.Minute)
+	put(t, s, second)
+	expect(t, lookup(t, s, first.Path), second)
+}
+
+// testExactPaths stores paths that a backend comparing loosely (by case, trimmed, as a LIKE pattern, or normalizing
+// Unicode) would confuse with each other.
+func testExactPaths(t *testing.T, s store.Store) {
+	paths := []string{
+		"/data/Report.txt",
+		"/data/report.txt",
+		"/data/report.txt ",
+		"/data/report_txt",
+		"/data/100%.txt",
+		"/data/caf\u00e9",
+		"/data/cafe\u0301",
+		"/data/line\nbreak",
+		"/data/tab\tand 'quote\"",
+	}
+	for i, path := range paths {
+		put(t, s, record(path, fmt.Sprintf("%032x", i), int64(i)))
+	}
+	for i, path := range paths {
+		expect(t, lookup(t, s, path), record(path, fmt.Sprintf("%032x", i), int64(i)))
+	}
+	if _, err := s.Lookup("/data/report%"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("Lookup(%q) returned %v, want store.ErrNotFound", "/data/report%", err)
+	}
+}
+
+func testSizes(t *testing.T, s store.Store) {
+	for _, size := range []int64{0, 1 << 40, math.MaxInt64} {
+		want := record(fmt.Sprintf("/data/size-%d", size), "d41d8cd98f00b204e9800998ecf8427e", size)
+		put(t, s, want)
+		expect(t, lookup(t, s, want.Path), want)
+	}
+}
+
+// testConcurrent puts and looks up from several goroutines at once, as scan workers do.
+func testConcurrent(t *testing.T, s store.Store) {
+	const workers, perWorker = 8, 25
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				r := record(fmt.Sprintf("/data/worker-%d/%d", w, i), fmt.Sprintf("%032x", i), int64(i))
+				if err := s.Put(r); err != nil {
+					errs <- fmt.Errorf("Put(%q): %v", r.Path, err)
+					return
+				}
+				if _, err := s.Lookup(r.Path); err != nil {
+					errs <- fmt.Errorf("Lookup(%q) right after Put: %v", r.Path, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	for w := 0; w < workers; w++ {
+		for i := 0; i < perWorker; i++ {
+			path := fmt.Sprintf("/data/worker-%d/%d", w, i)
+			expect(t, lookup(t, s, path), record(path, fmt.Sprintf("%032x", i), int64(i)))
+		}
+	}
+}
@@ -0,0 +1,4 @@
+package main
+
+// Links in the ClickHouse backend for --store clickhouse.
+import _ "fileindexer/store/clickhouse"
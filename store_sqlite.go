@@ -0,0 +1,4 @@
+package main
+
+// Links in the SQLite backend for --db-driver sqlite and --store sqlite.
+import _ "fileindexer/store/sqlite"
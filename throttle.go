@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateFileInterval is how often a scan rereads its --max-read-mbps-file.
+const rateFileInterval = time.Second
+
+// throttle limits the rate at which every worker together reads file contents with --max-read-mbps or
+// --max-read-mbps-file, or is nil.
+var throttle *readThrottle
+
+// readThrottle spreads reads out to a number of bytes per second. Time not spent reading isn't saved up, so a pause
+// in the scan doesn't turn into a burst afterwards.
+type readThrottle struct {
+	mu             sync.Mutex
+	bytesPerSecond float64
+	next           time.Time // when the reads made so far have been paid for
+}
+
+func newReadThrottle(megabytesPerSecond float64) *readThrottle {
+	return &readThrottle{bytesPerSecond: megabytesPerSecond * 1e6}
+}
+
+// setRate changes the limit for the reads from now on.
+func (t *readThrottle) setRate(megabytesPerSecond float64) {
+	t.mu.Lock()
+	t.bytesPerSecond = megabytesPerSecond * 1e6
+	t.mu.Unlock()
+}
+
+// follow rereads the rate in path every rateFileInterval for as long as the scan runs, so it can be changed from
+// outside. While the file can't be read, the last rate stays.
+func (t *readThrottle) follow(path string) {
+	go func() {
+		for range time.Tick(rateFileInterval) {
+			if rate, err := readRateFile(path); err == nil {
+				t.setRate(rate)
+			}
+		}
+	}()
+}
+
+// readRateFile returns the megabytes per second in a --max-read-mbps-file, a single positive number.
+func readRateFile(path string) (float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	rate, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+	if err != nil || rate <= 0 {
+		return 0, fmt.Errorf("%s: invalid rate %q, expected megabytes per second", path, strings.TrimSpace(string(data)))
+	}
+	return rate, nil
+}
+
+// writeRateFile replaces the rate in path, through a rename so that a scan never reads half of it.
+func writeRateFile(path string, megabytesPerSecond float64) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(temp, "%g\n", megabytesPerSecond)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+	}
+	return err
+}
+
+// wait blocks until n more bytes may have been read.
+func (t *readThrottle) wait(n int) {
+	t.mu.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	t.next = t.next.Add(time.Duration(float64(n) / t.bytesPerSecond * float64(time.Second)))
+	delay := t.next.Sub(now)
+	t.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// throttledReader passes reads through throttle, after they are made, since only then is their size known.
+type throttledReader struct {
+	reader io.Reader
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		throttle.wait(n)
+	}
+	return n, err
+}
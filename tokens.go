@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Each row of api_tokens is a bearer token serve --require-token accepts. Only the SHA-256 of the token is stored, so
+// a copy of the database doesn't hand out access. namespace is the stored path prefix the token is confined to, ending
+// in a slash, or empty for the whole index.
+const createAPITokensTableQuery = `
+CREATE TABLE IF NOT EXISTS api_tokens (
+    name TEXT PRIMARY KEY,
+    token_hash TEXT NOT NULL UNIQUE,
+    role TEXT NOT NULL,
+    namespace TEXT NOT NULL DEFAULT '',
+    created_timestamp TIMESTAMP NOT NULL,
+    revoked_timestamp TIMESTAMP
+);
+`
+
+// apiRoles are the roles a token can have, each allowed everything the ones before it are: read-only tokens can look
+// up the index, scan-trigger tokens can also start scans, and admin tokens can also manage tokens.
+var apiRoles = []string{"read-only", "scan-trigger", "admin"}
+
+// apiToken is an unrevoked row of api_tokens.
+type apiToken struct {
+	Name      string `json:"name"`
+	Role      string `json:"role"`
+	Namespace string `json:"namespace"`
+}
+
+// allows reports whether the token's role includes role.
+func (t apiToken) allows(role string) bool {
+	return slices.Index(apiRoles, t.Role) >= slices.Index(apiRoles, role)
+}
+
+// covers reports whether path, a stored path or prefix, is inside the token's namespace.
+func (t apiToken) covers(path string) bool {
+	return strings.HasPrefix(path, t.Namespace)
+}
+
+// scopePrefix narrows prefix, a stored path prefix a request asked for ("" for all), to the token's namespace. It
+// reports false if the two don't overlap.
+func (t apiToken) scopePrefix(prefix string) (string, bool) {
+	switch {
+	case strings.HasPrefix(prefix, t.Namespace):
+		return prefix, true
+	case strings.HasPrefix(t.Namespace, prefix):
+		return t.Namespace, true
+	}
+	return "", false
+}
+
+// namespacePrefix turns a --namespace value into the stored path prefix kept in api_tokens, ending in a slash so that
+// a sibling whose name merely starts the same isn't included.
+func namespacePrefix(namespace string) string {
+	if namespace == "" {
+		return ""
+	}
+	return strings.TrimSuffix(namespace, "/") + "/"
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createAPIToken records a new token and returns it. This is the only time the token itself is available.
+func createAPIToken(ctx context.Context, db *sql.DB, name, role, namespace string) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	token := "fi_" + hex.EncodeToString(secret)
+	_, err := db.ExecContext(ctx, "INSERT INTO api_tokens (name, token_hash, role, namespace, created_timestamp) VALUES ($1, $2, $3, $4, $5)",
+		name, hashAPIToken(token), role, namespace, time.Now().UTC())
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// revokeAPIToken revokes the token called name, and reports whether there was an unrevoked one.
+func revokeAPIToken(ctx context.Context, db *sql.DB, name string) (bool, error) {
+	result, err := db.ExecContext(ctx, "UPDATE api_tokens SET revoked_timestamp = $2 WHERE name = $1 AND revoked_timestamp IS NULL", name, time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+	revoked, err := result.RowsAffected()
+	return revoked > 0, err
+}
+
+// lookupAPIToken returns the unrevoked token whose secret is token, or sql.ErrNoRows. Tokens are looked up on every
+// request, so a revocation takes effect at once.
+func lookupAPIToken(ctx context.Context, db *sql.DB, token string) (apiToken, error) {
+	var t apiToken
+	err := db.QueryRowContext(ctx, "SELECT name, role, namespace FROM api_tokens WHERE token_hash = $1 AND revoked_timestamp IS NULL",
+		hashAPIToken(token)).Scan(&t.Name, &t.Role, &t.Namespace)
+	return t, err
+}
+
+// apiAuth checks the bearer tokens of API requests when tokens are required. Without them every request acts as an
+// admin token over the whole index, as the API did before tokens existed. Requests are limited by limiter per client
+// address, and per token too when tokens are required, unless it is nil.
+type apiAuth struct {
+	db       *sql.DB
+	required bool
+	limiter  *rateLimiter
+}
+
+type apiTokenKey struct{}
+
+// requestToken returns the token a request was authorized with.
+func requestToken(r *http.Request) apiToken {
+	return contextToken(r.Context())
+}
+
+// contextToken returns the token of the request whose context ctx is.
+func contextToken(ctx context.Context) apiToken {
+	return ctx.Value(apiTokenKey{}).(apiToken)
+}
+
+// authorize wraps handler so that it only runs for requests whose token includes role.
+func (a *apiAuth) authorize(role string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The address is limited before the token is looked up, so a flood of invalid tokens is throttled too rather
+		// than costing a query each.
+		address, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if !a.allow(w, "address "+address) {
+			return
+		}
+		token := apiToken{Role: "admin"}
+		if a.required {
+			secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || secret == "" {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "missing API token", http.StatusUnauthorized)
+				return
+			}
+			var err error
+			token, err = lookupAPIToken(r.Context(), a.db, secret)
+			if err == sql.ErrNoRows {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, "invalid or revoked API token", http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				log.Printf("Failed to look up API token: %v", err)
+				http.Error(w, "token lookup failed", http.StatusInternalServerError)
+				return
+			}
+		}
+		// A token used from several addresses still gets only its own share.
+		if a.required && !a.allow(w, "token "+token.Name) {
+			return
+		}
+		if !token.allows(role) {
+			http.Error(w, fmt.Sprintf("token %s has role %s, this needs %s", token.Name, token.Role, role), http.StatusForbidden)
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), apiTokenKey{}, token)))
+	}
+}
+
+// allow takes a request of client from the limiter, answering it with 429 and reporting false if there was none left.
+func (a *apiAuth) allow(w http.ResponseWriter, client string) bool {
+	if a.limiter == nil {
+		return true
+	}
+	ok, wait := a.limiter.allow(client)
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+	}
+	return ok
+}
+
+// handleTokens adds the admin endpoints managing tokens to mux. An admin token confined to a namespace only sees and
+// manages tokens confined to that namespace or one inside it.
+func handleTokens(mux *http.ServeMux, db *sql.DB, auth *apiAuth) {
+	mux.HandleFunc("GET /tokens", auth.authorize("admin", func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.QueryContext(r.Context(), "SELECT name, role, namespace FROM api_tokens WHERE revoked_timestamp IS NULL AND namespace LIKE $1 ORDER BY name",
+			likePrefix(requestToken(r).Namespace))
+		if err != nil {
+			log.Printf("Failed to list API tokens: %v", err)
+			http.Error(w, "listing tokens failed", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		tokens := []apiToken{}
+		for rows.Next() {
+			var t apiToken
+			if err := rows.Scan(&t.Name, &t.Role, &t.Namespace); err != nil {
+				log.Printf("Failed to list API tokens: %v", err)
+				http.Error(w, "listing tokens failed", http.StatusInternalServerError)
+				return
+			}
+			tokens = append(tokens, t)
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Failed to list API tokens: %v", err)
+			http.Error(w, "listing tokens failed", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, tokens)
+	}))
+	mux.HandleFunc("POST /tokens", auth.authorize("admin", func(w http.ResponseWriter, r *http.Request) {
+		var req apiToken
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Namespace = namespacePrefix(req.Namespace)
+		switch {
+		case req.Name == "":
+			http.Error(w, "missing name", http.StatusBadRequest)
+			return
+		case !slices.Contains(apiRoles, req.Role):
+			http.Error(w, fmt.Sprintf("invalid role %q, expected one of %v", req.Role, apiRoles), http.StatusBadRequest)
+			return
+		case !requestToken(r).covers(req.Namespace):
+			http.Error(w, "the namespace is outside the token's own", http.StatusForbidden)
+			return
+		}
+		token, err := createAPIToken(r.Context(), db, req.Name, req.Role, req.Namespace)
+		if err != nil {
+			// Most likely the name is taken; the database's message says so.
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Print(msg("TokenCreated", map[string]any{"Name": req.Name, "Role": req.Role}))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{"name": req.Name, "role": req.Role, "namespace": req.Namespace, "token": token})
+	}))
+	mux.HandleFunc("DELETE /tokens/{name}", auth.authorize("admin", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		var namespace string
+		err := db.QueryRowContext(r.Context(), "SELECT namespace FROM api_tokens WHERE name = $1 AND revoked_timestamp IS NULL", name).Scan(&namespace)
+		if err == sql.ErrNoRows || err == nil && !requestToken(r).covers(namespace) {
+			http.NotFound(w, r)
+			return
+		}
+		if err == nil {
+			_, err = revokeAPIToken(r.Context(), db, name)
+		}
+		if err != nil {
+			log.Printf("Failed to revoke API token %s: %v", name, err)
+			http.Error(w, "revoking the token failed", http.StatusInternalServerError)
+			return
+		}
+		log.Print(msg("TokenRevoked", map[string]any{"Name": name}))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+// runToken manages the API tokens serve --require-token accepts: token create prints a new token, token list shows
+// them all (never the tokens themselves) and token revoke disables one.
+func runToken(args []string) {
+	fs := flag.NewFlagSet("token", flag.ContinueOnError)
+	var dbCfg DBConfig
+	registerDBFlags(fs, &dbCfg)
+	name := fs.String("name", "", "Name of the token, e.g. the service or person using it. Required for create and revoke.")
+	role := fs.String("role", "read-only", fmt.Sprintf("Role of the created token, one of %v: read-only looks up the index, scan-trigger also starts and cancels scans, admin also manages tokens over the API.", apiRoles))
+	namespace := fs.String("namespace", "", "Confine the created token to stored paths under this prefix, e.g. /mnt/projects/acme. By default it covers the whole index.")
+	fs.Usage = commandUsage(fs, "TokenUsage")
+
+	var action string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		action, args = args[0], args[1:]
+	}
+	parseArgs(fs, args)
+
+	if action != "create" && action != "list" && action != "revoke" || fs.NArg() != 0 {
+		usageError(fs, "", msg("TokenUsage", nil))
+	}
+	if dbCfg.DbName == "" {
+		usageError(fs, "dbname", msg("MissingFlag", map[string]any{"Flag": "dbname"}))
+	}
+	if action != "list" && *name == "" {
+		usageError(fs, "name", msg("MissingFlag", map[string]any{"Flag": "name"}))
+	}
+	if !slices.Contains(apiRoles, *role) {
+		usageError(fs, "role", fmt.Sprintf("Invalid --role %q, expected one of %v.", *role, apiRoles))
+	}
+
+	db := connectToDatabase(dbCfg)
+	defer db.Close()
+	if _, err := db.Exec(createAPITokensTableQuery); err != nil {
+		log.Fatalf("Failed to create API tokens table: %v", err)
+	}
+	ctx := context.Background()
+
+	switch action {
+	case "create":
+		token, err := createAPIToken(ctx, db, *name, *role, namespacePrefix(*namespace))
+		if err != nil {
+			log.Fatalf("Failed to create token %s: %v", *name, err)
+		}
+		log.Print(msg("TokenCreated", map[string]any{"Name": *name, "Role": *role}))
+		fmt.Println(token)
+	case "revoke":
+		revoked, err := revokeAPIToken(ctx, db, *name)
+		if err != nil {
+			log.Fatalf("Failed to revoke token %s: %v", *name, err)
+		}
+		if !revoked {
+			log.Fatalf("No unrevoked token %s in api_tokens", *name)
+		}
+		log.Print(msg("TokenRevoked", map[string]any{"Name": *name}))
+	case "list":
+		rows, err := db.Query("SELECT name, role, namespace, created_timestamp, revoked_timestamp FROM api_tokens ORDER BY name")
+		if err != nil {
+			log.Fatalf("Failed to list tokens: %v", err)
+		}
+		defer rows.Close()
+		writer := csv.NewWriter(os.Stdout)
+		writer.Write([]string{"name", "role", "namespace", "created", "revoked"})
+		for rows.Next() {
+			var t apiToken
+			var created time.Time
+			var revoked sql.NullTime
+			if err := rows.Scan(&t.Name, &t.Role, &t.Namespace, &created, &revoked); err != nil {
+				log.Fatalf("Failed to list tokens: %v", err)
+			}
+			revokedText := ""
+			if revoked.Valid {
+				revokedText = revoked.Time.Format(time.RFC3339)
+			}
+			writer.Write([]string{t.Name, t.Role, t.Namespace, created.Format(time.RFC3339), revokedText})
+		}
+		if err := rows.Err(); err != nil {
+			log.Fatalf("Failed to list tokens: %v", err)
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			log.Fatalf("Failed to write results: %v", err)
+		}
+	}
+}
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"fileindexer/store"
+)
+
+// flagErrorName pulls the flag name out of the errors flag.FlagSet.Parse returns, e.g.
+// "flag provided but not defined: -dirctory" or `invalid value "2XB" for flag -memory-limit: ...`.
+var flagErrorName = regexp.MustCompile(`(?:defined: |flag |for |argument: )-([^\s:]+)`)
+
+// parseArgs parses args into fs, which must use flag.ContinueOnError. Unlike flag.ExitOnError it doesn't dump the
+// full usage on a mistake: an unknown flag is reported with the closest real one, and a bad value with that flag's
+// help.
+func parseArgs(fs *flag.FlagSet, args []string) {
+	usage, output := fs.Usage, fs.Output()
+	fs.Usage = func() {}
+	fs.SetOutput(io.Discard)
+	err := fs.Parse(args)
+	fs.Usage = usage
+	fs.SetOutput(output)
+
+	if errors.Is(err, flag.ErrHelp) {
+		fs.Usage()
+		os.Exit(0)
+	}
+	if err == nil {
+		return
+	}
+	match := flagErrorName.FindStringSubmatch(err.Error())
+	if match == nil {
+		usageError(fs, "", err.Error())
+	}
+	name := match[1]
+	if fs.Lookup(name) != nil {
+		usageError(fs, name, err.Error())
+	}
+	if suggestion := closestFlag(fs, name); suggestion != "" {
+		usageError(fs, suggestion, msg("UnknownFlagSuggest", map[string]any{"Flag": name, "Suggestion": suggestion}))
+	}
+	usageError(fs, "", msg("UnknownFlag", map[string]any{"Flag": name}))
+}
+
+// closestFlag returns the defined flag nearest to name by edit distance, or "" if none is close enough to be a typo.
+func closestFlag(fs *flag.FlagSet, name string) string {
+	best, bestDistance := "", len(name)/3+2
+	fs.VisitAll(func(f *flag.Flag) {
+		if d := editDistance(name, f.Name); d < bestDistance {
+			best, bestDistance = f.Name, d
+		}
+	})
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// checkSourceFlags checks the flags choosing which files a scan of command reads: --directory, file arguments, the
+// worklist, queue and snapshot diff sources, and the scan modes that only work with some of them.
+func checkSourceFlags(command string, cfg *Config) {
+	directory, paths := cfg.Directory, cfg.Paths
+	if directory == "" && cfg.Worklist == "" && !cfg.FromQueue && len(paths) == 0 && command != "rescan" {
+		usageError(flag.CommandLine, "directory", msg("MissingDirectory", nil))
+	}
+	if cfg.Incremental && (cfg.EnumerateOnly != "" || cfg.Worklist != "" || cfg.Enqueue || cfg.FromQueue) {
+		log.Fatalf("--incremental can't be combined with --enumerate-only, --worklist, --enqueue or --from-queue: directory state is only recorded by a scan that walks and hashes in one run")
+	}
+	if len(paths) > 0 && ((directory != "" && cfg.VerifyAgainst == "") || cfg.Worklist != "" || cfg.FromQueue || cfg.ChangesFrom != "" || cfg.Incremental) {
+		log.Fatalf("Files named as arguments are walked instead of --directory and can't be combined with it (except to locate replicas for --verify-against), --worklist, --from-queue, --changes-from or --incremental")
+	}
+	if cfg.ChangesFrom != "" && (cfg.Worklist != "" || cfg.FromQueue || cfg.Enqueue || cfg.EnumerateOnly != "" || cfg.Incremental) {
+		log.Fatalf("--changes-from replaces the directory walk and can't be combined with --worklist, --from-queue, --enqueue, --enumerate-only or --incremental")
+	}
+	if cfg.ChangesFormat != "zfs" && cfg.ChangesFormat != "btrfs" {
+		usageError(flag.CommandLine, "changes-format", fmt.Sprintf("Invalid --changes-format %q.", cfg.ChangesFormat))
+	}
+	if cfg.DetectDeleted && (directory == "" || len(paths) > 0 || cfg.Worklist != "" || cfg.FromQueue || cfg.Enqueue || cfg.EnumerateOnly != "" || cfg.ChangesFrom != "" || cfg.VerifyAgainst != "" || cfg.PrivacyMode) {
+		log.Fatalf("--detect-deleted needs a full scan of --directory and can't be combined with file arguments, --worklist, --from-queue, --enqueue, --enumerate-only, --changes-from, --verify-against or --privacy-mode")
+	}
+	if cfg.Subpath != "" {
+		if directory == "" || len(paths) > 0 || cfg.Worklist != "" || cfg.FromQueue || cfg.ChangesFrom != "" || cfg.Partition {
+			log.Fatalf("--subpath narrows a walk of --directory and can't be combined with file arguments, --worklist, --from-queue, --changes-from or --partition")
+		}
+		if !filepath.IsLocal(cfg.Subpath) {
+			usageError(flag.CommandLine, "subpath", fmt.Sprintf("Invalid --subpath %q, expected a path inside --directory, relative to it.", cfg.Subpath))
+		}
+		cfg.Subpath = filepath.Clean(cfg.Subpath)
+		if cfg.Subpath == "." {
+			cfg.Subpath = ""
+		}
+	}
+	if command == "rescan" {
+		if cfg.Glob == "" {
+			usageError(flag.CommandLine, "glob", msg("MissingFlag", map[string]any{"Flag": "glob"}))
+		}
+		if cfg.Under == "" {
+			usageError(flag.CommandLine, "under", msg("MissingFlag", map[string]any{"Flag": "under"}))
+		}
+		if err := checkGlob(cfg.Glob); err != nil {
+			usageError(flag.CommandLine, "glob", fmt.Sprintf("Invalid --glob %q: %v.", cfg.Glob, err))
+		}
+		if directory != "" || len(paths) > 0 || cfg.Worklist != "" || cfg.FromQueue || cfg.Enqueue || cfg.EnumerateOnly != "" || cfg.ChangesFrom != "" || cfg.VerifyAgainst != "" || cfg.Incremental || cfg.PrivacyMode || cfg.Store != "" || cfg.DBDriver == "sqlite" {
+			log.Fatalf("rescan finds its files in the file_hashes table and can't be combined with --directory, file arguments, --worklist, --from-queue, --enqueue, --enumerate-only, --changes-from, --verify-against, --incremental, --privacy-mode, --store or --db-driver sqlite")
+		}
+		cfg.Under = filepath.Clean(cfg.Under)
+	}
+	if cfg.Partition && (directory == "" || len(paths) > 0 || cfg.Worklist != "" || cfg.FromQueue || cfg.Enqueue || cfg.EnumerateOnly != "" || cfg.ChangesFrom != "" || cfg.VerifyAgainst != "" || cfg.Incremental || cfg.DBDriver == "sqlite") {
+		log.Fatalf("--partition needs a full scan of --directory recorded in PostgreSQL and can't be combined with file arguments, --worklist, --from-queue, --enqueue, --enumerate-only, --changes-from, --verify-against, --incremental or --db-driver sqlite")
+	}
+	if cfg.Watch && (directory == "" || len(paths) > 0 || cfg.Worklist != "" || cfg.FromQueue || cfg.Enqueue || cfg.EnumerateOnly != "" || cfg.ChangesFrom != "" || cfg.VerifyAgainst != "" || cfg.PrivacyMode || cfg.Store != "" || cfg.DBDriver == "sqlite") {
+		log.Fatalf("--watch follows --directory after a full scan of it and can't be combined with file arguments, --worklist, --from-queue, --enqueue, --enumerate-only, --changes-from, --verify-against, --privacy-mode, --store or --db-driver sqlite")
+	}
+	if cfg.MaxRuntime > 0 && cfg.Watch {
+		log.Fatalf("--max-runtime stops the scan and can't be combined with --watch, which runs until stopped")
+	}
+	if cfg.ScanEpochs && cfg.VerifyAgainst != "" {
+		log.Fatalf("--scan-epochs marks the file_hashes records a scan run sees and can't be combined with --verify-against, which doesn't record a run")
+	}
+	if cfg.Preload && (directory == "" || cfg.Store != "" || cfg.PrivacyMode || cfg.VerifyAgainst != "" || cfg.DBDriver == "sqlite") {
+		log.Fatalf("--preload reads the file_hashes records under --directory and can't be combined with --store, --privacy-mode, --verify-against or --db-driver sqlite")
+	}
+	if cfg.Resume && !cfg.Partition && (directory == "" || len(paths) > 0 || cfg.Worklist != "" || cfg.FromQueue || cfg.Enqueue || cfg.EnumerateOnly != "" || cfg.ChangesFrom != "" || cfg.VerifyAgainst != "" || cfg.Incremental || cfg.PrivacyMode || cfg.DBDriver == "sqlite") {
+		log.Fatalf("--resume continues a full scan of --directory recorded in PostgreSQL and can't be combined with file arguments, --worklist, --from-queue, --enqueue, --enumerate-only, --changes-from, --verify-against, --incremental, --privacy-mode or --db-driver sqlite")
+	}
+	if cfg.VerifyAgainst != "" && (cfg.Worklist != "" || cfg.FromQueue || directory == "") {
+		log.Fatalf("--verify-against needs --directory to locate replicas and can't be combined with --worklist or --from-queue")
+	}
+	if cfg.PrivacyMode && cfg.VerifyAgainst != "" {
+		log.Fatalf("--privacy-mode and --verify-against can't be combined")
+	}
+	if len(cfg.Prefixes) > 1 && len(cfg.Roots) < 2 {
+		log.Fatalf("--prefix is only repeated to give several --directory roots their own prefixes")
+	}
+	if len(cfg.Roots) > 1 {
+		if cfg.Subpath != "" || cfg.Partition || cfg.Resume || cfg.Watch || cfg.Preload || cfg.DetectMoves || cfg.VerifyAgainst != "" || cfg.EnumerateOnly != "" || cfg.Enqueue || cfg.ChangesFrom != "" {
+			log.Fatalf("Several --directory roots are scanned one after another and can't be combined with --subpath, --partition, --resume, --watch, --preload, --detect-moves, --verify-against, --enumerate-only, --enqueue or --changes-from, which work on a single directory")
+		}
+		for i, root := range cfg.Roots {
+			for _, other := range cfg.Roots[:i] {
+				if within(root, other) || within(other, root) {
+					usageError(flag.CommandLine, "directory", fmt.Sprintf("--directory %q and %q overlap, so files under both would be scanned twice.", other, root))
+				}
+			}
+		}
+	}
+}
+
+// checkDatabaseFlags checks where the index is kept: the database flags, --store and --db-driver sqlite, which becomes
+// --store sqlite, and how records reach it with --batch-size and the write-ahead log.
+func checkDatabaseFlags(cfg *Config, raw scanFlags) {
+	if cfg.DBDriver != "postgres" && cfg.DBDriver != "sqlite" {
+		usageError(flag.CommandLine, "db-driver", fmt.Sprintf("Invalid --db-driver %q.", cfg.DBDriver))
+	}
+	if cfg.DBDriver == "sqlite" && raw.dbPath == "" && cfg.EnumerateOnly == "" {
+		usageError(flag.CommandLine, "db-path", msg("MissingFlag", map[string]any{"Flag": "db-path"}))
+	}
+	if cfg.DbName == "" && cfg.EnumerateOnly == "" && cfg.DBDriver != "sqlite" {
+		usageError(flag.CommandLine, "dbname", msg("MissingDBName", nil))
+	}
+	if cfg.DBDriver == "sqlite" {
+		if cfg.Store != "" {
+			log.Fatalf("--db-driver sqlite keeps file records in --db-path and can't be combined with --store")
+		}
+		if cfg.RecordLineage || len(raw.quotas) > 0 || cfg.RecordAtime || cfg.RecordAllocation || cfg.Enqueue || cfg.FromQueue || cfg.DetectPII || cfg.Incremental || cfg.DetectDeleted || cfg.ScanEpochs {
+			log.Fatalf("--db-driver sqlite can't be combined with --record-lineage, --quota, --record-atime, --record-allocation, --extent-map, --enqueue, --from-queue, --detect-pii, --incremental, --detect-deleted or --scan-epochs, which need PostgreSQL")
+		}
+		// Only file records are kept in SQLite, through the same store backend --store sqlite uses.
+		cfg.Store, cfg.StoreDSN = "sqlite", raw.dbPath
+	}
+	if cfg.BatchSize < 0 {
+		usageError(flag.CommandLine, "batch-size", fmt.Sprintf("Invalid --batch-size %d.", cfg.BatchSize))
+	}
+	if cfg.BatchSize > 1 && (cfg.Store != "" || cfg.RecordLineage || cfg.RecordAtime || cfg.RecordAllocation) {
+		log.Fatalf("--batch-size can't be combined with --store, --db-driver sqlite, --record-lineage, --record-atime, --record-allocation or --extent-map, which need each file's record written before they run")
+	}
+	if cfg.Store != "" && !slices.Contains(store.Names(), cfg.Store) {
+		usageError(flag.CommandLine, "store", fmt.Sprintf("Unknown --store %q, expected one of %v.", cfg.Store, store.Names()))
+	}
+	if cfg.Store != "" && (cfg.RecordLineage || len(raw.quotas) > 0 || cfg.RecordAtime || cfg.RecordAllocation || cfg.DetectDeleted || cfg.ScanEpochs) {
+		log.Fatalf("--store can't be combined with --record-lineage, --quota, --record-atime, --record-allocation, --extent-map, --detect-deleted or --scan-epochs, which work on the file_hashes table")
+	}
+
+	if cfg.WALPath == "" {
+		cfg.WALPath = defaultWALPath(cfg.DBConfig)
+	}
+	// The write-ahead log is replayed into file_hashes, so it isn't used with --store.
+	if raw.noWAL || cfg.Store != "" {
+		cfg.WALPath = ""
+	}
+}
+
+// checkResourceFlags checks the limits on what a scan uses: --workers, which defaults by --network-share, the runtime,
+// read rate and memory limits.
+func checkResourceFlags(cfg *Config, raw scanFlags) {
+	if cfg.Workers < 0 {
+		usageError(flag.CommandLine, "workers", fmt.Sprintf("Invalid --workers %d.", cfg.Workers))
+	}
+	if cfg.Workers == 0 {
+		cfg.Workers = defaultWorkerCount
+		if cfg.NetworkShare {
+			cfg.Workers = shareWorkerCount
+		}
+	}
+	if cfg.MaxRuntime < 0 {
+		usageError(flag.CommandLine, "max-runtime", fmt.Sprintf("Invalid --max-runtime %s.", cfg.MaxRuntime))
+	}
+	if cfg.MaxReadMBps < 0 {
+		usageError(flag.CommandLine, "max-read-mbps", fmt.Sprintf("Invalid --max-read-mbps %g.", cfg.MaxReadMBps))
+	}
+	if cfg.MaxReadMBps > 0 && cfg.MaxReadMBpsFile != "" {
+		log.Fatalf("--max-read-mbps and --max-read-mbps-file can't be combined")
+	}
+	if raw.memoryLimit != "" {
+		var err error
+		if cfg.MemoryLimit, err = parseByteSize(raw.memoryLimit); err != nil {
+			log.Fatalf("Invalid --memory-limit: %v", err)
+		}
+	}
+}
+
+// checkHashFlags checks how files are hashed and when they are hashed again, and sets cfg.HashAlgorithm to the name
+// their records get, which with --chunk-size names the chunk size too.
+func checkHashFlags(cfg *Config, raw scanFlags) {
+	if _, ok := hashAlgorithms[cfg.HashAlgorithm]; !ok {
+		usageError(flag.CommandLine, "hash-algo", fmt.Sprintf("Invalid --hash-algo %q, expected one of %v.", cfg.HashAlgorithm, hashAlgorithmNames()))
+	}
+	if !slices.Contains(changeDetectPolicies, cfg.ChangeDetect) {
+		usageError(flag.CommandLine, "change-detect", fmt.Sprintf("Invalid --change-detect %q, expected one of %v.", cfg.ChangeDetect, changeDetectPolicies))
+	}
+	if raw.minRehashAge != "" {
+		var err error
+		if cfg.MinRehashAge, err = parseAge(raw.minRehashAge); err != nil {
+			usageError(flag.CommandLine, "min-rehash-age", err.Error())
+		}
+	}
+	if raw.quickHash != "" && !raw.fullHash {
+		if cfg.DetectPII || cfg.VerifyAgainst != "" || cfg.PrivacyMode {
+			log.Fatalf("--quick-hash reads only part of large files and can't be combined with --detect-pii, --verify-against or --privacy-mode")
+		}
+		var err error
+		if cfg.QuickHash, err = parseByteSize(raw.quickHash); err != nil || cfg.QuickHash == 0 {
+			usageError(flag.CommandLine, "quick-hash", fmt.Sprintf("Invalid --quick-hash %q, expected a file size like 10GiB.", raw.quickHash))
+		}
+	}
+	if raw.chunkSize != "" {
+		var err error
+		if cfg.ChunkSize, err = parseByteSize(raw.chunkSize); err != nil || cfg.ChunkSize < minChunkSize {
+			usageError(flag.CommandLine, "chunk-size", fmt.Sprintf("Invalid --chunk-size %q, expected a size of at least 4KiB like 4MiB.", raw.chunkSize))
+		}
+		if cfg.QuickHash > 0 || cfg.PrivacyMode || cfg.VerifyAgainst != "" || cfg.Store != "" {
+			log.Fatalf("--chunk-size can't be combined with --quick-hash, --privacy-mode, --verify-against, --db-driver sqlite or --store: chunks are only recorded for files read whole, in file_chunks")
+		}
+		cfg.HashAlgorithm = chunkedAlgorithmName(cfg.HashAlgorithm, cfg.ChunkSize)
+	}
+}
+
+// checkContentFlags checks the flags that read file contents for more than their hash, or record them elsewhere,
+// against the scans that don't read them whole.
+func checkContentFlags(cfg Config) {
+	if cfg.WriteManifests && (cfg.Directory == "" || len(cfg.Paths) > 0 || cfg.Worklist != "" || cfg.FromQueue || cfg.Enqueue || cfg.EnumerateOnly != "" || cfg.ChangesFrom != "" || cfg.VerifyAgainst != "" || cfg.Incremental || cfg.Partition || cfg.Resume || cfg.Watch || cfg.PrivacyMode || cfg.QuickHash > 0 || cfg.ChunkSize > 0 || cfg.ReadOnlyGuarantee) {
+		log.Fatalf("--write-manifests needs a full walk of --directory hashing whole files, and can't be combined with file arguments, --worklist, --from-queue, --enqueue, --enumerate-only, --changes-from, --verify-against, --incremental, --partition, --resume, --watch, --privacy-mode, --quick-hash, --chunk-size or --read-only-guarantee")
+	}
+	if cfg.DetectMoves && (cfg.Store != "" || cfg.PrivacyMode || cfg.VerifyAgainst != "" || cfg.EnumerateOnly != "" || cfg.Enqueue) {
+		log.Fatalf("--detect-moves moves records in file_hashes and can't be combined with --store, --db-driver sqlite, --privacy-mode, --verify-against, --enumerate-only or --enqueue")
+	}
+	if cfg.PrivacyMode && (cfg.DetectPII || cfg.CheckTypes || cfg.ExecutableReport != "" || cfg.SBOMOutput != "" || cfg.RecordLineage) {
+		log.Fatalf("--privacy-mode doesn't read file contents, so it can't be combined with --detect-pii, --check-types, --executable-report, --sbom-output or --record-lineage")
+	}
+	if cfg.SBOMOutput != "" && cfg.VerifyAgainst != "" {
+		log.Fatalf("--verify-against hashes indexed files with the algorithm of their record rather than --hash-algo, so it can't be combined with --sbom-output")
+	}
+	checkEncryptColumns(flag.CommandLine, "scan", cfg.EncryptColumns)
+}
+
+// checkFilterFlags checks the flags that leave files out of a scan, turning them into cfg's exclusions, path filter,
+// time window, owner and group.
+func checkFilterFlags(cfg *Config, raw scanFlags) {
+	cfg.ExcludeStrings = strings.Split(raw.exclude, ",")
+	filter, name, err := newPathFilter(raw.excludeGlobs, raw.includeGlobs, raw.excludeRegexps, raw.ignoreFile)
+	if err != nil {
+		usageError(flag.CommandLine, name, err.Error())
+	}
+	cfg.Filter = filter
+
+	// The time window is fixed when the scan starts, so a long scan doesn't drift through it.
+	var newerThan, olderThan time.Duration
+	if raw.ignoreNewerThan != "" {
+		var err error
+		if newerThan, err = parseAge(raw.ignoreNewerThan); err != nil {
+			usageError(flag.CommandLine, "ignore-newer-than", err.Error())
+		}
+		cfg.NewestModified = time.Now().Add(-newerThan)
+	}
+	if raw.ignoreOlderThan != "" {
+		var err error
+		if olderThan, err = parseAge(raw.ignoreOlderThan); err != nil {
+			usageError(flag.CommandLine, "ignore-older-than", err.Error())
+		}
+		cfg.OldestModified = time.Now().Add(-olderThan)
+	}
+	if raw.ignoreNewerThan != "" && raw.ignoreOlderThan != "" && olderThan <= newerThan {
+		log.Fatalf("--ignore-newer-than %s and --ignore-older-than %s leave no files to scan", raw.ignoreNewerThan, raw.ignoreOlderThan)
+	}
+
+	cfg.OwnerID, cfg.GroupID = -1, -1
+	if (raw.owner != "" || raw.group != "") && !ownersSupported {
+		log.Fatalf("--owner and --group aren't supported on %s", runtime.GOOS)
+	}
+	if raw.owner != "" {
+		if cfg.OwnerID, err = resolveOwner(raw.owner); err != nil {
+			usageError(flag.CommandLine, "owner", fmt.Sprintf("Unknown --owner %q: %v.", raw.owner, err))
+		}
+	}
+	if raw.group != "" {
+		if cfg.GroupID, err = resolveGroup(raw.group); err != nil {
+			usageError(flag.CommandLine, "group", fmt.Sprintf("Unknown --group %q: %v.", raw.group, err))
+		}
+	}
+}
+
+// checkPrivilegeFlags checks the flags that change what the scan is allowed to do to the tree: --run-as,
+// --keep-read-access and --read-only-guarantee.
+func checkPrivilegeFlags(cfg *Config, raw scanFlags) {
+	if raw.runAs != "" {
+		if !runAsSupported {
+			log.Fatalf("--run-as isn't supported on %s", runtime.GOOS)
+		}
+		if os.Geteuid() != 0 {
+			log.Fatalf("--run-as changes the user of the scan, which needs it to be started as root")
+		}
+		var err error
+		if cfg.RunAs, err = resolveRunAs(raw.runAs); err != nil {
+			usageError(flag.CommandLine, "run-as", fmt.Sprintf("Invalid --run-as %q: %v.", raw.runAs, err))
+		}
+	}
+	if cfg.KeepReadAccess {
+		if raw.runAs == "" {
+			usageError(flag.CommandLine, "run-as", msg("MissingFlag", map[string]any{"Flag": "run-as"}))
+		}
+		if runtime.GOOS != "linux" {
+			log.Fatalf("--keep-read-access keeps a Linux capability and isn't supported on %s", runtime.GOOS)
+		}
+	}
+	if cfg.ReadOnlyGuarantee && (cfg.Watch || cfg.Incremental || cfg.Partition || cfg.VerifyAgainst != "") {
+		log.Fatalf("--read-only-guarantee can't be combined with --watch, --incremental, --partition or --verify-against, which read the tree in ways it doesn't cover")
+	}
+}
+
+// checkOutputFlags checks what the scan writes besides the index: the results file and its format, the reports,
+// --status-policy and the --quota alerts.
+func checkOutputFlags(cfg *Config, raw scanFlags) {
+	if !slices.Contains(outputFormats, cfg.OutputFormat) {
+		usageError(flag.CommandLine, "output-format", fmt.Sprintf("Invalid --output-format %q, expected one of %v.", cfg.OutputFormat, outputFormats))
+	}
+	// The timestamped default name follows the format.
+	if !raw.set["output"] && cfg.OutputFormat != "csv" {
+		cfg.OutputFile = strings.TrimSuffix(cfg.OutputFile, ".csv") + "." + cfg.OutputFormat
+	}
+	if raw.reportTemplate != "" {
+		if cfg.ReportOutput == "" {
+			usageError(flag.CommandLine, "report-output", msg("MissingFlag", map[string]any{"Flag": "report-output"}))
+		}
+		var err error
+		if cfg.ReportTemplate, err = parseReportTemplate(raw.reportTemplate); err != nil {
+			usageError(flag.CommandLine, "report-template", fmt.Sprintf("Invalid --report-template: %v.", err))
+		}
+	} else if cfg.ReportOutput != "" {
+		usageError(flag.CommandLine, "report-template", msg("MissingFlag", map[string]any{"Flag": "report-template"}))
+	}
+	if cfg.HumanReadable && cfg.OutputFormat == "xlsx" {
+		log.Fatalf("--human-readable can't be combined with --output-format xlsx, whose sizes are numbers formatted by the spreadsheet")
+	}
+	if raw.statusPolicy != "" {
+		var err error
+		if cfg.StatusPolicy, err = loadStatusPolicy(raw.statusPolicy); err != nil {
+			log.Fatalf("Invalid --status-policy: %v", err)
+		}
+	}
+	var err error
+	if cfg.Quotas, err = parseQuotas(raw.quotas); err != nil {
+		usageError(flag.CommandLine, "quota", err.Error())
+	}
+}
+
+// checkIneffectiveFlags looks for flags that were given but will have no effect in this run. They're logged as
+// warnings, or with --strict, refused.
+func checkIneffectiveFlags(cfg Config, set map[string]bool, strict bool) {
+	var problems []string
+	for _, root := range cfg.Roots {
+		prefix := rootPrefix(root, cfg.Prefixes)
+		if len(cfg.Prefixes) > 1 && prefix == "" {
+			problems = append(problems, fmt.Sprintf("no --prefix matches --directory %q, so its paths will be stored unchanged", root))
+		} else if set["prefix"] && !hasPathPrefix(root, prefix) {
+			problems = append(problems, fmt.Sprintf("--prefix %q doesn't match --directory %q, so paths will be stored unchanged", prefix, root))
+		}
+	}
+	for _, prefix := range cfg.Prefixes {
+		if len(cfg.Prefixes) > 1 && !slices.ContainsFunc(cfg.Roots, func(root string) bool { return rootPrefix(root, cfg.Prefixes) == prefix }) {
+			problems = append(problems, fmt.Sprintf("--prefix %q isn't the prefix of any --directory, so it has no effect", prefix))
+		}
+	}
+	if set["prefix"] && cfg.Under != "" && !hasPathPrefix(cfg.Under, cfg.Prefix) {
+		problems = append(problems, fmt.Sprintf("--prefix %q doesn't match --under %q, so indexed paths are looked up unchanged", cfg.Prefix, cfg.Under))
+	}
+	for _, path := range cfg.Paths {
+		if set["prefix"] && !hasPathPrefix(path, cfg.Prefix) {
+			problems = append(problems, fmt.Sprintf("--prefix %q doesn't match %q, so its paths will be stored unchanged", cfg.Prefix, path))
+		}
+	}
+	for _, name := range []string{"report-html", "report-template"} {
+		if set[name] && (cfg.EnumerateOnly != "" || cfg.Enqueue) {
+			problems = append(problems, fmt.Sprintf("--%s has no effect with --enumerate-only or --enqueue, which don't process files", name))
+		}
+	}
+	if set["safe-csv"] && cfg.OutputFormat != "csv" && cfg.TypeReport == "" && cfg.ExecutableReport == "" {
+		problems = append(problems, fmt.Sprintf("--safe-csv only applies to CSV, and --output-format is %s", cfg.OutputFormat))
+	}
+	if set["direct-io"] && cfg.VerifyAgainst == "" {
+		problems = append(problems, "--direct-io only applies to --verify-against")
+	}
+	if set["pii-max-bytes"] && !cfg.DetectPII {
+		problems = append(problems, "--pii-max-bytes has no effect without --detect-pii")
+	}
+	if slices.Contains(cfg.EncryptColumns, "pii_findings.pattern") && !cfg.DetectPII {
+		problems = append(problems, "--encrypt-column pii_findings.pattern has no effect without --detect-pii")
+	}
+	if slices.Contains(cfg.EncryptColumns, "file_lineage.host") && !cfg.RecordLineage {
+		problems = append(problems, "--encrypt-column file_lineage.host has no effect without --record-lineage")
+	}
+	if (set["worker-id"] || set["queue-lease"]) && !cfg.FromQueue {
+		problems = append(problems, "--worker-id and --queue-lease have no effect without --from-queue")
+	}
+	if set["diag-interval"] && cfg.DiagDir == "" {
+		problems = append(problems, "--diag-interval has no effect without --diag-dir")
+	}
+	if (set["ignore-newer-than"] || set["ignore-older-than"] || set["owner"] || set["group"]) && (cfg.Worklist != "" || cfg.FromQueue) {
+		problems = append(problems, "--ignore-newer-than, --ignore-older-than, --owner and --group apply when files are found, so they have no effect with --worklist or --from-queue; pass them to --enumerate-only or --enqueue instead")
+	}
+	if set["min-rehash-age"] && !cfg.Force && !cfg.Verify && cfg.ChangeDetect != "always" {
+		problems = append(problems, "--min-rehash-age only holds back --force, --verify and --change-detect always")
+	}
+	if set["preload"] && (cfg.Force || cfg.EnumerateOnly != "" || cfg.Enqueue) {
+		problems = append(problems, "--preload has no effect with --force, --enumerate-only or --enqueue, which don't look up indexed records")
+	}
+	if set["scan-epochs"] && (cfg.EnumerateOnly != "" || cfg.Enqueue) {
+		problems = append(problems, "--scan-epochs has no effect with --enumerate-only or --enqueue, which don't process files")
+	}
+	if set["spill-dir"] && cfg.MemoryLimit == 0 {
+		problems = append(problems, "--spill-dir has no effect without --memory-limit")
+	}
+	if set["verify"] && (cfg.Force || cfg.PrivacyMode || cfg.VerifyAgainst != "" || cfg.EnumerateOnly != "" || cfg.Enqueue) {
+		problems = append(problems, "--verify has no effect with --force, --privacy-mode, --verify-against, --enumerate-only or --enqueue")
+	}
+	if set["change-detect"] && (cfg.Force || cfg.PrivacyMode || cfg.VerifyAgainst != "" || cfg.EnumerateOnly != "" || cfg.Enqueue) {
+		problems = append(problems, "--change-detect has no effect with --force, --privacy-mode, --verify-against, --enumerate-only or --enqueue")
+	}
+	if set["verify"] && cfg.Incremental {
+		problems = append(problems, "--incremental skips files in unchanged directories, so --verify only checks files in changed ones")
+	}
+	if set["incremental"] && cfg.Force {
+		problems = append(problems, "--force rehashes everything, so --incremental is ignored")
+	}
+	if (set["base-snapshot"] || set["snapshot"]) && cfg.ChangesFrom == "" {
+		problems = append(problems, "--base-snapshot and --snapshot are only recorded with --changes-from")
+	}
+	if set["changes-format"] && cfg.ChangesFrom == "" {
+		problems = append(problems, "--changes-format has no effect without --changes-from")
+	}
+	if (set["alert-webhook"] || set["alert-email"]) && len(cfg.Quotas) == 0 {
+		problems = append(problems, "--alert-webhook and --alert-email only send --quota alerts")
+	}
+	if set["record-atime"] && (cfg.VerifyAgainst != "" || cfg.EnumerateOnly != "" || cfg.Enqueue) {
+		problems = append(problems, "--record-atime has no effect with --verify-against, --enumerate-only or --enqueue, which don't write file_hashes")
+	}
+	if (set["record-allocation"] || set["extent-map"]) && (cfg.VerifyAgainst != "" || cfg.EnumerateOnly != "" || cfg.Enqueue) {
+		problems = append(problems, "--record-allocation and --extent-map have no effect with --verify-against, --enumerate-only or --enqueue, which don't write file_hashes")
+	}
+	if set["hash-algo"] && cfg.PrivacyMode {
+		problems = append(problems, "--hash-algo has no effect with --privacy-mode, which doesn't read file contents")
+	}
+	if cfg.QuickHash > 0 && (cfg.EnumerateOnly != "" || cfg.Enqueue) {
+		problems = append(problems, "--quick-hash has no effect with --enumerate-only or --enqueue, which don't hash files")
+	}
+	if set["wal"] && cfg.WALPath == "" {
+		problems = append(problems, "--wal has no effect with --no-wal or --store")
+	}
+	if set["store-dsn"] && cfg.Store == "" {
+		problems = append(problems, "--store-dsn has no effect without --store")
+	}
+	if set["db-path"] && cfg.DBDriver != "sqlite" {
+		problems = append(problems, "--db-path has no effect without --db-driver sqlite")
+	}
+	if (set["dbname"] || set["dbuser"] || set["dbhost"] || set["dbport"]) && cfg.DBDriver == "sqlite" {
+		problems = append(problems, "--dbname, --dbuser, --dbhost and --dbport have no effect with --db-driver sqlite")
+	}
+	if (set["network-share"] || set["workers"]) && (cfg.EnumerateOnly != "" || cfg.Enqueue) {
+		problems = append(problems, "--network-share and --workers have no effect with --enumerate-only or --enqueue, which don't hash files")
+	}
+	if set["max-runtime"] && (cfg.EnumerateOnly != "" || cfg.Enqueue) {
+		problems = append(problems, "--max-runtime has no effect with --enumerate-only or --enqueue, which don't hash files")
+	}
+	if (set["max-read-mbps"] || set["max-read-mbps-file"]) && (cfg.PrivacyMode || cfg.EnumerateOnly != "" || cfg.Enqueue) {
+		problems = append(problems, "--max-read-mbps and --max-read-mbps-file have no effect with --privacy-mode, --enumerate-only or --enqueue, which don't read file contents")
+	}
+	if set["batch-size"] && (cfg.VerifyAgainst != "" || cfg.EnumerateOnly != "" || cfg.Enqueue) {
+		problems = append(problems, "--batch-size has no effect with --verify-against, --enumerate-only or --enqueue, which don't write file_hashes")
+	}
+	if set["status-policy"] && cfg.PrivacyMode {
+		problems = append(problems, "--status-policy under: and name: conditions never match the path digests stored by --privacy-mode")
+	}
+	if set["output"] && (cfg.EnumerateOnly != "" || cfg.Enqueue) {
+		problems = append(problems, "--output isn't written by --enumerate-only or --enqueue runs")
+	}
+
+	for _, problem := range problems {
+		if strict {
+			log.Fatalf("%s (refusing because of --strict)", problem)
+		}
+		log.Printf("WARNING: %s", problem)
+	}
+}
+
+// validateSetup checks everything a scan needs before it starts, reports each check, and exits non-zero if any
+// failed. It is run by --validate-config in place of the scan.
+func validateSetup(cfg Config) {
+	type check struct {
+		name string
+		run  func() error
+	}
+	var checks []check
+	output := cfg.OutputFile
+	if cfg.EnumerateOnly != "" {
+		output = cfg.EnumerateOnly
+	}
+	if !cfg.Enqueue {
+		checks = append(checks, check{msg("CheckOutput", map[string]any{"Path": output}), func() error {
+			return checkWritableDir(filepath.Dir(output))
+		}})
+	}
+	roots := append(slices.Clone(cfg.Roots), cfg.Paths...)
+	for _, root := range roots {
+		checks = append(checks, check{msg("CheckDirectory", map[string]any{"Path": root}), func() error {
+			return checkReadable(root)
+		}})
+	}
+	if cfg.Worklist != "" {
+		checks = append(checks, check{msg("CheckWorklist", map[string]any{"Path": cfg.Worklist}), func() error {
+			file, err := os.Open(cfg.Worklist)
+			if err == nil {
+				file.Close()
+			}
+			return err
+		}})
+	}
+	if cfg.DBDriver == "sqlite" && cfg.EnumerateOnly == "" {
+		checks = append(checks, check{msg("CheckSQLite", map[string]any{"Path": cfg.StoreDSN}), func() error {
+			s, err := store.Open(cfg.Store, cfg.StoreDSN)
+			if err != nil {
+				return err
+			}
+			defer s.Close()
+			return s.Ping()
+		}})
+	} else if cfg.DbName != "" && cfg.EnumerateOnly == "" {
+		checks = append(checks, check{msg("CheckDatabase", map[string]any{"Name": cfg.DbName, "Host": cfg.DbHost}), func() error {
+			db := connectToDatabase(cfg.DBConfig)
+			defer db.Close()
+			return db.Ping()
+		}})
+	}
+
+	failed := 0
+	for _, c := range checks {
+		if err := c.run(); err != nil {
+			failed++
+			fmt.Println(msg("CheckFailed", map[string]any{"Check": c.name, "Error": err}))
+		} else {
+			fmt.Println(msg("CheckPassed", map[string]any{"Check": c.name}))
+		}
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// checkReadable checks that the directory at path can be listed, or if path is a file, that it can be opened.
+func checkReadable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		_, err = os.ReadDir(path)
+		return err
+	}
+	file, err := os.Open(path)
+	if err == nil {
+		file.Close()
+	}
+	return err
+}
+
+// checkWritableDir confirms files can be created in dir by creating and removing one.
+func checkWritableDir(dir string) error {
+	file, err := os.CreateTemp(dir, ".fileindexer-check-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
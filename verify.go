@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// replicaStatuses are the statuses --verify-against gives files besides verified.
+var replicaStatuses = []string{"replica-corrupt", "primary-corrupt", "index-stale", "all-differ", "replica-missing", "match-unindexed", "mismatch-unindexed"}
+
+// verifyAgainstReplica hashes path and its counterpart under replicaRoot concurrently and compares both digests with
+// the indexed hash, which acts as the arbiter when the two copies disagree. Both are hashed with the algorithm the
+// index used, or for unindexed files, algorithm. Nothing is written to the database.
+func verifyAgainstReplica(path, storedPath, root, replicaRoot string, db *sql.DB, algorithm string, direct bool, tree treeReader) (string, int64, string, error) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return "", -1, "", fmt.Errorf("failed to resolve %s relative to %s: %v", path, root, err)
+	}
+	replicaPath := filepath.Join(replicaRoot, rel)
+
+	dbHash, _, dbAlgorithm, _, dbErr := getDatabaseRecord(db, storedPath)
+	if dbErr != nil && !errors.Is(dbErr, sql.ErrNoRows) {
+		return "", -1, "", fmt.Errorf("failed to query database for %s: %v", storedPath, dbErr)
+	}
+	indexed := dbErr == nil
+	if indexed {
+		if _, ok := hashAlgorithms[dbAlgorithm]; !ok {
+			return "", -1, "", fmt.Errorf("%s is indexed with %s, which can't be verified", storedPath, dbAlgorithm)
+		}
+		algorithm = dbAlgorithm
+	}
+
+	type digest struct {
+		hash string
+		size int64
+		err  error
+	}
+	replicaDone := make(chan digest, 1)
+	go func() {
+		hash, size, err := hashPath(replicaPath, algorithm, direct, tree)
+		replicaDone <- digest{hash, size, err}
+	}()
+	primaryHash, primarySize, primaryErr := hashPath(path, algorithm, direct, tree)
+	replica := <-replicaDone
+
+	if primaryErr != nil {
+		return "", -1, "", fmt.Errorf("failed to hash %s: %v", path, primaryErr)
+	}
+	if errors.Is(replica.err, os.ErrNotExist) {
+		return primaryHash, primarySize, "replica-missing", nil
+	}
+	if replica.err != nil {
+		return "", -1, "", fmt.Errorf("failed to hash replica %s: %v", replicaPath, replica.err)
+	}
+
+	if !indexed {
+		if primaryHash == replica.hash {
+			return primaryHash, primarySize, "match-unindexed", nil
+		}
+		return primaryHash, primarySize, "mismatch-unindexed", nil
+	}
+
+	switch {
+	case primaryHash == dbHash && replica.hash == dbHash:
+		return primaryHash, primarySize, "verified", nil
+	case primaryHash == dbHash:
+		return primaryHash, primarySize, "replica-corrupt", nil
+	case replica.hash == dbHash:
+		return primaryHash, primarySize, "primary-corrupt", nil
+	case primaryHash == replica.hash:
+		// Both copies agree with each other but not the index: most likely the file was legitimately modified on
+		// both sides since it was last indexed.
+		return primaryHash, primarySize, "index-stale", nil
+	default:
+		return primaryHash, primarySize, "all-differ", nil
+	}
+}
+
+// hashPath opens and hashes a file for verification, returning its digest and size.
+func hashPath(path, algorithm string, direct bool, tree treeReader) (string, int64, error) {
+	file, reader, err := openForVerify(path, direct, tree)
+	if err != nil {
+		return "", -1, err
+	}
+	defer file.Close()
+
+	size, _, err := getFileMetadata(file)
+	if err != nil {
+		return "", -1, err
+	}
+	// Direct I/O reads go through an aligned buffer that expects sequential reads, so only buffered reads skip holes.
+	if !direct {
+		reader = skipHoles(file, size)
+	}
+	hash, err := hashReader(reader, algorithm)
+	return hash, size, err
+}
@@ -0,0 +1,40 @@
+package main
+
+import "runtime/debug"
+
+// version is the release the binary was built from, set with go build -ldflags "-X main.version=1.4.0".
+var version string
+
+// toolVersion returns the version recorded in scan_runs: version, or for builds that didn't set it, the module
+// version or VCS revision Go stamped into the binary, or "unknown".
+func toolVersion() string {
+	if version != "" {
+		return version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	var revision, modified string
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value
+		}
+	}
+	if revision == "" {
+		return "unknown"
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if modified == "true" {
+		revision += "-dirty"
+	}
+	return revision
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"fileindexer/pkg/indexer"
+)
+
+// walRecord is one file_hashes write that couldn't reach the database, as a line of JSON in the write-ahead log.
+type walRecord struct {
+	Filepath      string    `json:"filepath"`
+	Hash          string    `json:"hash"`
+	Algorithm     string    `json:"hash_algorithm,omitempty"`
+	Size          int64     `json:"size"`
+	FileTimestamp time.Time `json:"file_timestamp"`
+	Recorded      time.Time `json:"recorded"`
+}
+
+// writeAheadLog is an append-only local file of results the database didn't accept, replayed by flushWAL.
+type writeAheadLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// wal is the scan's write-ahead log, or nil when it is disabled with --no-wal.
+var wal *writeAheadLog
+
+// defaultWALPath gives each database its own log in the user's cache directory, so a later run against the same
+// database finds it without being told where it is.
+func defaultWALPath(cfg DBConfig) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	host := cfg.DbHost
+	if host == "" {
+		host = "localhost"
+	}
+	name := strings.NewReplacer("/", "_", `\`, "_", ":", "_").Replace(fmt.Sprintf("%s_%s_%s", host, cfg.DbPort, cfg.DbName))
+	return filepath.Join(dir, "fileindexer", name+".wal")
+}
+
+func openWAL(path string) (*writeAheadLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	// End a line cut short by a crash, so the next record doesn't run into it.
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			file.Write([]byte{'\n'})
+		}
+	}
+	return &writeAheadLog{path: path, file: file}, nil
+}
+
+// append writes record to the log and syncs it, so a result is durable before the worker moves on.
+func (w *writeAheadLog) append(record walRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+func (w *writeAheadLog) Close() error {
+	return w.file.Close()
+}
+
+// replayRecordQuery writes a logged result as an upsert, which is right whether or not the file was indexed while the
+// database was away. A row written after the logged result was recorded is newer and is left alone; the history row
+// is added either way, since it happened.
+const replayRecordQuery = recordHistoryQuery + `INSERT INTO file_hashes (filepath, hash, size, file_timestamp, hash_calculated_timestamp, hash_algorithm) VALUES ($1, $2, $3, $4, $5, $7)
+ON CONFLICT (filepath) DO UPDATE SET hash = EXCLUDED.hash, size = EXCLUDED.size, file_timestamp = EXCLUDED.file_timestamp,
+    hash_calculated_timestamp = EXCLUDED.hash_calculated_timestamp, hash_algorithm = EXCLUDED.hash_algorithm
+WHERE file_hashes.hash_calculated_timestamp < EXCLUDED.hash_calculated_timestamp`
+
+// flushWAL replays the log at path into db and returns how many records were written. The log is moved aside first
+// so runs appending to it meanwhile aren't lost; records that still fail are appended back to it. A log left aside
+// by an interrupted flush is replayed too, which may add duplicate history rows but never loses a result.
+func flushWAL(db *sql.DB, path string) (int, error) {
+	replaying := path + ".replaying"
+	if _, err := os.Stat(replaying); errors.Is(err, os.ErrNotExist) {
+		if err := os.Rename(path, replaying); errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	file, err := os.Open(replaying)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var failed []walRecord
+	written := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var record walRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// A line cut short by a crash while it was being appended; the result never reached the log.
+			log.Printf("Skipping unreadable line %d of %s: %v", line, replaying, err)
+			continue
+		}
+		// Records logged before the algorithm was recorded were MD5.
+		if record.Algorithm == "" {
+			record.Algorithm = defaultHashAlgorithm
+		}
+		_, err := db.Exec(replayRecordQuery, record.Filepath, record.Hash, record.Size, record.FileTimestamp,
+			record.Recorded.UTC(), record.Recorded.UTC(), record.Algorithm)
+		if err != nil {
+			log.Printf("Failed to replay %s, keeping it in %s: %v", record.Filepath, path, err)
+			failed = append(failed, record)
+			continue
+		}
+		written++
+	}
+	if err := scanner.Err(); err != nil {
+		return written, err
+	}
+
+	if len(failed) > 0 {
+		w, err := openWAL(path)
+		if err != nil {
+			return written, err
+		}
+		for _, record := range failed {
+			if err := w.append(record); err != nil {
+				w.Close()
+				return written, err
+			}
+		}
+		if err := w.Close(); err != nil {
+			return written, err
+		}
+	}
+	return written, os.Remove(replaying)
+}
+
+// writeFileRecord runs a file_hashes write, or writes record to --store instead, or holds it for the next flush of
+// batch unless batch is nil. With the write-ahead log enabled, a write that can't be made (the database is down, or the
+// statement keeps failing) is logged locally instead, and the worker carries on.
+func writeFileRecord(db *sql.DB, batch *recordBatch, what string, record walRecord, op func() error) error {
+	if index != nil {
+		return putStoreRecord(what, record)
+	}
+	if batch != nil {
+		batch.add(record)
+		return nil
+	}
+	if wal == nil {
+		return retryDB(db, what, op)
+	}
+	return retryDBOr(db, what, op, func(err error) error {
+		log.Printf("Saving %s to the write-ahead log %s until the database takes it: %v", what, wal.path, err)
+		return wal.append(record)
+	})
+}
+
+// runFlushWAL replays a write-ahead log into the database. Scans do this on their own when they start.
+func runFlushWAL(args []string) {
+	fs := flag.NewFlagSet("flush-wal", flag.ContinueOnError)
+	var dbCfg DBConfig
+	registerDBFlags(fs, &dbCfg)
+	path := fs.String("wal", "", "Write-ahead log to replay. Defaults to the one scans against this database use.")
+	fs.Usage = commandUsage(fs, "FlushWALUsage")
+	parseArgs(fs, args)
+
+	if dbCfg.DbName == "" {
+		usageError(fs, "dbname", msg("MissingFlag", map[string]any{"Flag": "dbname"}))
+	}
+	if *path == "" {
+		*path = defaultWALPath(dbCfg)
+	}
+
+	db := connectToDatabase(dbCfg)
+	defer db.Close()
+	if _, err := db.Exec(createTableQuery); err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+	if _, err := db.Exec(createFileHistoryTableQuery); err != nil {
+		log.Fatalf("Failed to create history table: %v", err)
+	}
+	if _, err := db.Exec(addHashAlgorithmColumnQuery); err != nil {
+		log.Fatalf("Failed to add hash_algorithm column: %v", err)
+	}
+	if err := indexer.UpgradeRecordedTimestamps(db); err != nil {
+		log.Fatalf("Failed to convert hash_calculated_timestamp to UTC: %v", err)
+	}
+
+	count, err := flushWAL(db, *path)
+	if err != nil {
+		log.Fatalf("Failed to replay %s after writing %d records: %v", *path, count, err)
+	}
+	fmt.Println(msg("WALFlushed", map[string]any{"Count": count, "Path": *path}))
+}
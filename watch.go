@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"fileindexer/pkg/indexer"
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchSettleDelay is how long a file has to go without events before --watch hashes it, so a file being copied in is
+// hashed once, when the copy is done, rather than on every write.
+const watchSettleDelay = 2 * time.Second
+
+// directoryWatch keeps the index of scanRoot(cfg) current with --watch. fsnotify watches single directories, so every
+// directory under it is watched on its own, and new ones are added as they appear.
+type directoryWatch struct {
+	cfg     Config
+	db      *sql.DB
+	watcher *fsnotify.Watcher
+	scanner *indexer.Scanner
+	options indexer.Options
+
+	// pending holds the files with events not yet hashed, with the time of their last event.
+	pending map[string]time.Time
+	dirs    int
+
+	hashed, deleted int
+}
+
+// watchDirectory follows filesystem events under scanRoot(cfg) after the initial scan until SIGINT or SIGTERM: created
+// and modified files are hashed as a scan would hash them, and files removed or renamed away are marked deleted like
+// --detect-deleted does. Results are logged rather than written to --output, which the initial scan s has finished.
+func watchDirectory(cfg Config, s *scanner) {
+	db := s.db
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Fatalf("Failed to watch %s: %v", cfg.Directory, err)
+	}
+	defer watcher.Close()
+
+	// The scan's bookkeeping doesn't outlive it: the preload would go stale as files change, and records are written
+	// one at a time so each event is reflected as soon as it is hashed.
+	preloaded = nil
+	files := (&scanner{db: db, tree: s.tree}).fileScanner(nil)
+	// A file rewritten in place often keeps its size, so the modification time counts too.
+	if cfg.ChangeDetect == "size" {
+		cfg.ChangeDetect = "mtime+size"
+	}
+
+	// Events are hashed like the scan hashes files, but without --verify: the files that changed have to be hashed
+	// anyway.
+	options := fileOptions(cfg)
+	options.Verify = false
+	w := &directoryWatch{cfg: cfg, db: db, watcher: watcher, scanner: files, options: options, pending: make(map[string]time.Time)}
+	if err := w.addTree(scanRoot(cfg), false); err != nil {
+		log.Fatalf("Failed to watch %s: %v", scanRoot(cfg), err)
+	}
+	log.Print(msg("WatchStarted", map[string]any{"Directory": scanRoot(cfg), "Count": w.dirs}))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ticker := time.NewTicker(watchSettleDelay / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// Files still being written are hashed as they are; the next event or scan catches up with them.
+			w.settle(time.Time{})
+			log.Print(msg("WatchStopped", map[string]any{"Directory": scanRoot(cfg), "Hashed": w.hashed, "Deleted": w.deleted}))
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			w.handle(event)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				log.Printf("WARNING: filesystem events under %s were lost; changes may be missing from the index until the next scan", cfg.Directory)
+			} else {
+				log.Printf("Error watching %s: %v", cfg.Directory, err)
+			}
+		case now := <-ticker.C:
+			w.settle(now)
+		}
+	}
+}
+
+// addTree watches root and every directory under it. With queue set, the files already there are hashed too, since
+// a new directory can fill up before its watch is in place.
+func (w *directoryWatch) addTree(root string, queue bool) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			log.Printf("Error accessing %s: %v", path, walkErr)
+			return nil
+		}
+		if exclusion(w.cfg, w.cfg.Directory, path, d.IsDir()) != "" {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if err := w.watcher.Add(path); err != nil {
+				return err
+			}
+			w.dirs++
+		} else if queue && d.Type().IsRegular() {
+			w.pending[path] = time.Now()
+		}
+		return nil
+	})
+}
+
+func (w *directoryWatch) handle(event fsnotify.Event) {
+	path := event.Name
+	if exclusionWithin(w.cfg, path) != "" {
+		return
+	}
+	switch {
+	case event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename):
+		delete(w.pending, path)
+		// A renamed directory's watch follows it under its old name, and its new name arrives as a create.
+		w.watcher.Remove(path)
+		w.removed(path)
+	case event.Has(fsnotify.Create):
+		info, err := os.Lstat(path)
+		if err != nil {
+			return
+		}
+		if info.IsDir() {
+			if err := w.addTree(path, true); err != nil {
+				log.Printf("Failed to watch %s: %v", path, err)
+			}
+		} else if info.Mode().IsRegular() {
+			w.pending[path] = time.Now()
+		}
+	case event.Has(fsnotify.Write):
+		w.pending[path] = time.Now()
+	}
+}
+
+// settle hashes the pending files that have had no events for watchSettleDelay, or all of them when now is zero.
+func (w *directoryWatch) settle(now time.Time) {
+	for path, last := range w.pending {
+		if !now.IsZero() && now.Sub(last) < watchSettleDelay {
+			continue
+		}
+		delete(w.pending, path)
+		w.hash(path)
+	}
+}
+
+// hash indexes a file that was created or modified, as the scan's workers do.
+func (w *directoryWatch) hash(path string) {
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() || filteredOut(w.cfg, path, info) {
+		return
+	}
+	storedPath := storedPathFor(w.cfg, path)
+	breaker.wait()
+	result := w.scanner.ScanFile(path, storedPath, w.options)
+	if result.Err != nil {
+		log.Printf("Failed to process file %s: %v", path, result.Err)
+		return
+	}
+	// A file that comes back under a path marked deleted is current again.
+	if err := retryDB(w.db, "restoration of "+storedPath, func() error {
+		_, err := w.db.Exec("UPDATE file_hashes SET deleted_timestamp = NULL WHERE filepath = $1 AND deleted_timestamp IS NOT NULL", storedPath)
+		return err
+	}); err != nil {
+		log.Printf("Failed to clear the deletion of %s: %v", storedPath, err)
+	}
+	w.hashed++
+	log.Printf("Path: %s Hash: %s, Size: %d, Status: %s", path, result.Hash, result.Size, result.Status)
+}
+
+// removed marks the records of path, and of everything under it if it was a directory, as deleted, unless something
+// is there again already.
+func (w *directoryWatch) removed(path string) {
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		return
+	}
+	storedPath := storedPathFor(w.cfg, path)
+	var paths []string
+	err := retryDB(w.db, "deletion of "+storedPath, func() error {
+		paths = paths[:0]
+		rows, err := w.db.Query(`
+UPDATE file_hashes SET deleted_timestamp = $3
+WHERE (filepath = $1 OR filepath LIKE $2) AND deleted_timestamp IS NULL
+RETURNING filepath`, storedPath, likePrefix(storedPath+"/"), time.Now())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var path string
+			if err := rows.Scan(&path); err != nil {
+				return err
+			}
+			paths = append(paths, path)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		log.Printf("Failed to mark %s as deleted: %v", storedPath, err)
+		return
+	}
+	for _, path := range paths {
+		log.Printf("Path: %s Status: missing", path)
+	}
+	w.deleted += len(paths)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// A worklist is a CSV of absolute paths with the size and mtime seen during enumeration. It is plain text on purpose:
+// it can be inspected, sorted to prioritise, split to hand out to several machines, or trimmed to resume.
+var worklistHeader = []string{"path", "size", "mtime"}
+
+// writeWorklist walks cfg.Directory through tree, applying the usual exclusions, and writes every file found to path
+// without touching the database or reading any file contents.
+func writeWorklist(cfg Config, tree treeReader, path string) (int, error) {
+	file, err := os.Create(partialOutputPath(path))
+	if err != nil {
+		return 0, err
+	}
+	writer := csv.NewWriter(file)
+	if err := writer.Write(worklistHeader); err != nil {
+		file.Close()
+		return 0, err
+	}
+
+	count := 0
+	var writeErr error
+	walkErr := walkFiles(context.Background(), cfg, tree, nil, func(path string, info os.FileInfo) {
+		if writeErr != nil {
+			return
+		}
+		writeErr = writer.Write([]string{path, fmt.Sprintf("%d", info.Size()), info.ModTime().UTC().Format(time.RFC3339Nano)})
+		count++
+	})
+	if walkErr != nil {
+		log.Printf("Error walking through files: %v", walkErr)
+	}
+	if writeErr != nil {
+		file.Close()
+		return count, writeErr
+	}
+	return count, finalizeOutput(writer, file, path)
+}
+
+// readWorklist calls visit for each file listed in a worklist, in file order. Files are stat'ed again rather than
+// trusting the recorded size and mtime, since the hashing pass may run long after enumeration. It stops with
+// errScanInterrupted once ctx is done.
+func readWorklist(ctx context.Context, path string, visit func(path string, info os.FileInfo)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read worklist header: %v", err)
+	}
+	if len(header) == 0 || header[0] != worklistHeader[0] {
+		return fmt.Errorf("%s is not a worklist: expected a %q header", path, worklistHeader[0])
+	}
+
+	for {
+		if ctx.Err() != nil {
+			return errScanInterrupted
+		}
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read worklist: %v", err)
+		}
+		info, err := os.Lstat(row[0])
+		if err != nil {
+			log.Printf("Error accessing %s: %v", row[0], err)
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		visit(row[0], info)
+	}
+}
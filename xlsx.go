@@ -0,0 +1,339 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// xlsxMaxRows is the most rows a worksheet can have. Results beyond it continue on another sheet.
+const xlsxMaxRows = 1 << 20
+
+// Cell styles of xlsxStyles: the default, bold headers, and whole numbers with thousands separators.
+const (
+	xlsxStyleHeader = 1
+	xlsxStyleNumber = 2
+)
+
+// xlsxColumn is a column of a worksheet. Whole numbers in a number column are written as numbers.
+type xlsxColumn struct {
+	name   string
+	width  float64
+	number bool
+}
+
+// xlsxResultColumns are resultColumns as worksheet columns.
+var xlsxResultColumns = []xlsxColumn{{"filepath", 80, false}, {"hash", 34, false}, {"size", 14, true}, {"status", 14, false}}
+
+// xlsxSheet is a worksheet being written. Its rows are kept in a temporary file until the workbook is put together,
+// since a zip archive can only be written one member at a time and rows for every sheet arrive together.
+type xlsxSheet struct {
+	name    string
+	columns []xlsxColumn
+	file    *os.File
+	writer  *bufio.Writer
+	rows    int
+}
+
+// xlsxStatusTotals are the files and bytes of one status, for the Summary sheet.
+type xlsxStatusTotals struct {
+	files int64
+	bytes int64
+}
+
+// xlsxRowWriter writes the results as an Excel workbook for --output-format xlsx: the results on a Results sheet,
+// files that failed on an Errors sheet, and the files and bytes of each status on a Summary sheet. Each sheet has a
+// bold, frozen header row with an autofilter, and sizes are numbers, so the workbook can be sorted and filtered as it
+// is. Cells are never formulas, whatever a file is named. The workbook is written to output by finish.
+type xlsxRowWriter struct {
+	output  io.Writer
+	dir     string
+	results []*xlsxSheet
+	errors  *xlsxSheet
+	summary *xlsxSheet
+	totals  map[string]*xlsxStatusTotals
+	err     error
+}
+
+func newXLSXRowWriter(output *os.File) (*xlsxRowWriter, error) {
+	w := &xlsxRowWriter{output: output, dir: filepath.Dir(output.Name()), totals: make(map[string]*xlsxStatusTotals)}
+	var err error
+	if w.errors, err = w.newSheet("Errors", []xlsxColumn{{"filepath", 80, false}, {"error", 80, false}}); err != nil {
+		return nil, err
+	}
+	if err := w.addResultsSheet(); err != nil {
+		w.removeSheets()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *xlsxRowWriter) newSheet(name string, columns []xlsxColumn) (*xlsxSheet, error) {
+	file, err := os.CreateTemp(w.dir, ".fileindexer-sheet-*")
+	if err != nil {
+		return nil, err
+	}
+	sheet := &xlsxSheet{name: name, columns: columns, file: file, writer: bufio.NewWriter(file)}
+	sheet.writeHeader()
+	return sheet, nil
+}
+
+func (w *xlsxRowWriter) addResultsSheet() error {
+	name := "Results"
+	if len(w.results) > 0 {
+		name = fmt.Sprintf("Results %d", len(w.results)+1)
+	}
+	sheet, err := w.newSheet(name, xlsxResultColumns)
+	if err != nil {
+		return err
+	}
+	w.results = append(w.results, sheet)
+	return nil
+}
+
+// Write adds a row of the results, an error if its status is one.
+func (w *xlsxRowWriter) Write(row []string) error {
+	if w.err != nil {
+		return w.err
+	}
+	status := row[3]
+	size, sizeErr := strconv.ParseInt(row[2], 10, 64)
+	if message, ok := strings.CutPrefix(status, "error: "); ok {
+		status = "error"
+		w.err = w.errors.writeRow([]string{row[0], message})
+	} else {
+		sheet := w.results[len(w.results)-1]
+		if sheet.rows == xlsxMaxRows {
+			if w.err = w.addResultsSheet(); w.err != nil {
+				return w.err
+			}
+			sheet = w.results[len(w.results)-1]
+		}
+		w.err = sheet.writeRow(row)
+	}
+	totals := w.totals[status]
+	if totals == nil {
+		totals = &xlsxStatusTotals{}
+		w.totals[status] = totals
+	}
+	totals.files++
+	if sizeErr == nil && size > 0 {
+		totals.bytes += size
+	}
+	return w.err
+}
+
+// Flush is a no-op: nothing reaches the output before finish.
+func (w *xlsxRowWriter) Flush() {}
+
+func (w *xlsxRowWriter) Error() error {
+	return w.err
+}
+
+// writeHeader writes the bold header row.
+func (s *xlsxSheet) writeHeader() {
+	s.rows++
+	s.writer.WriteString(`<row r="1">`)
+	for i, column := range s.columns {
+		writeXLSXString(s.writer, xlsxCellRef(i, 1), column.name, xlsxStyleHeader)
+	}
+	s.writer.WriteString("</row>")
+}
+
+// writeRow writes a row of strings, the whole numbers in number columns as numbers.
+func (s *xlsxSheet) writeRow(row []string) error {
+	s.rows++
+	fmt.Fprintf(s.writer, `<row r="%d">`, s.rows)
+	for i, value := range row {
+		ref := xlsxCellRef(i, s.rows)
+		if _, err := strconv.ParseInt(value, 10, 64); err == nil && s.columns[i].number {
+			fmt.Fprintf(s.writer, `<c r="%s" s="%d"><v>%s</v></c>`, ref, xlsxStyleNumber, value)
+		} else {
+			writeXLSXString(s.writer, ref, value, 0)
+		}
+	}
+	_, err := s.writer.WriteString("</row>")
+	return err
+}
+
+// writeXLSXString writes an inline string cell. EscapeText replaces the characters XML can't hold, including bytes
+// that aren't UTF-8, with U+FFFD.
+func writeXLSXString(w *bufio.Writer, ref, value string, style int) {
+	fmt.Fprintf(w, `<c r="%s" t="inlineStr"`, ref)
+	if style != 0 {
+		fmt.Fprintf(w, ` s="%d"`, style)
+	}
+	w.WriteString(`><is><t xml:space="preserve">`)
+	xml.EscapeText(w, []byte(value))
+	w.WriteString("</t></is></c>")
+}
+
+// xlsxCellRef returns the A1-style reference of a zero-based column and a row.
+func xlsxCellRef(column, row int) string {
+	return fmt.Sprintf("%s%d", xlsxColumnName(column), row)
+}
+
+func xlsxColumnName(column int) string {
+	name := ""
+	for column++; column > 0; column = (column - 1) / 26 {
+		name = string(rune('A'+(column-1)%26)) + name
+	}
+	return name
+}
+
+// summarySheet lists the files and bytes of each status, and their totals.
+func (w *xlsxRowWriter) summarySheet() (*xlsxSheet, error) {
+	sheet, err := w.newSheet("Summary", []xlsxColumn{{"status", 24, false}, {"files", 14, true}, {"size", 20, true}})
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]string, 0, len(w.totals))
+	for status := range w.totals {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	var total xlsxStatusTotals
+	for _, status := range statuses {
+		totals := w.totals[status]
+		total.files += totals.files
+		total.bytes += totals.bytes
+		sheet.writeRow([]string{status, strconv.FormatInt(totals.files, 10), strconv.FormatInt(totals.bytes, 10)})
+	}
+	err = sheet.writeRow([]string{"total", strconv.FormatInt(total.files, 10), strconv.FormatInt(total.bytes, 10)})
+	return sheet, err
+}
+
+// finish writes the workbook to the output and removes the temporary sheet files.
+func (w *xlsxRowWriter) finish() {
+	defer w.removeSheets()
+	if w.err != nil {
+		return
+	}
+	if w.summary, w.err = w.summarySheet(); w.err != nil {
+		return
+	}
+	sheets := append([]*xlsxSheet{w.summary}, w.results...)
+	w.err = writeXLSX(w.output, append(sheets, w.errors))
+}
+
+func (w *xlsxRowWriter) removeSheets() {
+	for _, sheet := range append(w.results, w.errors, w.summary) {
+		if sheet != nil {
+			sheet.file.Close()
+			os.Remove(sheet.file.Name())
+		}
+	}
+	w.results, w.errors, w.summary = nil, nil, nil
+}
+
+// writeXLSX writes a workbook of sheets as the zip archive of Office Open XML parts Excel expects.
+func writeXLSX(output io.Writer, sheets []*xlsxSheet) error {
+	archive := zip.NewWriter(output)
+	modified := time.Now()
+	create := func(name string) (io.Writer, error) {
+		return archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+	}
+	part := func(name, content string) error {
+		writer, err := create(name)
+		if err == nil {
+			_, err = io.WriteString(writer, xml.Header+content)
+		}
+		return err
+	}
+
+	var contentTypes, workbookSheets, definedNames, workbookRels strings.Builder
+	for i, sheet := range sheets {
+		n := i + 1
+		fmt.Fprintf(&contentTypes, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, n)
+		fmt.Fprintf(&workbookSheets, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, sheet.name, n, n)
+		fmt.Fprintf(&definedNames, `<definedName name="_xlnm._FilterDatabase" localSheetId="%d" hidden="1">'%s'!%s</definedName>`, i, sheet.name, sheet.filterRange(true))
+		fmt.Fprintf(&workbookRels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, n, n)
+	}
+	fmt.Fprintf(&workbookRels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`, len(sheets)+1)
+
+	parts := []struct{ name, content string }{
+		{"[Content_Types].xml", `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+			`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+			`<Default Extension="xml" ContentType="application/xml"/>` +
+			`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+			`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+			contentTypes.String() + `</Types>`},
+		{"_rels/.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+			`</Relationships>`},
+		{"xl/workbook.xml", `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+			`<sheets>` + workbookSheets.String() + `</sheets><definedNames>` + definedNames.String() + `</definedNames></workbook>`},
+		{"xl/_rels/workbook.xml.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			workbookRels.String() + `</Relationships>`},
+		{"xl/styles.xml", xlsxStyles},
+	}
+	for _, p := range parts {
+		if err := part(p.name, p.content); err != nil {
+			return err
+		}
+	}
+	for i, sheet := range sheets {
+		writer, err := create(fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1))
+		if err != nil {
+			return err
+		}
+		if err := sheet.copyTo(writer); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// filterRange returns the range of the sheet's rows, in absolute references if absolute is set.
+func (s *xlsxSheet) filterRange(absolute bool) string {
+	last := xlsxColumnName(len(s.columns) - 1)
+	if absolute {
+		return fmt.Sprintf("$A$1:$%s$%d", last, s.rows)
+	}
+	return fmt.Sprintf("A1:%s%d", last, s.rows)
+}
+
+// copyTo writes the worksheet part: the frozen header, the column widths, the rows kept so far and the autofilter.
+func (s *xlsxSheet) copyTo(w io.Writer) error {
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var cols strings.Builder
+	for i, column := range s.columns {
+		fmt.Fprintf(&cols, `<col min="%d" max="%d" width="%g" customWidth="1"/>`, i+1, i+1, column.width)
+	}
+	_, err := io.WriteString(w, xml.Header+`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`+
+		`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>`+
+		`<cols>`+cols.String()+`</cols><sheetData>`)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, s.file); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, `</sheetData><autoFilter ref="%s"/></worksheet>`, s.filterRange(false))
+	return err
+}
+
+// xlsxStyles defines the cell styles used: the default, bold (xlsxStyleHeader) and #,##0 (xlsxStyleNumber).
+const xlsxStyles = `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+	`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+	`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+	`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+	`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+	`<cellXfs count="3"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>` +
+	`<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>` +
+	`<xf numFmtId="3" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/></cellXfs>` +
+	`<cellStyles count="1"><cellStyle name="Normal" xfId="0" builtinId="0"/></cellStyles>` +
+	`</styleSheet>`